@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// netACL is a list of networks clients are matched against.
+type netACL []*net.IPNet
+
+// contains reports whether ip is in one of the networks.
+func (acl netACL) contains(ip net.IP) bool {
+	for _, n := range acl {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl netACL) String() string {
+	s := make([]string, len(acl))
+	for i, n := range acl {
+		s[i] = n.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// parseACL parses a comma separated list of networks in CIDR notation or
+// single addresses. "local" stands for the subnets of the host's interfaces
+// and "any" for every address.
+func parseACL(s string) (netACL, error) {
+	var acl netACL
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		switch item {
+		case "":
+			continue
+		case "local":
+			local, err := localSubnets()
+			if err != nil {
+				return nil, fmt.Errorf("detecting local subnets: %w", err)
+			}
+			acl = append(acl, local...)
+			continue
+		case "any":
+			acl = append(acl, &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)})
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			acl = append(acl, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, n)
+	}
+	return acl, nil
+}
+
+// localSubnets returns the networks of the addresses assigned to the host's
+// interfaces, loopback included.
+func localSubnets() (netACL, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	acl := netACL{
+		{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+		{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		acl = append(acl, &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask})
+	}
+	return acl, nil
+}
+
+// recursionGuard refuses to resolve queries through next for clients
+// outside acl, so that a forwarder on a public address is not an open
+// resolver. Queries without a network client, such as those read from
+// stdin, are always allowed.
+func recursionGuard(acl netACL, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Message) {
+		if ip := addrIP(w.RemoteAddr()); ip != nil && !acl.contains(ip) {
+			metrics.inc("recursion_refused_total")
+			reject(w, r, dns.RCODE_REFUSED, reasonRecursion)
+			return
+		}
+		next.ServeDNS(w, r)
+	})
+}
+
+// clientACL decides which clients may query the server at all. Denied
+// networks take precedence over allowed ones; without allowed networks every
+// client not denied is allowed.
+type clientACL struct {
+	allow  netACL
+	deny   netACL
+	action verdict // verdictRefuse or verdictDrop for disallowed clients
+}
+
+// parseACLAction parses what happens to queries of disallowed clients.
+func parseACLAction(s string) (verdict, error) {
+	switch s {
+	case "refuse":
+		return verdictRefuse, nil
+	case "drop":
+		return verdictDrop, nil
+	}
+	return 0, fmt.Errorf("unknown action %q", s)
+}
+
+// check returns how to treat a query from client. Queries without a network
+// client are always allowed.
+func (a *clientACL) check(client net.IP) verdict {
+	if client == nil {
+		return verdictAllow
+	}
+	if a.deny.contains(client) || (len(a.allow) > 0 && !a.allow.contains(client)) {
+		return a.action
+	}
+	return verdictAllow
+}
+
+// middleware refuses or drops the queries of disallowed clients.
+func (a *clientACL) middleware(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Message) {
+		switch a.check(addrIP(w.RemoteAddr())) {
+		case verdictRefuse:
+			metrics.inc("acl_refused_total")
+			reject(w, r, dns.RCODE_REFUSED, reasonACL)
+		case verdictDrop:
+			metrics.inc("acl_dropped_total")
+			drop(w, r, reasonACL)
+		default:
+			next.ServeDNS(w, r)
+		}
+	})
+}
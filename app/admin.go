@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// adminAPI serves the HTTP control interface used to inspect and change the
+// running server.
+type adminAPI struct {
+	server   *server          // Pipeline that /api/resolve queries run through, and the forwarder, cache, and zones in it
+	registry *serviceRegistry // Service registry, nil if disabled
+	allow    netACL           // Clients allowed to use the API
+	hosts    map[string]bool  // Names allowed in the Host header besides localhost and loopback addresses
+	started  time.Time
+}
+
+// adminHosts returns the names the admin API at addr may be reached by:
+// the host of addr itself and the comma separated names.
+func adminHosts(addr, names string) map[string]bool {
+	hosts := make(map[string]bool)
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		hosts[canonicalHost(host)] = true
+	}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			hosts[canonicalHost(name)] = true
+		}
+	}
+	return hosts
+}
+
+// canonicalHost lowercases a host name and drops its trailing dot, or
+// formats an IP address the way net.IP does.
+func canonicalHost(host string) string {
+	host = strings.Trim(host, "[]")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// serveAdmin runs the admin API on the given address. It should only be
+// reachable by operators, as it has no authentication of its own, so
+// clients outside api.allow are turned away, and so are requests for hosts
+// outside api.hosts, which a web page could otherwise send from the
+// operator's browser by rebinding a name of its own to the API address.
+func serveAdmin(addr string, api *adminAPI) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upstreams", api.upstreams)
+	mux.HandleFunc("/upstreams/outages", api.outages)
+	mux.HandleFunc("/services", api.services)
+	mux.HandleFunc("/services/", api.services)
+	mux.HandleFunc("/zones", api.zoneList)
+	mux.HandleFunc("/zones/reload", api.zoneReload)
+	mux.HandleFunc("/stats", api.stats)
+	mux.HandleFunc("/metrics", api.metrics)
+	mux.HandleFunc("/api/resolve", api.resolve)
+	mux.HandleFunc("/slo", api.slo)
+	mux.HandleFunc("/cache/dump", api.cacheDump)
+	mux.HandleFunc("/cache/load", api.cacheLoad)
+	mux.HandleFunc("/cache/flush", api.cacheFlush)
+	slog.Info("Serving admin API", "addr", addr, "allow", api.allow.String())
+	return http.ListenAndServe(addr, api.guard(mux))
+}
+
+// guard answers 403 to clients outside api.allow and to requests whose Host
+// header names another host than the API.
+func (api *adminAPI) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !api.allow.contains(ip) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !api.allowedHost(r.Host) {
+			http.Error(w, "forbidden host", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether the Host header of a request names the API:
+// localhost, a loopback address, or one of api.hosts.
+func (api *adminAPI) allowedHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = canonicalHost(host)
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	return host == "localhost" || api.hosts[host]
+}
+
+// upstreams lists the upstream resolvers on GET, and replaces them on PUT
+// with the JSON array of addresses in the body, in the order they should be
+// tried. Both answer with the resulting upstream list.
+func (api *adminAPI) upstreams(w http.ResponseWriter, r *http.Request) {
+	fwd := api.server.current().fwd
+	if fwd == nil {
+		http.Error(w, "forwarding is not enabled", http.StatusConflict)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var addresses []string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&addresses); err != nil {
+			http.Error(w, "body must be a JSON array of addresses", http.StatusBadRequest)
+			return
+		}
+		if err := fwd.setUpstreams(addresses); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("Upstreams replaced", "upstreams", addresses)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, fwd.status())
+}
+
+// outages answers GET with the upstream outages recorded in the journal,
+// oldest first, limited to the ones lasting until the RFC 3339 time in the
+// since parameter or later.
+func (api *adminAPI) outages(w http.ResponseWriter, r *http.Request) {
+	if outages == nil {
+		http.Error(w, "the upstream outage journal is not enabled", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, outages.list(since))
+}
+
+// zoneList answers GET with the serial and SOA timers of every
+// authoritative zone, and where and when it was loaded.
+func (api *adminAPI) zoneList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	current := api.server.current().zones
+	zones := make([]zoneStatus, 0, len(current))
+	for _, z := range current {
+		zones = append(zones, z.status())
+	}
+	writeJSON(w, zones)
+}
+
+// zoneReloadResult is the outcome of reloading a zone through
+// /zones/reload.
+type zoneReloadResult struct {
+	Origin string `json:"origin"`
+	Serial uint32 `json:"serial"`
+	Error  string `json:"error,omitempty"` // Why the zone was kept as it was
+}
+
+// zoneReload answers POST by reading the zones loaded from files again,
+// and regenerating the reverse zones, or only the zone named by the zone
+// parameter. A zone that fails to load keeps its records. The response is
+// 200 if every zone was reloaded and 500 otherwise. The -notify secondaries
+// are notified of the zones whose serial grew.
+func (api *adminAPI) zoneReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	only := dns.CanonicalName(r.URL.Query().Get("zone"))
+	results := []zoneReloadResult{}
+	failed := false
+	for _, z := range api.server.current().zones {
+		if z.load == nil || only != "" && z.origin != only {
+			continue
+		}
+		res := zoneReloadResult{Origin: z.origin}
+		fresh, err := z.load()
+		if err != nil {
+			res.Error, failed = err.Error(), true
+			slog.Warn("Failed to reload zone, keeping the current one", "zone", z.origin, "err", err)
+		} else {
+			old := z.status().Serial
+			z.replace(fresh)
+			api.server.notifier.changed(z, old)
+		}
+		res.Serial = z.status().Serial
+		results = append(results, res)
+	}
+	if only != "" && len(results) == 0 {
+		http.Error(w, "no zone "+only+" to reload", http.StatusNotFound)
+		return
+	}
+	metrics.inc("zone_reloads_total")
+	if failed {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+	writeJSON(w, results)
+}
+
+// runtimeStats is the state of the process reported by /stats.
+type runtimeStats struct {
+	Uptime       float64 `json:"uptime_seconds"`
+	GoVersion    string  `json:"go_version"`
+	Goroutines   int     `json:"goroutines"`
+	HeapAlloc    uint64  `json:"heap_alloc_bytes"`
+	HeapSys      uint64  `json:"heap_sys_bytes"`
+	GCRuns       uint32  `json:"gc_runs"`
+	CacheEntries int     `json:"cache_entries"`
+	Zones        int     `json:"zones"`
+	Queries      uint64  `json:"queries"`           // Received over every transport
+	ShedLevel    string  `json:"memory_shed_level"` // Load shed to stay under -memory-limit
+}
+
+// stats answers GET with the uptime, memory, and goroutines of the
+// process, along with the size of the cache and the number of queries
+// answered.
+func (api *adminAPI) stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	p := api.server.current()
+	st := runtimeStats{
+		Uptime:     time.Since(api.started).Seconds(),
+		GoVersion:  runtime.Version(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		HeapSys:    mem.HeapSys,
+		GCRuns:     mem.NumGC,
+		Zones:      len(p.zones),
+		ShedLevel:  shedder.current().String(),
+	}
+	for name, v := range metrics.snapshot() {
+		if strings.HasPrefix(name, "queries_received_") {
+			st.Queries += v
+		}
+	}
+	if p.rootCache != nil {
+		st.CacheEntries = p.rootCache.len()
+	}
+	writeJSON(w, st)
+}
+
+// metrics answers GET with the current value of every counter, such as the
+// queries received and forwarded over each transport.
+func (api *adminAPI) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, metrics.snapshot())
+}
+
+// slo answers GET with the share of responses meeting the latency objective
+// and the burn rate of its error budget over the alert windows.
+func (api *adminAPI) slo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, api.server.slo.status(time.Now()))
+}
+
+// cacheDump answers GET with the contents of the cache in the format of
+// unbound-control dump_cache.
+func (api *adminAPI) cacheDump(w http.ResponseWriter, r *http.Request) {
+	cache := api.server.current().rootCache
+	if cache == nil {
+		http.Error(w, "caching is not enabled", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := cache.dump(w, time.Now()); err != nil {
+		slog.Warn("Failed to write cache dump", "err", err)
+	}
+}
+
+// cacheFlushResult is the outcome of a POST to /cache/flush.
+type cacheFlushResult struct {
+	Removed int `json:"removed"`
+}
+
+// cacheFlush answers POST by removing cached responses: those for the name
+// parameter, those for the domain parameter and the names below it, or
+// every response without either.
+func (api *adminAPI) cacheFlush(w http.ResponseWriter, r *http.Request) {
+	cache := api.server.current().rootCache
+	if cache == nil {
+		http.Error(w, "caching is not enabled", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, domain := r.URL.Query().Get("name"), r.URL.Query().Get("domain")
+	var removed int
+	switch {
+	case name != "" && domain != "":
+		http.Error(w, "name and domain are mutually exclusive", http.StatusBadRequest)
+		return
+	case name != "":
+		removed = cache.flush(name, false)
+	default:
+		removed = cache.flush(domain, true)
+	}
+	slog.Info("Cache flushed", "name", name, "domain", domain, "removed", removed)
+	writeJSON(w, cacheFlushResult{Removed: removed})
+}
+
+// cacheLoadResult is the outcome of a POST to /cache/load.
+type cacheLoadResult struct {
+	Loaded  int `json:"loaded"`
+	Skipped int `json:"skipped"` // Messages referring to RRsets missing from the dump
+}
+
+// cacheLoad answers POST by adding the messages of the dump in the body, in
+// the format of unbound-control dump_cache, to the cache.
+func (api *adminAPI) cacheLoad(w http.ResponseWriter, r *http.Request) {
+	cache := api.server.current().rootCache
+	if cache == nil {
+		http.Error(w, "caching is not enabled", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	loaded, skipped, err := cache.load(http.MaxBytesReader(w, r.Body, 64<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("Cache dump loaded", "loaded", loaded, "skipped", skipped)
+	writeJSON(w, cacheLoadResult{Loaded: loaded, Skipped: skipped})
+}
+
+// resolveResult is the outcome of a query made through /api/resolve.
+type resolveResult struct {
+	Name       string             `json:"name"`
+	Type       string             `json:"type"`
+	RCode      string             `json:"rcode"`
+	AnsweredBy []string           `json:"answered_by"` // Stages that wrote a response, one per lookup of a CNAME chain
+	Stages     []stageTrace       `json:"stages"`      // In the order they finished, nested stages first
+	Latency    float64            `json:"latency_ms"`
+	Answer     []string           `json:"answer"`
+	Authority  []string           `json:"authority"`
+	Additional []string           `json:"additional"`
+	Provenance []recordProvenance `json:"provenance"` // Where each record came from
+	Wire       []byte             `json:"wire"`       // Response in wire format, base64 encoded
+}
+
+// resolve answers GET /api/resolve?name=&type= by running the query through
+// the full pipeline, as if a client had sent it, and reporting the response
+// along with the stages it passed through and their latencies. The type
+// defaults to A.
+func (api *adminAPI) resolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSuffix(r.URL.Query().Get("name"), ".")
+	if name == "" && r.URL.Query().Get("name") != "." {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	qtype := uint16(dns.TYPE_A)
+	if t := r.URL.Query().Get("type"); t != "" {
+		var ok bool
+		if qtype, ok = dns.ParseType(t); !ok {
+			http.Error(w, "unknown type "+t, http.StatusBadRequest)
+			return
+		}
+	}
+	req := dns.NewQuery(name, qtype).Message()
+	rw := &resolveWriter{trace: &resolveTrace{}}
+	start := time.Now()
+	api.server.handle(req.Byte(), rw)
+	if !rw.written {
+		http.Error(w, "the query was dropped without a response", http.StatusServiceUnavailable)
+		return
+	}
+	res := resolveResult{
+		Name:       dns.CanonicalName(name),
+		Type:       dns.TypeString(qtype),
+		RCode:      rw.msg.Header.RCode().String(),
+		AnsweredBy: []string{},
+		Stages:     rw.trace.stages,
+		Latency:    float64(time.Since(start).Microseconds()) / 1000,
+		Answer:     recordStrings(rw.msg.Answer.Records),
+		Authority:  recordStrings(rw.msg.Authority.Records),
+		Additional: recordStrings(rw.msg.Additional.Records),
+		Provenance: provenance(rw.msg),
+		Wire:       rw.msg.Byte(),
+	}
+	for _, s := range res.Stages {
+		if s.Answered {
+			res.AnsweredBy = append(res.AnsweredBy, s.Stage)
+		}
+	}
+	writeJSON(w, res)
+}
+
+func recordStrings(records []dns.Record) []string {
+	s := make([]string, 0, len(records))
+	for _, r := range records {
+		if r.Type != dns.TYPE_OPT {
+			s = append(s, r.String())
+		}
+	}
+	return s
+}
+
+// resolveWriter keeps the response to a query made through /api/resolve.
+type resolveWriter struct {
+	trace   *resolveTrace
+	msg     dns.Message
+	written bool
+}
+
+func (w *resolveWriter) RemoteAddr() net.Addr {
+	return traceAddr{trace: w.trace}
+}
+
+func (w *resolveWriter) WriteMsg(m dns.Message) error {
+	w.msg, w.written = m, true
+	return nil
+}
+
+// services lists the registered service instances on GET /services. PUT
+// /services/<service>/<name> registers an instance, or renews it as a
+// heartbeat, with a JSON body holding its address, port, metadata, and ttl.
+// DELETE on the same path removes it, if it is an instance of that service.
+func (api *adminAPI) services(w http.ResponseWriter, r *http.Request) {
+	if api.registry == nil {
+		http.Error(w, "service registry is not enabled", http.StatusConflict)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/services"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, api.registry.list())
+		return
+	}
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	service, name := path[:i], path[i+1:]
+	switch r.Method {
+	case http.MethodPut:
+		var reg registration
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&reg); err != nil {
+			http.Error(w, "body must be a JSON registration", http.StatusBadRequest)
+			return
+		}
+		reg.Service, reg.Name = service, name
+		if err := api.registry.register(reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !api.registry.deregister(service, name) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write admin response", "err", err)
+	}
+}
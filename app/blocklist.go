@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// blockTTL is the TTL of the unspecified addresses answered for blocked
+// names.
+const blockTTL = 60
+
+// blockAction is how queries for blocked names are answered.
+type blockAction int
+
+const (
+	blockNXDOMAIN blockAction = iota
+	blockRefused
+	blockNull // 0.0.0.0 for A, :: for AAAA, no records for other types
+)
+
+func parseBlockAction(s string) (blockAction, error) {
+	switch s {
+	case "nxdomain":
+		return blockNXDOMAIN, nil
+	case "refused":
+		return blockRefused, nil
+	case "null":
+		return blockNull, nil
+	}
+	return 0, fmt.Errorf("unknown action %q", s)
+}
+
+// blocklist filters queries for the domains listed in its files, and their
+// subdomains. The files are read again periodically, so lists can be
+// updated without a restart.
+type blocklist struct {
+	files  []string
+	action blockAction
+
+	mu      sync.RWMutex
+	domains map[string]bool // Lowercased blocked domains
+}
+
+func newBlocklist(files []string, action blockAction) (*blocklist, error) {
+	b := &blocklist{files: files, action: action}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// load reads the files, replacing the blocked domains only if all of them
+// could be read.
+func (b *blocklist) load() error {
+	domains := make(map[string]bool)
+	for _, path := range b.files {
+		if err := readBlocklist(path, domains); err != nil {
+			return err
+		}
+	}
+	b.mu.Lock()
+	b.domains = domains
+	b.mu.Unlock()
+	slog.Info("Loaded blocklists", "files", len(b.files), "domains", len(domains))
+	return nil
+}
+
+// readBlocklist adds the domains of a file in hosts format (an address
+// followed by names) or domain list format (one name per line, optionally
+// as *.domain) to domains. Comments start with #.
+func readBlocklist(path string, domains map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			name = dns.CanonicalName(strings.TrimPrefix(strings.TrimSuffix(name, "."), "*."))
+			switch name {
+			case "", "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback":
+				// Entries of the stock hosts file, not meant to be blocked.
+				continue
+			}
+			domains[name] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// blocked reports whether name or one of its parent domains is listed.
+func (b *blocklist) blocked(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for name = dns.CanonicalName(name); name != ""; {
+		if b.domains[name] {
+			return true
+		}
+		name, _ = dns.Parent(name)
+	}
+	return false
+}
+
+// run reloads the files every interval, until stop is closed.
+func (b *blocklist) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := b.load(); err != nil {
+			slog.Warn("Failed to reload blocklists, keeping the current ones", "err", err)
+		}
+	}
+}
+
+func (b *blocklist) middleware(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Message) {
+		if len(r.Question.Queries) == 0 || !b.blocked(r.Question.Queries[0].Name) {
+			next.ServeDNS(w, r)
+			return
+		}
+		metrics.inc("queries_blocked_total")
+		switch b.action {
+		case blockRefused:
+			reject(w, r, dns.RCODE_REFUSED, reasonBlocked)
+		case blockNull:
+			w.WriteMsg(nullResponse(*r))
+		default:
+			reject(w, r, dns.RCODE_NXDOMAIN, reasonBlocked)
+		}
+	})
+}
+
+// nullResponse answers r with the unspecified address of the queried
+// family, or with no records for other types.
+func nullResponse(r dns.Message) dns.Message {
+	m := errorResponse(r, dns.RCODE_NOERROR, reasonBlocked)
+	q := r.Question.Queries[0]
+	var data dns.RData
+	switch q.Type {
+	case dns.TYPE_A:
+		data = dns.A{Addr: net.IPv4zero}
+	case dns.TYPE_AAAA:
+		data = dns.AAAA{Addr: net.IPv6zero}
+	default:
+		return m
+	}
+	m.Answer.Records = []dns.Record{dns.NewRecord(q.Name, q.Class, blockTTL, data)}
+	m.Header.ANCOUNT = 1
+	tagOrigin(&m, originBlocklist)
+	return m
+}
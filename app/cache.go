@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// maxNegativeTTL caps how long negative answers are cached (RFC 2308
+// section 5).
+const maxNegativeTTL = 3 * 60 * 60
+
+// cacheKey partitions cached responses. DNSSEC-requesting clients (DO set)
+// never share entries with other clients, nor do clients that disable
+// validation (CD set).
+type cacheKey struct {
+	name   string // Lowercased query name
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+// nxdomainKey identifies a name cached as nonexistent, regardless of the
+// query type.
+type nxdomainKey struct {
+	name   string // Lowercased name
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+// cacheEntry is a cached response along with the clients it may be served to.
+type cacheEntry struct {
+	msg     dns.Message
+	stored  time.Time
+	expires time.Time
+	scope   *net.IPNet // ECS scope of the answer, nil if valid for every client
+}
+
+// refreshAheadPercent is the share of its TTL below which a cached answer
+// is refreshed in the background when it is served, with a stale window.
+const refreshAheadPercent = 10
+
+// responseCache stores upstream responses until their TTL expires. Negative
+// answers are kept for as long as the SOA record of their authority section
+// allows, and an NXDOMAIN answer also answers the names below its name
+// (RFC 8020).
+//
+// With a stale window, popular answers are never waited for once cached: a
+// hit on an answer close to expiring, or expired for less than the window,
+// is served right away and refreshed in the background.
+type responseCache struct {
+	maxSize int
+	ttls    *ttlPolicy    // TTL clamps of cached records, nil for none
+	stale   time.Duration // How long expired answers are served while refreshed, 0 for not at all
+
+	mu         sync.Mutex
+	entries    map[cacheKey][]*cacheEntry
+	nxdomains  map[nxdomainKey]*cacheEntry // NXDOMAIN entries, also held in entries
+	size       int
+	refreshing map[cacheKey]bool // Keys being refreshed in the background
+}
+
+func newResponseCache(maxSize int, ttls *ttlPolicy, stale time.Duration) *responseCache {
+	return &responseCache{
+		maxSize:    maxSize,
+		ttls:       ttls,
+		stale:      stale,
+		entries:    make(map[cacheKey][]*cacheEntry),
+		nxdomains:  make(map[nxdomainKey]*cacheEntry),
+		refreshing: make(map[cacheKey]bool),
+	}
+}
+
+// cached wraps next in a response cache of the given size, serving answers
+// for up to stale past their expiry while refreshing them, and revalidating
+// cached responses in the background every revalidate if it is positive,
+// until stop is closed.
+func cached(next dns.Handler, size int, ttls *ttlPolicy, stale, revalidate time.Duration, stop <-chan struct{}) dns.Handler {
+	return newResponseCache(size, ttls, stale).handler(next, revalidate, stop)
+}
+
+// handler wraps next in the cache, revalidating cached responses in the
+// background every revalidate if it is positive, until stop is closed.
+func (c *responseCache) handler(next dns.Handler, revalidate time.Duration, stop <-chan struct{}) dns.Handler {
+	if revalidate > 0 {
+		go (&cacheRevalidator{cache: c, upstream: next, interval: revalidate, stop: stop}).run()
+	}
+	return c.middleware(next)
+}
+
+// cacheKeyOf returns the cache key of the request, or false if the request
+// cannot be cached.
+func cacheKeyOf(r dns.Message) (cacheKey, bool) {
+	if len(r.Question.Queries) != 1 || r.Header.OpCode() != dns.OPCODE_QUERY {
+		return cacheKey{}, false
+	}
+	q := r.Question.Queries[0]
+	k := cacheKey{name: dns.CanonicalName(q.Name), qtype: q.Type, qclass: q.Class, cd: r.Header.CD()}
+	if opt, ok := r.EDNS(); ok {
+		k.do = opt.DO
+	}
+	return k, true
+}
+
+// requestSubnet returns the client address the request carries in its ECS
+// option, if any.
+func requestSubnet(r dns.Message) net.IP {
+	opt, ok := r.EDNS()
+	if !ok {
+		return nil
+	}
+	o, ok := opt.Option(dns.EDNS_OPTION_ECS)
+	if !ok {
+		return nil
+	}
+	cs, ok := o.ClientSubnet()
+	if !ok {
+		return nil
+	}
+	return cs.Address
+}
+
+// responseScope returns the network an ECS-scoped response applies to, or
+// nil if the response is valid for all clients.
+func responseScope(m dns.Message) *net.IPNet {
+	opt, ok := m.EDNS()
+	if !ok {
+		return nil
+	}
+	o, ok := opt.Option(dns.EDNS_OPTION_ECS)
+	if !ok {
+		return nil
+	}
+	cs, ok := o.ClientSubnet()
+	if !ok || cs.ScopePrefix == 0 {
+		return nil
+	}
+	bits := len(cs.Address) * 8
+	mask := net.CIDRMask(int(cs.ScopePrefix), bits)
+	return &net.IPNet{IP: cs.Address.Mask(mask), Mask: mask}
+}
+
+// lookup returns a copy of the cached response to r with its TTLs reduced by
+// the time spent in the cache. It also reports whether the response should
+// be refreshed: with a stale window, when the response expired less than
+// the window ago, served with TTLs of zero, or when it is about to expire.
+func (c *responseCache) lookup(r dns.Message) (m dns.Message, ok, refresh bool) {
+	k, ok := cacheKeyOf(r)
+	if !ok {
+		return dns.Message{}, false, false
+	}
+	subnet := requestSubnet(r)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries[k] {
+		if !now.Before(e.expires.Add(c.stale)) {
+			continue
+		}
+		if e.scope != nil && (subnet == nil || !e.scope.Contains(subnet)) {
+			continue
+		}
+		if !now.Before(e.expires) {
+			metrics.inc("cache_stale_hits_total")
+			return agedResponse(e, r, now), true, true
+		}
+		ahead := e.expires.Sub(e.stored) * refreshAheadPercent / 100
+		return agedResponse(e, r, now), true, c.stale > 0 && e.expires.Sub(now) < ahead
+	}
+	// A name below a nonexistent name does not exist either.
+	for name, ok := dns.Parent(k.name); ok; name, ok = dns.Parent(name) {
+		e := c.nxdomains[nxdomainKey{name: name, qclass: k.qclass, do: k.do, cd: k.cd}]
+		if e != nil && now.Before(e.expires) {
+			metrics.inc("cache_nxdomain_cut_hits_total")
+			return agedResponse(e, r, now), true, false
+		}
+	}
+	return dns.Message{}, false, false
+}
+
+// agedResponse turns a cache entry into a response to the request r.
+func agedResponse(e *cacheEntry, r dns.Message, now time.Time) dns.Message {
+	m := e.msg
+	m.Header.ID = r.Header.ID
+	m.Header.SetRD(r.Header.RD())
+	m.Question.Queries = r.Question.Queries
+	age := uint32(now.Sub(e.stored) / time.Second)
+	m.Answer.Records = agedRecords(m.Answer.Records, age)
+	m.Authority.Records = agedRecords(m.Authority.Records, age)
+	m.Additional.Records = agedRecords(m.Additional.Records, age)
+	return m
+}
+
+func agedRecords(records []dns.Record, age uint32) []dns.Record {
+	out := make([]dns.Record, len(records))
+	for i, r := range records {
+		if r.Type != dns.TYPE_OPT {
+			if r.TTL > age {
+				r.TTL -= age
+			} else {
+				r.TTL = 0
+			}
+			r.Origin = cachedOrigin(r.Origin)
+		}
+		out[i] = r
+	}
+	return out
+}
+
+// store caches the response m to the request r, if it is cacheable.
+func (c *responseCache) store(r, m dns.Message) {
+	k, ok := cacheKeyOf(r)
+	if !ok || m.Header.TC() {
+		return
+	}
+	var ttl uint32
+	switch rcode := m.Header.RCode(); {
+	case rcode == dns.RCODE_NXDOMAIN || rcode == dns.RCODE_NOERROR && len(m.Answer.Records) == 0:
+		ttl, ok = negativeTTL(m)
+	case rcode == dns.RCODE_NOERROR:
+		ttl, ok = minTTL(m)
+	default:
+		return
+	}
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{msg: m, stored: now, expires: now.Add(time.Duration(ttl) * time.Second), scope: responseScope(m)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := c.entries[k]
+	// Replace an entry for the same scope.
+	defer c.storeNXDOMAIN(k, e)
+	for i, old := range entries {
+		if sameScope(old.scope, e.scope) {
+			entries[i] = e
+			return
+		}
+	}
+	if c.size >= c.maxSize {
+		c.evict(now)
+		if c.size >= c.maxSize {
+			return
+		}
+	}
+	c.entries[k] = append(entries, e)
+	c.size++
+}
+
+// storeNXDOMAIN remembers the stored entry e for k as covering the names
+// below k if it is an NXDOMAIN answer for k itself, not for the target of a
+// CNAME, and forgets an earlier one for k otherwise. Only answers valid for
+// every client count. The caller must hold c.mu.
+func (c *responseCache) storeNXDOMAIN(k cacheKey, e *cacheEntry) {
+	if e.scope != nil {
+		return
+	}
+	nk := nxdomainKey{name: k.name, qclass: k.qclass, do: k.do, cd: k.cd}
+	if e.msg.Header.RCode() != dns.RCODE_NXDOMAIN || len(e.msg.Answer.Records) > 0 {
+		delete(c.nxdomains, nk)
+		return
+	}
+	for _, stored := range c.entries[k] {
+		if stored == e {
+			c.nxdomains[nk] = e
+			return
+		}
+	}
+}
+
+// evict removes entries expired for longer than the stale window, or an
+// arbitrary entry if there are none.
+func (c *responseCache) evict(now time.Time) {
+	for k, entries := range c.entries {
+		kept := entries[:0]
+		for _, e := range entries {
+			if now.Before(e.expires.Add(c.stale)) {
+				kept = append(kept, e)
+			}
+		}
+		c.size -= len(entries) - len(kept)
+		if len(kept) == 0 {
+			delete(c.entries, k)
+		} else {
+			c.entries[k] = kept
+		}
+	}
+	for k, e := range c.nxdomains {
+		if !now.Before(e.expires) {
+			delete(c.nxdomains, k)
+		}
+	}
+	if c.size < c.maxSize {
+		return
+	}
+	for k, entries := range c.entries {
+		c.size -= len(entries)
+		delete(c.entries, k)
+		delete(c.nxdomains, nxdomainKey{name: k.name, qclass: k.qclass, do: k.do, cd: k.cd})
+		return
+	}
+}
+
+// len returns the number of cached responses.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// trim removes expired responses, and then arbitrary ones until at most
+// size are left. It returns the number of responses removed.
+func (c *responseCache) trim(size int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	before := c.size
+	c.evict(time.Now())
+	for k, entries := range c.entries {
+		if c.size <= size {
+			break
+		}
+		c.size -= len(entries)
+		delete(c.entries, k)
+		delete(c.nxdomains, nxdomainKey{name: k.name, qclass: k.qclass, do: k.do, cd: k.cd})
+	}
+	return before - c.size
+}
+
+// flush removes the cached responses for name, of every type, or also for
+// the names below it with subtree. An empty name with subtree flushes the
+// whole cache. It returns the number of responses removed.
+func (c *responseCache) flush(name string, subtree bool) int {
+	name = dns.CanonicalName(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for k, entries := range c.entries {
+		if k.name == name || subtree && dns.IsSubDomain(name, k.name) {
+			removed += len(entries)
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.nxdomains {
+		if k.name == name || subtree && dns.IsSubDomain(name, k.name) {
+			delete(c.nxdomains, k)
+		}
+	}
+	c.size -= removed
+	return removed
+}
+
+func sameScope(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+// minTTL returns the lowest TTL among the records of the response, ignoring
+// the OPT pseudo-record.
+func minTTL(m dns.Message) (uint32, bool) {
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, section := range [][]dns.Record{m.Answer.Records, m.Authority.Records, m.Additional.Records} {
+		for _, r := range section {
+			if r.Type == dns.TYPE_OPT {
+				continue
+			}
+			if !found || r.TTL < ttl {
+				ttl, found = r.TTL, true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// negativeTTL returns how long an NXDOMAIN or NODATA response may be cached:
+// the lower of the TTL and the MINIMUM field of the SOA record in the
+// authority section (RFC 2308 section 5). Without a SOA record the response
+// is not cached.
+func negativeTTL(m dns.Message) (uint32, bool) {
+	for _, r := range m.Authority.Records {
+		if r.Type != dns.TYPE_SOA || len(r.Data) < 20 {
+			continue
+		}
+		// MINIMUM is the last field of the SOA data.
+		ttl := binary.BigEndian.Uint32(r.Data[len(r.Data)-4:])
+		if r.TTL < ttl {
+			ttl = r.TTL
+		}
+		if ttl > maxNegativeTTL {
+			ttl = maxNegativeTTL
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// middleware answers queries from the cache and caches the responses of
+// the next handler.
+func (c *responseCache) middleware(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Message) {
+		if m, ok, refresh := c.lookup(*r); ok {
+			metrics.inc("cache_hits_total")
+			w.WriteMsg(m)
+			if refresh {
+				c.refresh(next, *r, w.RemoteAddr())
+			}
+			return
+		}
+		metrics.inc("cache_misses_total")
+		next.ServeDNS(&cacheWriter{ResponseWriter: w, cache: c, req: *r}, r)
+	})
+}
+
+// refresh resolves r again through next in the background, on behalf of the
+// client at addr, and caches the response. A key is refreshed once at a
+// time; if the refresh fails, the cached answer is served until the stale
+// window ends.
+func (c *responseCache) refresh(next dns.Handler, r dns.Message, addr net.Addr) {
+	k, _ := cacheKeyOf(r)
+	c.mu.Lock()
+	if c.refreshing[k] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[k] = true
+	c.mu.Unlock()
+	metrics.inc("cache_refreshes_total")
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, k)
+			c.mu.Unlock()
+		}()
+		next.ServeDNS(&cacheWriter{ResponseWriter: &probeWriter{addr: addr}, cache: c, req: r}, &r)
+	}()
+}
+
+// cacheWriter stores responses in the cache on their way to the client,
+// with their TTLs clamped as they will be served from the cache.
+type cacheWriter struct {
+	dns.ResponseWriter
+	cache *responseCache
+	req   dns.Message
+}
+
+func (w *cacheWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *cacheWriter) WriteMsg(m dns.Message) error {
+	if w.cache.ttls != nil {
+		m = w.cache.ttls.clamp(m)
+	}
+	w.cache.store(w.req, m)
+	return w.ResponseWriter.WriteMsg(m)
+}
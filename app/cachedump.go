@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// The cache is dumped and loaded in the text format of unbound-control
+// dump_cache and load_cache: a section of RRsets in zone file syntax,
+// each preceded by an ;rrset line, and a section of messages that refer to
+// the RRsets of their answer, authority, and additional sections by name,
+// class, and type.
+
+// dump writes the cached responses that are valid for every client and do
+// not carry DNSSEC records requested with DO.
+func (c *responseCache) dump(w io.Writer, now time.Time) error {
+	type dumpedMsg struct {
+		key      cacheKey
+		flags    uint16
+		ttl      int64
+		sections [3][]dns.RRSet
+	}
+	var (
+		msgs   []dumpedMsg
+		rrsets []dns.RRSet
+		seen   = make(map[dns.RRSetKey]bool)
+	)
+	c.mu.Lock()
+	for k, entries := range c.entries {
+		if k.do || k.cd {
+			continue
+		}
+		for _, e := range entries {
+			if e.scope != nil || !now.Before(e.expires) {
+				continue
+			}
+			m := agedResponse(e, e.msg, now)
+			d := dumpedMsg{key: k, flags: m.Header.Flag, ttl: int64(e.expires.Sub(now) / time.Second)}
+			for i, records := range [][]dns.Record{m.Answer.Records, m.Authority.Records, m.Additional.Records} {
+				for _, set := range dns.GroupRRSets(records) {
+					if set.Type == dns.TYPE_OPT {
+						continue
+					}
+					d.sections[i] = append(d.sections[i], set)
+					if !seen[set.Key()] {
+						seen[set.Key()] = true
+						rrsets = append(rrsets, set)
+					}
+				}
+			}
+			msgs = append(msgs, d)
+		}
+	}
+	c.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "START_RRSET_CACHE")
+	for _, set := range rrsets {
+		fmt.Fprintf(bw, ";rrset %d %d 0 4 0\n", set.TTL, len(set.Data))
+		for _, r := range set.Records() {
+			fmt.Fprintln(bw, r.String())
+		}
+	}
+	fmt.Fprintln(bw, "END_RRSET_CACHE")
+	fmt.Fprintln(bw, "START_MSG_CACHE")
+	for _, d := range msgs {
+		fmt.Fprintf(bw, "msg %s %s %s %d 1 %d 0 %d %d %d\n", d.key.name+".", dns.ClassString(d.key.qclass), dns.TypeString(d.key.qtype),
+			d.flags, d.ttl, len(d.sections[0]), len(d.sections[1]), len(d.sections[2]))
+		for _, sets := range d.sections {
+			for _, set := range sets {
+				fmt.Fprintf(bw, "%s. %s %s 0\n", dns.CanonicalName(set.Name), dns.ClassString(set.Class), dns.TypeString(set.Type))
+			}
+		}
+	}
+	fmt.Fprintln(bw, "END_MSG_CACHE")
+	fmt.Fprintln(bw, "EOF")
+	return bw.Flush()
+}
+
+// pendingMsg is a message being read from a dump, waiting for the
+// references to its RRsets.
+type pendingMsg struct {
+	m      dns.Message
+	counts [3]int // RRsets still expected per section
+}
+
+// load adds the messages of a dump to the cache, with the TTLs of their
+// records as given. Messages referring to RRsets missing from the dump or
+// that cannot be parsed are skipped. It returns the number of messages
+// loaded and skipped.
+func (c *responseCache) load(r io.Reader) (loaded, skipped int, err error) {
+	rrsets := make(map[dns.RRSetKey][]dns.Record)
+	var (
+		msg     *pendingMsg
+		missing bool // A reference of msg could not be resolved
+		line    int
+	)
+	finish := func() {
+		if msg == nil {
+			return
+		}
+		if missing {
+			skipped++
+		} else {
+			c.store(dns.Message{Header: dns.Header{QDCOUNT: 1}, Question: msg.m.Question}, msg.m)
+			loaded++
+		}
+		msg, missing = nil, false
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, ";") || text == "START_RRSET_CACHE" || text == "END_RRSET_CACHE" || text == "START_MSG_CACHE":
+			continue
+		case text == "END_MSG_CACHE" || text == "EOF":
+			finish()
+			continue
+		case strings.HasPrefix(text, "msg "):
+			finish()
+			m, counts, err := parseDumpMsg(strings.Fields(text)[1:])
+			if err != nil {
+				return loaded, skipped, fmt.Errorf("line %d: %w", line, err)
+			}
+			msg = &pendingMsg{m: m, counts: counts}
+		case msg != nil:
+			fields := strings.Fields(text)
+			if len(fields) < 3 {
+				return loaded, skipped, fmt.Errorf("line %d: invalid RRset reference", line)
+			}
+			t, ok := dns.ParseType(fields[2])
+			if !ok || fields[1] != "IN" {
+				missing = true
+			}
+			records := rrsets[dns.RRSetKey{Name: dns.CanonicalName(fields[0]), Type: t, Class: dns.CLASS_IN}]
+			if len(records) == 0 {
+				missing = true
+			}
+			switch {
+			case msg.counts[0] > 0:
+				msg.m.Answer.Records = append(msg.m.Answer.Records, records...)
+				msg.counts[0]--
+			case msg.counts[1] > 0:
+				msg.m.Authority.Records = append(msg.m.Authority.Records, records...)
+				msg.counts[1]--
+			case msg.counts[2] > 0:
+				msg.m.Additional.Records = append(msg.m.Additional.Records, records...)
+				msg.counts[2]--
+			default:
+				return loaded, skipped, fmt.Errorf("line %d: more RRset references than the message has", line)
+			}
+			if msg.counts == [3]int{} {
+				msg.m.Header.ANCOUNT = uint16(len(msg.m.Answer.Records))
+				msg.m.Header.NSCOUNT = uint16(len(msg.m.Authority.Records))
+				msg.m.Header.ARCOUNT = uint16(len(msg.m.Additional.Records))
+				finish()
+			}
+		default:
+			// A record of the RRset section. Types the zone file parser
+			// does not know, such as RRSIG, leave their RRset out.
+			records, err := dns.ParseZone(strings.NewReader(text), ".")
+			if err != nil {
+				continue
+			}
+			for _, r := range records {
+				k := dns.RRSetKey{Name: dns.CanonicalName(r.Name), Type: r.Type, Class: r.Class}
+				rrsets[k] = append(rrsets[k], r)
+			}
+		}
+	}
+	finish()
+	return loaded, skipped, scanner.Err()
+}
+
+// parseDumpMsg parses the fields of a msg line: the query name, class, and
+// type, the header flags, the question count, the TTL, the security status,
+// and the number of RRsets in each section.
+func parseDumpMsg(fields []string) (dns.Message, [3]int, error) {
+	var counts [3]int
+	if len(fields) != 10 {
+		return dns.Message{}, counts, fmt.Errorf("msg line has %d fields, want 10", len(fields))
+	}
+	if fields[1] != "IN" {
+		return dns.Message{}, counts, fmt.Errorf("unsupported class %s", fields[1])
+	}
+	qtype, ok := dns.ParseType(fields[2])
+	if !ok {
+		return dns.Message{}, counts, fmt.Errorf("unknown type %s", fields[2])
+	}
+	flags, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return dns.Message{}, counts, fmt.Errorf("invalid flags %s", fields[3])
+	}
+	for i := range counts {
+		if counts[i], err = strconv.Atoi(fields[7+i]); err != nil || counts[i] < 0 {
+			return dns.Message{}, counts, fmt.Errorf("invalid RRset count %s", fields[7+i])
+		}
+	}
+	m := dns.Message{
+		Header:   dns.Header{Flag: uint16(flags) | dns.FLAG_QR, QDCOUNT: 1},
+		Question: dns.Question{Queries: []dns.Query{{Name: dns.CanonicalName(fields[0]), Type: qtype, Class: dns.CLASS_IN}}},
+	}
+	return m, counts, nil
+}
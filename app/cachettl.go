@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// ttlClamp bounds the TTL of cached records. A zero bound is not applied.
+type ttlClamp struct {
+	min, max uint32
+}
+
+func (c ttlClamp) apply(ttl uint32) uint32 {
+	if c.min > 0 && ttl < c.min {
+		ttl = c.min
+	}
+	if c.max > 0 && ttl > c.max {
+		ttl = c.max
+	}
+	return ttl
+}
+
+// ttlPolicy holds the TTL clamps applied to records entering the cache, per
+// record type, with a default for the types without their own.
+type ttlPolicy struct {
+	byType   map[uint16]ttlClamp
+	fallback ttlClamp
+}
+
+// parseTTLPolicy parses clamps of the form TYPE=MIN:MAX, where TYPE is a
+// record type or * for all other types, and either bound may be omitted,
+// e.g. NS=86400: or A=:300.
+func parseTTLPolicy(specs []string) (*ttlPolicy, error) {
+	p := &ttlPolicy{byType: make(map[uint16]ttlClamp)}
+	for _, spec := range specs {
+		name, bounds, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form TYPE=MIN:MAX", spec)
+		}
+		minS, maxS, ok := strings.Cut(bounds, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form TYPE=MIN:MAX", spec)
+		}
+		var c ttlClamp
+		for _, b := range []struct {
+			s string
+			v *uint32
+		}{{minS, &c.min}, {maxS, &c.max}} {
+			if b.s == "" {
+				continue
+			}
+			n, err := strconv.ParseUint(b.s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TTL %q in %q", b.s, spec)
+			}
+			*b.v = uint32(n)
+		}
+		if c.max > 0 && c.min > c.max {
+			return nil, fmt.Errorf("minimum above maximum in %q", spec)
+		}
+		if name == "*" {
+			p.fallback = c
+			continue
+		}
+		t, ok := dns.ParseType(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown record type %q", name)
+		}
+		p.byType[t] = c
+	}
+	return p, nil
+}
+
+// clamp returns m with the TTL of every record clamped for its type. The
+// records are copied, leaving m untouched.
+func (p *ttlPolicy) clamp(m dns.Message) dns.Message {
+	for _, section := range []*[]dns.Record{&m.Answer.Records, &m.Authority.Records, &m.Additional.Records} {
+		records := make([]dns.Record, len(*section))
+		for i, r := range *section {
+			if r.Type != dns.TYPE_OPT {
+				c, ok := p.byType[r.Type]
+				if !ok {
+					c = p.fallback
+				}
+				r.TTL = c.apply(r.TTL)
+			}
+			records[i] = r
+		}
+		*section = records
+	}
+	return m
+}
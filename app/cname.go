@@ -0,0 +1,106 @@
+package main
+
+import "github.com/codecrafters-io/dns-server-starter-go/app/dns"
+
+// maxCNAMEChain is the number of aliases resolved for a single query.
+const maxCNAMEChain = 8
+
+// followCNAMEs is a middleware completing answers that end in an alias. The
+// target of the last CNAME record is resolved through next, which routes it
+// to a zone or to the forwarder, and its records are appended to the answer
+// as recursive resolvers do (RFC 1034 section 4.3.2). The rcode and authority
+// section of the response are those of the last lookup, so an alias to a
+// missing name answers NXDOMAIN (RFC 6604). Aliases whose target the client
+// may not resolve are returned unresolved.
+func followCNAMEs(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Message) {
+		if len(r.Question.Queries) != 1 || !followsCNAMEs(r.Question.Queries[0].Type) {
+			next.ServeDNS(w, r)
+			return
+		}
+		q := r.Question.Queries[0]
+		cw := &captureWriter{ResponseWriter: w}
+		next.ServeDNS(cw, r)
+		if !cw.written {
+			return
+		}
+		res := cw.msg
+		for i := 0; i < maxCNAMEChain && res.Header.RCode() == dns.RCODE_NOERROR; i++ {
+			target, ok := unresolvedAlias(res.Answer.Records, q)
+			if !ok {
+				break
+			}
+			sub := *r
+			sub.Question.Queries = []dns.Query{{Name: target, Type: q.Type, Class: q.Class}}
+			cw := &captureWriter{ResponseWriter: w}
+			next.ServeDNS(cw, &sub)
+			if !cw.written || cw.msg.Header.RCode() == dns.RCODE_REFUSED {
+				// The client may not resolve the target, leave the
+				// alias unresolved.
+				break
+			}
+			res.Answer.Records = append(res.Answer.Records, cw.msg.Answer.Records...)
+			res.Authority = cw.msg.Authority
+			res.Header.SetRCode(cw.msg.Header.RCode())
+			// The answer is only as authenticated as its least part.
+			if !cw.msg.Header.AD() {
+				res.Header.SetAD(false)
+			}
+		}
+		res.Header.ANCOUNT = uint16(len(res.Answer.Records))
+		res.Header.NSCOUNT = uint16(len(res.Authority.Records))
+		w.WriteMsg(res)
+	})
+}
+
+// followsCNAMEs reports whether aliases are resolved for queries of type t.
+// Queries for the CNAME itself, for all records, and for zone transfers are
+// answered as they are.
+func followsCNAMEs(t uint16) bool {
+	return t != dns.TYPE_CNAME && t != dns.TYPE_ANY && t != dns.TYPE_AXFR && t != dns.TYPE_IXFR
+}
+
+// unresolvedAlias walks the chain of aliases in the answer starting at the
+// query name. If it ends in a CNAME whose target has no records of the asked
+// type in the answer, it returns that target. Chains that loop are not
+// followed.
+func unresolvedAlias(answer []dns.Record, q dns.Query) (string, bool) {
+	name := dns.CanonicalName(q.Name)
+	seen := make(map[string]bool)
+	for !seen[name] {
+		seen[name] = true
+		next := ""
+		for _, r := range answer {
+			if dns.CanonicalName(r.Name) != name {
+				continue
+			}
+			if r.Type == q.Type {
+				return "", false
+			}
+			if c, ok := r.CNAME(); ok {
+				next = dns.CanonicalName(c.Target)
+			}
+		}
+		if next == "" {
+			return name, len(seen) > 1
+		}
+		name = next
+	}
+	return "", false
+}
+
+// captureWriter keeps the response of a handler instead of sending it.
+type captureWriter struct {
+	dns.ResponseWriter
+	msg     dns.Message
+	written bool
+}
+
+// Unwrap returns the writer the response would have gone to, which is how
+// stages called through the capture find the profile of the query.
+func (w *captureWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *captureWriter) WriteMsg(m dns.Message) error {
+	w.msg, w.written = m, true
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The configuration file sets the same options as the flags, in TOML
+// (https://toml.io). Keys are flag names, and tables prefix the names of
+// their keys, so these set -listen, -resolver-timeout, and -cache-size:
+//
+//	listen = ["127.0.0.1:53", "[::1]:53"]
+//	[resolver]
+//	timeout = "2s"
+//	[cache]
+//	size = 20000
+//
+// Flags that may be repeated take arrays. Flags given on the command line
+// take precedence over the file. Only the part of TOML needed for flags is
+// supported: no multi-line strings, inline tables, or arrays of tables.
+
+// configFlags are the flags that cannot be set from the configuration file.
+var configFlags = map[string]bool{"config": true, "check-config": true}
+
+// loadConfig sets the flags of fs from the file at path, except the ones in
+// explicit.
+func loadConfig(path string, fs *flag.FlagSet, explicit map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	seen := make(map[string]bool)
+	table := ""
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fail := func(format string, a ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", path, line, fmt.Sprintf(format, a...))
+		}
+		p := &configParser{s: scanner.Text()}
+		p.skipSpace()
+		if p.done() {
+			continue
+		}
+		if p.peek() == '[' {
+			p.next()
+			if p.peek() == '[' {
+				return fail("arrays of tables are not supported")
+			}
+			name, err := p.key()
+			if err != nil {
+				return fail("%v", err)
+			}
+			p.skipSpace()
+			if p.next() != ']' {
+				return fail("missing ] after table name")
+			}
+			if p.skipSpace(); !p.done() {
+				return fail("unexpected text after table name")
+			}
+			table = name
+			continue
+		}
+		name, err := p.key()
+		if err != nil {
+			return fail("%v", err)
+		}
+		if table != "" {
+			name = table + "-" + name
+		}
+		p.skipSpace()
+		if p.next() != '=' {
+			return fail("missing = after %s", name)
+		}
+		// Arrays may continue on the following lines.
+		for p.openArray() {
+			if !scanner.Scan() {
+				return fail("unterminated array")
+			}
+			line++
+			p.s += "\n" + scanner.Text()
+		}
+		values, isArray, err := p.value()
+		if err != nil {
+			return fail("%v", err)
+		}
+		if p.skipSpace(); !p.done() {
+			return fail("unexpected text after the value of %s", name)
+		}
+
+		fl := fs.Lookup(name)
+		switch {
+		case fl == nil || configFlags[name]:
+			return fail("unknown setting %s", name)
+		case seen[name]:
+			return fail("%s is set twice", name)
+		}
+		seen[name] = true
+		if _, repeatable := listValues(fl.Value); isArray && !repeatable {
+			return fail("%s takes a single value, not an array", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		for _, v := range values {
+			if err := fl.Value.Set(v); err != nil {
+				return fail("invalid value %q for %s: %v", v, name, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// configParser reads the tokens of a line of the configuration file, or of
+// several lines for arrays.
+type configParser struct {
+	s string
+	i int
+}
+
+func (p *configParser) done() bool { return p.i >= len(p.s) }
+
+func (p *configParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *configParser) next() byte {
+	c := p.peek()
+	p.i++
+	return c
+}
+
+// skipSpace skips whitespace, newlines, and comments.
+func (p *configParser) skipSpace() {
+	for !p.done() {
+		switch p.s[p.i] {
+		case ' ', '\t', '\n', '\r':
+			p.i++
+		case '#':
+			for !p.done() && p.s[p.i] != '\n' {
+				p.i++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// key reads a bare, quoted, or dotted key, joining dotted parts with
+// dashes.
+func (p *configParser) key() (string, error) {
+	var parts []string
+	for {
+		p.skipSpace()
+		var part string
+		switch c := p.peek(); {
+		case c == '"' || c == '\'':
+			s, err := p.quoted()
+			if err != nil {
+				return "", err
+			}
+			part = s
+		default:
+			start := p.i
+			for !p.done() && isBareKeyChar(p.s[p.i]) {
+				p.i++
+			}
+			if start == p.i {
+				return "", errors.New("missing key")
+			}
+			part = p.s[start:p.i]
+		}
+		parts = append(parts, part)
+		p.skipSpace()
+		if p.peek() != '.' {
+			return strings.Join(parts, "-"), nil
+		}
+		p.i++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_'
+}
+
+// openArray reports whether the rest of the text holds an array that is
+// not closed yet, ignoring brackets in strings and comments.
+func (p *configParser) openArray() bool {
+	depth := 0
+	for i := p.i; i < len(p.s); i++ {
+		switch p.s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '#':
+			for i < len(p.s) && p.s[i] != '\n' {
+				i++
+			}
+		case '"', '\'':
+			quote := p.s[i]
+			for i++; i < len(p.s) && p.s[i] != quote && p.s[i] != '\n'; i++ {
+				if quote == '"' && p.s[i] == '\\' {
+					i++
+				}
+			}
+		}
+	}
+	return depth > 0
+}
+
+// value reads a scalar or an array of scalars, returning them in the form
+// flags take.
+func (p *configParser) value() ([]string, bool, error) {
+	p.skipSpace()
+	if p.peek() != '[' {
+		v, err := p.scalar()
+		return []string{v}, false, err
+	}
+	p.i++
+	var values []string
+	for {
+		p.skipSpace()
+		if p.peek() == ']' {
+			p.i++
+			return values, true, nil
+		}
+		if p.peek() == '[' {
+			return nil, false, errors.New("nested arrays are not supported")
+		}
+		v, err := p.scalar()
+		if err != nil {
+			return nil, false, err
+		}
+		values = append(values, v)
+		p.skipSpace()
+		switch p.next() {
+		case ',':
+		case ']':
+			return values, true, nil
+		default:
+			return nil, false, errors.New("missing , between array values")
+		}
+	}
+}
+
+// scalar reads a string, number, or boolean.
+func (p *configParser) scalar() (string, error) {
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return p.quoted()
+	case c == '{':
+		return "", errors.New("inline tables are not supported")
+	}
+	start := p.i
+	for !p.done() && !strings.ContainsRune(" \t\r\n,]#", rune(p.s[p.i])) {
+		p.i++
+	}
+	v := p.s[start:p.i]
+	switch {
+	case v == "":
+		return "", errors.New("missing value")
+	case v == "true" || v == "false":
+		return v, nil
+	}
+	// Numbers may use underscores between digits.
+	n := strings.ReplaceAll(v, "_", "")
+	if _, err := strconv.ParseFloat(n, 64); err != nil {
+		if _, err := strconv.ParseInt(n, 0, 64); err != nil {
+			return "", fmt.Errorf("invalid value %s, strings must be quoted", v)
+		}
+	}
+	return n, nil
+}
+
+// quoted reads a basic string in double quotes, with escapes, or a literal
+// string in single quotes.
+func (p *configParser) quoted() (string, error) {
+	quote := p.next()
+	if strings.HasPrefix(p.s[p.i:], string([]byte{quote, quote})) {
+		return "", errors.New("multi-line strings are not supported")
+	}
+	var b strings.Builder
+	for {
+		if p.done() || p.peek() == '\n' {
+			return "", errors.New("unterminated string")
+		}
+		c := p.next()
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && quote == '"':
+			e := p.next()
+			switch e {
+			case '"', '\\':
+				b.WriteByte(e)
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'u', 'U':
+				n := 4
+				if e == 'U' {
+					n = 8
+				}
+				if p.i+n > len(p.s) {
+					return "", errors.New("short unicode escape")
+				}
+				r, err := strconv.ParseUint(p.s[p.i:p.i+n], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", fmt.Errorf("invalid unicode escape \\%c%s", e, p.s[p.i:p.i+n])
+				}
+				b.WriteRune(rune(r))
+				p.i += n
+			default:
+				return "", fmt.Errorf("invalid escape \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
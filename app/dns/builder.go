@@ -0,0 +1,198 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Section identifies a record section of a message.
+type Section int
+
+const (
+	SectionAnswer Section = iota
+	SectionAuthority
+	SectionAdditional
+)
+
+var ErrSectionOrder = errors.New("dns: sections must be built in order")
+
+// Omission describes an RRset left out of a message for lack of space.
+type Omission struct {
+	Section Section
+	RRSet   RRSet
+}
+
+// Builder assembles the wire format of a message while keeping it within a
+// byte budget. RRsets are added whole, section by section; an RRset that
+// does not fit is omitted, and omissions from the answer or authority
+// section set the TC bit (RFC 2181 section 9).
+type Builder struct {
+	budget   int
+	reserved int
+	buf      []byte
+	offsets  map[string]int
+	section  Section
+	msg      Message
+	omitted  []Omission
+}
+
+// NewBuilder starts a message with the given header and questions. Budget is
+// the largest size of the encoded message, zero meaning unlimited.
+func NewBuilder(h Header, questions []Query, budget int) *Builder {
+	return newBuilder(h, questions, budget, make(map[string]int))
+}
+
+// NewUncompressedBuilder is like NewBuilder, for a message whose names are
+// written in full.
+func NewUncompressedBuilder(h Header, questions []Query, budget int) *Builder {
+	return newBuilder(h, questions, budget, nil)
+}
+
+func newBuilder(h Header, questions []Query, budget int, offsets map[string]int) *Builder {
+	b := &Builder{
+		budget:  budget,
+		buf:     make([]byte, headerSize),
+		offsets: offsets,
+	}
+	b.msg.Header = h
+	b.msg.Question.Queries = questions
+	b.msg.Header.QDCOUNT = uint16(len(questions))
+	for _, query := range questions {
+		b.buf = appendDomainName(b.buf, query.Name, b.offsets)
+		b.buf = binary.BigEndian.AppendUint16(b.buf, query.Type)
+		b.buf = binary.BigEndian.AppendUint16(b.buf, query.Class)
+	}
+	return b
+}
+
+// Reserve holds back n bytes of the budget, e.g. for an OPT record that is
+// added last with AddReserved.
+func (b *Builder) Reserve(n int) {
+	b.reserved += n
+}
+
+// Add appends the RRset to the section if it fits in the budget. It reports
+// whether the RRset was added.
+func (b *Builder) Add(section Section, set RRSet) (bool, error) {
+	return b.add(section, set, false)
+}
+
+// AddReserved appends the RRset using the space held back with Reserve.
+func (b *Builder) AddReserved(section Section, set RRSet) (bool, error) {
+	return b.add(section, set, true)
+}
+
+func (b *Builder) add(section Section, set RRSet, reserved bool) (bool, error) {
+	if section < b.section {
+		return false, ErrSectionOrder
+	}
+	b.section = section
+	start := len(b.buf)
+	records := set.Records()
+	for _, r := range records {
+		b.buf = appendRecord(b.buf, r, b.offsets)
+	}
+	limit := b.budget - b.reserved
+	if reserved {
+		limit = b.budget
+	}
+	if b.budget > 0 && len(b.buf) > limit {
+		// Roll back the partially written RRset.
+		b.buf = b.buf[:start]
+		for name, offset := range b.offsets {
+			if offset >= start {
+				delete(b.offsets, name)
+			}
+		}
+		b.omitted = append(b.omitted, Omission{Section: section, RRSet: set})
+		if section != SectionAdditional {
+			b.msg.Header.SetTC(true)
+		}
+		return false, nil
+	}
+	if reserved {
+		b.reserved = 0
+	}
+	switch section {
+	case SectionAnswer:
+		b.msg.Answer.Records = append(b.msg.Answer.Records, records...)
+	case SectionAuthority:
+		b.msg.Authority.Records = append(b.msg.Authority.Records, records...)
+	case SectionAdditional:
+		b.msg.Additional.Records = append(b.msg.Additional.Records, records...)
+	}
+	return true, nil
+}
+
+// Omitted returns the RRsets that did not fit.
+func (b *Builder) Omitted() []Omission {
+	return b.omitted
+}
+
+// Message returns the message containing the RRsets that fit, with the
+// section counts and TC bit set accordingly.
+func (b *Builder) Message() Message {
+	m := b.msg
+	m.Header.ANCOUNT = uint16(len(m.Answer.Records))
+	m.Header.NSCOUNT = uint16(len(m.Authority.Records))
+	m.Header.ARCOUNT = uint16(len(m.Additional.Records))
+	return m
+}
+
+// Len returns the size of the message built so far.
+func (b *Builder) Len() int {
+	return len(b.buf)
+}
+
+// Bytes returns the wire format of the message built so far.
+func (b *Builder) Bytes() []byte {
+	m := b.Message()
+	out := make([]byte, len(b.buf))
+	copy(out, b.buf)
+	binary.BigEndian.PutUint16(out[0:2], m.Header.ID)
+	binary.BigEndian.PutUint16(out[2:4], m.Header.Flag)
+	binary.BigEndian.PutUint16(out[4:6], m.Header.QDCOUNT)
+	binary.BigEndian.PutUint16(out[6:8], m.Header.ANCOUNT)
+	binary.BigEndian.PutUint16(out[8:10], m.Header.NSCOUNT)
+	binary.BigEndian.PutUint16(out[10:12], m.Header.ARCOUNT)
+	return out
+}
+
+// FitMessage rebuilds m within the byte budget, dropping whole RRsets that
+// do not fit and setting TC when answer or authority data is lost. The OPT
+// record is always kept. It returns the fitted message and the omissions.
+func FitMessage(m Message, budget int) (Message, []Omission) {
+	return fitMessage(m, NewBuilder(m.Header, m.Question.Queries, budget))
+}
+
+// FitMessageUncompressed is like FitMessage, for a message sent without name
+// compression.
+func FitMessageUncompressed(m Message, budget int) (Message, []Omission) {
+	return fitMessage(m, NewUncompressedBuilder(m.Header, m.Question.Queries, budget))
+}
+
+func fitMessage(m Message, b *Builder) (Message, []Omission) {
+	var opt *RRSet
+	for _, set := range GroupRRSets(m.Additional.Records) {
+		if set.Type == TYPE_OPT {
+			s := set
+			opt = &s
+			b.Reserve(len(appendRecord(nil, s.Records()[0], nil)))
+		}
+	}
+	for _, set := range GroupRRSets(m.Answer.Records) {
+		b.Add(SectionAnswer, set)
+	}
+	for _, set := range GroupRRSets(m.Authority.Records) {
+		b.Add(SectionAuthority, set)
+	}
+	for _, set := range GroupRRSets(m.Additional.Records) {
+		if set.Type != TYPE_OPT {
+			b.Add(SectionAdditional, set)
+		}
+	}
+	if opt != nil {
+		b.AddReserved(SectionAdditional, *opt)
+	}
+	return b.Message(), b.Omitted()
+}
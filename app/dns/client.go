@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the exchange timeout used by a Client without one.
+const DefaultTimeout = 2 * time.Second
+
+// maxUDPSize is the largest DNS message a UDP datagram can carry.
+const maxUDPSize = 65535
+
+// Client sends queries to DNS servers over UDP and transfers zones over TCP.
+type Client struct {
+	// Timeout bounds a single exchange when the context passed to Exchange
+	// has no earlier deadline. Zero means DefaultTimeout.
+	Timeout time.Duration
+	// Rand supplies the transaction IDs. Nil means CryptoRand.
+	Rand Rand
+	// TSIG signs queries, whose responses must then be signed with the
+	// same key. Nil sends them unsigned.
+	TSIG *TSIGKey
+}
+
+// Exchange sends msg to the server at addr and waits for its response. Every
+// exchange uses a fresh socket and a random transaction ID, which is replaced
+// by the ID of msg in the returned response. Datagrams that do not answer the
+// query, because their ID, question, opcode, or source differ, are discarded
+// while waiting. With a TSIG key, a response that fails verification ends
+// the exchange with an error.
+func (c *Client) Exchange(ctx context.Context, msg Message, addr string) (Message, error) {
+	id, err := RandomID(c.Rand)
+	if err != nil {
+		return Message{}, err
+	}
+	query := msg
+	query.Header.ID = id
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return Message{}, err
+	}
+	defer conn.Close()
+	udpConn := conn.(*net.UDPConn)
+	remote := udpConn.RemoteAddr().(*net.UDPAddr)
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return Message{}, err
+	}
+	// Unblock the read as soon as the context is canceled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	q, session, err := c.sign(query.Byte())
+	if err != nil {
+		return Message{}, err
+	}
+	if _, err := conn.Write(q); err != nil {
+		return Message{}, err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		size, source, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(ctxErr, context.DeadlineExceeded) {
+				return Message{}, ctxErr
+			}
+			return Message{}, err
+		}
+		if !source.IP.Equal(remote.IP) || source.Port != remote.Port {
+			continue
+		}
+		res, err := ParseMessage(buf[:size])
+		if err != nil {
+			continue
+		}
+		if err := ValidateResponse(query, res); err != nil {
+			continue
+		}
+		if session != nil {
+			if res, err = verifyResponse(session, buf[:size]); err != nil {
+				return Message{}, err
+			}
+		}
+		res.Header.ID = msg.Header.ID
+		return res, nil
+	}
+}
+
+// sign signs the wire format of a query with the TSIG key of the client,
+// if it has one, returning the session that verifies the responses.
+func (c *Client) sign(q []byte) ([]byte, *TSIGSession, error) {
+	if c.TSIG == nil {
+		return q, nil, nil
+	}
+	session := &TSIGSession{Key: *c.TSIG}
+	signed, err := session.Sign(q, time.Now())
+	return signed, session, err
+}
+
+// verifyResponse checks the TSIG record of a response and parses the
+// response without it.
+func verifyResponse(session *TSIGSession, b []byte) (Message, error) {
+	unsigned, err := session.Verify(b, time.Now())
+	if err != nil {
+		return Message{}, err
+	}
+	return ParseMessage(unsigned)
+}
+
+// ValidateResponse checks that res is a response to the request req: the ID
+// and opcode must match, QR must be set, and the question must be echoed.
+// Servers that do not handle several questions in a request often answer
+// it with FORMERR or NOTIMP and no question at all, which is accepted.
+func ValidateResponse(req, res Message) error {
+	if res.Header.ID != req.Header.ID {
+		return errors.New("dns: ID mismatch")
+	}
+	if !res.Header.QR() {
+		return errors.New("dns: QR bit not set")
+	}
+	if res.Header.OpCode() != req.Header.OpCode() {
+		return errors.New("dns: opcode mismatch")
+	}
+	if len(req.Question.Queries) > 1 && len(res.Question.Queries) == 0 {
+		if rcode := res.Header.RCode(); rcode == RCODE_FORMERR || rcode == RCODE_NOTIMP {
+			return nil
+		}
+	}
+	if len(res.Question.Queries) != len(req.Question.Queries) {
+		return errors.New("dns: question count mismatch")
+	}
+	for i, q := range req.Question.Queries {
+		rq := res.Question.Queries[i]
+		if !strings.EqualFold(rq.Name, q.Name) || rq.Type != q.Type || rq.Class != q.Class {
+			return fmt.Errorf("dns: question mismatch: %s", rq.Name)
+		}
+	}
+	return nil
+}
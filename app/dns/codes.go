@@ -0,0 +1,188 @@
+package dns
+
+import (
+	"strconv"
+	"strings"
+)
+
+// RCode is a response code. Codes above 15 are extended response codes that
+// only fit in a message using EDNS (RFC 6891 section 6.1.3).
+type RCode uint16
+
+const (
+	RCODE_NOERROR   RCode = 0  // No Error
+	RCODE_FORMERR   RCode = 1  // Format Error
+	RCODE_SERVFAIL  RCode = 2  // Server Failure
+	RCODE_NXDOMAIN  RCode = 3  // Non-Existent Domain
+	RCODE_NOTIMP    RCode = 4  // Not Implemented
+	RCODE_REFUSED   RCode = 5  // Query Refused
+	RCODE_YXDOMAIN  RCode = 6  // Name Exists when it should not (RFC 2136)
+	RCODE_YXRRSET   RCode = 7  // RR Set Exists when it should not (RFC 2136)
+	RCODE_NXRRSET   RCode = 8  // RR Set that should exist does not (RFC 2136)
+	RCODE_NOTAUTH   RCode = 9  // Server Not Authoritative for zone (RFC 2136, RFC 8945)
+	RCODE_NOTZONE   RCode = 10 // Name not contained in zone (RFC 2136)
+	RCODE_DSOTYPENI RCode = 11 // DSO-TYPE Not Implemented (RFC 8490)
+	RCODE_BADVERS   RCode = 16 // Bad OPT Version (RFC 6891)
+	RCODE_BADSIG    RCode = 16 // TSIG Signature Failure, in the error of TSIG records (RFC 8945)
+	RCODE_BADKEY    RCode = 17 // Key not recognized (RFC 8945)
+	RCODE_BADTIME   RCode = 18 // Signature out of time window (RFC 8945)
+	RCODE_BADMODE   RCode = 19 // Bad TKEY Mode (RFC 2930)
+	RCODE_BADNAME   RCode = 20 // Duplicate key name (RFC 2930)
+	RCODE_BADALG    RCode = 21 // Algorithm not supported (RFC 2930)
+	RCODE_BADTRUNC  RCode = 22 // Bad Truncation (RFC 8945)
+	RCODE_BADCOOKIE RCode = 23 // Bad/missing Server Cookie (RFC 7873)
+)
+
+var rcodeNames = map[RCode]string{
+	RCODE_NOERROR:   "NOERROR",
+	RCODE_FORMERR:   "FORMERR",
+	RCODE_SERVFAIL:  "SERVFAIL",
+	RCODE_NXDOMAIN:  "NXDOMAIN",
+	RCODE_NOTIMP:    "NOTIMP",
+	RCODE_REFUSED:   "REFUSED",
+	RCODE_YXDOMAIN:  "YXDOMAIN",
+	RCODE_YXRRSET:   "YXRRSET",
+	RCODE_NXRRSET:   "NXRRSET",
+	RCODE_NOTAUTH:   "NOTAUTH",
+	RCODE_NOTZONE:   "NOTZONE",
+	RCODE_DSOTYPENI: "DSOTYPENI",
+	RCODE_BADVERS:   "BADVERS",
+	RCODE_BADKEY:    "BADKEY",
+	RCODE_BADTIME:   "BADTIME",
+	RCODE_BADMODE:   "BADMODE",
+	RCODE_BADNAME:   "BADNAME",
+	RCODE_BADALG:    "BADALG",
+	RCODE_BADTRUNC:  "BADTRUNC",
+	RCODE_BADCOOKIE: "BADCOOKIE",
+}
+
+// String returns the mnemonic of the response code, or RCODE followed by its
+// number if it has none.
+func (c RCode) String() string {
+	if name, ok := rcodeNames[c]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(c))
+}
+
+// ParseRCode returns the response code with the given mnemonic, ignoring
+// case.
+func ParseRCode(s string) (RCode, bool) {
+	s = strings.ToUpper(s)
+	for c, name := range rcodeNames {
+		if name == s {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// OpCode is the kind of query a message carries.
+type OpCode uint16
+
+const (
+	OPCODE_QUERY  OpCode = 0 // Standard query
+	OPCODE_IQUERY OpCode = 1 // Inverse query (Obsolete - RFC 3425)
+	OPCODE_STATUS OpCode = 2 // Server status request
+	OPCODE_NOTIFY OpCode = 4 // Zone change notification (RFC 1996)
+	OPCODE_UPDATE OpCode = 5 // Dynamic update (RFC 2136)
+	OPCODE_DSO    OpCode = 6 // DNS Stateful Operations (RFC 8490)
+)
+
+var opcodeNames = map[OpCode]string{
+	OPCODE_QUERY:  "QUERY",
+	OPCODE_IQUERY: "IQUERY",
+	OPCODE_STATUS: "STATUS",
+	OPCODE_NOTIFY: "NOTIFY",
+	OPCODE_UPDATE: "UPDATE",
+	OPCODE_DSO:    "DSO",
+}
+
+// String returns the mnemonic of the opcode, or OPCODE followed by its number
+// if it has none.
+func (c OpCode) String() string {
+	if name, ok := opcodeNames[c]; ok {
+		return name
+	}
+	return "OPCODE" + strconv.Itoa(int(c))
+}
+
+// RCode returns the response code held in the header, without the upper bits
+// of an extended response code.
+func (h Header) RCode() RCode {
+	return RCode(h.Flag & 0xF)
+}
+
+// SetRCode stores the lower four bits of the response code in the header.
+func (h *Header) SetRCode(c RCode) {
+	h.Flag = h.Flag&^0xF | uint16(c)&0xF
+}
+
+// OpCode returns the opcode of the header.
+func (h Header) OpCode() OpCode {
+	return OpCode(h.Flag >> 11 & 0xF)
+}
+
+// SetOpCode stores the opcode in the header.
+func (h *Header) SetOpCode(c OpCode) {
+	h.Flag = h.Flag&^(0xF<<11) | (uint16(c)&0xF)<<11
+}
+
+var typeNames = map[uint16]string{
+	TYPE_A:          "A",
+	TYPE_NS:         "NS",
+	TYPE_MD:         "MD",
+	TYPE_MF:         "MF",
+	TYPE_CNAME:      "CNAME",
+	TYPE_SOA:        "SOA",
+	TYPE_MB:         "MB",
+	TYPE_MG:         "MG",
+	TYPE_MR:         "MR",
+	TYPE_NULL:       "NULL",
+	TYPE_WKS:        "WKS",
+	TYPE_PTR:        "PTR",
+	TYPE_HINFO:      "HINFO",
+	TYPE_MINFO:      "MINFO",
+	TYPE_MX:         "MX",
+	TYPE_TXT:        "TXT",
+	TYPE_AAAA:       "AAAA",
+	TYPE_SRV:        "SRV",
+	TYPE_DNAME:      "DNAME",
+	TYPE_OPT:        "OPT",
+	TYPE_DS:         "DS",
+	TYPE_RRSIG:      "RRSIG",
+	TYPE_NSEC:       "NSEC",
+	TYPE_DNSKEY:     "DNSKEY",
+	TYPE_NSEC3:      "NSEC3",
+	TYPE_NSEC3PARAM: "NSEC3PARAM",
+	TYPE_SVCB:       "SVCB",
+	TYPE_HTTPS:      "HTTPS",
+	TYPE_TSIG:       "TSIG",
+	TYPE_IXFR:       "IXFR",
+	TYPE_AXFR:       "AXFR",
+	TYPE_ANY:        "ANY",
+}
+
+// TypeString returns the mnemonic of a record type, or TYPE followed by its
+// number if it has none (RFC 3597 section 5).
+func TypeString(t uint16) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// ParseType returns the record type with the given mnemonic or in the
+// TYPEnnn form, ignoring case.
+func ParseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for t, name := range typeNames {
+		if name == s {
+			return t, true
+		}
+	}
+	if n, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16); err == nil && strings.HasPrefix(s, "TYPE") {
+		return uint16(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,75 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Conversions to and from the types of other DNS libraries, chiefly
+// github.com/miekg/dns, so that code written against them can be reused
+// with this package. The conversions go through the wire format, which both
+// sides implement completely, so this package does not depend on them:
+//
+//	m, err := dns.FromWireMessage(msg) // msg is a *miekgdns.Msg
+//	err = m.ToWireMessage(new(miekgdns.Msg))
+//	rr, _, err := miekgdns.UnpackRR(record.Pack(), 0)
+
+// WirePacker is a message of another library that can be encoded to the
+// wire format, such as *dns.Msg of github.com/miekg/dns.
+type WirePacker interface {
+	Pack() ([]byte, error)
+}
+
+// WireUnpacker is a message of another library that can be decoded from the
+// wire format, such as *dns.Msg of github.com/miekg/dns.
+type WireUnpacker interface {
+	Unpack([]byte) error
+}
+
+// FromWireMessage converts a message of another library.
+func FromWireMessage(src WirePacker) (Message, error) {
+	b, err := src.Pack()
+	if err != nil {
+		return Message{}, err
+	}
+	return ParseMessage(b)
+}
+
+// ToWireMessage converts the message into dst, a message of another
+// library.
+func (m Message) ToWireMessage(dst WireUnpacker) error {
+	return dst.Unpack(m.Byte())
+}
+
+// Pack returns the wire format of the record, without name compression, as
+// read by UnpackRR of github.com/miekg/dns.
+func (r Record) Pack() []byte {
+	return appendRecord(nil, r, nil)
+}
+
+// UnpackRecord decodes a record from its wire format, such as written by
+// PackRR of github.com/miekg/dns without compression.
+func UnpackRecord(b []byte) (Record, error) {
+	r, n, err := decodeRecord(b, 0)
+	if err != nil {
+		return Record{}, err
+	}
+	if n != len(b) {
+		return Record{}, fmt.Errorf("dns: %d bytes after the record", len(b)-n)
+	}
+	return r, nil
+}
+
+// ParseRecord parses a record in the presentation format of zone files, as
+// returned by the String method of records of github.com/miekg/dns. Names
+// must be fully qualified.
+func ParseRecord(s string) (Record, error) {
+	records, err := ParseZone(strings.NewReader(s), ".")
+	if err != nil {
+		return Record{}, err
+	}
+	if len(records) != 1 {
+		return Record{}, fmt.Errorf("dns: %d records in %q", len(records), s)
+	}
+	return records[0], nil
+}
@@ -2,19 +2,32 @@ package dns
 
 import (
 	"encoding/binary"
+	"errors"
 	"strings"
 )
 
 const (
-	FLAG_RCODE_NOERROR = 0       // Response Code (No Error)
-	FLAG_RCODE_NOTIMP  = 4       // Response Code (Not Implemented)
-	FLAG_Z             = 1 << 4  // Reserved
-	FLAG_RA            = 1 << 7  // Recursion Available
-	FLAG_RD            = 1 << 8  // Recursion Desired
-	FLAG_TC            = 1 << 9  // Truncated Message
-	FLAG_AA            = 1 << 10 // Authoritative Answer
-	FLAG_OPCODE_QUERY  = 1 << 11 // Operation Code (Query)
-	FLAG_QR            = 1 << 15 // Query Response
+	FLAG_CD           = 1 << 4  // Checking Disabled (RFC 4035)
+	FLAG_AD           = 1 << 5  // Authentic Data (RFC 4035)
+	FLAG_Z            = 1 << 6  // Reserved
+	FLAG_RA           = 1 << 7  // Recursion Available
+	FLAG_RD           = 1 << 8  // Recursion Desired
+	FLAG_TC           = 1 << 9  // Truncated Message
+	FLAG_AA           = 1 << 10 // Authoritative Answer
+	FLAG_OPCODE_QUERY = 1 << 11 // Operation Code (Query)
+	FLAG_QR           = 1 << 15 // Query Response
+)
+
+// Response codes as bits of the header flags, from before RCode.
+//
+// Deprecated: Use the RCODE_ constants with Header.RCode and Header.SetRCode.
+const (
+	FLAG_RCODE_NOERROR  = uint16(RCODE_NOERROR)  // Response Code (No Error)
+	FLAG_RCODE_FORMERR  = uint16(RCODE_FORMERR)  // Response Code (Format Error)
+	FLAG_RCODE_SERVFAIL = uint16(RCODE_SERVFAIL) // Response Code (Server Failure)
+	FLAG_RCODE_NXDOMAIN = uint16(RCODE_NXDOMAIN) // Response Code (Non-Existent Domain)
+	FLAG_RCODE_NOTIMP   = uint16(RCODE_NOTIMP)   // Response Code (Not Implemented)
+	FLAG_RCODE_REFUSED  = uint16(RCODE_REFUSED)  // Response Code (Query Refused)
 )
 
 const (
@@ -36,11 +49,32 @@ const (
 	TYPE_TXT              // text strings
 )
 
+const (
+	TYPE_AAAA       = 28  // an IPv6 host address (RFC 3596)
+	TYPE_SRV        = 33  // a service location (RFC 2782)
+	TYPE_DNAME      = 39  // a redirection of a subtree (RFC 6672)
+	TYPE_OPT        = 41  // an EDNS(0) pseudo-RR (RFC 6891)
+	TYPE_DS         = 43  // a delegation signer (RFC 4034)
+	TYPE_RRSIG      = 46  // a signature over an RRset (RFC 4034)
+	TYPE_NSEC       = 47  // the next secure name in a zone (RFC 4034)
+	TYPE_DNSKEY     = 48  // a public key of a zone (RFC 4034)
+	TYPE_NSEC3      = 50  // the next secure hashed name in a zone (RFC 5155)
+	TYPE_NSEC3PARAM = 51  // the NSEC3 parameters of a zone (RFC 5155)
+	TYPE_SVCB       = 64  // a service binding (RFC 9460)
+	TYPE_HTTPS      = 65  // a service binding for HTTPS (RFC 9460)
+	TYPE_TSIG       = 250 // a transaction signature (RFC 8945)
+	TYPE_IXFR       = 251 // a request for the changes to a zone (RFC 1995)
+	TYPE_AXFR       = 252 // a request for a transfer of an entire zone
+	TYPE_ANY        = 255 // a request for all records
+)
+
 const (
 	CLASS_IN = iota + 1 // the Internet
 	CLASS_CS            // the CSNET class (Obsolete - used only for examples in some obsolete RFCs)
 	CLASS_CH            // the CHAOS class
 	CLASS_HS            // Hesiod
+
+	CLASS_ANY = 255 // any class, the class of TSIG records (RFC 8945)
 )
 
 // Header represents a DNS message header section.
@@ -73,6 +107,11 @@ type Record struct {
 	TTL   uint32 // Time-to-live
 	Len   uint16 // Data length
 	Data  []byte // Data specific to the record type
+
+	// Origin tells where the record came from, such as the zone or the
+	// upstream that supplied it, for debugging. It is not part of the
+	// wire format.
+	Origin string
 }
 
 // Answer represents a DNS message answer section.
@@ -80,16 +119,45 @@ type Answer struct {
 	Records []Record
 }
 
+// Authority represents a DNS message authority section.
+type Authority struct {
+	Records []Record
+}
+
+// Additional represents a DNS message additional section.
+type Additional struct {
+	Records []Record
+}
+
 // Message represents a DNS message.
 type Message struct {
 	Header
 	Question
 	Answer
+	Authority
+	Additional
 }
 
-// NewRequest constructs a new DNS message from an incoming request.
+var (
+	ErrShortMessage   = errors.New("dns: message too short")
+	ErrInvalidName    = errors.New("dns: invalid domain name")
+	ErrPointerLoop    = errors.New("dns: too many compression pointers")
+	ErrTrailingRecord = errors.New("dns: record data exceeds message")
+)
+
+// NewRequest constructs a new DNS message from an incoming request. Malformed
+// input yields a partially filled message; use ParseMessage to detect it.
 func NewRequest(b []byte) Message {
+	m, _ := ParseMessage(b)
+	return m
+}
+
+// ParseMessage decodes a DNS message from its wire format.
+func ParseMessage(b []byte) (Message, error) {
 	m := Message{}
+	if len(b) < headerSize {
+		return m, ErrShortMessage
+	}
 	// Header section.
 	m.Header.ID = binary.BigEndian.Uint16(b[0:2])
 	m.Header.Flag = binary.BigEndian.Uint16(b[2:4])
@@ -99,83 +167,170 @@ func NewRequest(b []byte) Message {
 	m.Header.ARCOUNT = binary.BigEndian.Uint16(b[10:12])
 	// Question section.
 	i := headerSize
-	m.Question = Question{Queries: make([]Query, m.Header.QDCOUNT)}
+	var err error
 	for j := 0; j < int(m.Header.QDCOUNT); j++ {
-		m.Question.Queries[j].Name, i = decodeDomainName(b, i)
-		m.Question.Queries[j].Type = binary.BigEndian.Uint16(b[i : i+2])
-		m.Question.Queries[j].Class = binary.BigEndian.Uint16(b[i+2 : i+4])
+		var q Query
+		if q.Name, i, err = decodeDomainName(b, i); err != nil {
+			return m, err
+		}
+		if i+4 > len(b) {
+			return m, ErrShortMessage
+		}
+		q.Type = binary.BigEndian.Uint16(b[i : i+2])
+		q.Class = binary.BigEndian.Uint16(b[i+2 : i+4])
 		i += 4
+		m.Question.Queries = append(m.Question.Queries, q)
 	}
 	// Answer section.
-	m.Answer = Answer{Records: make([]Record, m.Header.ANCOUNT)}
 	for j := 0; j < int(m.Header.ANCOUNT); j++ {
-		m.Answer.Records[j].Name, i = decodeDomainName(b, i)
-		m.Answer.Records[j].Type = binary.BigEndian.Uint16(b[i : i+2])
-		m.Answer.Records[j].Class = binary.BigEndian.Uint16(b[i+2 : i+4])
-		m.Answer.Records[j].TTL = binary.BigEndian.Uint32(b[i+4 : i+8])
-		m.Answer.Records[j].Len = binary.BigEndian.Uint16(b[i+8 : i+10])
-		m.Answer.Records[j].Data = make([]byte, m.Answer.Records[j].Len)
-		i += 10
-		for k := 0; k < int(m.Answer.Records[j].Len); k++ {
-			m.Answer.Records[j].Data[k] = b[i+k]
+		var r Record
+		if r, i, err = decodeRecord(b, i); err != nil {
+			return m, err
 		}
-		i += int(m.Answer.Records[j].Len)
+		m.Answer.Records = append(m.Answer.Records, r)
 	}
-	return m
+	// Authority section.
+	for j := 0; j < int(m.Header.NSCOUNT); j++ {
+		var r Record
+		if r, i, err = decodeRecord(b, i); err != nil {
+			return m, err
+		}
+		m.Authority.Records = append(m.Authority.Records, r)
+	}
+	// Additional section.
+	for j := 0; j < int(m.Header.ARCOUNT); j++ {
+		var r Record
+		if r, i, err = decodeRecord(b, i); err != nil {
+			return m, err
+		}
+		m.Additional.Records = append(m.Additional.Records, r)
+	}
+	return m, nil
 }
 
-// NewResponse constructs a new DNS message in response to an incoming request.
-func NewResponse(r Message, forwarded bool) Message {
-	opcode := r.Header.Flag >> 11 & 0xF
-	opcodeFlag := opcode << 11
-	rd := r.Header.Flag >> 8 & 0x1
-	rdFlag := rd << 8
-	var rcodeFlag uint16
-	if opcode == 0 {
-		rcodeFlag = FLAG_RCODE_NOERROR
-	} else {
-		rcodeFlag = FLAG_RCODE_NOTIMP
+func decodeRecord(b []byte, i int) (Record, int, error) {
+	var r Record
+	var err error
+	if r.Name, i, err = decodeDomainName(b, i); err != nil {
+		return r, i, err
 	}
-	queries := make([]Query, r.Header.QDCOUNT)
-	for i := 0; i < int(r.Header.QDCOUNT); i++ {
-		queries[i] = Query{
-			Name:  r.Question.Queries[i].Name,
-			Type:  TYPE_A,
-			Class: CLASS_IN,
+	if i+10 > len(b) {
+		return r, i, ErrShortMessage
+	}
+	r.Type = binary.BigEndian.Uint16(b[i : i+2])
+	r.Class = binary.BigEndian.Uint16(b[i+2 : i+4])
+	r.TTL = binary.BigEndian.Uint32(b[i+4 : i+8])
+	r.Len = binary.BigEndian.Uint16(b[i+8 : i+10])
+	i += 10
+	if i+int(r.Len) > len(b) {
+		return r, i, ErrTrailingRecord
+	}
+	end := i + int(r.Len)
+	if layout, ok := nameLayouts[r.Type]; ok {
+		if r.Data, err = decompressRData(b, i, end, layout); err != nil {
+			return r, i, err
 		}
+		r.Len = uint16(len(r.Data))
+		return r, end, nil
 	}
-	var records []Record
-	if forwarded {
-		records = r.Answer.Records
-	} else {
-		records = make([]Record, r.Header.QDCOUNT)
-		for i := 0; i < int(r.Header.QDCOUNT); i++ {
-			b := byte(i + 1)
-			records[i] = Record{
-				Name:  r.Question.Queries[i].Name,
-				Type:  TYPE_A,
-				Class: CLASS_IN,
-				TTL:   60,
-				Len:   4,
-				Data:  []byte{b, b, b, b},
-			}
+	r.Data = make([]byte, r.Len)
+	copy(r.Data, b[i:end])
+	return r, end, nil
+}
+
+// rdataLayout describes the data of a type that embeds domain names: the
+// number of fixed bytes before the names, the number of names, and the
+// number of fixed bytes after them.
+type rdataLayout struct {
+	prefix, names, suffix int
+}
+
+// nameLayouts lists the types whose names may be compressed on the wire
+// (RFC 3597 section 4), plus SRV, whose target some servers compress anyway.
+var nameLayouts = map[uint16]rdataLayout{
+	TYPE_NS:    {0, 1, 0},
+	TYPE_MD:    {0, 1, 0},
+	TYPE_MF:    {0, 1, 0},
+	TYPE_CNAME: {0, 1, 0},
+	TYPE_SOA:   {0, 2, 20},
+	TYPE_MB:    {0, 1, 0},
+	TYPE_MG:    {0, 1, 0},
+	TYPE_MR:    {0, 1, 0},
+	TYPE_PTR:   {0, 1, 0},
+	TYPE_MINFO: {0, 2, 0},
+	TYPE_MX:    {2, 1, 0},
+	TYPE_SRV:   {6, 1, 0},
+}
+
+// decompressRData copies the record data in b[start:end], expanding
+// compressed names so that the data no longer refers to the message.
+func decompressRData(b []byte, start, end int, layout rdataLayout) ([]byte, error) {
+	i := start + layout.prefix
+	if i > end {
+		return nil, ErrTrailingRecord
+	}
+	data := append([]byte(nil), b[start:i]...)
+	for n := 0; n < layout.names; n++ {
+		name, next, err := decodeDomainName(b[:end], i)
+		if err != nil {
+			return nil, err
 		}
+		data = append(data, encodeDomainName(name)...)
+		i = next
+	}
+	if i+layout.suffix != end {
+		return nil, ErrTrailingRecord
 	}
+	return append(data, b[i:end]...), nil
+}
+
+// NewResponse constructs a new DNS message in response to an incoming request.
+// A forwarded response r is copied with its records and rcode; otherwise the
+// response answers the questions of r with no records.
+func NewResponse(r Message, forwarded bool) Message {
+	queries := make([]Query, r.Header.QDCOUNT)
+	copy(queries, r.Question.Queries)
 	m := Message{
 		Header: Header{
 			ID:      r.Header.ID,
-			Flag:    FLAG_QR | opcodeFlag | rdFlag | rcodeFlag,
+			Flag:    FLAG_QR | r.Header.Flag&FLAG_RD,
 			QDCOUNT: r.Header.QDCOUNT,
-			ANCOUNT: r.Header.QDCOUNT,
-			NSCOUNT: 0,
-			ARCOUNT: 0,
 		},
 		Question: Question{Queries: queries},
-		Answer:   Answer{Records: records},
+	}
+	m.Header.SetOpCode(r.Header.OpCode())
+	if forwarded {
+		m.Header.SetRCode(r.Header.RCode())
+	} else if r.Header.OpCode() != OPCODE_QUERY {
+		m.Header.SetRCode(RCODE_NOTIMP)
+	}
+	if forwarded {
+		m.Answer = r.Answer
+		m.Authority = r.Authority
+		m.Additional = r.Additional
+		m.Header.ANCOUNT = uint16(len(r.Answer.Records))
+		m.Header.NSCOUNT = uint16(len(r.Authority.Records))
+		m.Header.ARCOUNT = uint16(len(r.Additional.Records))
 	}
 	return m
 }
 
+// NewErrorResponse constructs a new DNS message that answers an incoming
+// request with the given response code and no records.
+func NewErrorResponse(r Message, rcode RCode) Message {
+	m := Message{
+		Header: Header{
+			ID:      r.Header.ID,
+			Flag:    FLAG_QR | r.Header.Flag&FLAG_RD,
+			QDCOUNT: uint16(len(r.Question.Queries)),
+		},
+		Question: Question{Queries: r.Question.Queries},
+	}
+	m.Header.SetOpCode(r.Header.OpCode())
+	m.Header.SetRCode(rcode)
+	return m
+}
+
 // SplitMessageQuestions splits the queries in the question section of the Message
 // into a slice of Message containing one query each.
 func SplitMessageQuestions(m Message) []Message {
@@ -193,48 +348,87 @@ func SplitMessageQuestions(m Message) []Message {
 // in the slice into a single Message containing all of them.
 func MergeMessageAnswers(msgs []Message) Message {
 	m := msgs[0]
-	m.Header.ANCOUNT = uint16(len(msgs))
 	for _, msg := range msgs[1:] {
-		m.Answer.Records = append(m.Answer.Records, msg.Records...)
+		m.Answer.Records = append(m.Answer.Records, msg.Answer.Records...)
 	}
+	m.Header.ANCOUNT = uint16(len(m.Answer.Records))
 	return m
 }
 
-func decodeDomainName(b []byte, start int) (string, int) {
+// ShuffleAnswers randomly reorders the records in the answer section of the
+// Message and lowers each TTL to a random value no smaller than minTTL, drawing
+// from r.
+func ShuffleAnswers(m *Message, r Rand, minTTL uint32) {
+	records := m.Answer.Records
+	for i := len(records) - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		records[i], records[j] = records[j], records[i]
+	}
+	for i := range records {
+		ttl := records[i].TTL
+		if ttl > minTTL {
+			records[i].TTL = minTTL + uint32(r.Intn(int(ttl-minTTL)+1))
+		}
+	}
+}
+
+// maxPointers bounds the compression pointers followed while decoding a
+// single name, which protects against pointer loops.
+const maxPointers = 32
+
+// decodeDomainName reads the possibly compressed name starting at offset
+// start and returns it along with the offset right after it.
+func decodeDomainName(b []byte, start int) (string, int, error) {
 	var sb strings.Builder
 	i := start
-	useCompression := false
-	for {
+	end := -1 // Offset after the name, fixed once the first pointer is seen.
+	for pointers := 0; ; {
+		if i >= len(b) {
+			return "", 0, ErrShortMessage
+		}
 		// Check if the compression pointer indicator exist.
-		p := binary.BigEndian.Uint16(b[i : i+2])
-		if p&0xC000 == 0xC000 {
-			useCompression = true
-			offset := p ^ 0xC000
-			name, _ := decodeDomainName(b, int(offset))
-			sb.WriteString(name)
-			i += 2
+		if b[i]&0xC0 == 0xC0 {
+			if i+2 > len(b) {
+				return "", 0, ErrShortMessage
+			}
+			if pointers++; pointers > maxPointers {
+				return "", 0, ErrPointerLoop
+			}
+			if end < 0 {
+				end = i + 2
+			}
+			i = int(binary.BigEndian.Uint16(b[i:i+2]) ^ 0xC000)
+		} else if b[i]&0xC0 != 0 {
+			return "", 0, ErrInvalidName
 		} else if b[i] != 0 {
 			n := int(b[i])
-			sb.Write(b[i+1 : i+1+n])
-			i += n + 1
-			if b[i] != 0 {
+			if i+1+n > len(b) {
+				return "", 0, ErrShortMessage
+			}
+			if sb.Len() > 0 {
 				sb.WriteByte('.')
 			}
+			sb.WriteString(escapeLabel(b[i+1 : i+1+n]))
+			i += n + 1
 		} else {
 			break
 		}
 	}
-	if useCompression {
-		return sb.String(), i
+	if end < 0 {
+		end = i + 1
 	}
-	return sb.String(), i + 1
+	return sb.String(), end, nil
 }
 
 func encodeDomainName(name string) []byte {
 	b := make([]byte, 0)
-	for _, label := range strings.Split(name, ".") {
-		b = append(b, byte(len(label)))
-		b = append(b, label...)
+	for _, label := range Labels(name) {
+		raw := unescapeLabel(label)
+		if len(raw) == 0 {
+			continue
+		}
+		b = append(b, byte(len(raw)))
+		b = append(b, raw...)
 	}
 	b = append(b, 0)
 	return b
@@ -243,7 +437,19 @@ func encodeDomainName(name string) []byte {
 const headerSize = 12
 
 // Byte creates a byte slice containing all the sections of the message.
+// Repeated owner names are compressed with pointers to earlier occurrences.
 func (m Message) Byte() []byte {
+	return m.pack(make(map[string]int))
+}
+
+// UncompressedByte is like Byte but writes every name in full, for
+// clients that cannot follow compression pointers.
+func (m Message) UncompressedByte() []byte {
+	return m.pack(nil)
+}
+
+// pack encodes the message, compressing names unless offsets is nil.
+func (m Message) pack(offsets map[string]int) []byte {
 	b := make([]byte, headerSize)
 	// Header section.
 	binary.BigEndian.PutUint16(b[0:2], m.Header.ID)
@@ -254,18 +460,62 @@ func (m Message) Byte() []byte {
 	binary.BigEndian.PutUint16(b[10:12], m.Header.ARCOUNT)
 	// Question section.
 	for _, query := range m.Question.Queries {
-		b = append(b, encodeDomainName(query.Name)...)
+		b = appendDomainName(b, query.Name, offsets)
 		b = binary.BigEndian.AppendUint16(b, query.Type)
 		b = binary.BigEndian.AppendUint16(b, query.Class)
 	}
 	// Answer section.
 	for _, record := range m.Answer.Records {
-		b = append(b, encodeDomainName(record.Name)...)
-		b = binary.BigEndian.AppendUint16(b, record.Type)
-		b = binary.BigEndian.AppendUint16(b, record.Class)
-		b = binary.BigEndian.AppendUint32(b, record.TTL)
-		b = binary.BigEndian.AppendUint16(b, record.Len)
-		b = append(b, record.Data...)
+		b = appendRecord(b, record, offsets)
+	}
+	// Authority section.
+	for _, record := range m.Authority.Records {
+		b = appendRecord(b, record, offsets)
+	}
+	// Additional section.
+	for _, record := range m.Additional.Records {
+		b = appendRecord(b, record, offsets)
 	}
 	return b
 }
+
+func appendRecord(b []byte, record Record, offsets map[string]int) []byte {
+	b = appendDomainName(b, record.Name, offsets)
+	b = binary.BigEndian.AppendUint16(b, record.Type)
+	b = binary.BigEndian.AppendUint16(b, record.Class)
+	b = binary.BigEndian.AppendUint32(b, record.TTL)
+	b = binary.BigEndian.AppendUint16(b, record.Len)
+	return append(b, record.Data...)
+}
+
+// maxPointerOffset is the largest offset a compression pointer can address.
+const maxPointerOffset = 0x3FFF
+
+// appendDomainName appends the encoded name to b. When offsets is non-nil,
+// the longest suffix of the name already present in the message is replaced
+// by a compression pointer (RFC 1035 section 4.1.4), and the offsets of the
+// newly written suffixes are recorded for later names.
+func appendDomainName(b []byte, name string, offsets map[string]int) []byte {
+	if offsets == nil {
+		return append(b, encodeDomainName(name)...)
+	}
+	var labels []string
+	for _, label := range Labels(name) {
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+	for i := range labels {
+		suffix := strings.Join(labels[i:], ".")
+		if offset, ok := offsets[suffix]; ok {
+			return binary.BigEndian.AppendUint16(b, 0xC000|uint16(offset))
+		}
+		if len(b) <= maxPointerOffset {
+			offsets[suffix] = len(b)
+		}
+		raw := unescapeLabel(labels[i])
+		b = append(b, byte(len(raw)))
+		b = append(b, raw...)
+	}
+	return append(b, 0)
+}
@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// packet decodes hex dumps of wire messages, one field group per string,
+// ignoring spaces.
+func packet(t *testing.T, parts ...string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(strings.Join(parts, ""), " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// goldenResponse is an authoritative answer whose names share suffixes with
+// the question in every section.
+func goldenResponse() Message {
+	return Message{
+		Header:   Header{ID: 0xabcd, Flag: FLAG_QR | FLAG_AA | FLAG_RD, QDCOUNT: 1, ANCOUNT: 2, NSCOUNT: 1, ARCOUNT: 4},
+		Question: Question{Queries: []Query{{Name: "www.example.com.", Type: TYPE_A, Class: CLASS_IN}}},
+		Answer: Answer{Records: []Record{
+			NewRecord("www.example.com.", CLASS_IN, 300, A{Addr: net.ParseIP("192.0.2.1")}),
+			NewRecord("www.example.com.", CLASS_IN, 300, A{Addr: net.ParseIP("192.0.2.2")}),
+		}},
+		Authority: Authority{Records: []Record{
+			NewRecord("example.com.", CLASS_IN, 3600, TXT{Strings: []string{"v=spf1 -all"}}),
+		}},
+		Additional: Additional{Records: []Record{
+			NewRecord("mail.example.com.", CLASS_IN, 300, AAAA{Addr: net.ParseIP("2001:db8::1")}),
+			NewRecord("example.org.", CLASS_IN, 60, A{Addr: net.ParseIP("198.51.100.1")}),
+			NewRecord("www.example.org.", CLASS_IN, 60, A{Addr: net.ParseIP("198.51.100.2")}),
+			OPT{UDPSize: 1232}.Record(),
+		}},
+	}
+}
+
+// The golden packets are the same messages encoded by the dnsmessage
+// package of golang.org/x/net, which compresses names the same way. The
+// query is also what dig +noedns +noadflag sends, with its random ID.
+func TestPackGolden(t *testing.T) {
+	compressed, uncompressed := Message.Byte, Message.UncompressedByte
+	tests := []struct {
+		name string
+		msg  Message
+		pack func(Message) []byte
+		want []byte
+	}{
+		{
+			name: "query",
+			msg:  NewQuery("example.com.", TYPE_A).WithID(0xabcd).Message(),
+			pack: compressed,
+			want: packet(t,
+				"abcd 0100 0001 0000 0000 0000",
+				"07 6578616d706c65 03 636f6d 00 0001 0001",
+			),
+		},
+		{
+			name: "compressed response",
+			msg:  goldenResponse(),
+			pack: compressed,
+			want: packet(t,
+				"abcd 8500 0001 0002 0001 0004",
+				// www.example.com. A IN, at offset 12
+				"03 777777 07 6578616d706c65 03 636f6d 00 0001 0001",
+				// Pointers to the question name at 12
+				"c00c 0001 0001 0000012c 0004 c0000201",
+				"c00c 0001 0001 0000012c 0004 c0000202",
+				// Pointer to example.com. at 16, inside the question name
+				"c010 0010 0001 00000e10 000c 0b 763d73706631202d616c6c",
+				// mail followed by a pointer to example.com.
+				"04 6d61696c c010 001c 0001 0000012c 0010 20010db8000000000000000000000001",
+				// example.org. shares no suffix and is written in full at 122
+				"07 6578616d706c65 03 6f7267 00 0001 0001 0000003c 0004 c6336401",
+				"03 777777 c07a 0001 0001 0000003c 0004 c6336402",
+				// The root owner of the OPT record is never a pointer
+				"00 0029 04d0 00000000 0000",
+			),
+		},
+		{
+			name: "uncompressed response",
+			msg:  goldenResponse(),
+			pack: uncompressed,
+			want: packet(t,
+				"abcd 8500 0001 0002 0001 0004",
+				"03 777777 07 6578616d706c65 03 636f6d 00 0001 0001",
+				"03 777777 07 6578616d706c65 03 636f6d 00 0001 0001 0000012c 0004 c0000201",
+				"03 777777 07 6578616d706c65 03 636f6d 00 0001 0001 0000012c 0004 c0000202",
+				"07 6578616d706c65 03 636f6d 00 0010 0001 00000e10 000c 0b 763d73706631202d616c6c",
+				"04 6d61696c 07 6578616d706c65 03 636f6d 00 001c 0001 0000012c 0010 20010db8000000000000000000000001",
+				"07 6578616d706c65 03 6f7267 00 0001 0001 0000003c 0004 c6336401",
+				"03 777777 07 6578616d706c65 03 6f7267 00 0001 0001 0000003c 0004 c6336402",
+				"00 0029 04d0 00000000 0000",
+			),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.pack(tt.msg); !bytes.Equal(got, tt.want) {
+				t.Errorf("packed\n%x\nwant\n%x", got, tt.want)
+			}
+			m, err := ParseMessage(tt.want)
+			if err != nil {
+				t.Fatalf("parsing the golden packet: %v", err)
+			}
+			if again := tt.pack(m); !bytes.Equal(again, tt.want) {
+				t.Errorf("packing the parsed golden packet gives\n%x", again)
+			}
+		})
+	}
+}
+
+// TestPackPointerLimit checks that names past the reach of a 14 bit pointer
+// are written in full rather than pointed to.
+func TestPackPointerLimit(t *testing.T) {
+	big := make([]string, 70)
+	for i := range big {
+		big[i] = strings.Repeat("x", 255)
+	}
+	m := NewQuery("example.com.", TYPE_TXT).Message()
+	m.Header.SetQR(true)
+	m.Answer.Records = []Record{
+		NewRecord("example.com.", CLASS_IN, 60, TXT{Strings: big}),
+		NewRecord("far.example.net.", CLASS_IN, 60, A{Addr: net.ParseIP("192.0.2.1")}),
+		NewRecord("far.example.net.", CLASS_IN, 60, A{Addr: net.ParseIP("192.0.2.2")}),
+	}
+	m.Header.ANCOUNT = 3
+	b := m.Byte()
+	if len(b) <= maxPointerOffset {
+		t.Fatalf("message of %d bytes does not reach past the pointer limit", len(b))
+	}
+	first := bytes.Index(b, []byte("\x03far\x07example\x03net\x00"))
+	if first <= maxPointerOffset {
+		t.Fatalf("far.example.net. at %d, want past the pointer limit", first)
+	}
+	if second := bytes.LastIndex(b, []byte("\x03far\x07example\x03net\x00")); second == first {
+		t.Error("far.example.net. is written once, want it repeated in full")
+	}
+	// The owner of the TXT record still points to the question name.
+	txt := 12 + len("\x07example\x03com\x00") + 4
+	if ptr := binary.BigEndian.Uint16(b[txt:]); ptr != 0xc00c {
+		t.Errorf("TXT owner is %#04x, want a pointer to the question name", ptr)
+	}
+	parsed, err := ParseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(parsed.Answer.Records); n != 3 {
+		t.Fatalf("parsed %d answers, want 3", n)
+	}
+	if name := parsed.Answer.Records[2].Name; CompareNames(name, "far.example.net.") != 0 {
+		t.Errorf("last answer owned by %s, want far.example.net.", name)
+	}
+}
@@ -0,0 +1,708 @@
+package dns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DNSSEC algorithm numbers (RFC 8624 section 3.1).
+const (
+	ALG_RSASHA1            = 5
+	ALG_RSASHA1_NSEC3_SHA1 = 7
+	ALG_RSASHA256          = 8
+	ALG_RSASHA512          = 10
+	ALG_ECDSAP256SHA256    = 13
+	ALG_ECDSAP384SHA384    = 14
+	ALG_ED25519            = 15
+)
+
+// DS digest types (RFC 8624 section 3.3).
+const (
+	DIGEST_SHA1   = 1
+	DIGEST_SHA256 = 2
+	DIGEST_SHA384 = 4
+)
+
+// DNSKEY flags (RFC 4034 section 2.1.1, RFC 5011 section 7).
+const (
+	DNSKEY_ZONE   = 1 << 8 // Zone Key
+	DNSKEY_REVOKE = 1 << 7 // Revoked
+	DNSKEY_SEP    = 1 << 0 // Secure Entry Point
+)
+
+const (
+	NSEC3_HASH_SHA1 = 1      // The only NSEC3 hash algorithm (RFC 5155 section 11)
+	NSEC3_OPT_OUT   = 1 << 0 // Unsigned delegations may be skipped
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("dns: unsupported DNSSEC algorithm")
+	ErrUnsupportedDigest    = errors.New("dns: unsupported DS digest type")
+	ErrInvalidKey           = errors.New("dns: invalid DNSKEY")
+	ErrInvalidSignature     = errors.New("dns: signature does not verify")
+	ErrSignatureExpired     = errors.New("dns: signature expired")
+	ErrSignatureNotYetValid = errors.New("dns: signature not yet valid")
+)
+
+// DNSKEY is the data of a DNSKEY record: a public key of the zone (RFC 4034
+// section 2).
+type DNSKEY struct {
+	Flags     uint16
+	Protocol  uint8 // Always 3
+	Algorithm uint8
+	PublicKey []byte
+}
+
+func (DNSKEY) Type() uint16 { return TYPE_DNSKEY }
+
+func (k DNSKEY) Pack() []byte {
+	b := binary.BigEndian.AppendUint16(nil, k.Flags)
+	b = append(b, k.Protocol, k.Algorithm)
+	return append(b, k.PublicKey...)
+}
+
+// DNSKEY returns the data of a DNSKEY record.
+func (r Record) DNSKEY() (DNSKEY, bool) {
+	if r.Type != TYPE_DNSKEY || len(r.Data) < 4 {
+		return DNSKEY{}, false
+	}
+	return DNSKEY{
+		Flags:     binary.BigEndian.Uint16(r.Data),
+		Protocol:  r.Data[2],
+		Algorithm: r.Data[3],
+		PublicKey: append([]byte(nil), r.Data[4:]...),
+	}, true
+}
+
+// KeyTag returns the tag that identifies the key in DS and RRSIG records
+// (RFC 4034 appendix B).
+func (k DNSKEY) KeyTag() uint16 {
+	var sum uint32
+	for i, c := range k.Pack() {
+		if i&1 == 0 {
+			sum += uint32(c) << 8
+		} else {
+			sum += uint32(c)
+		}
+	}
+	return uint16(sum + sum>>16)
+}
+
+// ToDS returns the DS data pointing at the key of the zone named owner.
+func (k DNSKEY) ToDS(owner string, digestType uint8) (DS, error) {
+	h, err := digestHash(digestType)
+	if err != nil {
+		return DS{}, err
+	}
+	h.Write(canonicalName(owner))
+	h.Write(k.Pack())
+	return DS{KeyTag: k.KeyTag(), Algorithm: k.Algorithm, DigestType: digestType, Digest: h.Sum(nil)}, nil
+}
+
+// DS is the data of a DS record: the digest of a key of a child zone, which
+// the parent zone signs to delegate trust to it (RFC 4034 section 5).
+type DS struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func (DS) Type() uint16 { return TYPE_DS }
+
+func (d DS) Pack() []byte {
+	b := binary.BigEndian.AppendUint16(nil, d.KeyTag)
+	b = append(b, d.Algorithm, d.DigestType)
+	return append(b, d.Digest...)
+}
+
+// DS returns the data of a DS record.
+func (r Record) DS() (DS, bool) {
+	if r.Type != TYPE_DS || len(r.Data) < 4 {
+		return DS{}, false
+	}
+	return DS{
+		KeyTag:     binary.BigEndian.Uint16(r.Data),
+		Algorithm:  r.Data[2],
+		DigestType: r.Data[3],
+		Digest:     append([]byte(nil), r.Data[4:]...),
+	}, true
+}
+
+// Matches reports whether the DS points at the key of the zone named owner.
+func (d DS) Matches(owner string, k DNSKEY) bool {
+	if d.KeyTag != k.KeyTag() || d.Algorithm != k.Algorithm {
+		return false
+	}
+	want, err := k.ToDS(owner, d.DigestType)
+	return err == nil && bytes.Equal(want.Digest, d.Digest)
+}
+
+// RRSIG is the data of an RRSIG record: a signature over an RRset (RFC 4034
+// section 3). Inception and Expiration are seconds since the epoch, modulo
+// 2^32.
+type RRSIG struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8 // Labels of the owner name, less a leading wildcard
+	OrigTTL     uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+}
+
+func (RRSIG) Type() uint16 { return TYPE_RRSIG }
+
+func (s RRSIG) Pack() []byte {
+	return append(s.header(), s.Signature...)
+}
+
+// header returns the data of the signature without the signature itself,
+// with the signer name in canonical form.
+func (s RRSIG) header() []byte {
+	b := binary.BigEndian.AppendUint16(nil, s.TypeCovered)
+	b = append(b, s.Algorithm, s.Labels)
+	b = binary.BigEndian.AppendUint32(b, s.OrigTTL)
+	b = binary.BigEndian.AppendUint32(b, s.Expiration)
+	b = binary.BigEndian.AppendUint32(b, s.Inception)
+	b = binary.BigEndian.AppendUint16(b, s.KeyTag)
+	return append(b, canonicalName(s.SignerName)...)
+}
+
+// RRSIG returns the data of an RRSIG record.
+func (r Record) RRSIG() (RRSIG, bool) {
+	if r.Type != TYPE_RRSIG || len(r.Data) < 18 {
+		return RRSIG{}, false
+	}
+	d := r.Data
+	signer, end, err := decodeDomainName(d, 18)
+	if err != nil {
+		return RRSIG{}, false
+	}
+	return RRSIG{
+		TypeCovered: binary.BigEndian.Uint16(d),
+		Algorithm:   d[2],
+		Labels:      d[3],
+		OrigTTL:     binary.BigEndian.Uint32(d[4:]),
+		Expiration:  binary.BigEndian.Uint32(d[8:]),
+		Inception:   binary.BigEndian.Uint32(d[12:]),
+		KeyTag:      binary.BigEndian.Uint16(d[16:]),
+		SignerName:  signer,
+		Signature:   append([]byte(nil), d[end:]...),
+	}, true
+}
+
+// ValidAt checks that t falls within the validity period of the signature,
+// comparing times in serial number arithmetic (RFC 4034 section 3.1.5).
+func (s RRSIG) ValidAt(t time.Time) error {
+	now := uint32(t.Unix())
+	if int32(now-s.Inception) < 0 {
+		return ErrSignatureNotYetValid
+	}
+	if int32(s.Expiration-now) < 0 {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+// NSEC is the data of an NSEC record: the next name of the zone in canonical
+// order and the types present at the owner name (RFC 4034 section 4). It
+// proves that no name sorts between the two, and that other types do not
+// exist at the owner.
+type NSEC struct {
+	NextName string
+	Types    []uint16
+}
+
+func (NSEC) Type() uint16 { return TYPE_NSEC }
+
+func (n NSEC) Pack() []byte {
+	return append(encodeDomainName(n.NextName), packTypeBitmap(n.Types)...)
+}
+
+// NSEC returns the data of an NSEC record.
+func (r Record) NSEC() (NSEC, bool) {
+	if r.Type != TYPE_NSEC {
+		return NSEC{}, false
+	}
+	next, end, err := decodeDomainName(r.Data, 0)
+	if err != nil {
+		return NSEC{}, false
+	}
+	types, ok := unpackTypeBitmap(r.Data[end:])
+	if !ok {
+		return NSEC{}, false
+	}
+	return NSEC{NextName: next, Types: types}, true
+}
+
+// NSEC3 is the data of an NSEC3 record, which is to hashed owner names what
+// NSEC is to plain ones (RFC 5155 section 3). The owner name of the record
+// is the base32hex form of the hash of a name, as its first label.
+type NSEC3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHash      []byte // Hash of the next name, in hash order
+	Types         []uint16
+}
+
+func (NSEC3) Type() uint16 { return TYPE_NSEC3 }
+
+func (n NSEC3) Pack() []byte {
+	b := []byte{n.HashAlgorithm, n.Flags}
+	b = binary.BigEndian.AppendUint16(b, n.Iterations)
+	b = append(b, byte(len(n.Salt)))
+	b = append(b, n.Salt...)
+	b = append(b, byte(len(n.NextHash)))
+	b = append(b, n.NextHash...)
+	return append(b, packTypeBitmap(n.Types)...)
+}
+
+// NSEC3 returns the data of an NSEC3 record.
+func (r Record) NSEC3() (NSEC3, bool) {
+	d := r.Data
+	if r.Type != TYPE_NSEC3 || len(d) < 5 {
+		return NSEC3{}, false
+	}
+	n := NSEC3{HashAlgorithm: d[0], Flags: d[1], Iterations: binary.BigEndian.Uint16(d[2:])}
+	i := 5 + int(d[4])
+	if i >= len(d) {
+		return NSEC3{}, false
+	}
+	n.Salt = append([]byte(nil), d[5:i]...)
+	j := i + 1 + int(d[i])
+	if j > len(d) {
+		return NSEC3{}, false
+	}
+	n.NextHash = append([]byte(nil), d[i+1:j]...)
+	types, ok := unpackTypeBitmap(d[j:])
+	if !ok {
+		return NSEC3{}, false
+	}
+	n.Types = types
+	return n, true
+}
+
+// HashName returns the NSEC3 hash of name with the parameters of the record
+// (RFC 5155 section 5).
+func (n NSEC3) HashName(name string) []byte {
+	return nsec3Hash(name, n.Salt, n.Iterations)
+}
+
+// HashedOwnerName returns the owner name of the NSEC3 record of a hash in
+// zone.
+func HashedOwnerName(hash []byte, zone string) string {
+	label := strings.ToLower(nsec3Encoding.EncodeToString(hash))
+	if zone = trimDot(zone); zone != "" {
+		return label + "." + zone
+	}
+	return label
+}
+
+// NSEC3PARAM is the data of an NSEC3PARAM record: the parameters the
+// authoritative servers of a zone hash names with (RFC 5155 section 4).
+type NSEC3PARAM struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+}
+
+func (NSEC3PARAM) Type() uint16 { return TYPE_NSEC3PARAM }
+
+func (p NSEC3PARAM) Pack() []byte {
+	b := []byte{p.HashAlgorithm, p.Flags}
+	b = binary.BigEndian.AppendUint16(b, p.Iterations)
+	b = append(b, byte(len(p.Salt)))
+	return append(b, p.Salt...)
+}
+
+// NSEC3PARAM returns the data of an NSEC3PARAM record.
+func (r Record) NSEC3PARAM() (NSEC3PARAM, bool) {
+	d := r.Data
+	if r.Type != TYPE_NSEC3PARAM || len(d) < 5 || len(d) != 5+int(d[4]) {
+		return NSEC3PARAM{}, false
+	}
+	return NSEC3PARAM{HashAlgorithm: d[0], Flags: d[1], Iterations: binary.BigEndian.Uint16(d[2:]), Salt: append([]byte(nil), d[5:]...)}, true
+}
+
+func nsec3Hash(name string, salt []byte, iterations uint16) []byte {
+	h := sha1.New()
+	h.Write(canonicalName(name))
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(digest[:0])
+	}
+	return digest
+}
+
+// nsec3Encoding is the base32 alphabet of hashed owner names, without
+// padding (RFC 5155 section 3.3).
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// HasType reports whether t is among the types of an NSEC or NSEC3 bitmap.
+func HasType(types []uint16, t uint16) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// packTypeBitmap encodes types as the windowed bitmap of NSEC and NSEC3
+// records (RFC 4034 section 4.1.2).
+func packTypeBitmap(types []uint16) []byte {
+	sorted := append([]uint16(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var b []byte
+	for i := 0; i < len(sorted); {
+		window := sorted[i] >> 8
+		var bits [32]byte
+		n := 0
+		for ; i < len(sorted) && sorted[i]>>8 == window; i++ {
+			low := sorted[i] & 0xFF
+			bits[low/8] |= 0x80 >> (low % 8)
+			n = int(low/8) + 1
+		}
+		b = append(b, byte(window), byte(n))
+		b = append(b, bits[:n]...)
+	}
+	return b
+}
+
+// unpackTypeBitmap decodes the windowed bitmap of NSEC and NSEC3 records.
+func unpackTypeBitmap(b []byte) ([]uint16, bool) {
+	var types []uint16
+	for len(b) > 0 {
+		if len(b) < 2 || b[1] == 0 || b[1] > 32 || len(b) < 2+int(b[1]) {
+			return nil, false
+		}
+		window, bits := uint16(b[0])<<8, b[2:2+int(b[1])]
+		for i, c := range bits {
+			for j := 0; j < 8; j++ {
+				if c&(0x80>>j) != 0 {
+					types = append(types, window|uint16(i*8+j))
+				}
+			}
+		}
+		b = b[2+len(bits):]
+	}
+	return types, true
+}
+
+// canonicalName returns the wire format of a name in lowercase, as hashed
+// and signed by DNSSEC (RFC 4034 section 6.2).
+func canonicalName(name string) []byte {
+	return encodeDomainName(strings.ToLower(name))
+}
+
+// canonicalRData lowercases the names embedded in the data of the types
+// listed by RFC 4034 section 6.2, as amended by RFC 6840 section 5.1. Those
+// are the types whose names may be compressed, so the data is in the form
+// ParseMessage leaves it in.
+func canonicalRData(t uint16, data []byte) []byte {
+	layout, ok := nameLayouts[t]
+	if !ok {
+		return data
+	}
+	out := append([]byte(nil), data...)
+	i := layout.prefix
+	for n := 0; n < layout.names; n++ {
+		for i < len(out) && out[i] != 0 {
+			end := i + 1 + int(out[i])
+			if end > len(out) {
+				return data
+			}
+			copy(out[i+1:end], bytes.ToLower(out[i+1:end]))
+			i = end
+		}
+		i++
+	}
+	return out
+}
+
+// SignedData returns the data an RRSIG over the set signs: the signature
+// fields followed by the records in canonical form and order, with the
+// original TTL (RFC 4034 section 3.1.8.1). The owner name of a set
+// synthesized from a wildcard is rebuilt from the label count.
+func SignedData(set RRSet, sig RRSIG) []byte {
+	owner := strings.ToLower(trimDot(set.Name))
+	if labels := Labels(owner); len(labels) > int(sig.Labels) {
+		owner = strings.Join(append([]string{"*"}, labels[len(labels)-int(sig.Labels):]...), ".")
+	}
+	head := encodeDomainName(owner)
+	head = binary.BigEndian.AppendUint16(head, set.Type)
+	head = binary.BigEndian.AppendUint16(head, set.Class)
+	head = binary.BigEndian.AppendUint32(head, sig.OrigTTL)
+	data := make([][]byte, len(set.Data))
+	for i, d := range set.Data {
+		data[i] = canonicalRData(set.Type, d)
+	}
+	sort.Slice(data, func(i, j int) bool { return bytes.Compare(data[i], data[j]) < 0 })
+	b := sig.header()
+	for i, d := range data {
+		// Duplicates are removed from the canonical set (RFC 4034 section 6.3).
+		if i > 0 && bytes.Equal(d, data[i-1]) {
+			continue
+		}
+		b = append(b, head...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(d)))
+		b = append(b, d...)
+	}
+	return b
+}
+
+// VerifyRRSIG checks the signature sig over set with key. It does not check
+// the validity period, nor that the key belongs to the signer.
+func VerifyRRSIG(set RRSet, sig RRSIG, key DNSKEY) error {
+	if sig.Algorithm != key.Algorithm || sig.KeyTag != key.KeyTag() || sig.TypeCovered != set.Type {
+		return ErrInvalidSignature
+	}
+	pub, err := key.publicKey()
+	if err != nil {
+		return err
+	}
+	data := SignedData(set, sig)
+	switch sig.Algorithm {
+	case ALG_ED25519:
+		if !ed25519.Verify(pub.(ed25519.PublicKey), data, sig.Signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case ALG_ECDSAP256SHA256, ALG_ECDSAP384SHA384:
+		h := algorithmHash(sig.Algorithm)
+		digest := hashOf(h, data)
+		n := len(sig.Signature) / 2
+		if len(sig.Signature) != 2*h.Size() {
+			return ErrInvalidSignature
+		}
+		r, s := new(big.Int).SetBytes(sig.Signature[:n]), new(big.Int).SetBytes(sig.Signature[n:])
+		if !ecdsa.Verify(pub.(*ecdsa.PublicKey), digest, r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	h := algorithmHash(sig.Algorithm)
+	if err := rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), h, hashOf(h, data), sig.Signature); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// ErrKeyMismatch is returned by SignRRSet when the private key is not of the
+// algorithm of the signature.
+var ErrKeyMismatch = errors.New("dns: private key does not match the algorithm")
+
+// NewDNSKEY returns the DNSKEY record data of a public key, with the
+// algorithm that fits it: ECDSAP256SHA256 or ECDSAP384SHA384 for ECDSA
+// keys, ED25519, and RSASHA256 for RSA keys.
+func NewDNSKEY(pub crypto.PublicKey, flags uint16) (DNSKEY, error) {
+	k := DNSKEY{Flags: flags, Protocol: 3}
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			k.Algorithm = ALG_ECDSAP256SHA256
+		case elliptic.P384():
+			k.Algorithm = ALG_ECDSAP384SHA384
+		default:
+			return DNSKEY{}, ErrUnsupportedAlgorithm
+		}
+		size := pub.Curve.Params().BitSize / 8
+		k.PublicKey = append(pub.X.FillBytes(make([]byte, size)), pub.Y.FillBytes(make([]byte, size))...)
+	case ed25519.PublicKey:
+		k.Algorithm = ALG_ED25519
+		k.PublicKey = append([]byte(nil), pub...)
+	case *rsa.PublicKey:
+		k.Algorithm = ALG_RSASHA256
+		e := big.NewInt(int64(pub.E)).Bytes()
+		if len(e) < 256 {
+			k.PublicKey = []byte{byte(len(e))}
+		} else {
+			k.PublicKey = []byte{0, byte(len(e) >> 8), byte(len(e))}
+		}
+		k.PublicKey = append(append(k.PublicKey, e...), pub.N.Bytes()...)
+	default:
+		return DNSKEY{}, ErrUnsupportedAlgorithm
+	}
+	return k, nil
+}
+
+// SignRRSet fills in the signature of sig over set with priv, the private
+// key of the DNSKEY that sig names by algorithm and key tag. The other
+// fields of sig, such as the validity period, are kept as given.
+func SignRRSet(set RRSet, sig RRSIG, priv crypto.Signer) (RRSIG, error) {
+	sig.TypeCovered = set.Type
+	data := SignedData(set, sig)
+	var err error
+	switch sig.Algorithm {
+	case ALG_ED25519:
+		if _, ok := priv.Public().(ed25519.PublicKey); !ok {
+			return RRSIG{}, ErrKeyMismatch
+		}
+		sig.Signature, err = priv.Sign(nil, data, crypto.Hash(0))
+	case ALG_ECDSAP256SHA256, ALG_ECDSAP384SHA384:
+		pub, ok := priv.Public().(*ecdsa.PublicKey)
+		if !ok {
+			return RRSIG{}, ErrKeyMismatch
+		}
+		h := algorithmHash(sig.Algorithm)
+		if pub.Curve.Params().BitSize/8 != h.Size() {
+			return RRSIG{}, ErrKeyMismatch
+		}
+		var der []byte
+		if der, err = priv.Sign(rand.Reader, hashOf(h, data), h); err != nil {
+			return RRSIG{}, err
+		}
+		// The signature is r and s side by side, each padded to the
+		// size of the curve (RFC 6605 section 4).
+		var rs struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(der, &rs); err != nil {
+			return RRSIG{}, err
+		}
+		sig.Signature = append(rs.R.FillBytes(make([]byte, h.Size())), rs.S.FillBytes(make([]byte, h.Size()))...)
+	case ALG_RSASHA1, ALG_RSASHA1_NSEC3_SHA1, ALG_RSASHA256, ALG_RSASHA512:
+		if _, ok := priv.Public().(*rsa.PublicKey); !ok {
+			return RRSIG{}, ErrKeyMismatch
+		}
+		h := algorithmHash(sig.Algorithm)
+		sig.Signature, err = priv.Sign(rand.Reader, hashOf(h, data), h)
+	default:
+		return RRSIG{}, ErrUnsupportedAlgorithm
+	}
+	if err != nil {
+		return RRSIG{}, err
+	}
+	return sig, nil
+}
+
+// SupportedAlgorithm reports whether keys and signatures of the algorithm
+// can be verified.
+func SupportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case ALG_RSASHA1, ALG_RSASHA1_NSEC3_SHA1, ALG_RSASHA256, ALG_RSASHA512,
+		ALG_ECDSAP256SHA256, ALG_ECDSAP384SHA384, ALG_ED25519:
+		return true
+	}
+	return false
+}
+
+// SupportedDigest reports whether DS records of the digest type can be
+// checked.
+func SupportedDigest(t uint8) bool {
+	_, err := digestHash(t)
+	return err == nil
+}
+
+func algorithmHash(alg uint8) crypto.Hash {
+	switch alg {
+	case ALG_RSASHA1, ALG_RSASHA1_NSEC3_SHA1:
+		return crypto.SHA1
+	case ALG_RSASHA256, ALG_ECDSAP256SHA256:
+		return crypto.SHA256
+	case ALG_ECDSAP384SHA384:
+		return crypto.SHA384
+	}
+	return crypto.SHA512
+}
+
+func hashOf(h crypto.Hash, data []byte) []byte {
+	switch h {
+	case crypto.SHA1:
+		sum := sha1.Sum(data)
+		return sum[:]
+	case crypto.SHA256:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(data)
+		return sum[:]
+	}
+	sum := sha512.Sum512(data)
+	return sum[:]
+}
+
+func digestHash(t uint8) (hash.Hash, error) {
+	switch t {
+	case DIGEST_SHA1:
+		return sha1.New(), nil
+	case DIGEST_SHA256:
+		return sha256.New(), nil
+	case DIGEST_SHA384:
+		return sha512.New384(), nil
+	}
+	return nil, ErrUnsupportedDigest
+}
+
+// publicKey decodes the key in the format of its algorithm: RFC 3110 for
+// RSA, RFC 6605 for ECDSA, and RFC 8080 for Ed25519.
+func (k DNSKEY) publicKey() (crypto.PublicKey, error) {
+	b := k.PublicKey
+	switch k.Algorithm {
+	case ALG_RSASHA1, ALG_RSASHA1_NSEC3_SHA1, ALG_RSASHA256, ALG_RSASHA512:
+		if len(b) < 1 {
+			return nil, ErrInvalidKey
+		}
+		n, i := int(b[0]), 1
+		if n == 0 {
+			if len(b) < 3 {
+				return nil, ErrInvalidKey
+			}
+			n, i = int(binary.BigEndian.Uint16(b[1:])), 3
+		}
+		if n == 0 || n > 4 || i+n >= len(b) {
+			return nil, ErrInvalidKey
+		}
+		var e int
+		for _, c := range b[i : i+n] {
+			e = e<<8 | int(c)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(b[i+n:]), E: e}, nil
+	case ALG_ECDSAP256SHA256, ALG_ECDSAP384SHA384:
+		curve := elliptic.P256()
+		if k.Algorithm == ALG_ECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		size := curve.Params().BitSize / 8
+		if len(b) != 2*size {
+			return nil, ErrInvalidKey
+		}
+		x, y := new(big.Int).SetBytes(b[:size]), new(big.Int).SetBytes(b[size:])
+		if !curve.IsOnCurve(x, y) {
+			return nil, ErrInvalidKey
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case ALG_ED25519:
+		if len(b) != ed25519.PublicKeySize {
+			return nil, ErrInvalidKey
+		}
+		return ed25519.PublicKey(b), nil
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
@@ -0,0 +1,256 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	EDNS_OPTION_ECS         = 8  // Client Subnet (RFC 7871)
+	EDNS_OPTION_EDE         = 15 // Extended DNS Error (RFC 8914)
+	EDNS_OPTION_ZONEVERSION = 19 // Zone Version (draft-ietf-dnsop-zoneversion)
+)
+
+// Extended DNS Error codes (RFC 8914 section 4).
+const (
+	EDE_OTHER                   = 0
+	EDE_UNSUPPORTED_DNSKEY_ALG  = 1
+	EDE_UNSUPPORTED_DS_DIGEST   = 2
+	EDE_STALE_ANSWER            = 3
+	EDE_FORGED_ANSWER           = 4
+	EDE_DNSSEC_INDETERMINATE    = 5
+	EDE_DNSSEC_BOGUS            = 6
+	EDE_SIGNATURE_EXPIRED       = 7
+	EDE_SIGNATURE_NOT_YET_VALID = 8
+	EDE_DNSKEY_MISSING          = 9
+	EDE_RRSIGS_MISSING          = 10
+	EDE_NO_ZONE_KEY_BIT_SET     = 11
+	EDE_NSEC_MISSING            = 12
+	EDE_CACHED_ERROR            = 13
+	EDE_NOT_READY               = 14
+	EDE_BLOCKED                 = 15
+	EDE_CENSORED                = 16
+	EDE_FILTERED                = 17
+	EDE_PROHIBITED              = 18
+	EDE_STALE_NXDOMAIN_ANSWER   = 19
+	EDE_NOT_AUTHORITATIVE       = 20
+	EDE_NOT_SUPPORTED           = 21
+	EDE_NO_REACHABLE_AUTHORITY  = 22
+	EDE_NETWORK_ERROR           = 23
+	EDE_INVALID_DATA            = 24
+)
+
+const (
+	ZONEVERSION_SOA_SERIAL = 0 // Zone version is the SOA serial of the zone
+)
+
+// DefaultUDPSize is the EDNS(0) payload size advertised by this package.
+const DefaultUDPSize = 1232
+
+// EDNSOption represents a single option carried in an OPT record.
+type EDNSOption struct {
+	Code uint16 // Option code
+	Data []byte // Option data specific to the code
+}
+
+// OPT represents the EDNS(0) OPT pseudo-record of a message.
+type OPT struct {
+	UDPSize       uint16 // Requestor's UDP payload size
+	ExtendedRCode uint8  // Upper 8 bits of the extended response code
+	Version       uint8  // EDNS version
+	DO            bool   // DNSSEC OK
+	Options       []EDNSOption
+}
+
+// Record converts the OPT into the resource record carried in the additional
+// section.
+func (o OPT) Record() Record {
+	var data []byte
+	for _, opt := range o.Options {
+		data = binary.BigEndian.AppendUint16(data, opt.Code)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(opt.Data)))
+		data = append(data, opt.Data...)
+	}
+	ttl := uint32(o.ExtendedRCode)<<24 | uint32(o.Version)<<16
+	if o.DO {
+		ttl |= 1 << 15
+	}
+	return Record{
+		Name:  "",
+		Type:  TYPE_OPT,
+		Class: o.UDPSize,
+		TTL:   ttl,
+		Len:   uint16(len(data)),
+		Data:  data,
+	}
+}
+
+// Option returns the first option with the given code.
+func (o OPT) Option(code uint16) (EDNSOption, bool) {
+	for _, opt := range o.Options {
+		if opt.Code == code {
+			return opt, true
+		}
+	}
+	return EDNSOption{}, false
+}
+
+// EDNS returns the OPT pseudo-record of the message, if there is one.
+func (m Message) EDNS() (OPT, bool) {
+	for _, r := range m.Additional.Records {
+		if r.Type != TYPE_OPT {
+			continue
+		}
+		o := OPT{
+			UDPSize:       r.Class,
+			ExtendedRCode: uint8(r.TTL >> 24),
+			Version:       uint8(r.TTL >> 16),
+			DO:            r.TTL&(1<<15) != 0,
+		}
+		for i := 0; i+4 <= len(r.Data); {
+			code := binary.BigEndian.Uint16(r.Data[i : i+2])
+			n := int(binary.BigEndian.Uint16(r.Data[i+2 : i+4]))
+			i += 4
+			if i+n > len(r.Data) {
+				break
+			}
+			o.Options = append(o.Options, EDNSOption{Code: code, Data: r.Data[i : i+n]})
+			i += n
+		}
+		return o, true
+	}
+	return OPT{}, false
+}
+
+// SetEDNS adds the OPT pseudo-record to the message, replacing any existing
+// one.
+func (m *Message) SetEDNS(o OPT) {
+	m.ClearEDNS()
+	m.Additional.Records = append(m.Additional.Records, o.Record())
+	m.Header.ARCOUNT = uint16(len(m.Additional.Records))
+}
+
+// ClearEDNS removes the OPT pseudo-record from the message.
+func (m *Message) ClearEDNS() {
+	records := m.Additional.Records[:0:0]
+	for _, r := range m.Additional.Records {
+		if r.Type != TYPE_OPT {
+			records = append(records, r)
+		}
+	}
+	m.Additional.Records = records
+	m.Header.ARCOUNT = uint16(len(records))
+}
+
+// NewExtendedErrorOption constructs an Extended DNS Error option with an
+// optional explanation.
+func NewExtendedErrorOption(code uint16, text string) EDNSOption {
+	data := binary.BigEndian.AppendUint16(nil, code)
+	return EDNSOption{Code: EDNS_OPTION_EDE, Data: append(data, text...)}
+}
+
+// ExtendedError decodes an Extended DNS Error option into its code and
+// explanation.
+func (o EDNSOption) ExtendedError() (code uint16, text string, ok bool) {
+	if o.Code != EDNS_OPTION_EDE || len(o.Data) < 2 {
+		return 0, "", false
+	}
+	return binary.BigEndian.Uint16(o.Data), string(o.Data[2:]), true
+}
+
+// AddExtendedError adds an Extended DNS Error option to the message,
+// creating its OPT record if needed.
+func (m *Message) AddExtendedError(code uint16, text string) {
+	o, ok := m.EDNS()
+	if !ok {
+		o = OPT{UDPSize: DefaultUDPSize}
+	}
+	o.Options = append(o.Options, NewExtendedErrorOption(code, text))
+	m.SetEDNS(o)
+}
+
+// NewZoneVersionOption constructs a ZONEVERSION option reporting the serial
+// of the zone with the given name.
+func NewZoneVersionOption(zone string, serial uint32) EDNSOption {
+	data := []byte{countLabels(zone), ZONEVERSION_SOA_SERIAL}
+	data = binary.BigEndian.AppendUint32(data, serial)
+	return EDNSOption{Code: EDNS_OPTION_ZONEVERSION, Data: data}
+}
+
+// ZoneVersion decodes a ZONEVERSION option into the label count of the zone
+// name, the version type, and the version itself.
+func (o EDNSOption) ZoneVersion() (labels uint8, typ uint8, version []byte, ok bool) {
+	if o.Code != EDNS_OPTION_ZONEVERSION || len(o.Data) < 2 {
+		return 0, 0, nil, false
+	}
+	return o.Data[0], o.Data[1], o.Data[2:], true
+}
+
+// AddZoneVersion includes the serial of the serving zone in the response if
+// the request asked for it with an empty ZONEVERSION option.
+func AddZoneVersion(req Message, res *Message, zone string, serial uint32) {
+	reqOPT, ok := req.EDNS()
+	if !ok {
+		return
+	}
+	if _, ok := reqOPT.Option(EDNS_OPTION_ZONEVERSION); !ok {
+		return
+	}
+	o, ok := res.EDNS()
+	if !ok {
+		o = OPT{UDPSize: DefaultUDPSize}
+	}
+	o.Options = append(o.Options, NewZoneVersionOption(zone, serial))
+	res.SetEDNS(o)
+}
+
+func countLabels(name string) uint8 {
+	return uint8(len(Labels(name)))
+}
+
+// ClientSubnet represents an EDNS Client Subnet option.
+type ClientSubnet struct {
+	SourcePrefix uint8  // Leftmost bits of the address that were sent
+	ScopePrefix  uint8  // Leftmost bits the answer is valid for
+	Address      net.IP // Client address, masked to SourcePrefix
+}
+
+// NewClientSubnetOption encodes the client subnet into an EDNS option.
+func NewClientSubnetOption(cs ClientSubnet) EDNSOption {
+	family, addr := uint16(1), cs.Address.To4()
+	if addr == nil {
+		family, addr = 2, cs.Address.To16()
+	}
+	n := (int(cs.SourcePrefix) + 7) / 8
+	if n > len(addr) {
+		n = len(addr)
+	}
+	data := binary.BigEndian.AppendUint16(nil, family)
+	data = append(data, cs.SourcePrefix, cs.ScopePrefix)
+	data = append(data, addr[:n]...)
+	return EDNSOption{Code: EDNS_OPTION_ECS, Data: data}
+}
+
+// ClientSubnet decodes an ECS option.
+func (o EDNSOption) ClientSubnet() (ClientSubnet, bool) {
+	if o.Code != EDNS_OPTION_ECS || len(o.Data) < 4 {
+		return ClientSubnet{}, false
+	}
+	cs := ClientSubnet{SourcePrefix: o.Data[2], ScopePrefix: o.Data[3]}
+	var size int
+	switch binary.BigEndian.Uint16(o.Data[0:2]) {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return ClientSubnet{}, false
+	}
+	addr := o.Data[4:]
+	if len(addr) > size || int(cs.SourcePrefix) > size*8 {
+		return ClientSubnet{}, false
+	}
+	cs.Address = make(net.IP, size)
+	copy(cs.Address, addr)
+	return cs, true
+}
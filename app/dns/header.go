@@ -0,0 +1,51 @@
+package dns
+
+// QR reports whether the message is a response.
+func (h Header) QR() bool { return h.Flag&FLAG_QR != 0 }
+
+// SetQR marks the message as a response or a query.
+func (h *Header) SetQR(v bool) { h.setFlag(FLAG_QR, v) }
+
+// AA reports whether the answer is authoritative.
+func (h Header) AA() bool { return h.Flag&FLAG_AA != 0 }
+
+// SetAA sets or clears the authoritative answer bit.
+func (h *Header) SetAA(v bool) { h.setFlag(FLAG_AA, v) }
+
+// TC reports whether the message was truncated.
+func (h Header) TC() bool { return h.Flag&FLAG_TC != 0 }
+
+// SetTC sets or clears the truncation bit.
+func (h *Header) SetTC(v bool) { h.setFlag(FLAG_TC, v) }
+
+// RD reports whether recursion is desired.
+func (h Header) RD() bool { return h.Flag&FLAG_RD != 0 }
+
+// SetRD sets or clears the recursion desired bit.
+func (h *Header) SetRD(v bool) { h.setFlag(FLAG_RD, v) }
+
+// RA reports whether recursion is available.
+func (h Header) RA() bool { return h.Flag&FLAG_RA != 0 }
+
+// SetRA sets or clears the recursion available bit.
+func (h *Header) SetRA(v bool) { h.setFlag(FLAG_RA, v) }
+
+// AD reports whether the data was authenticated with DNSSEC.
+func (h Header) AD() bool { return h.Flag&FLAG_AD != 0 }
+
+// SetAD sets or clears the authentic data bit.
+func (h *Header) SetAD(v bool) { h.setFlag(FLAG_AD, v) }
+
+// CD reports whether the requestor disabled DNSSEC validation.
+func (h Header) CD() bool { return h.Flag&FLAG_CD != 0 }
+
+// SetCD sets or clears the checking disabled bit.
+func (h *Header) SetCD(v bool) { h.setFlag(FLAG_CD, v) }
+
+func (h *Header) setFlag(flag uint16, v bool) {
+	if v {
+		h.Flag |= flag
+	} else {
+		h.Flag &^= flag
+	}
+}
@@ -0,0 +1,14 @@
+package dns
+
+// Middleware wraps a Handler to add behavior around it, such as logging,
+// rate limiting, caching, or access control.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with the middlewares. The first middleware is the outermost
+// one and sees every query first.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
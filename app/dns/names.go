@@ -0,0 +1,174 @@
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Names are kept in presentation format: labels are separated by dots, and
+// dots and backslashes within a label are escaped with a backslash, as are
+// unprintable bytes in the \DDD form (RFC 1035 section 5.1). Unlike joining
+// the raw labels, this keeps a label such as "a.b" apart from the two labels
+// "a" and "b".
+
+// CanonicalName returns the form of a name used to compare it: lowercase
+// and without the trailing dot (RFC 4034 section 6.2).
+func CanonicalName(name string) string {
+	return strings.ToLower(trimDot(name))
+}
+
+// trimDot removes the trailing dot of a fully qualified name, leaving a
+// trailing escaped dot in place.
+func trimDot(name string) string {
+	if n := len(name); n > 0 && name[n-1] == '.' && !escapedAt(name, n-1) {
+		return name[:n-1]
+	}
+	return name
+}
+
+// IsFQDN reports whether the name ends with an unescaped dot.
+func IsFQDN(name string) bool {
+	return trimDot(name) != name
+}
+
+// escapedAt reports whether the byte at i is escaped by an odd number of
+// backslashes before it.
+func escapedAt(name string, i int) bool {
+	n := 0
+	for j := i - 1; j >= 0 && name[j] == '\\'; j-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// Labels splits a name at its unescaped dots, leaving the labels in
+// presentation format.
+func Labels(name string) []string {
+	name = trimDot(name)
+	if name == "" {
+		return nil
+	}
+	var labels []string
+	start := 0
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' {
+			i++
+			continue
+		}
+		if name[i] == '.' {
+			labels = append(labels, name[start:i])
+			start = i + 1
+		}
+	}
+	return append(labels, name[start:])
+}
+
+// Parent returns the name without its first label, or false for the root.
+func Parent(name string) (string, bool) {
+	name = trimDot(name)
+	if name == "" {
+		return "", false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' {
+			i++
+			continue
+		}
+		if name[i] == '.' {
+			return name[i+1:], true
+		}
+	}
+	return "", true
+}
+
+// escapeLabel returns the presentation format of a label in wire format.
+func escapeLabel(label []byte) string {
+	var b strings.Builder
+	for _, c := range label {
+		switch {
+		case c == '.' || c == '\\' || c == '"' || c == '(' || c == ')' || c == ';':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x21 || c > 0x7E:
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeLabel returns the wire format of a label in presentation format.
+func unescapeLabel(label string) []byte {
+	if !strings.Contains(label, `\`) {
+		return []byte(label)
+	}
+	b := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 == len(label) {
+			b = append(b, label[i])
+			continue
+		}
+		if i+3 < len(label) && isDigits(label[i+1:i+4]) {
+			if n, err := strconv.Atoi(label[i+1 : i+4]); err == nil && n <= 255 {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		i++
+		b = append(b, label[i])
+	}
+	return b
+}
+
+// CompareNames orders names canonically (RFC 4034 section 6.1): label by
+// label starting from the root, comparing lowercased labels as byte strings,
+// with a name sorting before its subdomains. It returns -1, 0, or 1.
+func CompareNames(a, b string) int {
+	a, b = CanonicalName(a), CanonicalName(b)
+	for a != "" && b != "" {
+		var la, lb string
+		la, a = lastLabel(a)
+		lb, b = lastLabel(b)
+		if c := bytes.Compare(unescapeLabel(la), unescapeLabel(lb)); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return -1
+	}
+	return 1
+}
+
+// lastLabel splits the rightmost label off a name.
+func lastLabel(name string) (label, rest string) {
+	for i := len(name) - 1; i >= 0; i-- {
+		if name[i] == '.' && !escapedAt(name, i) {
+			return name[i+1:], name[:i]
+		}
+	}
+	return name, ""
+}
+
+// IsSubDomain reports whether child is parent or a name below it, ignoring
+// case. Every name is a subdomain of the root.
+func IsSubDomain(parent, child string) bool {
+	parent, child = CanonicalName(parent), CanonicalName(child)
+	if parent == "" || child == parent {
+		return true
+	}
+	i := len(child) - len(parent) - 1
+	return i > 0 && strings.HasSuffix(child, "."+parent) && !escapedAt(child, i)
+}
+
+// SortNames sorts names in canonical order.
+func SortNames(names []string) {
+	sort.Slice(names, func(i, j int) bool { return CompareNames(names[i], names[j]) < 0 })
+}
@@ -0,0 +1,174 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var classNames = map[uint16]string{
+	CLASS_IN: "IN",
+	CLASS_CS: "CS",
+	CLASS_CH: "CH",
+	CLASS_HS: "HS",
+}
+
+// ClassString returns the mnemonic of a class, or CLASS followed by its
+// number if it has none (RFC 3597 section 5).
+func ClassString(c uint16) string {
+	if name, ok := classNames[c]; ok {
+		return name
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+// String returns the record in the presentation format of zone files. The
+// data of types without a typed form, or that does not decode, is printed in
+// the generic \# format.
+func (r Record) String() string {
+	return strings.Join([]string{
+		fqdn(r.Name), strconv.FormatUint(uint64(r.TTL), 10), ClassString(r.Class), TypeString(r.Type), r.dataString(),
+	}, "\t")
+}
+
+// dataString returns the presentation format of the record data.
+func (r Record) dataString() string {
+	switch r.Type {
+	case TYPE_A:
+		if a, ok := r.A(); ok {
+			return a.Addr.String()
+		}
+	case TYPE_AAAA:
+		if a, ok := r.AAAA(); ok {
+			return a.Addr.String()
+		}
+	case TYPE_CNAME:
+		if c, ok := r.CNAME(); ok {
+			return fqdn(c.Target)
+		}
+	case TYPE_PTR:
+		if p, ok := r.PTR(); ok {
+			return fqdn(p.Target)
+		}
+	case TYPE_NS:
+		if n, ok := r.NS(); ok {
+			return fqdn(n.Host)
+		}
+	case TYPE_TXT:
+		if t, ok := r.TXT(); ok {
+			quoted := make([]string, len(t.Strings))
+			for i, s := range t.Strings {
+				quoted[i] = quoteCharacterString(s)
+			}
+			return strings.Join(quoted, " ")
+		}
+	case TYPE_SRV:
+		if s, ok := r.SRV(); ok {
+			return strconv.Itoa(int(s.Priority)) + " " + strconv.Itoa(int(s.Weight)) + " " +
+				strconv.Itoa(int(s.Port)) + " " + fqdn(s.Target)
+		}
+	case TYPE_SVCB, TYPE_HTTPS:
+		if s, ok := r.SVCB(); ok {
+			return s.String()
+		}
+	case TYPE_SOA:
+		if s, ok := r.SOA(); ok {
+			fields := []string{fqdn(s.MName), fqdn(s.RName)}
+			for _, v := range []uint32{s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum} {
+				fields = append(fields, strconv.FormatUint(uint64(v), 10))
+			}
+			return strings.Join(fields, " ")
+		}
+	case TYPE_DNSKEY:
+		if k, ok := r.DNSKEY(); ok {
+			return strconv.Itoa(int(k.Flags)) + " " + strconv.Itoa(int(k.Protocol)) + " " +
+				strconv.Itoa(int(k.Algorithm)) + " " + base64.StdEncoding.EncodeToString(k.PublicKey)
+		}
+	case TYPE_DS:
+		if d, ok := r.DS(); ok {
+			return strconv.Itoa(int(d.KeyTag)) + " " + strconv.Itoa(int(d.Algorithm)) + " " +
+				strconv.Itoa(int(d.DigestType)) + " " + strings.ToUpper(hex.EncodeToString(d.Digest))
+		}
+	case TYPE_RRSIG:
+		if s, ok := r.RRSIG(); ok {
+			return strings.Join([]string{
+				TypeString(s.TypeCovered), strconv.Itoa(int(s.Algorithm)), strconv.Itoa(int(s.Labels)),
+				strconv.FormatUint(uint64(s.OrigTTL), 10), signatureTime(s.Expiration), signatureTime(s.Inception),
+				strconv.Itoa(int(s.KeyTag)), fqdn(s.SignerName), base64.StdEncoding.EncodeToString(s.Signature),
+			}, " ")
+		}
+	case TYPE_NSEC:
+		if n, ok := r.NSEC(); ok {
+			return strings.TrimSpace(fqdn(n.NextName) + " " + typeList(n.Types))
+		}
+	case TYPE_NSEC3:
+		if n, ok := r.NSEC3(); ok {
+			salt := "-"
+			if len(n.Salt) > 0 {
+				salt = strings.ToUpper(hex.EncodeToString(n.Salt))
+			}
+			return strings.TrimSpace(strings.Join([]string{
+				strconv.Itoa(int(n.HashAlgorithm)), strconv.Itoa(int(n.Flags)), strconv.Itoa(int(n.Iterations)),
+				salt, nsec3Encoding.EncodeToString(n.NextHash), typeList(n.Types),
+			}, " "))
+		}
+	case TYPE_NSEC3PARAM:
+		if p, ok := r.NSEC3PARAM(); ok {
+			salt := "-"
+			if len(p.Salt) > 0 {
+				salt = strings.ToUpper(hex.EncodeToString(p.Salt))
+			}
+			return strings.Join([]string{
+				strconv.Itoa(int(p.HashAlgorithm)), strconv.Itoa(int(p.Flags)), strconv.Itoa(int(p.Iterations)), salt,
+			}, " ")
+		}
+	}
+	return Unknown{RRType: r.Type, Data: r.Data}.String()
+}
+
+// signatureTime formats the time of a signature as YYYYMMDDHHmmSS in UTC
+// (RFC 4034 section 3.2).
+func signatureTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
+// typeList returns the mnemonics of the types, separated by spaces.
+func typeList(types []uint16) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = TypeString(t)
+	}
+	return strings.Join(names, " ")
+}
+
+// fqdn returns the name with its trailing dot.
+func fqdn(name string) string {
+	if IsFQDN(name) {
+		return name
+	}
+	return name + "."
+}
+
+// quoteCharacterString quotes s, escaping quotes, backslashes, and bytes
+// that are not printable ASCII as \DDD.
+func quoteCharacterString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			b.WriteByte('\\')
+			b.WriteString(strconv.Itoa(int(c) + 1000)[1:])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package dns
+
+import "net"
+
+// QueryBuilder assembles a query message, e.g.
+//
+//	m := dns.NewQuery("example.com.", dns.TYPE_A).WithEDNS(1232).WithDO().Message()
+type QueryBuilder struct {
+	msg Message
+	opt *OPT // Set once EDNS is requested
+}
+
+// NewQuery starts a recursive query for name and type in class IN. Its ID is
+// 0 unless set with WithID; Client.Exchange picks a random one anyway.
+func NewQuery(name string, qtype uint16) *QueryBuilder {
+	return &QueryBuilder{msg: Message{
+		Header:   Header{Flag: FLAG_RD, QDCOUNT: 1},
+		Question: Question{Queries: []Query{{Name: name, Type: qtype, Class: CLASS_IN}}},
+	}}
+}
+
+// WithID sets the transaction ID.
+func (b *QueryBuilder) WithID(id uint16) *QueryBuilder {
+	b.msg.Header.ID = id
+	return b
+}
+
+// WithClass sets the class of the question.
+func (b *QueryBuilder) WithClass(class uint16) *QueryBuilder {
+	b.msg.Question.Queries[0].Class = class
+	return b
+}
+
+// WithoutRD clears the RD flag, for iterative queries to authoritative
+// servers.
+func (b *QueryBuilder) WithoutRD() *QueryBuilder {
+	b.msg.Header.SetRD(false)
+	return b
+}
+
+// WithEDNS adds an OPT record advertising the UDP payload size.
+func (b *QueryBuilder) WithEDNS(udpSize uint16) *QueryBuilder {
+	b.edns().UDPSize = udpSize
+	return b
+}
+
+// WithDO sets the DNSSEC OK bit, adding an OPT record with DefaultUDPSize if
+// there is none yet.
+func (b *QueryBuilder) WithDO() *QueryBuilder {
+	b.edns().DO = true
+	return b
+}
+
+// WithCD sets the checking disabled bit, asking a validating server for
+// the data even if it fails validation.
+func (b *QueryBuilder) WithCD() *QueryBuilder {
+	b.msg.Header.SetCD(true)
+	return b
+}
+
+// WithOption adds an EDNS option, adding an OPT record with DefaultUDPSize
+// if there is none yet.
+func (b *QueryBuilder) WithOption(o EDNSOption) *QueryBuilder {
+	opt := b.edns()
+	opt.Options = append(opt.Options, o)
+	return b
+}
+
+// WithClientSubnet adds an EDNS Client Subnet option (RFC 7871) for the
+// network.
+func (b *QueryBuilder) WithClientSubnet(network *net.IPNet) *QueryBuilder {
+	ones, _ := network.Mask.Size()
+	return b.WithOption(NewClientSubnetOption(ClientSubnet{SourcePrefix: uint8(ones), Address: network.IP.Mask(network.Mask)}))
+}
+
+func (b *QueryBuilder) edns() *OPT {
+	if b.opt == nil {
+		b.opt = &OPT{UDPSize: DefaultUDPSize}
+	}
+	return b.opt
+}
+
+// Message returns the query. The builder may be reused afterwards.
+func (b *QueryBuilder) Message() Message {
+	m := b.msg
+	m.Question.Queries = append([]Query(nil), b.msg.Question.Queries...)
+	if b.opt != nil {
+		m.SetEDNS(*b.opt)
+	}
+	return m
+}
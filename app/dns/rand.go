@@ -0,0 +1,74 @@
+package dns
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/big"
+	"math/rand"
+	"sync"
+)
+
+// Rand is a source of the random values used by the protocol, such as
+// transaction IDs. Implementations must be safe for concurrent use.
+type Rand interface {
+	// Read fills p with random bytes. It never fails for the
+	// implementations of this package.
+	Read(p []byte) (int, error)
+	// Intn returns a random number in [0, n). It panics if n <= 0.
+	Intn(n int) int
+}
+
+// CryptoRand draws from the operating system's secure random generator. It
+// is the default wherever a Rand can be configured.
+var CryptoRand Rand = cryptoRand{}
+
+type cryptoRand struct{}
+
+func (cryptoRand) Read(p []byte) (int, error) {
+	return crand.Read(p)
+}
+
+func (cryptoRand) Intn(n int) int {
+	v, err := crand.Int(crand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic("dns: secure random generator failed: " + err.Error())
+	}
+	return int(v.Int64())
+}
+
+// NewSeededRand returns a deterministic Rand producing the same sequence for
+// the same seed, so that protocol behaviors can be reproduced exactly. Its
+// values are predictable: it must only be used for tests.
+func NewSeededRand(seed int64) Rand {
+	return &seededRand{r: rand.New(rand.NewSource(seed))}
+}
+
+type seededRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (s *seededRand) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Read(p)
+}
+
+func (s *seededRand) Intn(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Intn(n)
+}
+
+// RandomID returns a transaction ID drawn from r, or from CryptoRand if r
+// is nil.
+func RandomID(r Rand) (uint16, error) {
+	if r == nil {
+		r = CryptoRand
+	}
+	var b [2]byte
+	if _, err := r.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
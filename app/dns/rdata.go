@@ -0,0 +1,272 @@
+package dns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RData is the typed data of a record of a known type.
+type RData interface {
+	Type() uint16 // Record type the data belongs to
+	Pack() []byte // Wire format of the data
+}
+
+// NewRecord constructs a record holding the typed data d.
+func NewRecord(name string, class uint16, ttl uint32, d RData) Record {
+	data := d.Pack()
+	return Record{Name: name, Type: d.Type(), Class: class, TTL: ttl, Len: uint16(len(data)), Data: data}
+}
+
+// A is the data of an A record: an IPv4 host address.
+type A struct {
+	Addr net.IP
+}
+
+func (A) Type() uint16 { return TYPE_A }
+
+func (a A) Pack() []byte { return []byte(a.Addr.To4()) }
+
+// A returns the data of an A record.
+func (r Record) A() (A, bool) {
+	if r.Type != TYPE_A || len(r.Data) != net.IPv4len {
+		return A{}, false
+	}
+	return A{Addr: net.IP(append([]byte(nil), r.Data...))}, true
+}
+
+// AAAA is the data of an AAAA record: an IPv6 host address (RFC 3596).
+type AAAA struct {
+	Addr net.IP
+}
+
+func (AAAA) Type() uint16 { return TYPE_AAAA }
+
+func (a AAAA) Pack() []byte { return []byte(a.Addr.To16()) }
+
+// AAAA returns the data of an AAAA record.
+func (r Record) AAAA() (AAAA, bool) {
+	if r.Type != TYPE_AAAA || len(r.Data) != net.IPv6len {
+		return AAAA{}, false
+	}
+	return AAAA{Addr: net.IP(append([]byte(nil), r.Data...))}, true
+}
+
+// CNAME is the data of a CNAME record: the canonical name of an alias.
+type CNAME struct {
+	Target string
+}
+
+func (CNAME) Type() uint16 { return TYPE_CNAME }
+
+func (c CNAME) Pack() []byte { return encodeDomainName(c.Target) }
+
+// CNAME returns the data of a CNAME record.
+func (r Record) CNAME() (CNAME, bool) {
+	if r.Type != TYPE_CNAME {
+		return CNAME{}, false
+	}
+	target, end, err := decodeDomainName(r.Data, 0)
+	if err != nil || end != len(r.Data) {
+		return CNAME{}, false
+	}
+	return CNAME{Target: target}, true
+}
+
+// PTR is the data of a PTR record: the name an address or other name points
+// to, as used in reverse zones.
+type PTR struct {
+	Target string
+}
+
+func (PTR) Type() uint16 { return TYPE_PTR }
+
+func (p PTR) Pack() []byte { return encodeDomainName(p.Target) }
+
+// PTR returns the data of a PTR record.
+func (r Record) PTR() (PTR, bool) {
+	if r.Type != TYPE_PTR {
+		return PTR{}, false
+	}
+	target, end, err := decodeDomainName(r.Data, 0)
+	if err != nil || end != len(r.Data) {
+		return PTR{}, false
+	}
+	return PTR{Target: target}, true
+}
+
+// NS is the data of an NS record: the name of an authoritative server for
+// the zone.
+type NS struct {
+	Host string
+}
+
+func (NS) Type() uint16 { return TYPE_NS }
+
+func (n NS) Pack() []byte { return encodeDomainName(n.Host) }
+
+// NS returns the data of an NS record.
+func (r Record) NS() (NS, bool) {
+	if r.Type != TYPE_NS {
+		return NS{}, false
+	}
+	host, end, err := decodeDomainName(r.Data, 0)
+	if err != nil || end != len(r.Data) {
+		return NS{}, false
+	}
+	return NS{Host: host}, true
+}
+
+// maxCharacterString is the longest character-string, limited by its one
+// byte length prefix.
+const maxCharacterString = 255
+
+// TXT is the data of a TXT record: a sequence of character strings.
+type TXT struct {
+	Strings []string
+}
+
+func (TXT) Type() uint16 { return TYPE_TXT }
+
+// Pack encodes every string with its length prefix. Strings longer than 255
+// bytes are split into several character-strings, which readers such as SPF
+// verifiers join again.
+func (t TXT) Pack() []byte {
+	var b []byte
+	for _, s := range t.Strings {
+		for {
+			n := len(s)
+			if n > maxCharacterString {
+				n = maxCharacterString
+			}
+			b = append(b, byte(n))
+			b = append(b, s[:n]...)
+			s = s[n:]
+			if s == "" {
+				break
+			}
+		}
+	}
+	return b
+}
+
+// Text returns the strings joined together, as expected by protocols that
+// store long values in TXT records.
+func (t TXT) Text() string {
+	return strings.Join(t.Strings, "")
+}
+
+// TXT returns the data of a TXT record, one string per character-string.
+func (r Record) TXT() (TXT, bool) {
+	if r.Type != TYPE_TXT {
+		return TXT{}, false
+	}
+	var t TXT
+	for i := 0; i < len(r.Data); {
+		n := int(r.Data[i])
+		if i+1+n > len(r.Data) {
+			return TXT{}, false
+		}
+		t.Strings = append(t.Strings, string(r.Data[i+1:i+1+n]))
+		i += 1 + n
+	}
+	return t, true
+}
+
+// SRV is the data of an SRV record locating a service (RFC 2782). The target
+// is never compressed.
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string // Host providing the service
+}
+
+func (SRV) Type() uint16 { return TYPE_SRV }
+
+func (s SRV) Pack() []byte {
+	b := binary.BigEndian.AppendUint16(nil, s.Priority)
+	b = binary.BigEndian.AppendUint16(b, s.Weight)
+	b = binary.BigEndian.AppendUint16(b, s.Port)
+	return append(b, encodeDomainName(s.Target)...)
+}
+
+// SRV returns the data of an SRV record.
+func (r Record) SRV() (SRV, bool) {
+	if r.Type != TYPE_SRV || len(r.Data) < 7 {
+		return SRV{}, false
+	}
+	target, end, err := decodeDomainName(r.Data, 6)
+	if err != nil || end != len(r.Data) {
+		return SRV{}, false
+	}
+	return SRV{
+		Priority: binary.BigEndian.Uint16(r.Data[0:2]),
+		Weight:   binary.BigEndian.Uint16(r.Data[2:4]),
+		Port:     binary.BigEndian.Uint16(r.Data[4:6]),
+		Target:   target,
+	}, true
+}
+
+// SOA is the data of the SOA record at the apex of a zone (RFC 1035 section
+// 3.3.13). Minimum is also the TTL of negative answers (RFC 2308).
+type SOA struct {
+	MName   string // Primary name server
+	RName   string // Mailbox of the person responsible, with @ as a dot
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func (SOA) Type() uint16 { return TYPE_SOA }
+
+func (s SOA) Pack() []byte {
+	b := append(encodeDomainName(s.MName), encodeDomainName(s.RName)...)
+	for _, v := range []uint32{s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// SOA returns the data of a SOA record.
+func (r Record) SOA() (SOA, bool) {
+	if r.Type != TYPE_SOA {
+		return SOA{}, false
+	}
+	mname, i, err := decodeDomainName(r.Data, 0)
+	if err != nil {
+		return SOA{}, false
+	}
+	rname, i, err := decodeDomainName(r.Data, i)
+	if err != nil || len(r.Data)-i != 20 {
+		return SOA{}, false
+	}
+	var v [5]uint32
+	for j := range v {
+		v[j] = binary.BigEndian.Uint32(r.Data[i+4*j:])
+	}
+	return SOA{MName: mname, RName: rname, Serial: v[0], Refresh: v[1], Retry: v[2], Expire: v[3], Minimum: v[4]}, true
+}
+
+// Unknown is the data of a record of a type without a typed form, kept as
+// opaque bytes so that it is relayed unchanged (RFC 3597).
+type Unknown struct {
+	RRType uint16
+	Data   []byte
+}
+
+func (u Unknown) Type() uint16 { return u.RRType }
+
+func (u Unknown) Pack() []byte { return u.Data }
+
+// String returns the data in the generic \# format of RFC 3597 section 5.
+func (u Unknown) String() string {
+	if len(u.Data) == 0 {
+		return `\# 0`
+	}
+	return `\# ` + strconv.Itoa(len(u.Data)) + " " + hex.EncodeToString(u.Data)
+}
@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	reverseZoneIPv4 = "in-addr.arpa"
+	reverseZoneIPv6 = "ip6.arpa"
+)
+
+const hexDigits = "0123456789abcdef"
+
+// ReverseAddr returns the name under in-addr.arpa or ip6.arpa at which PTR
+// records for the address are found (RFC 1035 section 3.5, RFC 3596 section
+// 2.5), or "" if ip is not a valid address.
+func ReverseAddr(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return strconv.Itoa(int(v4[3])) + "." + strconv.Itoa(int(v4[2])) + "." +
+			strconv.Itoa(int(v4[1])) + "." + strconv.Itoa(int(v4[0])) + "." + reverseZoneIPv4
+	}
+	if len(ip) != net.IPv6len {
+		return ""
+	}
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip[i]&0x0F])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString(reverseZoneIPv6)
+	return b.String()
+}
+
+// ReverseZone returns the name of the reverse zone holding the addresses of
+// the network. Its prefix length must fall on a label boundary: a multiple
+// of 8 for IPv4 and of 4 for IPv6.
+func ReverseZone(network *net.IPNet) (string, error) {
+	ones, bits := network.Mask.Size()
+	name := ReverseAddr(network.IP)
+	if name == "" || bits == 0 {
+		return "", errors.New("dns: invalid network")
+	}
+	step := 8
+	if bits == 8*net.IPv6len {
+		step = 4
+	}
+	if ones%step != 0 {
+		return "", errors.New("dns: prefix length does not fall on a label boundary")
+	}
+	// Drop the labels of the host part.
+	labels := strings.Split(name, ".")
+	return strings.Join(labels[(bits-ones)/step:], "."), nil
+}
@@ -0,0 +1,139 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrRRSetMismatch = errors.New("dns: records do not belong to the same RRset")
+
+// RRSet represents a set of records sharing owner name, type, and class
+// (RFC 2181 section 5). All records of a set have the same TTL.
+type RRSet struct {
+	Name  string   // Domain name
+	Type  uint16   // Record type
+	Class uint16   // Class code
+	TTL   uint32   // Time-to-live
+	Data  [][]byte // Data of every record in the set
+}
+
+// RRSetKey identifies an RRset regardless of the case of its owner name.
+type RRSetKey struct {
+	Name  string // Lowercased domain name
+	Type  uint16 // Record type
+	Class uint16 // Class code
+}
+
+// NewRRSet constructs an RRset containing the single record r.
+func NewRRSet(r Record) RRSet {
+	return RRSet{Name: r.Name, Type: r.Type, Class: r.Class, TTL: r.TTL, Data: [][]byte{r.Data}}
+}
+
+// Key returns the key identifying the RRset.
+func (s RRSet) Key() RRSetKey {
+	return RRSetKey{Name: CanonicalName(s.Name), Type: s.Type, Class: s.Class}
+}
+
+// Records expands the RRset into individual records.
+func (s RRSet) Records() []Record {
+	records := make([]Record, len(s.Data))
+	for i, data := range s.Data {
+		records[i] = Record{
+			Name:  s.Name,
+			Type:  s.Type,
+			Class: s.Class,
+			TTL:   s.TTL,
+			Len:   uint16(len(data)),
+			Data:  data,
+		}
+	}
+	return records
+}
+
+// Add appends data to the RRset unless an identical record is already
+// present. It reports whether the record was added.
+func (s *RRSet) Add(data []byte) bool {
+	for _, d := range s.Data {
+		if bytes.Equal(d, data) {
+			return false
+		}
+	}
+	s.Data = append(s.Data, data)
+	return true
+}
+
+// Merge adds the records of o to the RRset, keeping the lower of both TTLs.
+func (s *RRSet) Merge(o RRSet) error {
+	if s.Key() != o.Key() {
+		return ErrRRSetMismatch
+	}
+	for _, data := range o.Data {
+		s.Add(data)
+	}
+	if o.TTL < s.TTL {
+		s.TTL = o.TTL
+	}
+	return nil
+}
+
+// Rotate moves the first n records to the end of the set, as done for round
+// robin load distribution.
+func (s *RRSet) Rotate(n int) {
+	if len(s.Data) == 0 {
+		return
+	}
+	n %= len(s.Data)
+	if n < 0 {
+		n += len(s.Data)
+	}
+	s.Data = append(s.Data[n:len(s.Data):len(s.Data)], s.Data[:n]...)
+}
+
+// Canonical returns a copy of the RRset in DNSSEC canonical form (RFC 4034
+// section 6): a lowercase owner name and records sorted by their data.
+func (s RRSet) Canonical() RRSet {
+	c := s
+	c.Name = strings.ToLower(s.Name)
+	c.Data = make([][]byte, len(s.Data))
+	copy(c.Data, s.Data)
+	sort.Slice(c.Data, func(i, j int) bool {
+		return bytes.Compare(c.Data[i], c.Data[j]) < 0
+	})
+	return c
+}
+
+// GroupRRSets groups records into RRsets, in order of first appearance.
+func GroupRRSets(records []Record) []RRSet {
+	var sets []RRSet
+	index := make(map[RRSetKey]int)
+	for _, r := range records {
+		set := NewRRSet(r)
+		if i, ok := index[set.Key()]; ok {
+			sets[i].Merge(set)
+			continue
+		}
+		index[set.Key()] = len(sets)
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+// AddAnswer appends the records of the RRset to the answer section.
+func (m *Message) AddAnswer(s RRSet) {
+	m.Answer.Records = append(m.Answer.Records, s.Records()...)
+	m.Header.ANCOUNT = uint16(len(m.Answer.Records))
+}
+
+// AddAuthority appends the records of the RRset to the authority section.
+func (m *Message) AddAuthority(s RRSet) {
+	m.Authority.Records = append(m.Authority.Records, s.Records()...)
+	m.Header.NSCOUNT = uint16(len(m.Authority.Records))
+}
+
+// AddAdditional appends the records of the RRset to the additional section.
+func (m *Message) AddAdditional(s RRSet) {
+	m.Additional.Records = append(m.Additional.Records, s.Records()...)
+	m.Header.ARCOUNT = uint16(len(m.Additional.Records))
+}
@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// ResponseWriter is used by a Handler to send the response to a query.
+type ResponseWriter interface {
+	// RemoteAddr returns the address of the client that sent the query.
+	RemoteAddr() net.Addr
+	// WriteMsg sends the response to the client.
+	WriteMsg(m Message) error
+}
+
+// Handler responds to a DNS query. A Handler that does not call WriteMsg
+// drops the query without a response.
+type Handler interface {
+	ServeDNS(w ResponseWriter, r *Message)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(w ResponseWriter, r *Message)
+
+// ServeDNS calls f(w, r).
+func (f HandlerFunc) ServeDNS(w ResponseWriter, r *Message) {
+	f(w, r)
+}
+
+// TYPE_ANY_HANDLER registers a handler for queries of every type.
+const TYPE_ANY_HANDLER = 0
+
+type muxKey struct {
+	domain string // Lowercased domain name without the trailing dot
+	qtype  uint16 // Record type, or TYPE_ANY_HANDLER
+}
+
+// ServeMux is a DNS request multiplexer. It routes each query to the handler
+// registered for the longest domain suffix of the query name, preferring a
+// handler registered for the exact query type over one for all types.
+// Messages with several questions are routed by the most specific match
+// among them. Queries without any matching handler are REFUSED.
+type ServeMux struct {
+	mu sync.RWMutex
+	m  map[muxKey]Handler
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{m: make(map[muxKey]Handler)}
+}
+
+// Handle registers the handler for queries of any type at or below domain.
+// The root domain "." matches every query.
+func (mux *ServeMux) Handle(domain string, handler Handler) {
+	mux.HandleType(domain, TYPE_ANY_HANDLER, handler)
+}
+
+// HandleFunc registers the handler function for queries of any type at or
+// below domain.
+func (mux *ServeMux) HandleFunc(domain string, handler func(ResponseWriter, *Message)) {
+	mux.Handle(domain, HandlerFunc(handler))
+}
+
+// HandleType registers the handler for queries of type qtype at or below
+// domain.
+func (mux *ServeMux) HandleType(domain string, qtype uint16, handler Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.m[muxKey{domain: canonicalDomain(domain), qtype: qtype}] = handler
+}
+
+// HandleRemove removes the handlers registered for domain.
+func (mux *ServeMux) HandleRemove(domain string) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	d := canonicalDomain(domain)
+	for k := range mux.m {
+		if k.domain == d {
+			delete(mux.m, k)
+		}
+	}
+}
+
+// Handler returns the handler to use for the message, or nil if there is
+// none.
+func (mux *ServeMux) Handler(r *Message) Handler {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	var (
+		best      Handler
+		bestDepth = -1
+	)
+	for _, q := range r.Question.Queries {
+		h, depth := mux.match(q)
+		if h != nil && depth > bestDepth {
+			best, bestDepth = h, depth
+		}
+	}
+	return best
+}
+
+// match finds the handler for a single question along with the number of
+// labels of the domain it was registered for.
+func (mux *ServeMux) match(q Query) (Handler, int) {
+	name := canonicalDomain(q.Name)
+	labels := len(Labels(name))
+	for {
+		if h, ok := mux.m[muxKey{domain: name, qtype: q.Type}]; ok {
+			return h, labels
+		}
+		if h, ok := mux.m[muxKey{domain: name, qtype: TYPE_ANY_HANDLER}]; ok {
+			return h, labels
+		}
+		if name == "" {
+			return nil, -1
+		}
+		name, _ = Parent(name)
+		labels--
+	}
+}
+
+// ServeDNS dispatches the request to the handler whose domain most closely
+// matches the query name.
+func (mux *ServeMux) ServeDNS(w ResponseWriter, r *Message) {
+	h := mux.Handler(r)
+	if h == nil {
+		w.WriteMsg(NewErrorResponse(*r, RCODE_REFUSED))
+		return
+	}
+	h.ServeDNS(w, r)
+}
+
+func canonicalDomain(name string) string {
+	return CanonicalName(strings.TrimPrefix(name, "."))
+}
@@ -0,0 +1,33 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ReadStreamMessage reads a message prefixed with its two byte length, as
+// messages are sent over TCP and TLS (RFC 1035 section 4.2.2).
+func ReadStreamMessage(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteStreamMessage writes a message prefixed with its two byte length, in
+// a single write.
+func WriteStreamMessage(w io.Writer, data []byte) error {
+	if len(data) > 0xFFFF {
+		return errors.New("dns: message too large")
+	}
+	b := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(b, uint16(len(data)))
+	_, err := w.Write(append(b, data...))
+	return err
+}
@@ -0,0 +1,268 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SvcParamKeys of SVCB and HTTPS records (RFC 9460 section 14.3.2).
+const (
+	SVCPARAM_MANDATORY       = 0
+	SVCPARAM_ALPN            = 1
+	SVCPARAM_NO_DEFAULT_ALPN = 2
+	SVCPARAM_PORT            = 3
+	SVCPARAM_IPV4HINT        = 4
+	SVCPARAM_ECH             = 5
+	SVCPARAM_IPV6HINT        = 6
+)
+
+var svcParamNames = map[uint16]string{
+	SVCPARAM_MANDATORY:       "mandatory",
+	SVCPARAM_ALPN:            "alpn",
+	SVCPARAM_NO_DEFAULT_ALPN: "no-default-alpn",
+	SVCPARAM_PORT:            "port",
+	SVCPARAM_IPV4HINT:        "ipv4hint",
+	SVCPARAM_ECH:             "ech",
+	SVCPARAM_IPV6HINT:        "ipv6hint",
+}
+
+// SvcParam is a parameter of a service binding with its wire format value.
+type SvcParam struct {
+	Key   uint16
+	Value []byte
+}
+
+// SVCB is the data of an SVCB or HTTPS record (RFC 9460). A priority of 0
+// makes the record an alias to Target; otherwise Target serves the service
+// with the parameters, "" meaning the owner name itself.
+type SVCB struct {
+	HTTPS    bool // An HTTPS record rather than a plain SVCB one
+	Priority uint16
+	Target   string
+
+	Mandatory     []uint16 // Keys a client must understand to use the record
+	ALPN          []string // Protocol IDs, such as h2 and h3
+	NoDefaultALPN bool
+	Port          uint16 // Zero if the default port of the protocol is used
+	IPv4Hint      []net.IP
+	IPv6Hint      []net.IP
+	Other         []SvcParam // Parameters without a field of their own, such as ech
+}
+
+func (s SVCB) Type() uint16 {
+	if s.HTTPS {
+		return TYPE_HTTPS
+	}
+	return TYPE_SVCB
+}
+
+// Params returns the parameters in wire format, sorted by key as required
+// on the wire.
+func (s SVCB) Params() []SvcParam {
+	params := append([]SvcParam(nil), s.Other...)
+	if len(s.Mandatory) > 0 {
+		var v []byte
+		for _, k := range s.Mandatory {
+			v = binary.BigEndian.AppendUint16(v, k)
+		}
+		params = append(params, SvcParam{Key: SVCPARAM_MANDATORY, Value: v})
+	}
+	if len(s.ALPN) > 0 {
+		var v []byte
+		for _, id := range s.ALPN {
+			v = append(v, byte(len(id)))
+			v = append(v, id...)
+		}
+		params = append(params, SvcParam{Key: SVCPARAM_ALPN, Value: v})
+	}
+	if s.NoDefaultALPN {
+		params = append(params, SvcParam{Key: SVCPARAM_NO_DEFAULT_ALPN, Value: []byte{}})
+	}
+	if s.Port != 0 {
+		params = append(params, SvcParam{Key: SVCPARAM_PORT, Value: binary.BigEndian.AppendUint16(nil, s.Port)})
+	}
+	if len(s.IPv4Hint) > 0 {
+		var v []byte
+		for _, ip := range s.IPv4Hint {
+			v = append(v, ip.To4()...)
+		}
+		params = append(params, SvcParam{Key: SVCPARAM_IPV4HINT, Value: v})
+	}
+	if len(s.IPv6Hint) > 0 {
+		var v []byte
+		for _, ip := range s.IPv6Hint {
+			v = append(v, ip.To16()...)
+		}
+		params = append(params, SvcParam{Key: SVCPARAM_IPV6HINT, Value: v})
+	}
+	sort.SliceStable(params, func(i, j int) bool { return params[i].Key < params[j].Key })
+	return params
+}
+
+func (s SVCB) Pack() []byte {
+	b := binary.BigEndian.AppendUint16(nil, s.Priority)
+	b = append(b, encodeDomainName(s.Target)...)
+	for _, p := range s.Params() {
+		b = binary.BigEndian.AppendUint16(b, p.Key)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(p.Value)))
+		b = append(b, p.Value...)
+	}
+	return b
+}
+
+// SVCB returns the data of an SVCB or HTTPS record. Parameters must be in
+// increasing key order and the known ones well formed.
+func (r Record) SVCB() (SVCB, bool) {
+	if (r.Type != TYPE_SVCB && r.Type != TYPE_HTTPS) || len(r.Data) < 3 {
+		return SVCB{}, false
+	}
+	s := SVCB{HTTPS: r.Type == TYPE_HTTPS, Priority: binary.BigEndian.Uint16(r.Data)}
+	target, i, err := decodeDomainName(r.Data, 2)
+	if err != nil {
+		return SVCB{}, false
+	}
+	s.Target = target
+	last := -1
+	for i < len(r.Data) {
+		if i+4 > len(r.Data) {
+			return SVCB{}, false
+		}
+		key := binary.BigEndian.Uint16(r.Data[i:])
+		n := int(binary.BigEndian.Uint16(r.Data[i+2:]))
+		i += 4
+		if int(key) <= last || i+n > len(r.Data) {
+			return SVCB{}, false
+		}
+		last = int(key)
+		if err := s.setParam(key, r.Data[i:i+n]); err != nil {
+			return SVCB{}, false
+		}
+		i += n
+	}
+	return s, true
+}
+
+var errSvcParam = errors.New("dns: malformed SvcParam value")
+
+// setParam decodes a parameter from its wire format value.
+func (s *SVCB) setParam(key uint16, v []byte) error {
+	switch key {
+	case SVCPARAM_MANDATORY:
+		if len(v) == 0 || len(v)%2 != 0 {
+			return errSvcParam
+		}
+		for j := 0; j < len(v); j += 2 {
+			s.Mandatory = append(s.Mandatory, binary.BigEndian.Uint16(v[j:]))
+		}
+	case SVCPARAM_ALPN:
+		if len(v) == 0 {
+			return errSvcParam
+		}
+		for j := 0; j < len(v); {
+			n := int(v[j])
+			if n == 0 || j+1+n > len(v) {
+				return errSvcParam
+			}
+			s.ALPN = append(s.ALPN, string(v[j+1:j+1+n]))
+			j += 1 + n
+		}
+	case SVCPARAM_NO_DEFAULT_ALPN:
+		if len(v) != 0 {
+			return errSvcParam
+		}
+		s.NoDefaultALPN = true
+	case SVCPARAM_PORT:
+		if len(v) != 2 {
+			return errSvcParam
+		}
+		s.Port = binary.BigEndian.Uint16(v)
+	case SVCPARAM_IPV4HINT:
+		if len(v) == 0 || len(v)%net.IPv4len != 0 {
+			return errSvcParam
+		}
+		for j := 0; j < len(v); j += net.IPv4len {
+			s.IPv4Hint = append(s.IPv4Hint, net.IP(append([]byte(nil), v[j:j+net.IPv4len]...)))
+		}
+	case SVCPARAM_IPV6HINT:
+		if len(v) == 0 || len(v)%net.IPv6len != 0 {
+			return errSvcParam
+		}
+		for j := 0; j < len(v); j += net.IPv6len {
+			s.IPv6Hint = append(s.IPv6Hint, net.IP(append([]byte(nil), v[j:j+net.IPv6len]...)))
+		}
+	default:
+		s.Other = append(s.Other, SvcParam{Key: key, Value: append([]byte(nil), v...)})
+	}
+	return nil
+}
+
+// svcParamKeyString returns the presentation name of a key, or key
+// followed by its number.
+func svcParamKeyString(key uint16) string {
+	if name, ok := svcParamNames[key]; ok {
+		return name
+	}
+	return "key" + strconv.Itoa(int(key))
+}
+
+// parseSvcParamKey is the inverse of svcParamKeyString.
+func parseSvcParamKey(s string) (uint16, bool) {
+	s = strings.ToLower(s)
+	for key, name := range svcParamNames {
+		if name == s {
+			return key, true
+		}
+	}
+	if !strings.HasPrefix(s, "key") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s[3:], 10, 16)
+	return uint16(n), err == nil
+}
+
+// String returns the data in presentation format, with the parameters as
+// key=value pairs.
+func (s SVCB) String() string {
+	fields := []string{strconv.Itoa(int(s.Priority)), fqdn(s.Target)}
+	for _, p := range s.Params() {
+		var v string
+		switch p.Key {
+		case SVCPARAM_MANDATORY:
+			keys := make([]string, len(s.Mandatory))
+			for i, k := range s.Mandatory {
+				keys[i] = svcParamKeyString(k)
+			}
+			v = strings.Join(keys, ",")
+		case SVCPARAM_ALPN:
+			v = strings.Join(s.ALPN, ",")
+		case SVCPARAM_NO_DEFAULT_ALPN:
+			fields = append(fields, svcParamKeyString(p.Key))
+			continue
+		case SVCPARAM_PORT:
+			v = strconv.Itoa(int(s.Port))
+		case SVCPARAM_IPV4HINT:
+			v = joinIPs(s.IPv4Hint)
+		case SVCPARAM_IPV6HINT:
+			v = joinIPs(s.IPv6Hint)
+		case SVCPARAM_ECH:
+			v = base64.StdEncoding.EncodeToString(p.Value)
+		default:
+			v = quoteCharacterString(string(p.Value))
+		}
+		fields = append(fields, svcParamKeyString(p.Key)+"="+v)
+	}
+	return strings.Join(fields, " ")
+}
+
+func joinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,201 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Transfer requests a full transfer of zone from the server at addr over
+// TCP (RFC 5936) and returns its records, starting with the SOA record and
+// without the SOA record closing the transfer. The timeout of the client
+// bounds the whole transfer. With a TSIG key, every message of the transfer
+// must be signed.
+func (c *Client) Transfer(ctx context.Context, zone, addr string) ([]Record, error) {
+	t, err := c.TransferZone(ctx, zone, addr, nil)
+	return t.Records, err
+}
+
+// ZoneTransfer is what a server sent in a zone transfer.
+type ZoneTransfer struct {
+	SOA Record // Of the zone as the server has it
+	// Records is the whole zone, starting with the SOA record, when the
+	// server sent it in full. It is nil when the server sent the changes
+	// since the version asked for, or only its SOA record because the
+	// zone has not changed since.
+	Records []Record
+	Diffs   []ZoneDiff // Changes to apply in order, for an incremental transfer
+	Bytes   int        // Size of the messages received
+}
+
+// ZoneDiff is the change from one version of a zone to the next in an
+// incremental transfer. Removed starts with the SOA record of the version
+// it changes and Added with the one of the version it results in.
+type ZoneDiff struct {
+	Removed, Added []Record
+}
+
+// SerialNewer reports whether the serial a of a zone is newer than b, in
+// the serial number arithmetic of RFC 1982, where serials wrap around.
+func SerialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// TransferZone transfers zone from the server at addr over TCP. With have,
+// the SOA record of the version of the zone already held, it asks for the
+// changes since then with IXFR (RFC 1995); the server may still send the
+// whole zone, or only its SOA record if it has nothing newer. Without
+// have, it asks for the whole zone with AXFR.
+func (c *Client) TransferZone(ctx context.Context, zone, addr string, have *Record) (ZoneTransfer, error) {
+	id, err := RandomID(c.Rand)
+	if err != nil {
+		return ZoneTransfer{}, err
+	}
+	qtype := uint16(TYPE_AXFR)
+	var haveSerial uint32
+	if have != nil {
+		soa, ok := have.SOA()
+		if !ok {
+			return ZoneTransfer{}, errors.New("dns: IXFR needs the SOA record of the zone held")
+		}
+		qtype, haveSerial = TYPE_IXFR, soa.Serial
+	}
+	query := NewQuery(zone, qtype).WithID(id).WithoutRD().Message()
+	if have != nil {
+		query.AddAuthority(NewRRSet(*have))
+	}
+
+	var t ZoneTransfer
+	var serial uint32
+	incremental, adding := false, false
+	err = c.transfer(ctx, query, addr, &t.Bytes, func(r Record) (bool, error) {
+		isSOA := r.Type == TYPE_SOA && CompareNames(r.Name, zone) == 0
+		if t.SOA.Type == 0 {
+			soa, ok := r.SOA()
+			if !isSOA || !ok {
+				return false, errors.New("dns: transfer does not start with a SOA record")
+			}
+			t.SOA, serial = r, soa.Serial
+			if have != nil && !SerialNewer(serial, haveSerial) {
+				return true, nil
+			}
+			t.Records = []Record{r}
+			return false, nil
+		}
+		if !incremental && len(t.Records) == 1 && have != nil && isSOA {
+			// A second SOA record of another version starts the first
+			// change of an incremental transfer.
+			if soa, ok := r.SOA(); ok && soa.Serial != serial {
+				incremental, t.Records = true, nil
+				t.Diffs = append(t.Diffs, ZoneDiff{Removed: []Record{r}})
+				return false, nil
+			}
+		}
+		if !incremental {
+			if isSOA {
+				return true, nil
+			}
+			t.Records = append(t.Records, r)
+			return false, nil
+		}
+		diff := &t.Diffs[len(t.Diffs)-1]
+		switch {
+		case isSOA && !adding:
+			diff.Added, adding = []Record{r}, true
+		case isSOA:
+			if soa, ok := r.SOA(); ok && soa.Serial == serial {
+				return true, nil
+			}
+			t.Diffs, adding = append(t.Diffs, ZoneDiff{Removed: []Record{r}}), false
+		case adding:
+			diff.Added = append(diff.Added, r)
+		default:
+			diff.Removed = append(diff.Removed, r)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return ZoneTransfer{}, err
+	}
+	return t, nil
+}
+
+// transfer sends query to the server at addr over TCP and passes the
+// answer records of the messages it sends back to record, until record
+// reports that the transfer is done. The size of the messages is added to
+// bytes.
+func (c *Client) transfer(ctx context.Context, query Message, addr string, bytes *int, record func(Record) (done bool, err error)) error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	q, session, err := c.sign(query.Byte())
+	if err != nil {
+		return err
+	}
+	if err := WriteStreamMessage(conn, q); err != nil {
+		return err
+	}
+	for first := true; ; first = false {
+		b, err := ReadStreamMessage(conn)
+		if err != nil {
+			return err
+		}
+		*bytes += len(b)
+		var res Message
+		if session != nil {
+			res, err = verifyResponse(session, b)
+		} else {
+			res, err = ParseMessage(b)
+		}
+		if err != nil {
+			return err
+		}
+		// Only the first message has to carry the question.
+		if first {
+			err = ValidateResponse(query, res)
+		} else if res.Header.ID != query.Header.ID || !res.Header.QR() {
+			err = errors.New("dns: transfer message does not belong to the transfer")
+		}
+		if err != nil {
+			return err
+		}
+		if rcode := res.Header.RCode(); rcode != RCODE_NOERROR {
+			return fmt.Errorf("dns: transfer refused with %s", rcode)
+		}
+		if first && len(res.Answer.Records) == 0 {
+			return errors.New("dns: transfer returned no records")
+		}
+		for _, r := range res.Answer.Records {
+			done, err := record(r)
+			if err != nil || done {
+				return err
+			}
+		}
+	}
+}
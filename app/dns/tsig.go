@@ -0,0 +1,297 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// TSIG_HMAC_SHA256 is the name of the HMAC-SHA256 algorithm in TSIG records,
+// the only one supported.
+const TSIG_HMAC_SHA256 = "hmac-sha256"
+
+// DefaultTSIGFudge is the clock skew, in seconds, tolerated by the messages
+// of a TSIGSession without one (RFC 8945 section 10).
+const DefaultTSIGFudge = 300
+
+var (
+	ErrNoTSIG      = errors.New("dns: message not signed")
+	ErrTSIGNotLast = errors.New("dns: TSIG record is not the last record")
+	ErrTSIGBadKey  = errors.New("dns: TSIG key not recognized")
+	ErrTSIGBadSig  = errors.New("dns: TSIG signature does not verify")
+	ErrTSIGBadTime = errors.New("dns: TSIG signed outside the time window")
+)
+
+// TSIG is the data of a TSIG record, which signs the message it ends with
+// a secret shared by its sender and receiver (RFC 8945 section 4.2).
+type TSIG struct {
+	Algorithm  string
+	TimeSigned uint64 // Seconds since the epoch, on 48 bits
+	Fudge      uint16 // Seconds of clock skew tolerated
+	MAC        []byte
+	OrigID     uint16 // ID of the message when it was signed
+	Error      RCode
+	OtherData  []byte
+}
+
+func (TSIG) Type() uint16 { return TYPE_TSIG }
+
+func (t TSIG) Pack() []byte {
+	b := encodeDomainName(t.Algorithm)
+	b = appendUint48(b, t.TimeSigned)
+	b = binary.BigEndian.AppendUint16(b, t.Fudge)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.MAC)))
+	b = append(b, t.MAC...)
+	b = binary.BigEndian.AppendUint16(b, t.OrigID)
+	b = binary.BigEndian.AppendUint16(b, uint16(t.Error))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.OtherData)))
+	return append(b, t.OtherData...)
+}
+
+// TSIG returns the data of a TSIG record.
+func (r Record) TSIG() (TSIG, bool) {
+	alg, i, err := decodeDomainName(r.Data, 0)
+	if r.Type != TYPE_TSIG || err != nil || i+10 > len(r.Data) {
+		return TSIG{}, false
+	}
+	d := r.Data[i:]
+	t := TSIG{Algorithm: alg, TimeSigned: uint64(binary.BigEndian.Uint16(d))<<32 | uint64(binary.BigEndian.Uint32(d[2:])), Fudge: binary.BigEndian.Uint16(d[6:])}
+	macEnd := 10 + int(binary.BigEndian.Uint16(d[8:]))
+	if macEnd+6 > len(d) {
+		return TSIG{}, false
+	}
+	t.MAC = append([]byte(nil), d[10:macEnd]...)
+	d = d[macEnd:]
+	t.OrigID = binary.BigEndian.Uint16(d)
+	t.Error = RCode(binary.BigEndian.Uint16(d[2:]))
+	if 6+int(binary.BigEndian.Uint16(d[4:])) != len(d) {
+		return TSIG{}, false
+	}
+	t.OtherData = append([]byte(nil), d[6:]...)
+	return t, true
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(v>>32))
+	return binary.BigEndian.AppendUint32(b, uint32(v))
+}
+
+// TSIGKey is a secret shared with a peer to sign the messages exchanged
+// with it.
+type TSIGKey struct {
+	Name      string
+	Algorithm string // TSIG_HMAC_SHA256
+	Secret    []byte
+}
+
+func (k TSIGKey) hash() (hash.Hash, error) {
+	if !strings.EqualFold(trimDot(k.Algorithm), TSIG_HMAC_SHA256) {
+		return nil, fmt.Errorf("dns: unsupported TSIG algorithm %s", k.Algorithm)
+	}
+	return hmac.New(sha256.New, k.Secret), nil
+}
+
+// SplitTSIG separates the TSIG record ending msg from the message as it was
+// before it was signed: without the record, and with its original ID. It
+// returns the name of the key the message was signed with and the data of
+// the record, or ErrNoTSIG if the message is not signed.
+func SplitTSIG(msg []byte) (key string, t TSIG, unsigned []byte, err error) {
+	if len(msg) < headerSize {
+		return "", TSIG{}, nil, ErrShortMessage
+	}
+	i := headerSize
+	for n := binary.BigEndian.Uint16(msg[4:]); n > 0; n-- {
+		if _, i, err = decodeDomainName(msg, i); err != nil {
+			return "", TSIG{}, nil, err
+		}
+		i += 4
+	}
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	var last Record
+	start := 0
+	for n := 0; n < records; n++ {
+		if last.Type == TYPE_TSIG {
+			return "", TSIG{}, nil, ErrTSIGNotLast
+		}
+		start = i
+		if last.Name, i, err = decodeDomainName(msg, i); err != nil {
+			return "", TSIG{}, nil, err
+		}
+		if i+10 > len(msg) {
+			return "", TSIG{}, nil, ErrShortMessage
+		}
+		last.Type = binary.BigEndian.Uint16(msg[i:])
+		end := i + 10 + int(binary.BigEndian.Uint16(msg[i+8:]))
+		if end > len(msg) {
+			return "", TSIG{}, nil, ErrTrailingRecord
+		}
+		last.Data = msg[i+10 : end]
+		i = end
+	}
+	if last.Type != TYPE_TSIG || binary.BigEndian.Uint16(msg[10:]) == 0 {
+		return "", TSIG{}, nil, ErrNoTSIG
+	}
+	t, ok := last.TSIG()
+	if !ok {
+		return "", TSIG{}, nil, ErrTrailingRecord
+	}
+	unsigned = append([]byte(nil), msg[:start]...)
+	binary.BigEndian.PutUint16(unsigned, t.OrigID)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(msg[10:])-1)
+	return last.Name, t, unsigned, nil
+}
+
+// TSIGSession signs and verifies the messages of a transaction with a key:
+// a request and its response, or the messages of a zone transfer. Each
+// message after the first is signed together with the MAC of the one
+// before it, and the messages of a transfer after its first response with
+// only the time of their signature (RFC 8945 section 5.3.1).
+type TSIGSession struct {
+	Key   TSIGKey
+	Fudge uint16 // DefaultTSIGFudge if zero
+
+	// Error is the TSIG error of the messages signed. Messages with a
+	// BADKEY or BADSIG error are not signed at all, and BADTIME ones
+	// carry the time of the request they answer.
+	Error RCode
+
+	mac        []byte // Of the last message signed or verified
+	messages   int    // Signed or verified so far
+	timeSigned uint64 // Of the request whose time was refused
+}
+
+// Sign appends to msg a TSIG record that signs it at now.
+func (s *TSIGSession) Sign(msg []byte, now time.Time) ([]byte, error) {
+	if len(msg) < headerSize {
+		return nil, ErrShortMessage
+	}
+	t := TSIG{
+		Algorithm:  s.Key.Algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      s.Fudge,
+		OrigID:     binary.BigEndian.Uint16(msg),
+		Error:      s.Error,
+	}
+	if t.Fudge == 0 {
+		t.Fudge = DefaultTSIGFudge
+	}
+	if s.Error == RCODE_BADTIME {
+		// The client learns the time of the server (RFC 8945 section
+		// 5.2.3).
+		t.TimeSigned = s.timeSigned
+		t.OtherData = appendUint48(nil, uint64(now.Unix()))
+	}
+	if s.Error != RCODE_BADKEY && s.Error != RCODE_BADSIG {
+		mac, err := s.digest(s.Key.Name, t, msg)
+		if err != nil {
+			return nil, err
+		}
+		t.MAC = mac
+		s.mac = mac
+		s.messages++
+	}
+	signed := append([]byte(nil), msg...)
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(msg[10:])+1)
+	signed = append(signed, encodeDomainName(s.Key.Name)...)
+	signed = binary.BigEndian.AppendUint16(signed, TYPE_TSIG)
+	signed = binary.BigEndian.AppendUint16(signed, CLASS_ANY)
+	signed = binary.BigEndian.AppendUint32(signed, 0)
+	data := t.Pack()
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(data)))
+	return append(signed, data...), nil
+}
+
+// Size returns the number of bytes Sign adds to a message.
+func (s *TSIGSession) Size() int {
+	size := len(encodeDomainName(s.Key.Name)) + 10 + len(encodeDomainName(s.Key.Algorithm)) + 16
+	if s.Error != RCODE_BADKEY && s.Error != RCODE_BADSIG {
+		size += sha256.Size
+	}
+	if s.Error == RCODE_BADTIME {
+		size += 6
+	}
+	return size
+}
+
+// Verify checks the TSIG record ending msg against the key and now, and
+// returns the message without it. On ErrTSIGBadSig and ErrTSIGBadTime, the
+// session is left ready to sign the error response (RFC 8945 section 5.2).
+// A response carrying a TSIG error is reported as such.
+func (s *TSIGSession) Verify(msg []byte, now time.Time) ([]byte, error) {
+	name, t, unsigned, err := SplitTSIG(msg)
+	if err != nil {
+		return nil, err
+	}
+	if CompareNames(name, s.Key.Name) != 0 || CompareNames(t.Algorithm, s.Key.Algorithm) != 0 {
+		s.Error = RCODE_BADKEY
+		return nil, ErrTSIGBadKey
+	}
+	if t.Error != RCODE_NOERROR && len(t.MAC) == 0 {
+		return nil, tsigError(t.Error)
+	}
+	mac, err := s.digest(name, t, unsigned)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, t.MAC) {
+		s.Error = RCODE_BADSIG
+		return nil, ErrTSIGBadSig
+	}
+	s.mac = t.MAC
+	s.messages++
+	if d := int64(t.TimeSigned) - now.Unix(); d > int64(t.Fudge) || -d > int64(t.Fudge) {
+		s.Error = RCODE_BADTIME
+		s.timeSigned = t.TimeSigned
+		return nil, ErrTSIGBadTime
+	}
+	if t.Error != RCODE_NOERROR {
+		return nil, tsigError(t.Error)
+	}
+	return unsigned, nil
+}
+
+// tsigError describes the error of the TSIG record of a response, where 16
+// is BADSIG rather than BADVERS.
+func tsigError(code RCode) error {
+	name := code.String()
+	if code == RCODE_BADSIG {
+		name = "BADSIG"
+	}
+	return fmt.Errorf("dns: TSIG error %s", name)
+}
+
+// digest computes the MAC of the next message of the session, with the
+// TSIG variables of t (RFC 8945 section 4.3).
+func (s *TSIGSession) digest(name string, t TSIG, msg []byte) ([]byte, error) {
+	h, err := s.Key.hash()
+	if err != nil {
+		return nil, err
+	}
+	if s.messages > 0 {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(s.mac))))
+		h.Write(s.mac)
+	}
+	h.Write(msg)
+	var b []byte
+	if s.messages > 1 {
+		b = appendUint48(b, t.TimeSigned)
+		b = binary.BigEndian.AppendUint16(b, t.Fudge)
+	} else {
+		b = append(b, canonicalName(name)...)
+		b = binary.BigEndian.AppendUint16(b, CLASS_ANY)
+		b = binary.BigEndian.AppendUint32(b, 0)
+		b = append(b, canonicalName(t.Algorithm)...)
+		b = appendUint48(b, t.TimeSigned)
+		b = binary.BigEndian.AppendUint16(b, t.Fudge)
+		b = binary.BigEndian.AppendUint16(b, uint16(t.Error))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(t.OtherData)))
+		b = append(b, t.OtherData...)
+	}
+	h.Write(b)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,769 @@
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Security is the outcome of validating a response (RFC 4033 section 5).
+// A worse outcome has a higher value.
+type Security uint8
+
+const (
+	SECURITY_SECURE   Security = iota + 1 // Every RRset chains up to a trust anchor
+	SECURITY_INSECURE                     // Some data is in zones proven to be unsigned
+	SECURITY_BOGUS                        // Signatures or proofs that should exist are missing or wrong
+)
+
+var securityNames = map[Security]string{
+	SECURITY_SECURE:   "secure",
+	SECURITY_INSECURE: "insecure",
+	SECURITY_BOGUS:    "bogus",
+}
+
+func (s Security) String() string {
+	return securityNames[s]
+}
+
+// ValidationError explains why a response is bogus, along with the Extended
+// DNS Error code that describes it best.
+type ValidationError struct {
+	Code   uint16 // EDE_DNSSEC_BOGUS or a more specific EDE code
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return "dns: " + e.Reason
+}
+
+func bogus(code uint16, format string, args ...any) *ValidationError {
+	return &ValidationError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+const (
+	// MaxNSEC3Iterations is the most NSEC3 iterations a proof may use;
+	// zones using more are treated as insecure (RFC 9276 section 3.2).
+	MaxNSEC3Iterations = 150
+	// Validated keys and zone cuts are remembered for at most maxTrustTTL,
+	// and broken chains of trust for badTrustTTL (RFC 4035 section 4.7).
+	maxTrustTTL = time.Hour
+	badTrustTTL = time.Minute
+)
+
+// Validator checks the DNSSEC signatures of responses from a recursive
+// resolver, building the chain of trust from the DS records of the keys of
+// the root zone down to the signer of each RRset (RFC 4035 section 5).
+type Validator struct {
+	anchors []DS
+	lookup  func(name string, qtype uint16) (Message, error)
+
+	Now func() time.Time // Time signatures are checked against; time.Now if nil
+
+	mu   sync.Mutex
+	cuts map[string]zoneTrust // By canonical name, walked from the root
+}
+
+// NewValidator returns a validator trusting the root keys that match the
+// anchors. It fetches the DNSKEY and DS records it needs with lookup, which
+// must ask with the DO bit set, and CD too when it goes through another
+// validating resolver.
+func NewValidator(anchors []DS, lookup func(name string, qtype uint16) (Message, error)) *Validator {
+	return &Validator{anchors: anchors, lookup: lookup, cuts: make(map[string]zoneTrust)}
+}
+
+func (v *Validator) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+// trustKind is what a name turned out to be on the walk down from the root.
+type trustKind uint8
+
+const (
+	trustNone     trustKind = iota // Not a zone cut: the zone above holds the name
+	trustSecure                    // The apex of a signed zone whose keys were validated
+	trustInsecure                  // The apex of an unsigned zone, or one signed with algorithms not supported
+	trustBogus                     // Where the chain of trust breaks
+)
+
+// zoneTrust is what is known of a name as a possible zone cut.
+type zoneTrust struct {
+	kind    trustKind
+	keys    []DNSKEY         // Zone keys of a secure zone
+	err     *ValidationError // Why the chain breaks, for trustBogus
+	expires time.Time
+}
+
+// signedZone is a secure zone and its validated keys.
+type signedZone struct {
+	name string
+	keys []DNSKEY
+}
+
+// signedSet is an RRset and the signatures over it found next to it.
+type signedSet struct {
+	RRSet
+	sigs []RRSIG
+}
+
+// signedSets groups the records into RRsets, attaching the RRSIG records
+// that cover them.
+func signedSets(records []Record) []signedSet {
+	var plain, sigs []Record
+	for _, r := range records {
+		switch r.Type {
+		case TYPE_RRSIG:
+			sigs = append(sigs, r)
+		case TYPE_OPT:
+		default:
+			plain = append(plain, r)
+		}
+	}
+	var sets []signedSet
+	for _, s := range GroupRRSets(plain) {
+		set := signedSet{RRSet: s}
+		for _, r := range sigs {
+			if sig, ok := r.RRSIG(); ok && sig.TypeCovered == s.Type && CanonicalName(r.Name) == CanonicalName(s.Name) {
+				set.sigs = append(set.sigs, sig)
+			}
+		}
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+// verify checks that one of the signatures over the set is by a key of the
+// zone and valid at now, and returns it.
+func (z signedZone) verify(set signedSet, now time.Time) (RRSIG, *ValidationError) {
+	if len(set.sigs) == 0 {
+		return RRSIG{}, bogus(EDE_RRSIGS_MISSING, "no signature over %s %s", fqdn(set.Name), TypeString(set.Type))
+	}
+	err := bogus(EDE_DNSKEY_MISSING, "no key of %s signed %s %s", fqdn(z.name), fqdn(set.Name), TypeString(set.Type))
+	for _, sig := range set.sigs {
+		if CanonicalName(sig.SignerName) != CanonicalName(z.name) || int(sig.Labels) > len(Labels(set.Name)) {
+			continue
+		}
+		if e := sig.ValidAt(now); e != nil {
+			code := EDE_SIGNATURE_EXPIRED
+			if e == ErrSignatureNotYetValid {
+				code = EDE_SIGNATURE_NOT_YET_VALID
+			}
+			err = bogus(uint16(code), "signature over %s %s: %v", fqdn(set.Name), TypeString(set.Type), e)
+			continue
+		}
+		for _, k := range z.keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if VerifyRRSIG(set.RRSet, sig, k) == nil {
+				return sig, nil
+			}
+			err = bogus(EDE_DNSSEC_BOGUS, "signature over %s %s does not verify", fqdn(set.Name), TypeString(set.Type))
+		}
+	}
+	return RRSIG{}, err
+}
+
+// Validate checks the response to a query sent with the DO bit. Every RRset
+// of the answer must verify, and an answer that is negative, or synthesized
+// from a wildcard, must come with signed NSEC or NSEC3 records proving what
+// does not exist. A bogus response is returned with a *ValidationError.
+// Responses with other rcodes than NOERROR and NXDOMAIN are insecure.
+func (v *Validator) Validate(m Message) (Security, error) {
+	if len(m.Question.Queries) == 0 || (m.RCode() != RCODE_NOERROR && m.RCode() != RCODE_NXDOMAIN) {
+		// Nothing that could be signed.
+		return SECURITY_INSECURE, nil
+	}
+	q := m.Question.Queries[0]
+	now := v.now()
+	result := SECURITY_SECURE
+	qname, answered := q.Name, false
+	sets := signedSets(m.Answer.Records)
+	for _, set := range sets {
+		if set.Type == TYPE_CNAME && len(set.sigs) == 0 && dnameSynthesized(set.Name, sets) {
+			// Synthesized from a DNAME, which is validated on its own.
+			continue
+		}
+		sec, err := v.validateSet(set, m.Authority.Records, now)
+		if sec == SECURITY_BOGUS {
+			return sec, err
+		}
+		result = worse(result, sec)
+		if CanonicalName(set.Name) != CanonicalName(qname) {
+			continue
+		}
+		if set.Type == q.Type || q.Type == TYPE_ANY {
+			answered = true
+		} else if c, ok := set.Records()[0].CNAME(); ok {
+			qname = c.Target
+		}
+	}
+	if answered {
+		return result, nil
+	}
+	sec, err := v.validateDenial(m.Authority.Records, qname, q.Type, m.RCode() == RCODE_NXDOMAIN, now)
+	return worse(result, sec), err
+}
+
+// worse returns the worse of two outcomes.
+func worse(a, b Security) Security {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// dnameSynthesized reports whether a DNAME among the sets covers the name
+// of a CNAME (RFC 6672 section 5.3.1).
+func dnameSynthesized(name string, sets []signedSet) bool {
+	for _, s := range sets {
+		if s.Type == TYPE_DNAME && CanonicalName(s.Name) != CanonicalName(name) && IsSubDomain(s.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSet validates an RRset of the answer. authority holds the proofs
+// for a set synthesized from a wildcard.
+func (v *Validator) validateSet(set signedSet, authority []Record, now time.Time) (Security, error) {
+	if len(set.sigs) == 0 {
+		switch _, t := v.zoneOf(set.Name); t.kind {
+		case trustInsecure:
+			return SECURITY_INSECURE, nil
+		case trustBogus:
+			return SECURITY_BOGUS, t.err
+		}
+		return SECURITY_BOGUS, bogus(EDE_RRSIGS_MISSING, "no signature over %s %s", fqdn(set.Name), TypeString(set.Type))
+	}
+	signer := set.sigs[0].SignerName
+	if !IsSubDomain(signer, set.Name) {
+		return SECURITY_BOGUS, bogus(EDE_DNSSEC_BOGUS, "%s signed %s, outside its zone", fqdn(signer), fqdn(set.Name))
+	}
+	z, t := v.zoneOf(signer)
+	switch t.kind {
+	case trustInsecure:
+		return SECURITY_INSECURE, nil
+	case trustBogus:
+		return SECURITY_BOGUS, t.err
+	}
+	if CanonicalName(z.name) != CanonicalName(signer) {
+		return SECURITY_BOGUS, bogus(EDE_DNSSEC_BOGUS, "signer %s is not a zone apex", fqdn(signer))
+	}
+	sig, err := z.verify(set, now)
+	if err != nil {
+		return SECURITY_BOGUS, err
+	}
+	labels := Labels(set.Name)
+	if int(sig.Labels) == len(labels) {
+		return SECURITY_SECURE, nil
+	}
+	// The set was expanded from a wildcard at the closest encloser, so the
+	// name itself must be proven not to exist (RFC 4035 section 5.3.4).
+	encloser := strings.Join(labels[len(labels)-int(sig.Labels):], ".")
+	nsecs, nsec3s, err := z.denials(authority, now)
+	if err != nil {
+		return SECURITY_BOGUS, err
+	}
+	for _, n := range nsecs {
+		if n.covers(set.Name) {
+			return SECURITY_SECURE, nil
+		}
+	}
+	next := strings.Join(labels[len(labels)-int(sig.Labels)-1:], ".")
+	for _, n := range nsec3s {
+		if n.Iterations > MaxNSEC3Iterations {
+			return SECURITY_INSECURE, nil
+		}
+		if n.covers(n.HashName(next)) {
+			return SECURITY_SECURE, nil
+		}
+	}
+	return SECURITY_BOGUS, bogus(EDE_NSEC_MISSING, "no proof that %s does not exist besides the wildcard at %s", fqdn(set.Name), fqdn(encloser))
+}
+
+// validateDenial checks that the authority section proves that qname does
+// not exist, or that it has no records of qtype (RFC 4035 section 5.4, RFC
+// 5155 section 8).
+func (v *Validator) validateDenial(authority []Record, qname string, qtype uint16, nxdomain bool, now time.Time) (Security, error) {
+	// The apex of the root zone is the empty name, so finding it is kept
+	// apart.
+	apex, found := "", false
+	for _, set := range signedSets(authority) {
+		switch {
+		case set.Type == TYPE_SOA:
+			apex, found = set.Name, true
+		case !found && (set.Type == TYPE_NSEC || set.Type == TYPE_NSEC3) && len(set.sigs) > 0:
+			apex, found = set.sigs[0].SignerName, true
+		}
+	}
+	if !found {
+		switch _, t := v.zoneOf(qname); t.kind {
+		case trustInsecure:
+			return SECURITY_INSECURE, nil
+		case trustBogus:
+			return SECURITY_BOGUS, t.err
+		}
+		return SECURITY_BOGUS, bogus(EDE_NSEC_MISSING, "no proof of the negative answer for %s", fqdn(qname))
+	}
+	z, t := v.zoneOf(apex)
+	switch t.kind {
+	case trustInsecure:
+		return SECURITY_INSECURE, nil
+	case trustBogus:
+		return SECURITY_BOGUS, t.err
+	}
+	if CanonicalName(z.name) != CanonicalName(apex) || !IsSubDomain(apex, qname) {
+		return SECURITY_BOGUS, bogus(EDE_DNSSEC_BOGUS, "negative answer for %s from %s, which is not its zone", fqdn(qname), fqdn(apex))
+	}
+	nsecs, nsec3s, err := z.denials(authority, now)
+	if err != nil {
+		return SECURITY_BOGUS, err
+	}
+	if len(nsecs) > 0 {
+		if nsecDenies(nsecs, qname, qtype, nxdomain) {
+			return SECURITY_SECURE, nil
+		}
+	} else if len(nsec3s) > 0 {
+		if nsec3s[0].Iterations > MaxNSEC3Iterations {
+			return SECURITY_INSECURE, nil
+		}
+		switch nsec3Denies(nsec3s, z.name, qname, qtype, nxdomain) {
+		case proofSecure:
+			return SECURITY_SECURE, nil
+		case proofOptOut:
+			return SECURITY_INSECURE, nil
+		}
+	}
+	return SECURITY_BOGUS, bogus(EDE_NSEC_MISSING, "no proof of the negative answer for %s %s", fqdn(qname), TypeString(qtype))
+}
+
+// denials verifies the SOA, NSEC, and NSEC3 sets among the records and
+// returns the NSEC and NSEC3 records.
+func (z signedZone) denials(records []Record, now time.Time) ([]nsecRecord, []nsec3Record, *ValidationError) {
+	var nsecs []nsecRecord
+	var nsec3s []nsec3Record
+	for _, set := range signedSets(records) {
+		if set.Type != TYPE_SOA && set.Type != TYPE_NSEC && set.Type != TYPE_NSEC3 {
+			continue
+		}
+		if _, err := z.verify(set, now); err != nil {
+			return nil, nil, err
+		}
+		for _, r := range set.Records() {
+			if n, ok := r.NSEC(); ok {
+				nsecs = append(nsecs, nsecRecord{owner: r.Name, NSEC: n})
+			}
+			if n, ok := r.NSEC3(); ok && n.HashAlgorithm == NSEC3_HASH_SHA1 {
+				label, parent, _ := strings.Cut(CanonicalName(r.Name), ".")
+				hash, err := nsec3Encoding.DecodeString(strings.ToUpper(label))
+				if err != nil || parent != CanonicalName(z.name) {
+					continue
+				}
+				nsec3s = append(nsec3s, nsec3Record{hash: hash, NSEC3: n})
+			}
+		}
+	}
+	return nsecs, nsec3s, nil
+}
+
+// nsecRecord is an NSEC record and its owner name.
+type nsecRecord struct {
+	owner string
+	NSEC
+}
+
+// covers reports whether the name sorts strictly between the owner and the
+// next name, where the last NSEC of a zone wraps around to the apex.
+func (n nsecRecord) covers(name string) bool {
+	if CompareNames(n.owner, n.NextName) < 0 {
+		return CompareNames(n.owner, name) < 0 && CompareNames(name, n.NextName) < 0
+	}
+	return CompareNames(n.owner, name) < 0
+}
+
+// encloser returns the closest encloser of a name that the NSEC covers: the
+// deepest ancestor of the name that the owner or the next name proves to
+// exist.
+func (n nsecRecord) encloser(name string) string {
+	ce := name
+	for !IsSubDomain(ce, n.owner) && !IsSubDomain(ce, n.NextName) {
+		parent, ok := Parent(ce)
+		if !ok {
+			break
+		}
+		ce = parent
+	}
+	return ce
+}
+
+// nsecDenies checks the NSEC proof of a negative answer.
+func nsecDenies(nsecs []nsecRecord, qname string, qtype uint16, nxdomain bool) bool {
+	nodata := func(types []uint16) bool {
+		return !HasType(types, qtype) && !HasType(types, TYPE_CNAME)
+	}
+	if !nxdomain {
+		for _, n := range nsecs {
+			if CanonicalName(n.owner) == CanonicalName(qname) {
+				return nodata(n.Types)
+			}
+			// An empty non-terminal has no NSEC of its own; the NSEC that
+			// covers it leads to a name below it.
+			if n.covers(qname) && CanonicalName(n.NextName) != CanonicalName(qname) && IsSubDomain(qname, n.NextName) {
+				return true
+			}
+		}
+	}
+	for _, n := range nsecs {
+		if !n.covers(qname) {
+			continue
+		}
+		wildcard := "*." + trimDot(n.encloser(qname))
+		for _, w := range nsecs {
+			if nxdomain && w.covers(wildcard) {
+				return true
+			}
+			// The name is covered but the wildcard that would match it
+			// exists, without the type.
+			if !nxdomain && CanonicalName(w.owner) == CanonicalName(wildcard) {
+				return nodata(w.Types)
+			}
+		}
+	}
+	return false
+}
+
+// nsec3Record is an NSEC3 record and the hash its owner name holds.
+type nsec3Record struct {
+	hash []byte
+	NSEC3
+}
+
+func (n nsec3Record) matches(hash []byte) bool {
+	return bytes.Equal(n.hash, hash)
+}
+
+// covers reports whether the hash sorts strictly between the hash of the
+// owner and the next one, where the last NSEC3 of a zone wraps around.
+func (n nsec3Record) covers(hash []byte) bool {
+	if bytes.Compare(n.hash, n.NextHash) < 0 {
+		return bytes.Compare(n.hash, hash) < 0 && bytes.Compare(hash, n.NextHash) < 0
+	}
+	return bytes.Compare(n.hash, hash) < 0 || bytes.Compare(hash, n.NextHash) < 0
+}
+
+type proofResult uint8
+
+const (
+	proofNone   proofResult = iota
+	proofSecure             // The proof holds
+	proofOptOut             // The name may be an unsigned delegation skipped by an opt-out NSEC3
+)
+
+// nsec3Match returns the NSEC3 record matching the name.
+func nsec3Match(nsec3s []nsec3Record, name string) (nsec3Record, bool) {
+	for _, n := range nsec3s {
+		if n.matches(n.HashName(name)) {
+			return n, true
+		}
+	}
+	return nsec3Record{}, false
+}
+
+// nsec3Cover returns the NSEC3 record covering the name.
+func nsec3Cover(nsec3s []nsec3Record, name string) (nsec3Record, bool) {
+	for _, n := range nsec3s {
+		if n.covers(n.HashName(name)) {
+			return n, true
+		}
+	}
+	return nsec3Record{}, false
+}
+
+// closestEncloser finds the closest encloser proof of a name in the zone:
+// an NSEC3 matching its deepest existing ancestor, and one covering the
+// next closer name below that (RFC 5155 section 8.3). It also returns the
+// covering record.
+func closestEncloser(nsec3s []nsec3Record, zone, name string) (string, nsec3Record, bool) {
+	next := name
+	for ce, ok := Parent(name); ok && IsSubDomain(zone, ce); ce, ok = Parent(ce) {
+		if _, ok := nsec3Match(nsec3s, ce); ok {
+			cover, ok := nsec3Cover(nsec3s, next)
+			return ce, cover, ok
+		}
+		next = ce
+	}
+	return "", nsec3Record{}, false
+}
+
+// nsec3Denies checks the NSEC3 proof of a negative answer.
+func nsec3Denies(nsec3s []nsec3Record, zone, qname string, qtype uint16, nxdomain bool) proofResult {
+	nodata := func(types []uint16) proofResult {
+		if HasType(types, qtype) || HasType(types, TYPE_CNAME) {
+			return proofNone
+		}
+		return proofSecure
+	}
+	if !nxdomain {
+		if n, ok := nsec3Match(nsec3s, qname); ok {
+			return nodata(n.Types)
+		}
+	}
+	ce, cover, ok := closestEncloser(nsec3s, zone, qname)
+	if !ok {
+		return proofNone
+	}
+	wildcard := "*." + trimDot(ce)
+	if nxdomain {
+		if _, ok := nsec3Cover(nsec3s, wildcard); ok {
+			return proofSecure
+		}
+		return proofNone
+	}
+	// Without an NSEC3 of its own, the name may be an unsigned delegation
+	// in an opt-out span (RFC 5155 section 8.6), or match a wildcard.
+	if cover.Flags&NSEC3_OPT_OUT != 0 && qtype == TYPE_DS {
+		return proofOptOut
+	}
+	if w, ok := nsec3Match(nsec3s, wildcard); ok {
+		return nodata(w.Types)
+	}
+	return proofNone
+}
+
+// zoneOf walks the chain of trust from the root down to the name, one label
+// at a time, and returns the deepest zone holding it along with what is
+// known of that zone.
+func (v *Validator) zoneOf(name string) (signedZone, zoneTrust) {
+	z := signedZone{}
+	t := v.trust("", func() zoneTrust { return v.zoneKeys("", v.anchors, uint32(maxTrustTTL/time.Second)) })
+	labels := Labels(name)
+	for i := len(labels) - 1; i >= 0 && t.kind == trustSecure; i-- {
+		z.keys = t.keys
+		child := strings.Join(labels[i:], ".")
+		parent := z
+		ct := v.trust(child, func() zoneTrust { return v.delegation(parent, child) })
+		if ct.kind != trustNone {
+			z.name, t = child, ct
+		}
+	}
+	z.keys = t.keys
+	return z, t
+}
+
+// trust returns what is known of the name, finding it out with find unless
+// it is remembered.
+func (v *Validator) trust(name string, find func() zoneTrust) zoneTrust {
+	key := CanonicalName(name)
+	now := time.Now()
+	v.mu.Lock()
+	t, ok := v.cuts[key]
+	v.mu.Unlock()
+	if ok && now.Before(t.expires) {
+		return t
+	}
+	t = find()
+	v.mu.Lock()
+	v.cuts[key] = t
+	v.mu.Unlock()
+	return t
+}
+
+// expiry returns when to forget a finding that holds for ttl seconds.
+func expiry(kind trustKind, ttl uint32) time.Time {
+	d := time.Duration(ttl) * time.Second
+	switch {
+	case kind == trustBogus:
+		d = badTrustTTL
+	case d > maxTrustTTL:
+		d = maxTrustTTL
+	}
+	return time.Now().Add(d)
+}
+
+func bogusTrust(err *ValidationError) zoneTrust {
+	return zoneTrust{kind: trustBogus, err: err, expires: expiry(trustBogus, 0)}
+}
+
+// delegation finds out whether the child of a secure zone is a zone cut, by
+// asking for its DS records: signed ones lead to the keys of a secure child
+// zone, while a proof that there are none either shows an unsigned
+// delegation or that the name is still in the parent zone.
+func (v *Validator) delegation(parent signedZone, child string) zoneTrust {
+	m, err := v.lookup(child, TYPE_DS)
+	if err != nil {
+		return bogusTrust(bogus(EDE_NETWORK_ERROR, "DS lookup of %s: %v", fqdn(child), err))
+	}
+	switch m.RCode() {
+	case RCODE_NXDOMAIN:
+		// Names below do not exist either, so whatever claims they do
+		// must be signed by the parent.
+		return zoneTrust{expires: expiry(trustNone, minTTL(m.Authority.Records))}
+	case RCODE_NOERROR:
+	default:
+		return bogusTrust(bogus(EDE_DNSSEC_BOGUS, "DS lookup of %s: %s", fqdn(child), m.RCode()))
+	}
+	now := v.now()
+	for _, set := range signedSets(m.Answer.Records) {
+		if CanonicalName(set.Name) != CanonicalName(child) {
+			continue
+		}
+		switch set.Type {
+		case TYPE_CNAME:
+			// An alias is never a zone cut.
+			return zoneTrust{expires: expiry(trustNone, set.TTL)}
+		case TYPE_DS:
+			if _, err := parent.verify(set, now); err != nil {
+				return bogusTrust(err)
+			}
+			var ds []DS
+			for _, r := range set.Records() {
+				if d, ok := r.DS(); ok {
+					ds = append(ds, d)
+				}
+			}
+			return v.zoneKeys(child, ds, set.TTL)
+		}
+	}
+	nsecs, nsec3s, verr := parent.denials(m.Authority.Records, now)
+	if verr != nil {
+		return bogusTrust(verr)
+	}
+	ttl := minTTL(m.Authority.Records)
+	for _, n := range nsecs {
+		if CanonicalName(n.owner) == CanonicalName(child) {
+			return nsecCut(n.Types, ttl, child)
+		}
+	}
+	for _, n := range nsecs {
+		if n.covers(child) {
+			return zoneTrust{expires: expiry(trustNone, ttl)}
+		}
+	}
+	if len(nsec3s) > 0 {
+		if nsec3s[0].Iterations > MaxNSEC3Iterations {
+			return zoneTrust{kind: trustInsecure, expires: expiry(trustInsecure, ttl)}
+		}
+		if n, ok := nsec3Match(nsec3s, child); ok {
+			return nsecCut(n.Types, ttl, child)
+		}
+		if _, cover, ok := closestEncloser(nsec3s, parent.name, child); ok {
+			if cover.Flags&NSEC3_OPT_OUT != 0 {
+				return zoneTrust{kind: trustInsecure, expires: expiry(trustInsecure, ttl)}
+			}
+			return zoneTrust{expires: expiry(trustNone, ttl)}
+		}
+	}
+	return bogusTrust(bogus(EDE_NSEC_MISSING, "no proof that %s has no DS records", fqdn(child)))
+}
+
+// nsecCut interprets the types of the NSEC or NSEC3 record of a name that
+// has no DS records: with NS, it is an unsigned delegation.
+func nsecCut(types []uint16, ttl uint32, child string) zoneTrust {
+	switch {
+	case HasType(types, TYPE_DS):
+		return bogusTrust(bogus(EDE_DNSSEC_BOGUS, "DS records of %s are both denied and claimed", fqdn(child)))
+	case HasType(types, TYPE_NS) && !HasType(types, TYPE_SOA):
+		return zoneTrust{kind: trustInsecure, expires: expiry(trustInsecure, ttl)}
+	}
+	return zoneTrust{expires: expiry(trustNone, ttl)}
+}
+
+// zoneKeys fetches the DNSKEY set of the zone, and validates it against the
+// DS records, which are either trust anchors or validated in the parent
+// zone. A zone whose DS records all use algorithms or digests that are not
+// supported is insecure (RFC 4035 section 5.2).
+func (v *Validator) zoneKeys(zone string, ds []DS, ttl uint32) zoneTrust {
+	var usable []DS
+	for _, d := range ds {
+		if SupportedAlgorithm(d.Algorithm) && SupportedDigest(d.DigestType) {
+			usable = append(usable, d)
+		}
+	}
+	if len(usable) == 0 {
+		return zoneTrust{kind: trustInsecure, expires: expiry(trustInsecure, ttl)}
+	}
+	m, err := v.lookup(zone, TYPE_DNSKEY)
+	if err != nil {
+		return bogusTrust(bogus(EDE_NETWORK_ERROR, "DNSKEY lookup of %s: %v", fqdn(zone), err))
+	}
+	var set *signedSet
+	for _, s := range signedSets(m.Answer.Records) {
+		if s.Type == TYPE_DNSKEY && CanonicalName(s.Name) == CanonicalName(zone) {
+			set = &s
+			break
+		}
+	}
+	if set == nil {
+		return bogusTrust(bogus(EDE_DNSKEY_MISSING, "no DNSKEY records for %s", fqdn(zone)))
+	}
+	var keys, entry []DNSKEY
+	for _, r := range set.Records() {
+		k, ok := r.DNSKEY()
+		if !ok || k.Flags&DNSKEY_ZONE == 0 || k.Flags&DNSKEY_REVOKE != 0 {
+			continue
+		}
+		keys = append(keys, k)
+		for _, d := range usable {
+			if d.Matches(zone, k) {
+				entry = append(entry, k)
+				break
+			}
+		}
+	}
+	if len(entry) == 0 {
+		return bogusTrust(bogus(EDE_DNSKEY_MISSING, "no DNSKEY of %s matches its DS records", fqdn(zone)))
+	}
+	if _, err := (signedZone{name: zone, keys: entry}).verify(*set, v.now()); err != nil {
+		return bogusTrust(err)
+	}
+	if set.TTL < ttl {
+		ttl = set.TTL
+	}
+	return zoneTrust{kind: trustSecure, keys: keys, expires: expiry(trustSecure, ttl)}
+}
+
+// minTTL returns the lowest TTL of the records, or 0 if there are none.
+func minTTL(records []Record) uint32 {
+	var ttl uint32
+	for i, r := range records {
+		if i == 0 || r.TTL < ttl {
+			ttl = r.TTL
+		}
+	}
+	return ttl
+}
+
+// RemoveDNSSEC removes the RRSIG, NSEC, and NSEC3 records that a response
+// carries only for requestors that set the DO bit, unless the question asks
+// for their type (RFC 4035 section 3.2.1).
+func (m *Message) RemoveDNSSEC() {
+	var qtype uint16
+	if len(m.Question.Queries) > 0 {
+		qtype = m.Question.Queries[0].Type
+	}
+	keep := func(records []Record, asked bool) []Record {
+		out := records[:0:0]
+		for _, r := range records {
+			switch r.Type {
+			case TYPE_RRSIG, TYPE_NSEC, TYPE_NSEC3:
+				if !asked || r.Type != qtype {
+					continue
+				}
+			}
+			out = append(out, r)
+		}
+		return out
+	}
+	m.Answer.Records = keep(m.Answer.Records, true)
+	m.Authority.Records = keep(m.Authority.Records, false)
+	m.Additional.Records = keep(m.Additional.Records, false)
+	m.Header.ANCOUNT = uint16(len(m.Answer.Records))
+	m.Header.NSCOUNT = uint16(len(m.Authority.Records))
+	m.Header.ARCOUNT = uint16(len(m.Additional.Records))
+}
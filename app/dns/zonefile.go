@@ -0,0 +1,560 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultZoneTTL is the TTL of zone file records when neither the record
+// nor a $TTL directive gives one.
+const DefaultZoneTTL = 3600
+
+// zoneToken is a word of a zone file entry.
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// zoneEntry is a logical line of a zone file, with parentheses joined.
+type zoneEntry struct {
+	line       int  // Line the entry starts on
+	blankOwner bool // The entry starts with whitespace and reuses the owner
+	tokens     []zoneToken
+}
+
+// ParseZone reads records in the master file format (RFC 1035 section 5).
+// Relative names are completed with origin, which $ORIGIN directives
+// change. Names are returned without the trailing dot.
+func ParseZone(r io.Reader, origin string) ([]Record, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := splitZoneEntries(string(b))
+	if err != nil {
+		return nil, err
+	}
+	origin = strings.Trim(origin, ".")
+	var (
+		records    []Record
+		owner      string
+		defaultTTL uint32 = DefaultZoneTTL
+		haveTTL    bool
+		lastTTL    uint32
+	)
+	for _, e := range entries {
+		tokens := e.tokens
+		fail := func(format string, a ...interface{}) error {
+			return fmt.Errorf("dns: zone line %d: %s", e.line, fmt.Sprintf(format, a...))
+		}
+		if first := tokens[0].text; !tokens[0].quoted && strings.HasPrefix(first, "$") {
+			switch strings.ToUpper(first) {
+			case "$ORIGIN":
+				if len(tokens) != 2 {
+					return nil, fail("$ORIGIN takes one name")
+				}
+				origin = absoluteName(tokens[1].text, origin)
+			case "$TTL":
+				if len(tokens) != 2 {
+					return nil, fail("$TTL takes one value")
+				}
+				ttl, err := parseTTL(tokens[1].text)
+				if err != nil {
+					return nil, fail("%v", err)
+				}
+				defaultTTL, haveTTL = ttl, true
+			default:
+				return nil, fail("unsupported directive %s", first)
+			}
+			continue
+		}
+
+		if !e.blankOwner {
+			owner = absoluteName(tokens[0].text, origin)
+			tokens = tokens[1:]
+		} else if owner == "" && origin == "" {
+			return nil, fail("no owner name")
+		} else if owner == "" {
+			owner = origin
+		}
+
+		ttl, explicitTTL := defaultTTL, false
+		if !haveTTL && lastTTL != 0 {
+			ttl = lastTTL
+		}
+		rtype := uint16(0)
+		for len(tokens) > 0 && rtype == 0 {
+			word := tokens[0].text
+			tokens = tokens[1:]
+			if t, err := parseTTL(word); err == nil {
+				ttl, explicitTTL = t, true
+				continue
+			}
+			if strings.EqualFold(word, "IN") {
+				continue
+			}
+			t, ok := ParseType(word)
+			if !ok {
+				return nil, fail("unknown type or class %s", word)
+			}
+			rtype = t
+		}
+		if rtype == 0 {
+			return nil, fail("missing type")
+		}
+		if explicitTTL {
+			lastTTL = ttl
+		}
+		d, err := parseRData(rtype, tokens, origin)
+		if err != nil {
+			return nil, fail("%s: %v", TypeString(rtype), err)
+		}
+		records = append(records, NewRecord(owner, CLASS_IN, ttl, d))
+	}
+	return records, nil
+}
+
+// parseRData parses the presentation format of the data of a record.
+func parseRData(t uint16, tokens []zoneToken, origin string) (RData, error) {
+	words := make([]string, len(tokens))
+	for i, tok := range tokens {
+		words[i] = tok.text
+	}
+	if len(tokens) > 0 && !tokens[0].quoted && words[0] == `\#` {
+		return parseGenericRData(t, words[1:])
+	}
+	switch t {
+	case TYPE_A:
+		if len(words) != 1 {
+			return nil, errors.New("want an address")
+		}
+		ip := net.ParseIP(words[0]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %s", words[0])
+		}
+		return A{Addr: ip}, nil
+	case TYPE_AAAA:
+		if len(words) != 1 {
+			return nil, errors.New("want an address")
+		}
+		ip := net.ParseIP(words[0])
+		if ip == nil || !strings.Contains(words[0], ":") {
+			return nil, fmt.Errorf("invalid IPv6 address %s", words[0])
+		}
+		return AAAA{Addr: ip}, nil
+	case TYPE_CNAME, TYPE_PTR, TYPE_NS:
+		if len(words) != 1 {
+			return nil, errors.New("want a target name")
+		}
+		switch t {
+		case TYPE_PTR:
+			return PTR{Target: absoluteName(words[0], origin)}, nil
+		case TYPE_NS:
+			return NS{Host: absoluteName(words[0], origin)}, nil
+		}
+		return CNAME{Target: absoluteName(words[0], origin)}, nil
+	case TYPE_TXT:
+		if len(tokens) == 0 {
+			return nil, errors.New("want at least one string")
+		}
+		var txt TXT
+		for _, tok := range tokens {
+			s, err := unescapeZoneString(tok.text)
+			if err != nil {
+				return nil, err
+			}
+			txt.Strings = append(txt.Strings, s)
+		}
+		return txt, nil
+	case TYPE_SRV:
+		if len(words) != 4 {
+			return nil, errors.New("want priority, weight, port, and target")
+		}
+		var v [3]uint16
+		for i := range v {
+			n, err := strconv.ParseUint(words[i], 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = uint16(n)
+		}
+		return SRV{Priority: v[0], Weight: v[1], Port: v[2], Target: absoluteName(words[3], origin)}, nil
+	case TYPE_SVCB, TYPE_HTTPS:
+		return parseSVCB(t, tokens, origin)
+	case TYPE_SOA:
+		if len(words) != 7 {
+			return nil, errors.New("want mname, rname, serial, refresh, retry, expire, and minimum")
+		}
+		serial, err := strconv.ParseUint(words[2], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		// The timers accept the same units as TTLs.
+		var v [4]uint32
+		for i := range v {
+			if v[i], err = parseTTL(words[3+i]); err != nil {
+				return nil, err
+			}
+		}
+		return SOA{
+			MName:   absoluteName(words[0], origin),
+			RName:   absoluteName(words[1], origin),
+			Serial:  uint32(serial),
+			Refresh: v[0],
+			Retry:   v[1],
+			Expire:  v[2],
+			Minimum: v[3],
+		}, nil
+	case TYPE_DNSKEY:
+		if len(words) < 4 {
+			return nil, errors.New("want flags, protocol, algorithm, and key")
+		}
+		var v [3]uint64
+		for i, bits := range []int{16, 8, 8} {
+			n, err := strconv.ParseUint(words[i], 10, bits)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = n
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.Join(words[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %v", err)
+		}
+		return DNSKEY{Flags: uint16(v[0]), Protocol: uint8(v[1]), Algorithm: uint8(v[2]), PublicKey: key}, nil
+	case TYPE_DS:
+		if len(words) < 4 {
+			return nil, errors.New("want key tag, algorithm, digest type, and digest")
+		}
+		var v [3]uint64
+		for i, bits := range []int{16, 8, 8} {
+			n, err := strconv.ParseUint(words[i], 10, bits)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = n
+		}
+		digest, err := hex.DecodeString(strings.Join(words[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest: %v", err)
+		}
+		return DS{KeyTag: uint16(v[0]), Algorithm: uint8(v[1]), DigestType: uint8(v[2]), Digest: digest}, nil
+	}
+	return nil, errors.New("type not supported in zone files")
+}
+
+// parseSVCB parses the data of an SVCB or HTTPS record: the priority, the
+// target, and the parameters as key=value words (RFC 9460 section 2.1).
+func parseSVCB(t uint16, tokens []zoneToken, origin string) (RData, error) {
+	if len(tokens) < 2 {
+		return nil, errors.New("want priority and target")
+	}
+	priority, err := strconv.ParseUint(tokens[0].text, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	s := SVCB{HTTPS: t == TYPE_HTTPS, Priority: uint16(priority), Target: absoluteName(tokens[1].text, origin)}
+	seen := make(map[uint16]bool)
+	for i := 2; i < len(tokens); i++ {
+		name, value, hasValue := strings.Cut(tokens[i].text, "=")
+		// A quoted value is a token of its own: key="value".
+		if hasValue && value == "" && i+1 < len(tokens) && tokens[i+1].quoted {
+			i++
+			value = tokens[i].text
+		}
+		if value, err = unescapeZoneString(value); err != nil {
+			return nil, err
+		}
+		key, ok := parseSvcParamKey(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown parameter %s", name)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate parameter %s", name)
+		}
+		seen[key] = true
+		if hasValue == (key == SVCPARAM_NO_DEFAULT_ALPN) {
+			return nil, fmt.Errorf("parameter %s: missing or unexpected value", name)
+		}
+		if err := s.parseParam(key, value); err != nil {
+			return nil, fmt.Errorf("parameter %s: %v", name, err)
+		}
+	}
+	return s, nil
+}
+
+// parseParam sets a parameter from its presentation format value.
+func (s *SVCB) parseParam(key uint16, value string) error {
+	list := strings.Split(value, ",")
+	switch key {
+	case SVCPARAM_MANDATORY:
+		for _, name := range list {
+			k, ok := parseSvcParamKey(name)
+			if !ok {
+				return fmt.Errorf("unknown key %s", name)
+			}
+			s.Mandatory = append(s.Mandatory, k)
+		}
+	case SVCPARAM_ALPN:
+		for _, id := range list {
+			if id == "" || len(id) > maxCharacterString {
+				return fmt.Errorf("invalid protocol ID %q", id)
+			}
+		}
+		s.ALPN = list
+	case SVCPARAM_NO_DEFAULT_ALPN:
+		s.NoDefaultALPN = true
+	case SVCPARAM_PORT:
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return err
+		}
+		s.Port = uint16(port)
+	case SVCPARAM_IPV4HINT:
+		for _, addr := range list {
+			ip := net.ParseIP(addr).To4()
+			if ip == nil {
+				return fmt.Errorf("invalid IPv4 address %s", addr)
+			}
+			s.IPv4Hint = append(s.IPv4Hint, ip)
+		}
+	case SVCPARAM_IPV6HINT:
+		for _, addr := range list {
+			ip := net.ParseIP(addr)
+			if ip == nil || !strings.Contains(addr, ":") {
+				return fmt.Errorf("invalid IPv6 address %s", addr)
+			}
+			s.IPv6Hint = append(s.IPv6Hint, ip)
+		}
+	case SVCPARAM_ECH:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		s.Other = append(s.Other, SvcParam{Key: key, Value: b})
+	default:
+		s.Other = append(s.Other, SvcParam{Key: key, Value: []byte(value)})
+	}
+	return nil
+}
+
+// parseGenericRData parses data in the \# format of RFC 3597 section 5: its
+// length followed by the data in hex, which may be split into several words.
+func parseGenericRData(t uint16, words []string) (RData, error) {
+	if len(words) == 0 {
+		return nil, errors.New("want a data length")
+	}
+	n, err := strconv.ParseUint(words[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data length %s", words[0])
+	}
+	data, err := hex.DecodeString(strings.Join(words[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex data: %v", err)
+	}
+	if len(data) != int(n) {
+		return nil, fmt.Errorf("data is %d bytes long, want %d", len(data), n)
+	}
+	return Unknown{RRType: t, Data: data}, nil
+}
+
+// splitZoneEntries tokenizes a zone file into entries, dropping comments and
+// joining lines enclosed in parentheses.
+func splitZoneEntries(s string) ([]zoneEntry, error) {
+	var (
+		entries []zoneEntry
+		cur     = zoneEntry{line: 1}
+		word    strings.Builder
+		inWord  bool
+		quoted  bool
+		depth   int
+		line    = 1
+		atStart = true
+	)
+	endWord := func() {
+		if inWord {
+			cur.tokens = append(cur.tokens, zoneToken{text: word.String(), quoted: quoted})
+			word.Reset()
+			inWord, quoted = false, false
+		}
+	}
+	endEntry := func() {
+		endWord()
+		if len(cur.tokens) > 0 {
+			entries = append(entries, cur)
+		}
+		cur = zoneEntry{line: line}
+		atStart = true
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quoted {
+			switch c {
+			case '"':
+				endWord()
+			case '\\':
+				word.WriteByte(c)
+				if i+1 < len(s) {
+					i++
+					word.WriteByte(s[i])
+				}
+			case '\n':
+				return nil, fmt.Errorf("dns: zone line %d: unterminated string", line)
+			default:
+				word.WriteByte(c)
+			}
+			continue
+		}
+		switch c {
+		case ';':
+			for i+1 < len(s) && s[i+1] != '\n' {
+				i++
+			}
+		case '\n':
+			line++
+			if depth == 0 {
+				endEntry()
+			} else {
+				endWord()
+			}
+		case ' ', '\t', '\r':
+			if atStart && len(cur.tokens) == 0 && !inWord && depth == 0 {
+				cur.blankOwner = true
+			}
+			endWord()
+		case '(':
+			endWord()
+			depth++
+		case ')':
+			endWord()
+			if depth == 0 {
+				return nil, fmt.Errorf("dns: zone line %d: unbalanced parenthesis", line)
+			}
+			depth--
+		case '"':
+			endWord()
+			inWord, quoted = true, true
+		case '\\':
+			inWord = true
+			word.WriteByte(c)
+			if i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			atStart = false
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("dns: zone file ends inside parentheses")
+	}
+	endEntry()
+	return entries, nil
+}
+
+// unescapeZoneString resolves \X and \DDD escapes of a character-string.
+func unescapeZoneString(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			if n > 255 {
+				return "", fmt.Errorf("invalid escape \\%s", s[i+1:i+4])
+			}
+			b.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		if i+1 < len(s) {
+			i++
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// absoluteName completes a relative name with the origin. "@" stands for the
+// origin itself.
+func absoluteName(name, origin string) string {
+	if name == "@" {
+		return origin
+	}
+	if IsFQDN(name) {
+		return trimDot(name)
+	}
+	if origin == "" {
+		return name
+	}
+	return name + "." + origin
+}
+
+// parseTTL parses a TTL in seconds, or with BIND style unit suffixes such as
+// 1h30m.
+func parseTTL(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	if s == "" {
+		return 0, errors.New("empty TTL")
+	}
+	var total, n uint64
+	digits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			n = n*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, fmt.Errorf("invalid TTL %s", s)
+		}
+		switch c | 0x20 {
+		case 's':
+		case 'm':
+			n *= 60
+		case 'h':
+			n *= 60 * 60
+		case 'd':
+			n *= 24 * 60 * 60
+		case 'w':
+			n *= 7 * 24 * 60 * 60
+		default:
+			return 0, fmt.Errorf("invalid TTL %s", s)
+		}
+		total += n
+		n, digits = 0, false
+	}
+	// Trailing digits without a unit are seconds.
+	total += n
+	if total > 1<<31-1 {
+		return 0, fmt.Errorf("invalid TTL %s", s)
+	}
+	return uint32(total), nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// DNS64 (RFC 6147) lets hosts on IPv6-only networks reach IPv4-only
+// services through a NAT64 gateway: names without AAAA records get
+// addresses synthesized from their A records under the NAT64 prefix.
+
+const (
+	// ipv4onlyName has only the A records ipv4onlyAddrs, so the AAAA
+	// records a DNS64 resolver answers for it reveal its prefix (RFC 7050).
+	ipv4onlyName            = "ipv4only.arpa"
+	nat64DiscoveryRetry     = time.Minute
+	nat64DiscoveryMinPeriod = time.Minute
+	nat64DiscoveryMaxPeriod = 24 * time.Hour
+)
+
+var ipv4onlyAddrs = []net.IP{net.IPv4(192, 0, 0, 170).To4(), net.IPv4(192, 0, 0, 171).To4()}
+
+// nat64PrefixLens are the prefix lengths defined by RFC 6052 section 2.2.
+var nat64PrefixLens = []int{96, 64, 56, 48, 40, 32}
+
+// parseNAT64Prefix parses a NAT64 prefix in CIDR notation.
+func parseNAT64Prefix(s string) (*net.IPNet, error) {
+	ip, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("%s is not an IPv6 prefix", s)
+	}
+	ones, _ := prefix.Mask.Size()
+	for _, n := range nat64PrefixLens {
+		if ones == n {
+			return prefix, nil
+		}
+	}
+	return nil, fmt.Errorf("prefix length of %s must be 32, 40, 48, 56, 64, or 96", s)
+}
+
+// embedIPv4 returns the IPv6 address of v4 under prefix (RFC 6052 section
+// 2.2). Bits 64 to 71 are left zero.
+func embedIPv4(prefix *net.IPNet, v4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:ones/8])
+	j := ones / 8
+	for _, b := range v4.To4() {
+		if j == 8 {
+			j++
+		}
+		ip[j] = b
+		j++
+	}
+	return ip
+}
+
+// extractIPv4 returns the IPv4 address embedded in ip with a prefix of ones
+// bits.
+func extractIPv4(ip net.IP, ones int) net.IP {
+	v4 := make(net.IP, net.IPv4len)
+	j := ones / 8
+	for i := range v4 {
+		if j == 8 {
+			j++
+		}
+		v4[i] = ip[j]
+		j++
+	}
+	return v4
+}
+
+// dns64 synthesizes AAAA records under a NAT64 prefix, which may be
+// discovered from the network.
+type dns64 struct {
+	mu     sync.RWMutex
+	prefix *net.IPNet // Nil until discovered
+}
+
+func (d *dns64) currentPrefix() *net.IPNet {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.prefix
+}
+
+// discoverNAT64Prefix looks up ipv4only.arpa through h, which must not
+// synthesize AAAA records itself, and returns the NAT64 prefix of the
+// network and how long it is valid.
+func discoverNAT64Prefix(h dns.Handler) (*net.IPNet, time.Duration, error) {
+	req := dns.NewQuery(ipv4onlyName, dns.TYPE_AAAA).Message()
+	w := &probeWriter{addr: &net.UDPAddr{IP: net.IPv6loopback, Port: 53}}
+	h.ServeDNS(w, &req)
+	if !w.written {
+		return nil, 0, errors.New("no response for " + ipv4onlyName)
+	}
+	if rcode := w.msg.Header.RCode(); rcode != dns.RCODE_NOERROR {
+		return nil, 0, fmt.Errorf("%s answered %s", ipv4onlyName, rcode)
+	}
+	for _, rr := range w.msg.Answer.Records {
+		a, ok := rr.AAAA()
+		if !ok {
+			continue
+		}
+		for _, ones := range nat64PrefixLens {
+			v4 := extractIPv4(a.Addr, ones)
+			for _, known := range ipv4onlyAddrs {
+				if v4.Equal(known) {
+					prefix := &net.IPNet{IP: a.Addr.Mask(net.CIDRMask(ones, 128)), Mask: net.CIDRMask(ones, 128)}
+					return prefix, time.Duration(rr.TTL) * time.Second, nil
+				}
+			}
+		}
+	}
+	return nil, 0, errors.New("the resolvers do not synthesize AAAA records, no NAT64 prefix found")
+}
+
+// runDiscovery keeps the prefix current by looking it up again when its
+// TTL expires, or sooner after a failure, until stop is closed.
+func (d *dns64) runDiscovery(h dns.Handler, stop <-chan struct{}) {
+	for {
+		prefix, ttl, err := discoverNAT64Prefix(h)
+		wait := nat64DiscoveryRetry
+		if err != nil {
+			slog.Warn("Failed to discover NAT64 prefix", "err", err)
+		} else {
+			d.mu.Lock()
+			changed := d.prefix == nil || d.prefix.String() != prefix.String()
+			d.prefix = prefix
+			d.mu.Unlock()
+			if changed {
+				slog.Info("Discovered NAT64 prefix", "prefix", prefix.String())
+			}
+			wait = ttl
+			if wait < nat64DiscoveryMinPeriod {
+				wait = nat64DiscoveryMinPeriod
+			} else if wait > nat64DiscoveryMaxPeriod {
+				wait = nat64DiscoveryMaxPeriod
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// middleware answers AAAA queries for names without usable AAAA records
+// with records synthesized from their A records, keeping the aliases that
+// lead to them.
+func (d *dns64) middleware(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Message) {
+		prefix := d.currentPrefix()
+		if prefix == nil || len(r.Question.Queries) != 1 ||
+			r.Question.Queries[0].Type != dns.TYPE_AAAA || r.Question.Queries[0].Class != dns.CLASS_IN {
+			next.ServeDNS(w, r)
+			return
+		}
+		cw := &captureWriter{ResponseWriter: w}
+		next.ServeDNS(cw, r)
+		if !cw.written {
+			return
+		}
+		res := cw.msg
+		// Only a name that exists without AAAA records is synthesized, and
+		// IPv4-mapped addresses do not count (RFC 6147 section 5.1.4).
+		if res.Header.RCode() != dns.RCODE_NOERROR || hasUsableAAAA(res.Answer.Records) {
+			w.WriteMsg(res)
+			return
+		}
+		sub := *r
+		sub.Question.Queries = []dns.Query{{Name: r.Question.Queries[0].Name, Type: dns.TYPE_A, Class: dns.CLASS_IN}}
+		aw := &captureWriter{ResponseWriter: w}
+		next.ServeDNS(aw, &sub)
+		if !aw.written || aw.msg.Header.RCode() != dns.RCODE_NOERROR {
+			w.WriteMsg(res)
+			return
+		}
+		var answer []dns.Record
+		synthesized := 0
+		for _, rr := range aw.msg.Answer.Records {
+			if a, ok := rr.A(); ok {
+				aaaa := dns.NewRecord(rr.Name, rr.Class, rr.TTL, dns.AAAA{Addr: embedIPv4(prefix, a.Addr)})
+				aaaa.Origin = originDNS64
+				if rr.Origin != "" {
+					aaaa.Origin += " from an A record (" + rr.Origin + ")"
+				}
+				answer = append(answer, aaaa)
+				synthesized++
+			} else if rr.Type == dns.TYPE_CNAME {
+				answer = append(answer, rr)
+			}
+		}
+		if synthesized == 0 {
+			w.WriteMsg(res)
+			return
+		}
+		metrics.inc("queries_dns64_synthesized_total")
+		res.Answer.Records = answer
+		res.Authority.Records = nil
+		res.Header.ANCOUNT = uint16(len(answer))
+		res.Header.NSCOUNT = 0
+		w.WriteMsg(res)
+	})
+}
+
+// hasUsableAAAA reports whether records hold an AAAA record that is not an
+// IPv4-mapped address.
+func hasUsableAAAA(records []dns.Record) bool {
+	for _, rr := range records {
+		if a, ok := rr.AAAA(); ok && a.Addr.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
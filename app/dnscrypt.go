@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// DNSCrypt version 2 (https://dnscrypt.info/protocol): queries are
+// encrypted to a short-term key of the resolver, published in a certificate
+// that is signed with the long-term key of the provider and fetched with a
+// plain TXT query for the provider name.
+
+const (
+	dnscryptCertLen      = 124 // Certificate without extensions
+	dnscryptMinQueryLen  = 256 // Padded length of UDP queries, which bounds the response size
+	dnscryptPadBlock     = 64
+	dnscryptCertRefresh  = time.Hour // Fetch the certificate again after this long
+	dnscryptESXSalsa20   = 1         // es-version of X25519-XSalsa20Poly1305
+	dnscryptClientNonce  = 12
+	dnscryptDefaultPort  = "443"
+	dnscryptResponseHead = 8 + boxNonceLen // Resolver magic and nonce
+)
+
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+
+	errInvalidDNSCryptResponse = errors.New("invalid DNSCrypt response")
+)
+
+// dnscryptUpstream is how a DNSCrypt resolver is configured: its provider
+// name, the provider public key in hex, and the resolver address, as in
+// dnscrypt://<key>@<host>[:port]/<provider name>.
+type dnscryptUpstream struct {
+	host        string
+	port        string
+	provider    string
+	providerKey ed25519.PublicKey
+}
+
+func parseDNSCryptAddress(address string) (dnscryptUpstream, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return dnscryptUpstream{}, err
+	}
+	if u.User == nil {
+		return dnscryptUpstream{}, errors.New("DNSCrypt resolver needs the provider public key, as dnscrypt://<key>@<host>[:port]/<provider name>")
+	}
+	key, err := hex.DecodeString(strings.ReplaceAll(u.User.Username(), ":", ""))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return dnscryptUpstream{}, fmt.Errorf("invalid DNSCrypt provider public key %q", u.User.Username())
+	}
+	d := dnscryptUpstream{host: u.Hostname(), port: u.Port(), provider: strings.Trim(u.Path, "/"), providerKey: key}
+	if d.port == "" {
+		d.port = dnscryptDefaultPort
+	}
+	if d.provider == "" {
+		return dnscryptUpstream{}, errors.New("DNSCrypt resolver needs a provider name, as dnscrypt://<key>@<host>[:port]/<provider name>")
+	}
+	return d, nil
+}
+
+// dnscryptCert is the part of a resolver certificate used by clients.
+type dnscryptCert struct {
+	resolverKey []byte // X25519 public key
+	clientMagic []byte // First 8 bytes of queries encrypted to resolverKey
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+}
+
+// parseDNSCryptCert parses a certificate and verifies its signature by the
+// provider.
+func parseDNSCryptCert(b []byte, providerKey ed25519.PublicKey) (dnscryptCert, uint16, error) {
+	if len(b) < dnscryptCertLen || !bytes.Equal(b[:4], dnscryptCertMagic) {
+		return dnscryptCert{}, 0, errors.New("not a DNSCrypt certificate")
+	}
+	esVersion := binary.BigEndian.Uint16(b[4:])
+	signature, signed := b[8:72], b[72:]
+	if !ed25519.Verify(providerKey, signed, signature) {
+		return dnscryptCert{}, 0, errors.New("DNSCrypt certificate signature does not match the provider key")
+	}
+	return dnscryptCert{
+		resolverKey: signed[:32],
+		clientMagic: signed[32:40],
+		serial:      binary.BigEndian.Uint32(signed[40:]),
+		notBefore:   time.Unix(int64(binary.BigEndian.Uint32(signed[44:])), 0),
+		notAfter:    time.Unix(int64(binary.BigEndian.Uint32(signed[48:])), 0),
+	}, esVersion, nil
+}
+
+// dnscryptClient exchanges queries with a DNSCrypt resolver at one address.
+type dnscryptClient struct {
+	addr     string
+	upstream dnscryptUpstream
+
+	mu      sync.Mutex
+	cert    *dnscryptCert
+	fetched time.Time
+}
+
+func newDNSCryptClient(addr string, upstream dnscryptUpstream) *dnscryptClient {
+	return &dnscryptClient{addr: addr, upstream: upstream}
+}
+
+// certificate returns the current certificate of the resolver, fetching it
+// when none is known, it expired, or it was fetched long ago.
+func (c *dnscryptClient) certificate(ctx context.Context) (*dnscryptCert, error) {
+	c.mu.Lock()
+	cert, fetched := c.cert, c.fetched
+	c.mu.Unlock()
+	now := time.Now()
+	if cert != nil && now.Before(cert.notAfter) && now.Sub(fetched) < dnscryptCertRefresh {
+		return cert, nil
+	}
+	fresh, err := c.fetchCertificate(ctx, now)
+	if err != nil {
+		if cert != nil && now.Before(cert.notAfter) {
+			slog.Warn("Failed to refresh DNSCrypt certificate, keeping the current one", "resolver", c.addr, "err", err)
+			return cert, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.cert, c.fetched = fresh, now
+	c.mu.Unlock()
+	if cert == nil || cert.serial != fresh.serial {
+		slog.Info("Using DNSCrypt certificate", "resolver", c.addr, "provider", c.upstream.provider, "serial", fresh.serial, "expires", fresh.notAfter)
+	}
+	return fresh, nil
+}
+
+// fetchCertificate asks the resolver for its certificates with a TXT query
+// for the provider name and returns the valid one with the highest serial.
+func (c *dnscryptClient) fetchCertificate(ctx context.Context, now time.Time) (*dnscryptCert, error) {
+	req := dns.NewQuery(c.upstream.provider, dns.TYPE_TXT).WithEDNS(dns.DefaultUDPSize).Message()
+	client := &dns.Client{Rand: rng}
+	if deadline, ok := ctx.Deadline(); ok {
+		client.Timeout = time.Until(deadline)
+	}
+	res, err := client.Exchange(ctx, req, c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("fetching DNSCrypt certificate: %w", err)
+	}
+	var (
+		best    *dnscryptCert
+		lastErr = errors.New("no DNSCrypt certificate in the response")
+	)
+	for _, rr := range res.Answer.Records {
+		txt, ok := rr.TXT()
+		if !ok {
+			continue
+		}
+		cert, esVersion, err := parseDNSCryptCert([]byte(txt.Text()), c.upstream.providerKey)
+		switch {
+		case err != nil:
+			lastErr = err
+		case esVersion != dnscryptESXSalsa20:
+			lastErr = fmt.Errorf("unsupported DNSCrypt encryption system %d", esVersion)
+		case now.Before(cert.notBefore) || !now.Before(cert.notAfter):
+			lastErr = errors.New("DNSCrypt certificate is not valid now")
+		case best == nil || cert.serial > best.serial:
+			cert := cert
+			best = &cert
+		}
+	}
+	if best == nil {
+		return nil, lastErr
+	}
+	return best, nil
+}
+
+// exchange encrypts msg to the resolver and decrypts its response. A
+// truncated response over UDP is retried over TCP.
+func (c *dnscryptClient) exchange(ctx context.Context, msg dns.Message) (dns.Message, error) {
+	cert, err := c.certificate(ctx)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	res, err := c.exchangeOver(ctx, "udp", cert, msg)
+	if err == nil && res.Header.TC() {
+		res, err = c.exchangeOver(ctx, "tcp", cert, msg)
+	}
+	return res, err
+}
+
+func (c *dnscryptClient) exchangeOver(ctx context.Context, network string, cert *dnscryptCert, msg dns.Message) (dns.Message, error) {
+	// A fresh key for every query keeps queries from being linked.
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	key, err := boxSharedKey(private, cert.resolverKey)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	var nonce [boxNonceLen]byte
+	if _, err := rng.Read(nonce[:dnscryptClientNonce]); err != nil {
+		return dns.Message{}, err
+	}
+	query := msg
+	if query.Header.ID, err = randomID(); err != nil {
+		return dns.Message{}, err
+	}
+	packet := append(append([]byte{}, cert.clientMagic...), private.PublicKey().Bytes()...)
+	packet = append(packet, nonce[:dnscryptClientNonce]...)
+	packet = append(packet, secretboxSeal(dnscryptPad(query.Byte(), network == "udp"), &nonce, &key)...)
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, c.addr)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if network == "tcp" {
+		err = dns.WriteStreamMessage(conn, packet)
+	} else {
+		_, err = conn.Write(packet)
+	}
+	if err != nil {
+		return dns.Message{}, err
+	}
+	for {
+		var data []byte
+		if network == "tcp" {
+			data, err = dns.ReadStreamMessage(conn)
+		} else {
+			buf := make([]byte, 65535)
+			var n int
+			n, err = conn.Read(buf)
+			data = buf[:n]
+		}
+		if err != nil {
+			return dns.Message{}, err
+		}
+		// Over UDP, datagrams that do not answer the query are skipped.
+		res, ok := dnscryptOpen(data, &nonce, &key)
+		var m dns.Message
+		if ok {
+			m, err = dns.ParseMessage(res)
+			ok = err == nil && dns.ValidateResponse(query, m) == nil
+		}
+		if !ok {
+			if network == "tcp" {
+				return dns.Message{}, errInvalidDNSCryptResponse
+			}
+			continue
+		}
+		m.Header.ID = msg.Header.ID
+		return m, nil
+	}
+}
+
+// dnscryptOpen decrypts a response to the query sent with the client half
+// of nonce and returns the DNS message it carries.
+func dnscryptOpen(data []byte, nonce *[boxNonceLen]byte, key *[32]byte) ([]byte, bool) {
+	if len(data) < dnscryptResponseHead+boxOverhead || !bytes.Equal(data[:8], dnscryptResolverMagic) ||
+		!bytes.Equal(data[8:8+dnscryptClientNonce], nonce[:dnscryptClientNonce]) {
+		return nil, false
+	}
+	var resNonce [boxNonceLen]byte
+	copy(resNonce[:], data[8:dnscryptResponseHead])
+	padded, ok := secretboxOpen(data[dnscryptResponseHead:], &resNonce, key)
+	if !ok {
+		return nil, false
+	}
+	// Strip the ISO/IEC 7816-4 padding.
+	end := bytes.LastIndexByte(padded, 0x80)
+	if end < 0 || len(bytes.Trim(padded[end+1:], "\x00")) > 0 {
+		return nil, false
+	}
+	return padded[:end], true
+}
+
+// dnscryptPad pads a query with 0x80 and zeros to a multiple of 64 bytes,
+// and over UDP to at least the minimum query length.
+func dnscryptPad(query []byte, udp bool) []byte {
+	n := (len(query) + 1 + dnscryptPadBlock - 1) / dnscryptPadBlock * dnscryptPadBlock
+	if udp && n < dnscryptMinQueryLen {
+		n = dnscryptMinQueryLen
+	}
+	padded := make([]byte, n)
+	copy(padded, query)
+	padded[len(query)] = 0x80
+	return padded
+}
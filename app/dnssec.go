@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// builtinRootAnchors are the DS records of the key signing keys of the root
+// zone from 2017 and 2024, trusted unless -dnssec-trust-anchor or -root-dir
+// provides others.
+const builtinRootAnchors = `
+. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+// loadTrustAnchors reads the DS records trusted for the root zone from a
+// root-anchors.xml file as published by IANA, keeping the keys valid at
+// now, or from a zone file of DS and DNSKEY records of the root. An empty
+// path yields the built-in anchors.
+func loadTrustAnchors(path string, now time.Time) ([]dns.DS, error) {
+	b := []byte(builtinRootAnchors)
+	if path != "" {
+		var err error
+		if b, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	var anchors []dns.DS
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "<") {
+		a, err := parseTrustAnchor(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range a.validDigests(now) {
+			// parseTrustAnchor checked that the digests are hex.
+			digest, _ := hex.DecodeString(d.Digest)
+			anchors = append(anchors, dns.DS{KeyTag: d.KeyTag, Algorithm: d.Algorithm, DigestType: d.DigestType, Digest: digest})
+		}
+	} else {
+		records, err := dns.ParseZone(strings.NewReader(string(b)), ".")
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if r.Name != "" && r.Name != "." {
+				return nil, fmt.Errorf("trust anchor for %s, want the root", r.Name)
+			}
+			if ds, ok := r.DS(); ok {
+				anchors = append(anchors, ds)
+			} else if k, ok := r.DNSKEY(); ok {
+				ds, err := k.ToDS(".", dns.DIGEST_SHA256)
+				if err != nil {
+					return nil, err
+				}
+				anchors = append(anchors, ds)
+			}
+		}
+	}
+	if len(anchors) == 0 {
+		return nil, errors.New("no valid trust anchor")
+	}
+	return anchors, nil
+}
+
+// dnssecValidator validates the responses of the resolver behind it. It
+// asks with the DO bit, to get signatures, and the CD bit, to get the data
+// even if the resolver considers it bogus, so that the failure is decided
+// and explained here. Secure answers get the AD bit, bogus ones are
+// answered with SERVFAIL and the Extended DNS Error that describes the
+// failure. Queries with CD set are passed on unvalidated, for clients that
+// validate themselves.
+type dnssecValidator struct {
+	next      dns.Handler
+	validator *dns.Validator
+}
+
+func newDNSSECValidator(next dns.Handler, anchors []dns.DS) *dnssecValidator {
+	d := &dnssecValidator{next: next}
+	d.validator = dns.NewValidator(anchors, d.lookup)
+	return d
+}
+
+// lookup asks the resolver for the DS and DNSKEY records of the chain of
+// trust.
+func (d *dnssecValidator) lookup(name string, qtype uint16) (dns.Message, error) {
+	req := dns.NewQuery(name, qtype).WithDO().WithCD().Message()
+	w := &probeWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	d.next.ServeDNS(w, &req)
+	if !w.written {
+		return dns.Message{}, errors.New("no response")
+	}
+	metrics.inc("dnssec_lookups_total")
+	return w.msg, nil
+}
+
+func (d *dnssecValidator) ServeDNS(w dns.ResponseWriter, r *dns.Message) {
+	if r.Header.CD() || len(r.Question.Queries) == 0 {
+		d.next.ServeDNS(w, r)
+		return
+	}
+	opt, hasEDNS := r.EDNS()
+	sub := *r
+	o := opt
+	if !hasEDNS {
+		o = dns.OPT{UDPSize: dns.DefaultUDPSize}
+	}
+	o.DO = true
+	sub.SetEDNS(o)
+	sub.Header.SetCD(true)
+	cw := &captureWriter{ResponseWriter: w}
+	d.next.ServeDNS(cw, &sub)
+	if !cw.written {
+		return
+	}
+	res := cw.msg
+	sec, err := d.validator.Validate(res)
+	metrics.inc("dnssec_" + sec.String() + "_total")
+	if sec == dns.SECURITY_BOGUS {
+		q := r.Question.Queries[0]
+		// The reason keeps its code, with the EDE code that fits the
+		// failure best.
+		reason := reasonBogus
+		var verr *dns.ValidationError
+		if errors.As(err, &verr) {
+			reason.ede = verr.Code
+		}
+		slog.Warn("DNSSEC validation failed", "name", privacy.name(q.Name), "type", dns.TypeString(q.Type), "err", err)
+		reject(w, r, dns.RCODE_SERVFAIL, reason)
+		return
+	}
+	res.Header.SetCD(false)
+	// The AD bit is for clients that show they understand it (RFC 6840
+	// section 5.7).
+	res.Header.SetAD(sec == dns.SECURITY_SECURE && (opt.DO || r.Header.AD()))
+	if !opt.DO {
+		res.RemoveDNSSEC()
+		if ro, ok := res.EDNS(); ok && hasEDNS {
+			ro.DO = false
+			res.SetEDNS(ro)
+		} else {
+			res.ClearEDNS()
+		}
+	}
+	w.WriteMsg(res)
+}
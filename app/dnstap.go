@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// dnstap message types (dnstap.proto, Message.Type).
+const (
+	dnstapResolverQuery    = 3
+	dnstapResolverResponse = 4
+	dnstapClientQuery      = 5
+	dnstapClientResponse   = 6
+)
+
+// dnstap socket protocols (dnstap.proto, SocketProtocol).
+var dnstapProtocols = map[string]uint64{"udp": 1, "tcp": 2, "dot": 3, "doh": 4, "dnscrypt": 5}
+
+const (
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+	dnstapQueueSize   = 4096
+	dnstapRetry       = 5 * time.Second // Wait before reconnecting to a socket
+
+	// Frame Streams control frame types.
+	fstrmAccept = 1
+	fstrmStart  = 2
+	fstrmReady  = 4
+
+	fstrmContentType = 1 // Control field holding the content type
+)
+
+// tap is the dnstap output, nil if disabled.
+var tap *dnstapWriter
+
+// dnstapEvent is a message exchanged with a client or an upstream resolver.
+type dnstapEvent struct {
+	kind     uint64 // One of the dnstap message types
+	protocol string // Transport as named by writerTransport
+	peer     net.Addr
+	queryAt  time.Time
+	query    []byte
+	respAt   time.Time // Zero for queries
+	response []byte
+}
+
+// dnstapWriter encodes events as dnstap frames and writes them to a file or
+// to a Unix socket in the Frame Streams format. Events are queued and
+// written by a single goroutine; they are dropped when the queue is full or
+// the socket is unavailable.
+type dnstapWriter struct {
+	target   string // File path, or unix: followed by a socket path
+	identity string
+	queue    chan dnstapEvent
+}
+
+// newDnstapWriter starts writing to target, which is a file path or
+// unix:/path/to/socket. Files are truncated.
+func newDnstapWriter(target, identity string) (*dnstapWriter, error) {
+	t := &dnstapWriter{target: target, identity: identity, queue: make(chan dnstapEvent, dnstapQueueSize)}
+	if strings.HasPrefix(target, "unix:") {
+		go t.runSocket(strings.TrimPrefix(target, "unix:"))
+		return t, nil
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	if err := writeControlFrame(w, fstrmStart, true); err != nil {
+		return nil, err
+	}
+	go t.runFile(w)
+	return t, nil
+}
+
+// log queues an event for writing. It does nothing on a nil writer, so
+// callers need not check whether dnstap is enabled.
+func (t *dnstapWriter) log(e dnstapEvent) {
+	if t == nil {
+		return
+	}
+	select {
+	case t.queue <- e:
+	default:
+		metrics.inc("dnstap_dropped_total")
+	}
+}
+
+func (t *dnstapWriter) runFile(w *bufio.Writer) {
+	for e := range t.queue {
+		if err := writeDataFrame(w, t.encode(e)); err != nil {
+			slog.Error("Failed to write dnstap file", "file", t.target, "err", err)
+			return
+		}
+		// Flush once the queue is drained, so the file stays readable
+		// while batching bursts of events.
+		if len(t.queue) == 0 {
+			if err := w.Flush(); err != nil {
+				slog.Error("Failed to write dnstap file", "file", t.target, "err", err)
+				return
+			}
+		}
+	}
+}
+
+// runSocket connects to the collector, reconnecting when the connection is
+// lost. Events arriving while disconnected are dropped.
+func (t *dnstapWriter) runSocket(path string) {
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			err = t.stream(conn)
+			conn.Close()
+		}
+		slog.Warn("dnstap socket unavailable, retrying", "socket", path, "err", err)
+		deadline := time.After(dnstapRetry)
+	drain:
+		for {
+			select {
+			case <-t.queue:
+				metrics.inc("dnstap_dropped_total")
+			case <-deadline:
+				break drain
+			}
+		}
+	}
+}
+
+// stream performs the bidirectional Frame Streams handshake and then writes
+// events until an error occurs.
+func (t *dnstapWriter) stream(conn net.Conn) error {
+	w := bufio.NewWriter(conn)
+	if err := writeControlFrame(w, fstrmReady, true); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(dnstapRetry))
+	typ, err := readControlFrame(conn)
+	if err != nil {
+		return err
+	}
+	if typ != fstrmAccept {
+		return fmt.Errorf("unexpected control frame %d instead of ACCEPT", typ)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err := writeControlFrame(w, fstrmStart, true); err != nil {
+		return err
+	}
+	slog.Info("Connected to dnstap socket", "socket", conn.RemoteAddr().String())
+	for e := range t.queue {
+		if err := writeDataFrame(w, t.encode(e)); err != nil {
+			return err
+		}
+		if len(t.queue) == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeDataFrame(w io.Writer, b []byte) error {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(b)))
+	_, err := w.Write(append(frame, b...))
+	return err
+}
+
+// writeControlFrame writes a control frame, escaped by a zero length, with
+// the dnstap content type if withType is set.
+func writeControlFrame(w io.Writer, typ uint32, withType bool) error {
+	control := binary.BigEndian.AppendUint32(nil, typ)
+	if withType {
+		control = binary.BigEndian.AppendUint32(control, fstrmContentType)
+		control = binary.BigEndian.AppendUint32(control, uint32(len(dnstapContentType)))
+		control = append(control, dnstapContentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(control)))
+	_, err := w.Write(append(frame, control...))
+	return err
+}
+
+// readControlFrame reads a control frame and returns its type.
+func readControlFrame(r io.Reader) (uint32, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(head[:4]) != 0 {
+		return 0, errors.New("expected a control frame")
+	}
+	n := binary.BigEndian.Uint32(head[4:])
+	if n < 4 || n > 512 {
+		return 0, errors.New("invalid control frame length")
+	}
+	control := make([]byte, n)
+	if _, err := io.ReadFull(r, control); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(control), nil
+}
+
+// encode returns the event as a Dnstap protobuf message.
+func (t *dnstapWriter) encode(e dnstapEvent) []byte {
+	var m []byte
+	m = appendProtoVarint(m, 1, e.kind)
+	if ip := addrIP(e.peer); ip != nil {
+		family := uint64(2)
+		if ip4 := ip.To4(); ip4 != nil {
+			family, ip = 1, ip4
+		}
+		m = appendProtoVarint(m, 2, family)
+		// The client sent queries to us and we sent resolver queries.
+		addrField, portField := 4, 6
+		if e.kind == dnstapResolverQuery || e.kind == dnstapResolverResponse {
+			addrField, portField = 5, 7
+		}
+		m = appendProtoBytes(m, addrField, ip)
+		if port := addrPort(e.peer); port != 0 {
+			m = appendProtoVarint(m, portField, uint64(port))
+		}
+	}
+	if p, ok := dnstapProtocols[e.protocol]; ok {
+		m = appendProtoVarint(m, 3, p)
+	}
+	if !e.queryAt.IsZero() {
+		m = appendProtoVarint(m, 8, uint64(e.queryAt.Unix()))
+		m = appendProtoFixed32(m, 9, uint32(e.queryAt.Nanosecond()))
+	}
+	if e.query != nil {
+		m = appendProtoBytes(m, 10, e.query)
+	}
+	if !e.respAt.IsZero() {
+		m = appendProtoVarint(m, 12, uint64(e.respAt.Unix()))
+		m = appendProtoFixed32(m, 13, uint32(e.respAt.Nanosecond()))
+	}
+	if e.response != nil {
+		m = appendProtoBytes(m, 14, e.response)
+	}
+
+	var d []byte
+	if t.identity != "" {
+		d = appendProtoBytes(d, 1, []byte(t.identity))
+	}
+	d = appendProtoBytes(d, 2, []byte("codecrafters-dns-server-go"))
+	d = appendProtoBytes(d, 14, m)
+	d = appendProtoVarint(d, 15, 1) // Type MESSAGE
+	return d
+}
+
+// addrPort extracts the port from a network address, or 0 if it has none.
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	return 0
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// tapWriter logs the responses sent to a client.
+type tapWriter struct {
+	dns.ResponseWriter
+	transport string
+	start     time.Time
+}
+
+func (w *tapWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *tapWriter) WriteMsg(m dns.Message) error {
+	tap.log(dnstapEvent{
+		kind:     dnstapClientResponse,
+		protocol: w.transport,
+		peer:     w.RemoteAddr(),
+		queryAt:  w.start,
+		respAt:   time.Now(),
+		response: m.Byte(),
+	})
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,323 @@
+// Package dnstest runs the server for integration tests. StartServer builds
+// the server, launches it on free loopback ports with the flags of the
+// test, and stops it when the test ends:
+//
+//	srv := dnstest.StartServer(t, dnstest.Options{
+//		Flags: []string{"-zone", "example.test=testdata/example.test.zone"},
+//		DoH:   true,
+//	})
+//	res, err := srv.UDP.Exchange(dns.NewQuery("example.test", dns.TYPE_A).Message())
+package dnstest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// serverPackage is the import path of the server command, built with the
+// go tool from the module cache or the workspace the test runs in.
+const serverPackage = "github.com/codecrafters-io/dns-server-starter-go/app"
+
+const (
+	startTimeout    = 10 * time.Second
+	exchangeTimeout = 3 * time.Second
+	dohPath         = "/dns-query"
+	dohMediaType    = "application/dns-message"
+)
+
+// Options configures a server started by StartServer.
+type Options struct {
+	Flags  []string  // Server flags, besides the listener addresses
+	DoH    bool      // Serve DNS over plain HTTP too, for Server.DoH
+	Binary string    // Server binary to run, built from serverPackage if empty
+	Output io.Writer // Receives the server logs; they are logged with t.Log if the test fails otherwise
+}
+
+// Server is a running server with clients for each of its listeners.
+type Server struct {
+	Addr    string      // UDP and TCP address
+	DoHURL  string      // URL of the DNS-over-HTTP endpoint, empty without Options.DoH
+	UDP     *UDPClient  // Sends queries to Addr over UDP
+	TCP     *TCPClient  // Sends queries to Addr over TCP
+	DoH     *DoHClient  // Sends queries to DoHURL, nil without Options.DoH
+	Process *os.Process // The server, to send it signals such as SIGHUP
+
+	httpAddr string // Of the DNS-over-HTTP listener
+	logs     lockedBuffer
+	exited   chan struct{} // Closed once the server exited
+}
+
+// Client is implemented by the clients of every transport.
+type Client interface {
+	// Exchange sends the query and returns the response, after checking
+	// that it answers the query.
+	Exchange(req dns.Message) (dns.Message, error)
+}
+
+// StartServer launches the server and waits until it accepts queries. The
+// test fails if it does not start; it is killed at the end of the test.
+func StartServer(t testing.TB, opts Options) *Server {
+	t.Helper()
+	if opts.Binary == "" {
+		opts.Binary = filepath.Join(t.TempDir(), "server")
+		if err := Build(opts.Binary); err != nil {
+			t.Fatalf("dnstest: %v", err)
+		}
+	}
+	s, err := Start(opts)
+	if err != nil {
+		t.Fatalf("dnstest: %v", err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		if t.Failed() && opts.Output == nil {
+			t.Logf("dnstest: server output:\n%s", s.logs.String())
+		}
+	})
+	return s
+}
+
+// Build builds the server into the binary bin, for Options.Binary.
+func Build(bin string) error {
+	build := exec.Command("go", "build", "-o", bin, serverPackage)
+	if out, err := build.CombinedOutput(); err != nil {
+		return fmt.Errorf("building the server: %w\n%s", err, out)
+	}
+	return nil
+}
+
+// Start is StartServer for programs other than tests, such as the e2e
+// command: it reports the failure to start instead of failing a test, and
+// the server runs until Close. Options.Binary must be set.
+func Start(opts Options) (*Server, error) {
+	if opts.Binary == "" {
+		return nil, errors.New("dnstest: no server binary")
+	}
+	addr, err := FreeAddr()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-listen", addr}
+	s := &Server{Addr: addr, UDP: &UDPClient{Addr: addr}, TCP: &TCPClient{Addr: addr}, exited: make(chan struct{})}
+	if opts.DoH {
+		httpAddr, err := FreeAddr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-doh-http-addr", httpAddr)
+		s.httpAddr = httpAddr
+		s.DoHURL = "http://" + httpAddr + dohPath
+		s.DoH = &DoHClient{URL: s.DoHURL}
+	}
+	args = append(args, opts.Flags...)
+
+	cmd := exec.Command(opts.Binary, args...)
+	cmd.Stdout, cmd.Stderr = &s.logs, &s.logs
+	if opts.Output != nil {
+		cmd.Stdout = io.MultiWriter(&s.logs, opts.Output)
+		cmd.Stderr = cmd.Stdout
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting the server: %w", err)
+	}
+	s.Process = cmd.Process
+	go func() {
+		cmd.Wait()
+		close(s.exited)
+	}()
+	if err := waitReady(s); err != nil {
+		s.Close()
+		if opts.Output != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w\n%s", err, s.logs.String())
+	}
+	return s, nil
+}
+
+// Close kills the server and waits until it exited.
+func (s *Server) Close() {
+	s.Process.Kill()
+	<-s.exited
+}
+
+// FreeAddr returns a loopback address with a port that is free for both UDP
+// and TCP at the time of the call.
+func FreeAddr() (string, error) {
+	for i := 0; i < 10; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		addr := pc.LocalAddr().String()
+		ln, err := net.Listen("tcp", addr)
+		pc.Close()
+		if err != nil {
+			continue
+		}
+		ln.Close()
+		return addr, nil
+	}
+	return "", errors.New("dnstest: no free port found")
+}
+
+// waitReady waits until the server accepts TCP connections on all of its
+// listeners, or exits.
+func waitReady(s *Server) error {
+	addrs := []string{s.Addr}
+	if s.httpAddr != "" {
+		addrs = append(addrs, s.httpAddr)
+	}
+	deadline := time.Now().Add(startTimeout)
+	for _, addr := range addrs {
+		for {
+			conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			select {
+			case <-s.exited:
+				return errors.New("server exited before listening")
+			default:
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("server not listening on %s: %w", addr, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// UDPClient exchanges queries over UDP, one socket per query.
+type UDPClient struct {
+	Addr string
+}
+
+func (c *UDPClient) Exchange(req dns.Message) (dns.Message, error) {
+	b, err := c.ExchangeRaw(req.Byte())
+	if err != nil {
+		return dns.Message{}, err
+	}
+	return ParseResponse(req, b)
+}
+
+// ExchangeRaw sends a message in wire format, which may be malformed, and
+// returns the response as received.
+func (c *UDPClient) ExchangeRaw(req []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", c.Addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(exchangeTimeout))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// TCPClient exchanges queries over TCP, one connection per query.
+type TCPClient struct {
+	Addr string
+}
+
+func (c *TCPClient) Exchange(req dns.Message) (dns.Message, error) {
+	conn, err := net.DialTimeout("tcp", c.Addr, time.Second)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(exchangeTimeout))
+	if err := dns.WriteStreamMessage(conn, req.Byte()); err != nil {
+		return dns.Message{}, err
+	}
+	res, err := dns.ReadStreamMessage(conn)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	return ParseResponse(req, res)
+}
+
+// DoHClient exchanges queries with POST requests to a DNS-over-HTTPS
+// endpoint (RFC 8484).
+type DoHClient struct {
+	URL    string
+	Client *http.Client // http.DefaultClient if nil
+}
+
+func (c *DoHClient) Exchange(req dns.Message) (dns.Message, error) {
+	hc := c.Client
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	hreq, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(req.Byte()))
+	if err != nil {
+		return dns.Message{}, err
+	}
+	hreq.Header.Set("Content-Type", dohMediaType)
+	hreq.Header.Set("Accept", dohMediaType)
+	hres, err := hc.Do(hreq)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	defer hres.Body.Close()
+	if hres.StatusCode != http.StatusOK {
+		return dns.Message{}, fmt.Errorf("HTTP status %s", hres.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(hres.Body, 65535))
+	if err != nil {
+		return dns.Message{}, err
+	}
+	return ParseResponse(req, b)
+}
+
+// ParseResponse parses a response and checks that it answers req, as
+// dns.ValidateResponse does.
+func ParseResponse(req dns.Message, b []byte) (dns.Message, error) {
+	res, err := dns.ParseMessage(b)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	if err := dns.ValidateResponse(req, res); err != nil {
+		return dns.Message{}, err
+	}
+	return res, nil
+}
+
+// lockedBuffer collects the server output, written from the goroutines of
+// os/exec while the test may read it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
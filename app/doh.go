@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	dohPath      = "/dns-query"
+	dohMediaType = "application/dns-message"
+	// dohMaxSize is the largest DNS message accepted over HTTP.
+	dohMaxSize = 65535
+)
+
+// serveDoH runs a DNS-over-HTTPS (RFC 8484) listener on the given address.
+func serveDoH(addr, certFile, keyFile string, s *server) error {
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, dohHandler{s: s})
+	srv := &http.Server{Addr: addr, Handler: mux}
+	slog.Info("Serving DNS-over-HTTPS", "addr", addr, "path", dohPath)
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+// serveDoHPlain runs the DNS-over-HTTPS mapping over plain HTTP, meant for
+// localhost clients and TLS terminating reverse proxies. Requests relayed by
+// a proxy on the loopback interface are attributed to the client named in
+// X-Forwarded-For.
+func serveDoHPlain(addr string, s *server) error {
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, dohHandler{s: s, trustProxy: true})
+	srv := &http.Server{Addr: addr, Handler: mux}
+	slog.Info("Serving DNS over plain HTTP", "addr", addr, "path", dohPath)
+	return srv.ListenAndServe()
+}
+
+// dohHandler answers DNS queries carried in HTTP requests.
+type dohHandler struct {
+	s          *server
+	trustProxy bool // Honor X-Forwarded-For from loopback peers
+}
+
+func (h dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		data []byte
+		err  error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(r.Body, dohMaxSize+1))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		if len(data) > dohMaxSize {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "invalid remote address", http.StatusBadRequest)
+		return
+	}
+	if h.trustProxy && remote.IP.IsLoopback() {
+		if ip := forwardedFor(r); ip != nil {
+			remote = &net.TCPAddr{IP: ip}
+		}
+	}
+	transport := "HTTPS"
+	if r.TLS == nil {
+		transport = "HTTP"
+	}
+	slog.Debug("Received query", "bytes", len(data), addrAttr("client", remote), "transport", transport)
+
+	if _, err := dns.ParseMessage(data); err != nil {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+	dw := &dohWriter{w: w, remote: remote}
+	h.s.handle(data, dw)
+	if !dw.written {
+		status := dropStatus(dw.dropped)
+		http.Error(w, strings.ToLower(http.StatusText(status)), status)
+	}
+}
+
+// dropStatus returns the HTTP status of the response to a query the
+// pipeline dropped for the reason, or left unanswered without one.
+func dropStatus(reason *rejectReason) int {
+	if reason == nil {
+		return http.StatusInternalServerError
+	}
+	switch *reason {
+	case reasonRateLimited, reasonQuota, reasonQuotaLimited:
+		return http.StatusTooManyRequests
+	case reasonMalformed:
+		return http.StatusBadRequest
+	case reasonPanic:
+		return http.StatusInternalServerError
+	case reasonUpstream, reasonInternalUpstream, reasonResolution, reasonBogus:
+		return http.StatusBadGateway
+	}
+	return http.StatusForbidden
+}
+
+// noteDrop records the reason on the dohWriter under w, if any, for the
+// query it carries being dropped.
+func noteDrop(w dns.ResponseWriter, reason rejectReason) {
+	for {
+		switch v := w.(type) {
+		case *dohWriter:
+			v.dropped = &reason
+			return
+		case interface{ Unwrap() dns.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+// dohWriter sends a response as the body of an HTTP response.
+type dohWriter struct {
+	w       http.ResponseWriter
+	remote  net.Addr
+	written bool
+	dropped *rejectReason // Why the query was dropped, nil if it was not
+	enc     responseEncoding
+}
+
+func (w *dohWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *dohWriter) WriteMsg(m dns.Message) error {
+	if w.written {
+		return errors.New("response already written")
+	}
+	w.written = true
+	b := w.enc.encode(m)
+	w.w.Header().Set("Content-Type", dohMediaType)
+	w.w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	if ttl, ok := minAnswerTTL(m); ok {
+		w.w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	if _, err := w.w.Write(b); err != nil {
+		slog.Warn("Failed to send response", "err", err)
+		return err
+	}
+	return nil
+}
+
+// forwardedFor returns the client address appended to X-Forwarded-For by
+// the nearest proxy.
+func forwardedFor(r *http.Request) net.IP {
+	values := r.Header.Values("X-Forwarded-For")
+	if len(values) == 0 {
+		return nil
+	}
+	addrs := strings.Split(values[len(values)-1], ",")
+	return net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+}
+
+// minAnswerTTL returns the smallest TTL among the answer records, which bounds
+// how long HTTP caches may keep the response.
+func minAnswerTTL(m dns.Message) (uint32, bool) {
+	if len(m.Answer.Records) == 0 {
+		return 0, false
+	}
+	ttl := m.Answer.Records[0].TTL
+	for _, r := range m.Answer.Records[1:] {
+		if r.TTL < ttl {
+			ttl = r.TTL
+		}
+	}
+	return ttl, true
+}
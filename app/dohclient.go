@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// dohClient sends queries to a DNS over HTTPS resolver (RFC 8484) at one
+// address, over connections kept open between queries. Over HTTP/2 many
+// queries share a connection as concurrent streams; the client tracks how
+// connections are reused to help tune the limits.
+type dohClient struct {
+	url     string
+	client  *http.Client
+	streams chan struct{} // Semaphore bounding the requests in flight
+
+	mu        sync.Mutex
+	conns     map[*tls.Conn]*dohConn // Open connections
+	dialed    uint64                 // Connections opened
+	reused    uint64                 // Requests sent over an already used connection
+	goAways   uint64                 // Requests failed because the server sent GOAWAY
+	connIndex int                    // Numbers the connections for the admin API
+}
+
+// dohConn counts the requests of a connection.
+type dohConn struct {
+	id       int
+	inFlight int
+	requests uint64
+}
+
+// newDoHClient returns a client for the resolver at rawURL that connects to
+// addr, whatever the host in the URL resolves to.
+func newDoHClient(rawURL, addr string, tlsConfig *tls.Config, opts upstreamOptions) *dohClient {
+	c := &dohClient{url: rawURL, conns: make(map[*tls.Conn]*dohConn)}
+	if opts.dohMaxStreams > 0 {
+		c.streams = make(chan struct{}, opts.dohMaxStreams)
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	c.client = &http.Client{Transport: &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			raw, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tc := &closeNotifyConn{Conn: raw}
+			conn := tls.Client(tc, tlsConfig)
+			if err := conn.HandshakeContext(ctx); err != nil {
+				raw.Close()
+				return nil, err
+			}
+			c.opened(conn)
+			tc.onClose = func() { c.closed(conn) }
+			return conn, nil
+		},
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   opts.dohIdleTimeout,
+	}}
+	return c
+}
+
+// exchange posts msg to the resolver and returns its response.
+func (c *dohClient) exchange(ctx context.Context, msg dns.Message) (dns.Message, error) {
+	if c.streams != nil {
+		select {
+		case c.streams <- struct{}{}:
+			defer func() { <-c.streams }()
+		case <-ctx.Done():
+			return dns.Message{}, ctx.Err()
+		}
+	}
+	// The ID is always 0 to make responses cacheable by HTTP caches.
+	query := msg
+	query.Header.ID = 0
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(query.Byte()))
+	if err != nil {
+		return dns.Message{}, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+	var conn *tls.Conn
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn, _ = info.Conn.(*tls.Conn)
+			c.started(conn, info.Reused)
+		},
+	}))
+	defer func() { c.finished(conn) }()
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		if strings.Contains(err.Error(), "GOAWAY") {
+			c.mu.Lock()
+			c.goAways++
+			c.mu.Unlock()
+			metrics.inc("upstream_doh_goaway_total")
+		}
+		return dns.Message{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return dns.Message{}, fmt.Errorf("DoH resolver answered %s", res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != dohMediaType {
+		return dns.Message{}, fmt.Errorf("DoH resolver answered with content type %q", ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, dohMaxSize+1))
+	if err != nil {
+		return dns.Message{}, err
+	}
+	if len(body) > dohMaxSize {
+		return dns.Message{}, fmt.Errorf("DoH response larger than %d bytes", dohMaxSize)
+	}
+	m, err := dns.ParseMessage(body)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	if err := dns.ValidateResponse(query, m); err != nil {
+		return dns.Message{}, err
+	}
+	m.Header.ID = msg.Header.ID
+	return m, nil
+}
+
+func (c *dohClient) opened(conn *tls.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connIndex++
+	c.dialed++
+	c.conns[conn] = &dohConn{id: c.connIndex}
+	metrics.inc("upstream_doh_connections_total")
+}
+
+func (c *dohClient) closed(conn *tls.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, conn)
+}
+
+func (c *dohClient) started(conn *tls.Conn, reused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if reused {
+		c.reused++
+		metrics.inc("upstream_doh_connection_reuses_total")
+	}
+	if dc := c.conns[conn]; dc != nil {
+		dc.inFlight++
+		dc.requests++
+	}
+}
+
+func (c *dohClient) finished(conn *tls.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dc := c.conns[conn]; dc != nil {
+		dc.inFlight--
+	}
+}
+
+// dohStatus describes the connections of a DoH endpoint for the admin API.
+type dohStatus struct {
+	Dialed      uint64          `json:"connections_opened"`
+	Reused      uint64          `json:"requests_on_reused_connections"`
+	GoAways     uint64          `json:"goaway_failures"`
+	Connections []dohConnStatus `json:"connections"`
+}
+
+type dohConnStatus struct {
+	ID       int    `json:"id"`
+	Protocol string `json:"protocol"` // Negotiated with ALPN
+	InFlight int    `json:"in_flight"`
+	Requests uint64 `json:"requests"`
+}
+
+func (c *dohClient) status() dohStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := dohStatus{Dialed: c.dialed, Reused: c.reused, GoAways: c.goAways, Connections: []dohConnStatus{}}
+	for conn, dc := range c.conns {
+		st.Connections = append(st.Connections, dohConnStatus{
+			ID:       dc.id,
+			Protocol: conn.ConnectionState().NegotiatedProtocol,
+			InFlight: dc.inFlight,
+			Requests: dc.requests,
+		})
+	}
+	sort.Slice(st.Connections, func(i, j int) bool { return st.Connections[i].ID < st.Connections[j].ID })
+	return st
+}
+
+// closeNotifyConn calls onClose once when the connection is closed.
+type closeNotifyConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// fallbackTTL is the TTL of answers from the system resolver, which does
+// not report the TTLs of the records it looked up.
+const fallbackTTL = 30
+
+var errFallbackType = errors.New("type not supported by the system resolver")
+
+// systemResolver answers queries with the host's default resolver when all
+// upstreams are down. Only address, SRV, and TXT lookups are supported.
+type systemResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+}
+
+func newSystemResolver(timeout time.Duration) *systemResolver {
+	return &systemResolver{resolver: net.DefaultResolver, timeout: timeout}
+}
+
+// resolve answers every question of the request with the system resolver.
+func (s *systemResolver) resolve(req dns.Message) (dns.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	res := dns.NewErrorResponse(req, dns.RCODE_NOERROR)
+	res.Header.SetRA(true)
+	for _, q := range req.Question.Queries {
+		if q.Class != dns.CLASS_IN {
+			return dns.Message{}, errFallbackType
+		}
+		set, err := s.lookup(ctx, q)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			res.Header.SetRCode(dns.RCODE_NXDOMAIN)
+			continue
+		}
+		if err != nil {
+			return dns.Message{}, err
+		}
+		if len(set.Data) > 0 {
+			res.AddAnswer(set)
+		}
+	}
+	tagOrigin(&res, originSystem)
+	return res, nil
+}
+
+func (s *systemResolver) lookup(ctx context.Context, q dns.Query) (dns.RRSet, error) {
+	set := dns.RRSet{Name: q.Name, Type: q.Type, Class: q.Class, TTL: fallbackTTL}
+	host := strings.TrimSuffix(q.Name, ".")
+	switch q.Type {
+	case dns.TYPE_A, dns.TYPE_AAAA:
+		network := "ip4"
+		if q.Type == dns.TYPE_AAAA {
+			network = "ip6"
+		}
+		ips, err := s.resolver.LookupIP(ctx, network, host)
+		if err != nil {
+			return set, err
+		}
+		for _, ip := range ips {
+			if q.Type == dns.TYPE_A {
+				set.Add(dns.A{Addr: ip}.Pack())
+			} else {
+				set.Add(dns.AAAA{Addr: ip}.Pack())
+			}
+		}
+	case dns.TYPE_SRV:
+		_, srvs, err := s.resolver.LookupSRV(ctx, "", "", host)
+		if err != nil {
+			return set, err
+		}
+		for _, srv := range srvs {
+			set.Add(dns.SRV{Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: srv.Target}.Pack())
+		}
+	case dns.TYPE_TXT:
+		txts, err := s.resolver.LookupTXT(ctx, host)
+		if err != nil {
+			return set, err
+		}
+		for _, txt := range txts {
+			set.Add(dns.TXT{Strings: []string{txt}}.Pack())
+		}
+	default:
+		return set, errFallbackType
+	}
+	return set, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// stringList is a flag that may be given several times, each value
+// optionally holding a comma separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// valueList is a flag that may be given several times, each value taken
+// whole, for values that hold commas of their own.
+type valueList []string
+
+func (l *valueList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *valueList) Set(v string) error {
+	if v = strings.TrimSpace(v); v != "" {
+		*l = append(*l, v)
+	}
+	return nil
+}
+
+// listValues returns the values of a flag that may be given several
+// times, and false for other flags.
+func listValues(v flag.Value) (*[]string, bool) {
+	switch l := v.(type) {
+	case *stringList:
+		return (*[]string)(l), true
+	case *valueList:
+		return (*[]string)(l), true
+	}
+	return nil, false
+}
+
+// containsItem reports whether the comma separated list holds item.
+func containsItem(list, item string) bool {
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// parseRCodes parses a comma separated list of response code names.
+func parseRCodes(s string) (map[dns.RCode]bool, error) {
+	rcodes := make(map[dns.RCode]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		rcode, ok := dns.ParseRCode(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown rcode %q", name)
+		}
+		rcodes[rcode] = true
+	}
+	return rcodes, nil
+}
+
+// forwarder relays requests to a list of upstream resolvers. The list can be
+// replaced while requests are being forwarded.
+type forwarder struct {
+	client     *dns.Client
+	mu         sync.RWMutex
+	upstreams  []*upstream
+	timeout    time.Duration      // How long to wait for each upstream reply
+	retries    int                // Number of additional attempts after a failure
+	softRCodes map[dns.RCode]bool // Upstream rcodes that cause the next upstream to be tried
+
+	opts           upstreamOptions // Applied to upstreams added later
+	udpPayloadSize int             // Cap for the EDNS payload size advertised upstream
+	fallback       *systemResolver // Used when no upstream answers, nil if disabled
+}
+
+func newForwarder(addresses []string, opts upstreamOptions, timeout time.Duration, retries int, softRCodes map[dns.RCode]bool) (*forwarder, error) {
+	f := &forwarder{
+		client:     &dns.Client{Timeout: timeout, Rand: rng},
+		opts:       opts,
+		timeout:    timeout,
+		retries:    retries,
+		softRCodes: softRCodes,
+	}
+	for _, address := range addresses {
+		u, err := newUpstream(address, opts)
+		if err != nil {
+			return nil, err
+		}
+		f.upstreams = append(f.upstreams, u)
+	}
+	return f, nil
+}
+
+// candidates returns the upstreams in the order they should be tried: healthy
+// ones first, followed by the ones currently considered down as a last resort.
+func (f *forwarder) candidates() []*upstream {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var healthy, down []*upstream
+	for _, u := range f.upstreams {
+		if u.healthy() {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// setUpstreams replaces the upstreams with the given addresses, in order.
+// Upstreams that were already in use keep their health state, new ones are
+// probed before the list is swapped in.
+func (f *forwarder) setUpstreams(addresses []string) error {
+	if len(addresses) == 0 {
+		return errors.New("no upstreams given")
+	}
+	f.mu.RLock()
+	current := make(map[string]*upstream)
+	for _, u := range f.upstreams {
+		current[u.name] = u
+	}
+	f.mu.RUnlock()
+
+	var (
+		upstreams = make([]*upstream, len(addresses))
+		wg        sync.WaitGroup
+	)
+	for i, address := range addresses {
+		if old, ok := current[address]; ok {
+			upstreams[i] = old
+			continue
+		}
+		u, err := newUpstream(address, f.opts)
+		if err != nil {
+			return err
+		}
+		upstreams[i] = u
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.probe(u)
+		}()
+	}
+	wg.Wait()
+
+	f.mu.Lock()
+	f.upstreams = upstreams
+	f.mu.Unlock()
+	return nil
+}
+
+// probe checks that every endpoint of the upstream answers a query for the
+// root NS records and records the outcome in its health state.
+func (f *forwarder) probe(u *upstream) {
+	req := dns.NewQuery("", dns.TYPE_NS).Message()
+	for _, e := range u.endpoints {
+		start := time.Now()
+		_, err := f.exchange(e, req)
+		if err != nil {
+			slog.Warn("Probe of resolver failed", "resolver", e.addr.String(), "err", err)
+			// Count the probe as enough failures to skip the endpoint
+			// until it proves itself.
+			for i := 0; i < maxUpstreamFailures; i++ {
+				e.markResult(err, 0)
+			}
+			continue
+		}
+		e.markResult(nil, time.Since(start))
+	}
+}
+
+// upstreamStatus describes an upstream for the admin API.
+type upstreamStatus struct {
+	Address   string           `json:"address"`
+	Healthy   bool             `json:"healthy"`
+	Endpoints []endpointStatus `json:"endpoints"`
+}
+
+// status returns the upstreams in configured order.
+func (f *forwarder) status() []upstreamStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	statuses := make([]upstreamStatus, len(f.upstreams))
+	for i, u := range f.upstreams {
+		statuses[i] = upstreamStatus{Address: u.name, Healthy: u.healthy()}
+		for _, e := range u.endpoints {
+			statuses[i].Endpoints = append(statuses[i].Endpoints, e.status())
+		}
+	}
+	return statuses
+}
+
+// forward relays the request to the upstreams in order, moving on to the
+// next one when an upstream fails or answers with a soft rcode.
+func (f *forwarder) forward(r dns.Message) (dns.Message, error) {
+	var (
+		res     dns.Message
+		err     error
+		gotSoft bool
+	)
+	for _, u := range f.candidates() {
+		var ures dns.Message
+		ures, err = f.forwardQuestions(u, r)
+		if err != nil {
+			continue
+		}
+		res, gotSoft = ures, true
+		if rcode := ures.Header.RCode(); f.softRCodes[rcode] {
+			slog.Info("Resolver answered with a retried rcode, trying next", "resolver", u.String(), "rcode", rcode.String())
+			continue
+		}
+		return res, nil
+	}
+	// Pass the last upstream failure on to the client.
+	if gotSoft {
+		return res, nil
+	}
+	return dns.Message{}, err
+}
+
+// forwardTo sends the request to the upstream, retrying on errors. Every
+// attempt goes to the preferred endpoint among those that have not failed
+// yet, so a broken address family is bypassed within the same query. Each
+// endpoint is charged at most one failure per query.
+func (f *forwarder) forwardTo(u *upstream, r dns.Message) (dns.Message, error) {
+	var err error
+	tried := make(map[*endpoint]error)
+	defer func() {
+		for e, err := range tried {
+			e.markResult(err, 0)
+		}
+	}()
+	for attempt := 0; attempt <= f.retries; attempt++ {
+		e := u.pick(tried)
+		start := time.Now()
+		var res dns.Message
+		res, err = f.exchange(e, r)
+		if err == nil {
+			delete(tried, e)
+			e.markResult(nil, time.Since(start))
+			return res, nil
+		}
+		tried[e] = err
+		slog.Warn("Resolver failed", "resolver", e.addr.String(), "attempt", attempt+1, "attempts", f.retries+1, "err", err)
+	}
+	return dns.Message{}, fmt.Errorf("resolver: %w", err)
+}
+
+// exchange sends the request to the endpoint over its transport. Over UDP,
+// a truncated response is retried over TCP.
+func (f *forwarder) exchange(e *endpoint, r dns.Message) (dns.Message, error) {
+	switch e.transport {
+	case "tcp":
+		res, err := f.exchangeTCP(e, r)
+		if err != nil {
+			return dns.Message{}, err
+		}
+		return dns.NewResponse(res, true), nil
+	case "tls":
+		return f.exchangeEncrypted(e, r, "dot", e.tcp.exchange)
+	case "https":
+		return f.exchangeEncrypted(e, r, "doh", e.doh.exchange)
+	case "dnscrypt":
+		return f.exchangeEncrypted(e, r, "dnscrypt", e.dnscrypt.exchange)
+	}
+	metrics.inc("queries_forwarded_udp_total")
+	start := time.Now()
+	if tap != nil {
+		tap.log(dnstapEvent{kind: dnstapResolverQuery, protocol: "udp", peer: e.addr, queryAt: start, query: r.Byte()})
+	}
+	client := f.client
+	if e.tsig != nil {
+		c := *f.client
+		c.TSIG = e.tsig
+		client = &c
+	}
+	res, err := client.Exchange(context.Background(), r, e.addr.String())
+	if err != nil {
+		return dns.Message{}, err
+	}
+	if tap != nil {
+		tap.log(dnstapEvent{kind: dnstapResolverResponse, protocol: "udp", peer: e.addr, queryAt: start, respAt: time.Now(), response: res.Byte()})
+	}
+	slog.Debug("Received response", "resolver", e.addr.String())
+	tagOrigin(&res, "upstream "+e.addr.String())
+	if res.Header.TC() {
+		metrics.inc("upstream_truncated_total")
+		tcpRes, err := f.exchangeTCP(e, r)
+		if err != nil {
+			slog.Info("Upstream truncated the UDP response and failed over TCP, passing TC on to the client", "resolver", e.addr.String(), "name", privacy.name(r.Question.Queries[0].Name), "err", err)
+		} else {
+			res = tcpRes
+		}
+	}
+	return dns.NewResponse(res, true), nil
+}
+
+// exchangeTCP sends the request to the endpoint over its pooled TCP
+// connections.
+func (f *forwarder) exchangeTCP(e *endpoint, r dns.Message) (dns.Message, error) {
+	metrics.inc("queries_forwarded_tcp_total")
+	start := time.Now()
+	if tap != nil {
+		tap.log(dnstapEvent{kind: dnstapResolverQuery, protocol: "tcp", peer: e.addr, queryAt: start, query: r.Byte()})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	res, err := e.tcp.exchange(ctx, r)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	if tap != nil {
+		tap.log(dnstapEvent{kind: dnstapResolverResponse, protocol: "tcp", peer: e.addr, queryAt: start, respAt: time.Now(), response: res.Byte()})
+	}
+	slog.Debug("Received response over TCP", "resolver", e.addr.String())
+	tagOrigin(&res, "upstream "+e.addr.String()+" over TCP")
+	return res, nil
+}
+
+// exchangeEncrypted sends the request to a DNS over TLS, HTTPS, or DNSCrypt endpoint
+// with the exchange function of its transport.
+func (f *forwarder) exchangeEncrypted(e *endpoint, r dns.Message, protocol string, exchange func(context.Context, dns.Message) (dns.Message, error)) (dns.Message, error) {
+	metrics.inc("queries_forwarded_" + protocol + "_total")
+	start := time.Now()
+	if tap != nil {
+		tap.log(dnstapEvent{kind: dnstapResolverQuery, protocol: protocol, peer: e.addr, queryAt: start, query: r.Byte()})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	res, err := exchange(ctx, r)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	if tap != nil {
+		tap.log(dnstapEvent{kind: dnstapResolverResponse, protocol: protocol, peer: e.addr, queryAt: start, respAt: time.Now(), response: res.Byte()})
+	}
+	slog.Debug("Received response", "resolver", e.addr.String(), "transport", e.transport)
+	tagOrigin(&res, "upstream "+e.addr.String()+" over "+strings.ToUpper(protocol))
+	return dns.NewResponse(res, true), nil
+}
+
+// ServeDNS relays the request to the upstreams, answering with SERVFAIL
+// when none of them could be reached and the system resolver cannot help
+// either.
+func (f *forwarder) ServeDNS(w dns.ResponseWriter, r *dns.Message) {
+	req := *r
+	capEDNSSize(&req, f.udpPayloadSize)
+	res, err := f.forward(req)
+	if err != nil && f.fallback != nil {
+		slog.Warn("Forwarding failed, falling back to the system resolver", "err", err)
+		metrics.inc("fallback_queries_total")
+		res, err = f.fallback.resolve(*r)
+	}
+	if err != nil {
+		slog.Warn("Forwarding failed", "err", err)
+		res = errorResponse(req, dns.RCODE_SERVFAIL, reasonUpstream)
+	}
+	w.WriteMsg(res)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	hostsTTL          = 10 // Short, so that edits of the file are seen quickly
+	hostsPollInterval = 2 * time.Second
+)
+
+// hostsFile answers address queries for the names of a file in the
+// /etc/hosts format, and PTR queries for its addresses, ahead of the zones,
+// the cache, and the resolvers. The file is read again when it changes.
+type hostsFile struct {
+	path string
+
+	mu      sync.RWMutex
+	modTime time.Time
+	size    int64
+	addrs   map[string][]net.IP // Addresses by lowercased name
+	names   map[string][]string // Names by lowercased reverse name of their address
+}
+
+func newHostsFile(path string) (*hostsFile, error) {
+	h := &hostsFile{path: path}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reload reads the file if it changed since it was last read.
+func (h *hostsFile) reload() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	h.mu.RLock()
+	unchanged := info.ModTime().Equal(h.modTime) && info.Size() == h.size
+	h.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	addrs, names, err := readHostsFile(h.path)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.modTime, h.size, h.addrs, h.names = info.ModTime(), info.Size(), addrs, names
+	h.mu.Unlock()
+	slog.Info("Loaded hosts file", "file", h.path, "names", len(addrs))
+	return nil
+}
+
+// readHostsFile parses lines of an address followed by its names. Comments
+// start with #.
+func readHostsFile(path string) (map[string][]net.IP, map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	addrs := make(map[string][]net.IP)
+	names := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		// Zones of IPv6 link-local addresses are dropped with the zone
+		// identifier, as DNS cannot carry them.
+		addr, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("%s:%d: invalid address %q", path, line, fields[0])
+		}
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		reverse := dns.ReverseAddr(ip)
+		for _, name := range fields[1:] {
+			key := dns.CanonicalName(name)
+			addrs[key] = append(addrs[key], ip)
+			names[reverse] = append(names[reverse], name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return addrs, names, nil
+}
+
+// run reloads the file whenever it changes, until stop is closed.
+func (h *hostsFile) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(hostsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := h.reload(); err != nil {
+			slog.Warn("Failed to reload hosts file, keeping the current one", "file", h.path, "err", err)
+		}
+	}
+}
+
+// lookup returns the records of the file answering q, and whether the file
+// has the name at all.
+func (h *hostsFile) lookup(q dns.Query) ([]dns.Record, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	key := dns.CanonicalName(q.Name)
+	var records []dns.Record
+	switch q.Type {
+	case dns.TYPE_PTR:
+		names, ok := h.names[key]
+		for _, name := range names {
+			records = append(records, dns.NewRecord(q.Name, dns.CLASS_IN, hostsTTL, dns.PTR{Target: name}))
+		}
+		return records, ok
+	default:
+		addrs, ok := h.addrs[key]
+		for _, ip := range addrs {
+			switch {
+			case q.Type == dns.TYPE_A && len(ip) == net.IPv4len:
+				records = append(records, dns.NewRecord(q.Name, dns.CLASS_IN, hostsTTL, dns.A{Addr: ip}))
+			case q.Type == dns.TYPE_AAAA && len(ip) == net.IPv6len:
+				records = append(records, dns.NewRecord(q.Name, dns.CLASS_IN, hostsTTL, dns.AAAA{Addr: ip}))
+			}
+		}
+		return records, ok
+	}
+}
+
+// middleware answers queries for names of the file authoritatively. Address
+// queries of the other family get an empty answer, and other types are
+// passed on.
+func (h *hostsFile) middleware(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Message) {
+		if len(r.Question.Queries) != 1 {
+			next.ServeDNS(w, r)
+			return
+		}
+		q := r.Question.Queries[0]
+		if q.Class != dns.CLASS_IN || q.Type != dns.TYPE_A && q.Type != dns.TYPE_AAAA && q.Type != dns.TYPE_PTR {
+			next.ServeDNS(w, r)
+			return
+		}
+		records, ok := h.lookup(q)
+		if !ok {
+			next.ServeDNS(w, r)
+			return
+		}
+		metrics.inc("queries_hosts_total")
+		m := dns.NewErrorResponse(*r, dns.RCODE_NOERROR)
+		m.Header.SetAA(true)
+		m.Answer.Records = records
+		m.Header.ANCOUNT = uint16(len(records))
+		tagOrigin(&m, originHosts)
+		w.WriteMsg(m)
+	})
+}
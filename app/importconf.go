@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// runImport implements the import command, converting a BIND named.conf or
+// a dnsmasq.conf into the flags of this server, one -name=value per line.
+// Constructs without an equivalent are kept as comments, so the output can
+// be reviewed before use, for example with
+//
+//	your_server.sh $(grep -v '^#' flags.txt)
+func runImport(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	zoneDir := fs.String("zone-dir", ".", "directory where zone files generated from dnsmasq address= lines are written")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: import [-zone-dir dir] bind|dnsmasq FILE")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 || (fs.Arg(0) != "bind" && fs.Arg(0) != "dnsmasq") {
+		fs.Usage()
+		return 2
+	}
+	f, err := os.Open(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 1
+	}
+	defer f.Close()
+
+	c := &importedConfig{}
+	switch fs.Arg(0) {
+	case "bind":
+		err = c.importBIND(f)
+	case "dnsmasq":
+		err = c.importDnsmasq(f, *zoneDir)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %s: %v\n", fs.Arg(1), err)
+		return 1
+	}
+	fmt.Fprintf(out, "# Converted from %s (%s)\n", fs.Arg(1), fs.Arg(0))
+	c.write(out)
+	return 0
+}
+
+// importedConfig collects the flags converted from another server's
+// configuration.
+type importedConfig struct {
+	listen          []string
+	resolvers       []string
+	zones           []string // origin=path
+	forwards        []string // domain=addr,addr
+	internalDomains []string // Domains answered with NXDOMAIN
+	cacheSize       string
+	allow           []string
+	deny            []string
+	dropDenied      bool
+	recursionAllow  []string
+	recursionOff    bool
+	notes           []string // Constructs that were not converted
+}
+
+func (c *importedConfig) note(format string, a ...interface{}) {
+	c.notes = append(c.notes, fmt.Sprintf(format, a...))
+}
+
+// addInternal forwards a domain to its own resolvers, or answers it with
+// NXDOMAIN when resolvers is empty.
+func (c *importedConfig) addInternal(domain string, resolvers []string) {
+	if len(resolvers) > 0 {
+		c.forwards = append(c.forwards, domain+"="+strings.Join(resolvers, ","))
+		return
+	}
+	c.internalDomains = append(c.internalDomains, domain)
+}
+
+func (c *importedConfig) write(out io.Writer) {
+	for _, addr := range c.listen {
+		fmt.Fprintf(out, "-listen=%s\n", addr)
+	}
+	if len(c.resolvers) > 0 {
+		fmt.Fprintf(out, "-resolver=%s\n", strings.Join(c.resolvers, ","))
+	}
+	if c.cacheSize != "" {
+		fmt.Fprintf(out, "-cache-size=%s\n", c.cacheSize)
+	}
+	if len(c.allow) > 0 {
+		fmt.Fprintf(out, "-allow=%s\n", strings.Join(c.allow, ","))
+	}
+	if len(c.deny) > 0 {
+		fmt.Fprintf(out, "-deny=%s\n", strings.Join(c.deny, ","))
+	}
+	if c.dropDenied {
+		fmt.Fprintln(out, "-acl-action=drop")
+	}
+	if c.recursionOff {
+		fmt.Fprintln(out, "-recursion-allow=")
+	} else if len(c.recursionAllow) > 0 {
+		fmt.Fprintf(out, "-recursion-allow=%s\n", strings.Join(c.recursionAllow, ","))
+	}
+	for _, z := range c.zones {
+		fmt.Fprintf(out, "-zone=%s\n", z)
+	}
+	for _, f := range c.forwards {
+		fmt.Fprintf(out, "-forward=%s\n", f)
+	}
+	if len(c.internalDomains) > 0 {
+		fmt.Fprintf(out, "-internal-domains=%s\n", strings.Join(c.internalDomains, ","))
+	}
+	for _, n := range c.notes {
+		fmt.Fprintf(out, "# Not converted: %s\n", n)
+	}
+}
+
+// confStatement is a statement of named.conf: its words and the statements
+// of its block, if it has one.
+type confStatement struct {
+	words []string
+	block []confStatement
+}
+
+// importBIND converts the options, acl, and zone statements of named.conf.
+func (c *importedConfig) importBIND(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	tokens, err := tokenizeNamedConf(string(b))
+	if err != nil {
+		return err
+	}
+	statements, rest, err := parseNamedConf(tokens)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("unbalanced braces")
+	}
+
+	acls := make(map[string][]confStatement)
+	for _, s := range statements {
+		if s.words[0] == "acl" && len(s.words) > 1 {
+			acls[s.words[1]] = s.block
+		}
+	}
+
+	dir := ""
+	var zones []confStatement
+	for _, s := range statements {
+		switch s.words[0] {
+		case "options":
+			for _, o := range s.block {
+				switch o.words[0] {
+				case "directory":
+					if len(o.words) > 1 {
+						dir = o.words[1]
+					}
+				case "forwarders":
+					c.resolvers = append(c.resolvers, bindAddresses(o)...)
+				case "listen-on", "listen-on-v6":
+					c.listen = append(c.listen, bindListen(o)...)
+				case "allow-query":
+					allow, deny := c.bindAddressMatch(o, acls, nil)
+					c.allow = append(c.allow, allow...)
+					c.deny = append(c.deny, deny...)
+				case "allow-recursion":
+					allow, deny := c.bindAddressMatch(o, acls, nil)
+					c.recursionAllow = append(c.recursionAllow, allow...)
+					if len(deny) > 0 {
+						c.note("negated elements of allow-recursion: %s", strings.Join(deny, ","))
+					}
+				case "blackhole":
+					deny, _ := c.bindAddressMatch(o, acls, nil)
+					c.deny = append(c.deny, deny...)
+					c.dropDenied = true
+					if len(c.deny) > len(deny) {
+						c.note("clients denied by allow-query are dropped like those of blackhole")
+					}
+				case "recursion":
+					c.recursionOff = len(o.words) > 1 && o.words[1] == "no"
+				case "forward":
+				default:
+					c.note("option %s", strings.Join(o.words, " "))
+				}
+			}
+		case "zone":
+			zones = append(zones, s)
+		case "acl":
+		default:
+			c.note("statement %s", s.words[0])
+		}
+	}
+
+	for _, z := range zones {
+		if len(z.words) < 2 {
+			return errors.New("zone without a name")
+		}
+		name := z.words[1]
+		if name != "." {
+			name = strings.TrimSuffix(name, ".")
+		}
+		var ztype, file string
+		var forwarders []string
+		for _, o := range z.block {
+			switch o.words[0] {
+			case "type":
+				if len(o.words) > 1 {
+					ztype = o.words[1]
+				}
+			case "file":
+				if len(o.words) > 1 {
+					file = o.words[1]
+				}
+			case "forwarders":
+				forwarders = bindAddresses(o)
+			case "allow-transfer", "allow-query", "allow-update", "also-notify", "notify":
+				c.note("zone %s: %s", name, strings.Join(o.words, " "))
+			}
+		}
+		switch ztype {
+		case "master", "primary":
+			if file == "" {
+				c.note("zone %s has no file", name)
+				continue
+			}
+			if dir != "" && !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			c.zones = append(c.zones, name+"="+file)
+		case "forward":
+			c.addInternal(name, forwarders)
+		case "hint":
+			c.note("zone %s of type hint, root hints are kept up to date with -root-dir", name)
+		default:
+			c.note("zone %s of type %s", name, ztype)
+		}
+	}
+	return nil
+}
+
+// bindAddressMatch converts the address match list of a statement into the
+// networks it allows and denies, expanding named ACLs. Since the access
+// flags give denials precedence, BIND's first match semantics are only kept
+// when negated elements do not overlap later ones.
+func (c *importedConfig) bindAddressMatch(s confStatement, acls map[string][]confStatement, seen map[string]bool) (allow, deny []string) {
+	for _, e := range s.block {
+		element, negated := e.words[0], false
+		if strings.HasPrefix(element, "!") {
+			element, negated = strings.TrimPrefix(element, "!"), true
+		}
+		var a, d []string
+		switch {
+		case element == "any":
+			a = []string{"any"}
+		case element == "none":
+		case element == "localhost":
+			a = []string{"127.0.0.1", "::1"}
+		case element == "localnets":
+			a = []string{"local"}
+		case element == "key":
+			c.note("%s element %s", s.words[0], strings.Join(e.words, " "))
+		case acls[element] != nil:
+			if seen[element] {
+				continue
+			}
+			if seen == nil {
+				seen = make(map[string]bool)
+			}
+			seen[element] = true
+			a, d = c.bindAddressMatch(confStatement{words: s.words, block: acls[element]}, acls, seen)
+		default:
+			a = []string{element}
+		}
+		if negated {
+			a, d = d, a
+		}
+		allow, deny = append(allow, a...), append(deny, d...)
+	}
+	return allow, deny
+}
+
+// bindAddresses returns the addresses of a forwarders block as host:port.
+func bindAddresses(s confStatement) []string {
+	var addrs []string
+	for _, a := range s.block {
+		port := "53"
+		if len(a.words) == 3 && a.words[1] == "port" {
+			port = a.words[2]
+		}
+		addrs = append(addrs, net.JoinHostPort(a.words[0], port))
+	}
+	return addrs
+}
+
+// bindListen returns the listen addresses of a listen-on statement.
+func bindListen(s confStatement) []string {
+	port := "53"
+	if len(s.words) == 3 && s.words[1] == "port" {
+		port = s.words[2]
+	}
+	var addrs []string
+	for _, a := range s.block {
+		host := a.words[0]
+		switch host {
+		case "any":
+			host = "0.0.0.0"
+			if s.words[0] == "listen-on-v6" {
+				host = "::"
+			}
+		case "none":
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+	return addrs
+}
+
+// tokenizeNamedConf splits named.conf into words, quoted strings, braces,
+// and semicolons, dropping the three kinds of comments.
+func tokenizeNamedConf(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#' || strings.HasPrefix(s[i:], "//"):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			i += end + 4
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, s[i+1:i+1+end])
+			i += end + 2
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\r\n{};\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parseNamedConf parses statements until the end of the tokens or a closing
+// brace, returning the tokens after it.
+func parseNamedConf(tokens []string) ([]confStatement, []string, error) {
+	var statements []confStatement
+	var cur confStatement
+	for len(tokens) > 0 {
+		t := tokens[0]
+		tokens = tokens[1:]
+		switch t {
+		case "{":
+			block, rest, err := parseNamedConf(tokens)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(rest) == 0 || rest[0] != "}" {
+				return nil, nil, errors.New("unbalanced braces")
+			}
+			cur.block, tokens = block, rest[1:]
+		case "}":
+			if len(cur.words) > 0 {
+				return nil, nil, errors.New("missing semicolon before }")
+			}
+			return statements, append([]string{"}"}, tokens...), nil
+		case ";":
+			if len(cur.words) > 0 {
+				statements = append(statements, cur)
+			}
+			cur = confStatement{}
+		default:
+			cur.words = append(cur.words, t)
+		}
+	}
+	if len(cur.words) > 0 {
+		return nil, nil, errors.New("missing semicolon at end of file")
+	}
+	return statements, nil, nil
+}
+
+// importDnsmasq converts the DNS options of dnsmasq.conf. Addresses given
+// with address=/domain/ip are written as zone files in zoneDir.
+func (c *importedConfig) importDnsmasq(r io.Reader, zoneDir string) error {
+	port := "53"
+	var listenHosts []string
+	addresses := make(map[string][]string)
+	var domains []string
+	forwards := make(map[string][]string)
+	var forwardOrder []string
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, _ := strings.Cut(text, "=")
+		switch key {
+		case "port":
+			port = value
+		case "listen-address":
+			listenHosts = append(listenHosts, strings.Split(value, ",")...)
+		case "cache-size":
+			c.cacheSize = value
+		case "no-resolv", "domain-needed", "bogus-priv", "no-hosts", "bind-interfaces", "strict-order":
+		case "server", "local":
+			if !strings.HasPrefix(value, "/") {
+				if key == "server" {
+					c.resolvers = append(c.resolvers, dnsmasqAddress(value))
+				}
+				continue
+			}
+			parts := strings.Split(value[1:], "/")
+			target := parts[len(parts)-1]
+			for _, d := range parts[:len(parts)-1] {
+				if _, ok := forwards[d]; !ok {
+					forwardOrder = append(forwardOrder, d)
+				}
+				if target != "" {
+					forwards[d] = append(forwards[d], dnsmasqAddress(target))
+				} else if forwards[d] == nil {
+					forwards[d] = []string{}
+				}
+			}
+		case "address":
+			parts := strings.Split(strings.TrimPrefix(value, "/"), "/")
+			if len(parts) < 2 {
+				return fmt.Errorf("line %d: invalid address=%s", line, value)
+			}
+			ip := parts[len(parts)-1]
+			for _, d := range parts[:len(parts)-1] {
+				if ip == "" {
+					// No address: the domain does not exist.
+					c.addInternal(d, nil)
+					continue
+				}
+				if _, ok := addresses[d]; !ok {
+					domains = append(domains, d)
+				}
+				addresses[d] = append(addresses[d], ip)
+			}
+		default:
+			c.note("line %d: %s", line, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, h := range listenHosts {
+		c.listen = append(c.listen, net.JoinHostPort(h, port))
+	}
+	if len(listenHosts) == 0 && port != "53" {
+		c.listen = append(c.listen, net.JoinHostPort("0.0.0.0", port))
+	}
+	for _, d := range forwardOrder {
+		c.addInternal(d, forwards[d])
+	}
+	for _, d := range domains {
+		path := filepath.Join(zoneDir, d+".zone")
+		if err := writeAddressZone(path, d, addresses[d]); err != nil {
+			return err
+		}
+		c.zones = append(c.zones, d+"="+path)
+		c.note("address=/%s/ also answered for subdomains of %s in dnsmasq, only the domain itself is served", d, d)
+	}
+	return nil
+}
+
+// dnsmasqAddress converts a server address of dnsmasq, written ip#port, to
+// host:port.
+func dnsmasqAddress(s string) string {
+	host, port, ok := strings.Cut(s, "#")
+	if !ok {
+		port = "53"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// writeAddressZone writes a zone file serving the addresses at its apex.
+func writeAddressZone(path, origin string, addrs []string) error {
+	soa := dns.NewRecord(origin, dns.CLASS_IN, 3600, dns.SOA{
+		MName: origin, RName: "hostmaster." + origin, Serial: 1,
+		Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 300,
+	})
+	lines := []string{"; Generated from dnsmasq address= lines", soa.String()}
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return fmt.Errorf("invalid address %s for %s", a, origin)
+		}
+		var d dns.RData = dns.AAAA{Addr: ip}
+		if ip.To4() != nil {
+			d = dns.A{Addr: ip}
+		}
+		lines = append(lines, dns.NewRecord(origin, dns.CLASS_IN, 300, d).String())
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// internalGuard is registered for internal-only domains to keep their
+// queries away from the public upstreams. Such queries are answered by the
+// internal forwarder, or with NXDOMAIN when it is missing or unreachable, so
+// internal hostnames never leak even if routing to the internal forwarder
+// breaks.
+type internalGuard struct {
+	fwd *forwarder // Internal forwarder, nil if none is configured
+}
+
+func (g *internalGuard) ServeDNS(w dns.ResponseWriter, r *dns.Message) {
+	if g.fwd == nil {
+		reject(w, r, dns.RCODE_NXDOMAIN, reasonInternal)
+		return
+	}
+	res, err := g.fwd.forward(*r)
+	if err != nil {
+		slog.Warn("Internal forwarding failed", "err", err)
+		reject(w, r, dns.RCODE_NXDOMAIN, reasonInternalUpstream)
+		return
+	}
+	w.WriteMsg(res)
+}
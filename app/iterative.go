@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	iterativeMaxReferrals = 16   // Delegations followed to resolve one name
+	iterativeMaxDepth     = 4    // Nesting of lookups for the addresses of name servers
+	iterativeMaxQueries   = 64   // Queries sent to authoritative servers for one client query
+	iterativePayloadSize  = 1232 // EDNS payload size advertised to authoritative servers
+	iterativeMaxTTL       = 24 * time.Hour
+)
+
+// rootHints are the root name servers resolution starts from (IANA
+// named.root).
+var rootHints = []nameServer{
+	{"a.root-servers.net", []net.IP{net.ParseIP("198.41.0.4"), net.ParseIP("2001:503:ba3e::2:30")}},
+	{"b.root-servers.net", []net.IP{net.ParseIP("170.247.170.2"), net.ParseIP("2801:1b8:10::b")}},
+	{"c.root-servers.net", []net.IP{net.ParseIP("192.33.4.12"), net.ParseIP("2001:500:2::c")}},
+	{"d.root-servers.net", []net.IP{net.ParseIP("199.7.91.13"), net.ParseIP("2001:500:2d::d")}},
+	{"e.root-servers.net", []net.IP{net.ParseIP("192.203.230.10"), net.ParseIP("2001:500:a8::e")}},
+	{"f.root-servers.net", []net.IP{net.ParseIP("192.5.5.241"), net.ParseIP("2001:500:2f::f")}},
+	{"g.root-servers.net", []net.IP{net.ParseIP("192.112.36.4"), net.ParseIP("2001:500:12::d0d")}},
+	{"h.root-servers.net", []net.IP{net.ParseIP("198.97.190.53"), net.ParseIP("2001:500:1::53")}},
+	{"i.root-servers.net", []net.IP{net.ParseIP("192.36.148.17"), net.ParseIP("2001:7fe::53")}},
+	{"j.root-servers.net", []net.IP{net.ParseIP("192.58.128.30"), net.ParseIP("2001:503:c27::2:30")}},
+	{"k.root-servers.net", []net.IP{net.ParseIP("193.0.14.129"), net.ParseIP("2001:7fd::1")}},
+	{"l.root-servers.net", []net.IP{net.ParseIP("199.7.83.42"), net.ParseIP("2001:500:9f::42")}},
+	{"m.root-servers.net", []net.IP{net.ParseIP("202.12.27.33"), net.ParseIP("2001:dc3::35")}},
+}
+
+// nameServer is an authoritative server of a zone with the addresses known
+// for it, from glue or earlier lookups.
+type nameServer struct {
+	host  string
+	addrs []net.IP
+}
+
+// delegation is a zone and the servers it is delegated to.
+type delegation struct {
+	zone    string
+	servers []nameServer
+	expires time.Time
+}
+
+// addrEntry holds the addresses of a name server host.
+type addrEntry struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+// iterativeResolver resolves queries itself rather than forwarding them:
+// starting from the root hints, it follows the delegations in referrals down
+// to a server authoritative for the name, completing CNAME chains on the
+// way. The delegations and name server addresses learned are cached for
+// their TTL, so later queries start from the closest known zone.
+type iterativeResolver struct {
+	client *dns.Client
+	hints  []nameServer
+	port   int  // Port of the authoritative servers
+	ipv6   bool // Prefer IPv6 addresses of the servers, for IPv6-only hosts
+
+	mu          sync.Mutex
+	delegations map[string]*delegation // By canonical zone name
+	addrs       map[string]addrEntry   // By canonical host name
+}
+
+func newIterativeResolver(timeout time.Duration) *iterativeResolver {
+	return &iterativeResolver{
+		client:      &dns.Client{Timeout: timeout, Rand: rng},
+		hints:       rootHints,
+		port:        53,
+		delegations: make(map[string]*delegation),
+		addrs:       make(map[string]addrEntry),
+	}
+}
+
+// resolution is the state shared by the lookups made for one client query.
+type resolution struct {
+	queries int // Queries sent so far
+}
+
+// ServeDNS resolves every question of the request, answering with SERVFAIL
+// when one of them cannot be resolved.
+func (ir *iterativeResolver) ServeDNS(w dns.ResponseWriter, r *dns.Message) {
+	responses := make([]dns.Message, 0, len(r.Question.Queries))
+	for _, req := range dns.SplitMessageQuestions(*r) {
+		m, err := ir.resolve(&resolution{}, req.Question.Queries[0], 0)
+		if err != nil {
+			slog.Warn("Recursive resolution failed", "name", privacy.name(req.Question.Queries[0].Name), "err", err)
+			w.WriteMsg(errorResponse(*r, dns.RCODE_SERVFAIL, reasonResolution))
+			return
+		}
+		res := dns.NewErrorResponse(req, m.Header.RCode())
+		res.Header.SetRA(true)
+		res.Answer, res.Authority = m.Answer, m.Authority
+		res.Header.ANCOUNT = uint16(len(res.Answer.Records))
+		res.Header.NSCOUNT = uint16(len(res.Authority.Records))
+		responses = append(responses, res)
+	}
+	if len(responses) == 1 {
+		w.WriteMsg(responses[0])
+		return
+	}
+	w.WriteMsg(dns.MergeMessageAnswers(responses))
+}
+
+// resolve looks up q and the targets of the aliases in its answer.
+func (ir *iterativeResolver) resolve(res *resolution, q dns.Query, depth int) (dns.Message, error) {
+	m, err := ir.lookup(res, q, depth)
+	if err != nil || !followsCNAMEs(q.Type) {
+		return m, err
+	}
+	for i := 0; i < maxCNAMEChain && m.Header.RCode() == dns.RCODE_NOERROR; i++ {
+		target, ok := unresolvedAlias(m.Answer.Records, q)
+		if !ok {
+			break
+		}
+		sub, err := ir.lookup(res, dns.Query{Name: target, Type: q.Type, Class: q.Class}, depth)
+		if err != nil {
+			return dns.Message{}, err
+		}
+		m.Answer.Records = append(m.Answer.Records, sub.Answer.Records...)
+		m.Authority = sub.Authority
+		m.Header.SetRCode(sub.Header.RCode())
+	}
+	return m, nil
+}
+
+// lookup follows referrals from the closest known zone of the name until a
+// server answers for it.
+func (ir *iterativeResolver) lookup(res *resolution, q dns.Query, depth int) (dns.Message, error) {
+	d := ir.closest(q.Name)
+	for i := 0; i < iterativeMaxReferrals; i++ {
+		m, err := ir.queryZone(res, d, q, depth)
+		if err != nil {
+			return dns.Message{}, fmt.Errorf("zone %q: %w", d.zone+".", err)
+		}
+		next, ok := ir.referral(m, d, q.Name)
+		if !ok {
+			// Only trust the records the zone is authoritative for.
+			m.Answer.Records = inBailiwick(m.Answer.Records, d.zone)
+			return m, nil
+		}
+		slog.Debug("Following referral", "name", privacy.name(q.Name), "from", d.zone+".", "to", next.zone+".")
+		d = next
+	}
+	return dns.Message{}, errors.New("too many referrals")
+}
+
+// closest returns the cached delegation nearest to name, or the root hints.
+func (ir *iterativeResolver) closest(name string) *delegation {
+	now := time.Now()
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	for zone, ok := dns.CanonicalName(name), true; ok && zone != ""; zone, ok = dns.Parent(zone) {
+		if d, found := ir.delegations[zone]; found {
+			if now.Before(d.expires) {
+				return d
+			}
+			delete(ir.delegations, zone)
+		}
+	}
+	return &delegation{zone: "", servers: ir.hints}
+}
+
+// queryZone asks the servers of d in random order until one answers. Servers
+// without known addresses are only tried, after looking their addresses up,
+// once the others have failed.
+func (ir *iterativeResolver) queryZone(res *resolution, d *delegation, q dns.Query, depth int) (dns.Message, error) {
+	servers := append([]nameServer(nil), d.servers...)
+	shuffle(len(servers), func(i, j int) { servers[i], servers[j] = servers[j], servers[i] })
+	var (
+		pending []string
+		lastErr = errors.New("no server addresses")
+	)
+	for _, ns := range servers {
+		addrs := ns.addrs
+		if len(addrs) == 0 {
+			addrs = ir.cachedAddrs(ns.host)
+		}
+		if len(addrs) == 0 {
+			pending = append(pending, ns.host)
+			continue
+		}
+		m, err := ir.queryServer(res, addrs, q)
+		if err == nil {
+			return m, nil
+		}
+		lastErr = err
+	}
+	for _, host := range pending {
+		// A server inside the zone without glue can only be found
+		// through the zone itself.
+		if depth >= iterativeMaxDepth || dns.IsSubDomain(d.zone, host) {
+			continue
+		}
+		addrs, err := ir.hostAddrs(res, host, depth+1)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		m, err := ir.queryServer(res, addrs, q)
+		if err == nil {
+			return m, nil
+		}
+		lastErr = err
+	}
+	return dns.Message{}, lastErr
+}
+
+// queryServer sends q to the addresses of a server, IPv4 first unless ipv6
+// is set, until one gives a usable response.
+func (ir *iterativeResolver) queryServer(res *resolution, addrs []net.IP, q dns.Query) (dns.Message, error) {
+	var err error
+	for _, v4 := range []bool{!ir.ipv6, ir.ipv6} {
+		for _, ip := range addrs {
+			if (ip.To4() != nil) != v4 {
+				continue
+			}
+			if res.queries >= iterativeMaxQueries {
+				return dns.Message{}, errors.New("query budget exhausted")
+			}
+			res.queries++
+			var m dns.Message
+			m, err = ir.exchange(ip, q)
+			if err != nil {
+				continue
+			}
+			switch rcode := m.Header.RCode(); rcode {
+			case dns.RCODE_NOERROR, dns.RCODE_NXDOMAIN:
+				return m, nil
+			default:
+				err = fmt.Errorf("server %s answered %s", ip, rcode)
+			}
+		}
+	}
+	return dns.Message{}, err
+}
+
+func (ir *iterativeResolver) exchange(ip net.IP, q dns.Query) (dns.Message, error) {
+	req := dns.NewQuery(q.Name, q.Type).WithClass(q.Class).WithoutRD().WithEDNS(iterativePayloadSize).Message()
+	addr := &net.UDPAddr{IP: ip, Port: ir.port}
+	metrics.inc("queries_iterative_total")
+	start := time.Now()
+	if tap != nil {
+		tap.log(dnstapEvent{kind: dnstapResolverQuery, protocol: "udp", peer: addr, queryAt: start, query: req.Byte()})
+	}
+	m, err := ir.client.Exchange(context.Background(), req, addr.String())
+	if err != nil {
+		return dns.Message{}, err
+	}
+	if tap != nil {
+		tap.log(dnstapEvent{kind: dnstapResolverResponse, protocol: "udp", peer: addr, queryAt: start, respAt: time.Now(), response: m.Byte()})
+	}
+	tagOrigin(&m, "recursion, from "+addr.String())
+	if m.Header.TC() {
+		metrics.inc("upstream_truncated_total")
+		slog.Info("Authoritative server truncated the UDP response, using what fits", "server", addr.String(), "name", privacy.name(q.Name))
+	}
+	return m, nil
+}
+
+// referral returns the delegation in m if it is a referral from d to a zone
+// closer to name, and caches it along with its glue.
+func (ir *iterativeResolver) referral(m dns.Message, d *delegation, name string) (*delegation, bool) {
+	if m.Header.RCode() != dns.RCODE_NOERROR || m.Header.AA() || len(m.Answer.Records) > 0 {
+		return nil, false
+	}
+	next := &delegation{}
+	found := false
+	var ttl uint32
+	for _, rr := range m.Authority.Records {
+		ns, ok := rr.NS()
+		if !ok {
+			continue
+		}
+		zone := dns.CanonicalName(rr.Name)
+		if !found {
+			// The delegated zone must be below the one asked and
+			// contain the name, or servers could send us anywhere.
+			if zone == dns.CanonicalName(d.zone) || !dns.IsSubDomain(d.zone, zone) || !dns.IsSubDomain(zone, name) {
+				continue
+			}
+			next.zone, ttl, found = zone, rr.TTL, true
+		}
+		if zone != next.zone {
+			continue
+		}
+		if rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+		next.servers = append(next.servers, nameServer{host: dns.CanonicalName(ns.Host)})
+	}
+	if !found {
+		return nil, false
+	}
+	now := time.Now()
+	for i := range next.servers {
+		for _, rr := range m.Additional.Records {
+			// Glue is only taken from a server responsible for it.
+			if dns.CanonicalName(rr.Name) != next.servers[i].host || !dns.IsSubDomain(d.zone, rr.Name) {
+				continue
+			}
+			if a, ok := rr.A(); ok {
+				next.servers[i].addrs = append(next.servers[i].addrs, a.Addr)
+			} else if a, ok := rr.AAAA(); ok {
+				next.servers[i].addrs = append(next.servers[i].addrs, a.Addr)
+			}
+		}
+	}
+	next.expires = now.Add(ttlDuration(ttl))
+	ir.mu.Lock()
+	ir.delegations[next.zone] = next
+	for _, ns := range next.servers {
+		if len(ns.addrs) > 0 {
+			ir.addrs[ns.host] = addrEntry{addrs: ns.addrs, expires: next.expires}
+		}
+	}
+	ir.mu.Unlock()
+	return next, true
+}
+
+// cachedAddrs returns the known addresses of a name server host.
+func (ir *iterativeResolver) cachedAddrs(host string) []net.IP {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	e, ok := ir.addrs[dns.CanonicalName(host)]
+	if !ok || time.Now().After(e.expires) {
+		return nil
+	}
+	return e.addrs
+}
+
+// hostAddrs resolves the IPv4 addresses of a name server host, or its IPv6
+// addresses if it has none, and caches them. With ipv6 set, the IPv6
+// addresses are looked up first.
+func (ir *iterativeResolver) hostAddrs(res *resolution, host string, depth int) ([]net.IP, error) {
+	qtypes := []uint16{dns.TYPE_A, dns.TYPE_AAAA}
+	if ir.ipv6 {
+		qtypes[0], qtypes[1] = qtypes[1], qtypes[0]
+	}
+	for _, qtype := range qtypes {
+		m, err := ir.resolve(res, dns.Query{Name: host, Type: qtype, Class: dns.CLASS_IN}, depth)
+		if err != nil {
+			return nil, err
+		}
+		var addrs []net.IP
+		ttl := uint32(0)
+		for _, rr := range m.Answer.Records {
+			var ip net.IP
+			if a, ok := rr.A(); ok && qtype == dns.TYPE_A {
+				ip = a.Addr
+			} else if a, ok := rr.AAAA(); ok && qtype == dns.TYPE_AAAA {
+				ip = a.Addr
+			} else {
+				continue
+			}
+			if len(addrs) == 0 || rr.TTL < ttl {
+				ttl = rr.TTL
+			}
+			addrs = append(addrs, ip)
+		}
+		if len(addrs) > 0 {
+			ir.mu.Lock()
+			ir.addrs[dns.CanonicalName(host)] = addrEntry{addrs: addrs, expires: time.Now().Add(ttlDuration(ttl))}
+			ir.mu.Unlock()
+			return addrs, nil
+		}
+	}
+	return nil, fmt.Errorf("no addresses for name server %s", host)
+}
+
+// inBailiwick returns the records at or below zone.
+func inBailiwick(records []dns.Record, zone string) []dns.Record {
+	var kept []dns.Record
+	for _, rr := range records {
+		if dns.IsSubDomain(zone, rr.Name) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// ttlDuration converts a TTL to how long data is cached, capped at a day.
+func ttlDuration(ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d > iterativeMaxTTL {
+		return iterativeMaxTTL
+	}
+	return d
+}
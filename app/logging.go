@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// setupLogging makes slog write records of at least the given level to w,
+// as logfmt-style text or as one JSON object per line.
+func setupLogging(level, format string, w io.Writer) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(h))
+	// SetDefault sends the log package to slog at INFO; fatal errors, the
+	// only ones logged through it, are logged at ERROR so that they show
+	// at any level.
+	log.SetOutput(slog.NewLogLogger(h, slog.LevelError).Writer())
+	return nil
+}
+
+// queryLogWriter logs every response with the query it answers, the client,
+// the time it took to produce, and the reason of rejections. Since it sees
+// responses first, it also removes the OPT record carrying the reason from
+// responses to clients that did not use EDNS.
+type queryLogWriter struct {
+	dns.ResponseWriter
+	transport string
+	start     time.Time
+	edns      bool // Whether the query had an OPT record
+}
+
+func (w *queryLogWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *queryLogWriter) WriteMsg(m dns.Message) error {
+	attrs := []interface{}{
+		addrAttr("client", w.RemoteAddr()),
+		slog.String("transport", w.transport),
+		slog.String("rcode", m.Header.RCode().String()),
+		slog.Int("answers", len(m.Answer.Records)),
+		slog.Float64("latency_ms", float64(time.Since(w.start).Microseconds())/1000),
+	}
+	if len(m.Question.Queries) > 0 {
+		q := m.Question.Queries[0]
+		attrs = append(attrs, slog.String("name", privacy.name(q.Name)), slog.String("type", dns.TypeString(q.Type)))
+	}
+	if reason, ede, ok := responseReason(m); ok {
+		attrs = append(attrs, slog.String("reason", reason), slog.Int("ede", int(ede)))
+	}
+	if !w.edns {
+		m.ClearEDNS()
+	}
+	slog.Info("query", attrs...)
+	logProvenance(m)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// addrAttr is a client address attribute, redacted as privacy requires.
+func addrAttr(key string, addr net.Addr) slog.Attr {
+	return slog.String(key, privacy.addr(addr))
+}
@@ -1,110 +1,802 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
 )
 
 func main() {
-	resolver := flag.String("resolver", "", "resolver address")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "zonediff":
+			os.Exit(runZoneDiff(os.Args[2:], os.Stdout))
+		case "import":
+			os.Exit(runImport(os.Args[2:], os.Stdout))
+		}
+	}
+
+	var listenAddrs stringList
+	flag.Var(&listenAddrs, "listen", "address to serve UDP and TCP on, may be repeated (default 127.0.0.1:2053)")
+	resolver := flag.String("resolver", "", "comma separated list of resolver addresses, tried in order: host:port over UDP, tcp://host[:port] for DNS over TCP only, tls://host[:port] for DNS over TLS, https://host[:port]/path for DNS over HTTPS, dnscrypt://<provider public key>@host[:port]/<provider name> for DNSCrypt, or a DNS stamp (sdns://) of any of these")
+	var forwardRules valueList
+	flag.Var(&forwardRules, "forward", "forward a domain and its subdomains to other resolvers as domain=addr[,addr...], the longest matching domain wins over -resolver; may be repeated")
+	recursive := flag.Bool("recursive", false, "resolve names iteratively from the root servers instead of forwarding them to -resolver")
+	rootHintsPath := flag.String("root-hints", "", "named.root file listing the root servers -recursive starts from, primed at startup (the copy kept in -root-dir, or built-in hints, if empty)")
+	resolverTimeout := flag.Duration("resolver-timeout", 2*time.Second, "time to wait for a reply from the resolver or, with -recursive, an authoritative server")
+	resolverTLSCA := flag.String("resolver-tls-ca", "", "PEM file of the CA certificates that DNS over TLS and HTTPS resolvers are verified against (system roots if empty)")
+	resolverTLSInsecure := flag.Bool("resolver-tls-insecure", false, "skip certificate verification of DNS over TLS and HTTPS resolvers, for testing only")
+	resolverDoHStreams := flag.Int("resolver-doh-max-streams", 100, "requests in flight at once to each address of a DNS over HTTPS resolver (0 is unlimited)")
+	resolverDoHIdle := flag.Duration("resolver-doh-idle-timeout", 90*time.Second, "close connections to DNS over HTTPS resolvers idle for this long")
+	var resolverTSIG stringList
+	flag.Var(&resolverTSIG, "resolver-tsig", "sign the queries to a -resolver or -forward resolver over UDP, TCP, or TLS as resolver=key with a -tsig-key key, and require its responses to be signed; may be repeated")
+	resolverMultiQuestion := flag.String("resolver-multi-question", "auto", "how requests with several questions are forwarded: auto sends them whole to each resolver until it rejects one, split sends one request per question, and whole always sends them as they are")
+	resolverRetries := flag.Int("resolver-retries", 2, "number of retries when the resolver does not reply")
+	retryRCodes := flag.String("retry-rcodes", "SERVFAIL,REFUSED", "comma separated list of resolver rcodes that cause the next resolver to be tried")
+	outageJournal := flag.String("upstream-journal", "", "file recording when upstream resolvers were down, served at /upstreams/outages of the admin API (disabled if empty)")
+	systemFallback := flag.Bool("system-fallback", false, "answer with the host's default resolver when no resolver replies")
+	cacheSize := flag.Int("cache-size", 10000, "maximum number of cached resolver responses (0 disables caching)")
+	cacheStale := flag.Duration("cache-stale-window", 0, "answer from the cache right away when a cached answer has less than 10% of its TTL left, or expired less than this long ago, refreshing it in the background (0 disables)")
+	cacheRevalidate := flag.Duration("cache-revalidate-interval", 0, "re-resolve a random cached response this often and report it if the upstream now answers differently (0 disables)")
+	var cacheTTLs stringList
+	flag.Var(&cacheTTLs, "cache-ttl", "clamp the TTL of cached records of a type as TYPE=MIN:MAX in seconds, either bound optional and * for all other types, e.g. NS=86400: or A=:300; may be repeated")
+	allow := flag.String("allow", "", "comma separated networks allowed to query the server, everyone if empty; local stands for the subnets of the host's interfaces")
+	deny := flag.String("deny", "", "comma separated networks denied from querying the server, taking precedence over -allow")
+	aclAction := flag.String("acl-action", "refuse", "what happens to queries of clients not allowed: refuse or drop")
+	recursionAllow := flag.String("recursion-allow", "local", "comma separated networks allowed to resolve names through the upstream resolvers; local stands for the subnets of the host's interfaces, any for everyone")
+	openResolverCheck := flag.Duration("open-resolver-check-interval", 0, "how often to check that clients outside -recursion-allow are refused, 0 to check only at startup")
+	internalDomains := flag.String("internal-domains", "", "comma separated list of domains that must never be sent to public resolvers")
+	internalResolver := flag.String("internal-resolver", "", "comma separated list of resolvers answering internal domains")
+	quotaLimit := flag.Int("quota", 0, "daily number of queries allowed per client (0 disables)")
+	quotaAction := flag.String("quota-action", "log", "action once a client exceeds its quota: log, throttle, or refuse")
+	quotaFile := flag.String("quota-file", "", "file used to persist quota usage across restarts")
+	hostsPath := flag.String("hosts-file", "", "file in the /etc/hosts format whose names are answered ahead of zones, the cache, and the resolvers, reloaded when it changes (disabled if empty)")
+	var blocklistFiles stringList
+	flag.Var(&blocklistFiles, "blocklist", "file of domains to block with their subdomains, in hosts or domain list format; may be repeated")
+	blocklistAction := flag.String("blocklist-action", "nxdomain", "answer to queries for blocked domains: nxdomain, refused, or null for 0.0.0.0 and ::")
+	blocklistReload := flag.Duration("blocklist-reload-interval", time.Hour, "how often to read the blocklists again (0 disables)")
+	rrlRate := flag.Int("rrl-responses-per-second", 0, "identical authoritative UDP responses sent per second to a /24 (or /56) network before response rate limiting starts (0 disables)")
+	rrlSlip := flag.Int("rrl-slip", 2, "while rate limiting, send every Nth response truncated to make real clients retry over TCP and drop the rest (0 drops all)")
+	privacyMode := flag.String("privacy", "off", "anonymize client addresses and query names in logs and stats: off, hash, or truncate")
+	privacySalt := flag.String("privacy-salt", "", "key for hashed privacy mode, random per process if empty")
+	udpDedupWindow := flag.Duration("udp-dedup-window", 0, "answer a UDP query repeated by the same client within this long with the previous response, without resolving it again (0 disables)")
+	udpInflight := flag.Int("udp-max-inflight", defaultUDPInflight, "UDP queries handled at once on each -listen address; further queries wait in the socket buffer")
+	udpMaxSize := flag.Int("udp-max-size", 0, "largest UDP response payload, detected from the interface MTU if 0")
+	ipv6Only := flag.Bool("ipv6-only", false, "the host only has IPv6 connectivity: reach resolvers and name servers over IPv6 first, and turn on DNS64 with a discovered prefix unless -dns64 says otherwise")
+	dns64Prefix := flag.String("dns64", "", "synthesize AAAA records for names with only A records under this NAT64 prefix, such as the well-known 64:ff9b::/96, or auto to discover it from the resolvers through ipv4only.arpa (disabled if empty or off)")
+	randomSeed := flag.Int64("random-seed", 0, "draw transaction IDs, nonces, and other random protocol values from a generator with this seed, to reproduce a run exactly (0 uses the secure generator; for testing only)")
+	shuffleSeed := flag.Int64("shuffle-seed", 0, "randomize answer order and TTLs per query using this seed (0 disables, for testing only)")
+	shuffleMinTTL := flag.Uint("shuffle-min-ttl", 0, "lowest TTL produced when shuffling answers")
+	dohAddr := flag.String("doh-addr", "", "address of the DNS-over-HTTPS listener (disabled if empty)")
+	dohHTTPAddr := flag.String("doh-http-addr", "", "address of a plain HTTP listener for the DNS-over-HTTPS mapping, for localhost or reverse proxy use (disabled if empty)")
+	dotAddr := flag.String("dot-addr", "", "address of the DNS-over-TLS listener, usually :853 (disabled if empty)")
+	tcpIdleTimeout := flag.Duration("tcp-idle-timeout", 10*time.Second, "close TCP and DoT connections idle for this long")
+	transferConcurrency := flag.Int("transfer-max-concurrent", 4, "number of zone transfers served at once, further AXFR queries are refused")
+	transferRate := flag.Int("transfer-rate", 0, "bandwidth of each zone transfer in bytes per second (0 is unlimited)")
+	transferTSIGKeys := flag.String("transfer-tsig-keys", "", "comma separated names of -tsig-key keys, one of which must sign AXFR and IXFR queries (unsigned transfers are allowed if empty)")
+	var tsigKeySpecs stringList
+	flag.Var(&tsigKeySpecs, "tsig-key", "TSIG key as [hmac-sha256:]name:secret with the secret in base64; requests signed with it are verified and their responses signed, others get NOTAUTH; may be repeated")
+	memoryLimit := flag.Int("memory-limit", 0, "memory in MiB the process should stay under; above it, load is shed progressively: cached responses are evicted, then new TCP connections closed, then UDP queries beyond -memory-shed-udp-rate dropped (0 disables)")
+	memoryShedUDPRate := flag.Int("memory-shed-udp-rate", 1000, "UDP queries answered per second while shedding them to stay under -memory-limit")
+	rootDir := flag.String("root-dir", "", "directory where the root hints and trust anchor are kept up to date (disabled if empty)")
+	rootAnchorsCA := flag.String("root-anchors-ca", "", "PEM file of the ICANN CA certificate (icannbundle.pem from IANA, obtained out of band) that must have signed trust anchor updates in -root-dir; the trust anchor is not updated without it")
+	rootUpdateInterval := flag.Duration("root-update-interval", 7*24*time.Hour, "how often the root hints and trust anchor are refreshed")
+	dnssecValidate := flag.Bool("dnssec-validate", false, "validate the DNSSEC signatures of answers from -resolver and -forward upstreams, setting the AD bit on secure ones and answering SERVFAIL to bogus ones")
+	dnssecTrustAnchor := flag.String("dnssec-trust-anchor", "", "root-anchors.xml file, or zone file of DS or DNSKEY records, holding the trust anchor of the root zone for -dnssec-validate (the one kept up to date in -root-dir, or the built-in one, if empty)")
+	dnssecKeyDir := flag.String("dnssec-key-dir", "", "directory of the keys that sign the -zone zones, as <origin>.ksk.pem and <origin>.zsk.pem PKCS #8 files, generated as ECDSA P-256 keys if missing; queries with the DO bit get signed answers (zones are not signed if empty)")
+	dnssecSignatureValidity := flag.Duration("dnssec-signature-validity", 14*24*time.Hour, "how long the signatures of -dnssec-key-dir zones are valid; they are renewed with a quarter of it left")
+	dnssecNSEC3 := flag.Bool("dnssec-nsec3", false, "deny names in -dnssec-key-dir zones with NSEC3 records, which hide the names of the zone, rather than NSEC records")
+	dnssecNSEC3Iterations := flag.Int("dnssec-nsec3-iterations", 0, "additional hash iterations of the NSEC3 records of -dnssec-nsec3 zones")
+	dnssecNSEC3Salt := flag.String("dnssec-nsec3-salt", "", "salt of the NSEC3 records of -dnssec-nsec3 zones, in hex (none if empty)")
+	var staticLines valueList
+	var staticFiles stringList
+	flag.Var(&staticLines, "static-record", "record answered when neither forwarding nor resolving, in the zone file format such as \"app.test. 60 IN A 10.0.0.1\", may be repeated; other names get NXDOMAIN")
+	flag.Var(&staticFiles, "static-file", "zone file of records answered when neither forwarding nor resolving, with names relative to the root, may be repeated")
+	var zoneFiles stringList
+	flag.Var(&zoneFiles, "zone", "authoritative zone to serve as origin=path of its zone file, may be repeated")
+	var secondaryZones stringList
+	flag.Var(&secondaryZones, "secondary-zone", "zone to serve as a secondary of its primary server, as origin=primary[:port], transferred with AXFR or IXFR and refreshed on the timers of its SOA record; may be repeated")
+	var notifyAddrs stringList
+	flag.Var(&notifyAddrs, "notify", "secondary server, as host[:port], sent a NOTIFY when the serial of a -zone or -secondary-zone zone grows on reload or transfer; may be repeated")
+	secondaryTSIGKey := flag.String("secondary-tsig-key", "", "name of the -tsig-key key that signs the queries and transfers of -secondary-zone zones (unsigned if empty)")
+	var reverseZones stringList
+	flag.Var(&reverseZones, "reverse-zone", "network in CIDR notation whose reverse zone is served with PTR records for the addresses in the -zone zones, may be repeated")
+	registryZone := flag.String("registry-zone", "", "zone publishing the services registered through the admin API (disabled if empty)")
+	adminAddr := flag.String("admin-addr", "", "address of the admin HTTP API, keep it private (disabled if empty)")
+	adminAllow := flag.String("admin-allow", "127.0.0.1,::1", "comma separated networks allowed to use the admin API; local stands for the subnets of the host's interfaces, any for everyone")
+	adminHostNames := flag.String("admin-hosts", "", "comma separated names the admin API may be reached by in the Host header of requests, besides localhost, loopback addresses, and the host of -admin-addr; requests for other hosts are refused to thwart DNS rebinding")
+	var webhooks stringList
+	flag.Var(&webhooks, "webhook", "URL receiving a JSON POST for every change of authoritative records, may be repeated")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file for encrypted listeners")
+	tlsKey := flag.String("tls-key", "", "TLS private key file for encrypted listeners")
+	singleShot := flag.Bool("single-shot", false, "answer one wire format query read from stdin on stdout and exit, without listening")
+	sloLatency := flag.Duration("slo-latency", 50*time.Millisecond, "latency objective of responses, measured from the arrival of the query")
+	sloTarget := flag.Float64("slo-target", 0.99, "fraction of responses that must meet the latency objective")
+	sloBurnRate := flag.Float64("slo-burn-rate", 14.4, "error budget burn rate over both the last 5 minutes and hour that raises an alert, 0 to disable alerts")
+	var sloWebhooks stringList
+	flag.Var(&sloWebhooks, "slo-webhook", "URL receiving a JSON POST when the latency SLO alert fires or resolves, may be repeated")
+	dnstapTarget := flag.String("dnstap", "", "write dnstap frames of client and resolver messages to this file, or to unix:/path of a Frame Streams socket")
+	dnstapIdentity := flag.String("dnstap-identity", "", "identity of the server in dnstap messages")
+	uncompressedClients := flag.String("uncompressed-clients", "", "comma separated networks whose responses are sent with every name written in full, for stub resolvers that mishandle compression pointers; their responses are larger and truncated over UDP sooner")
+	profileClients := flag.String("profile-clients", "", "comma separated networks whose responses to queries with EDNS carry the time spent in each stage of the pipeline as the text of an Extended DNS Error, for debugging")
+	logLevel := flag.String("log-level", "info", "least severe log messages written: debug, info, warn, or error")
+	logFormat := flag.String("log-format", "text", "format of log messages: text or json")
+	configPath := flag.String("config", "", "TOML file setting any of these flags by name, grouped in tables by their first word if desired; flags on the command line take precedence; read again on SIGHUP")
+	checkConfig := flag.Bool("check-config", false, "validate the flags, the configuration file, and the files they refer to, then exit without serving")
 	flag.Parse()
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if *configPath != "" {
+		if err := loadConfig(*configPath, flag.CommandLine, explicit); err != nil {
+			log.Fatal("Invalid configuration: ", err)
+		}
+	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
-	if err != nil {
-		log.Fatal("Failed to resolve UDP address:", err)
+	// In single-shot mode stdout carries the response, so log to stderr.
+	stdout := os.Stdout
+	if *singleShot {
+		os.Stdout = os.Stderr
+	}
+	if err := setupLogging(*logLevel, *logFormat, os.Stdout); err != nil {
+		log.Fatal("Invalid logging flags: ", err)
+	}
+
+	if *randomSeed != 0 {
+		rng = dns.NewSeededRand(*randomSeed)
+		slog.Warn("Random values are predictable, do not use -random-seed in production", "seed", *randomSeed)
 	}
 
-	udpConn, err := net.ListenUDP("udp", udpAddr)
+	mode, err := parsePrivacyMode(*privacyMode)
 	if err != nil {
-		log.Fatal("Failed to bind to address:", err)
+		log.Fatal("Invalid -privacy:", err)
+	}
+	if privacy, err = newRedactor(mode, *privacySalt); err != nil {
+		log.Fatal("Failed to set up privacy mode:", err)
 	}
-	defer udpConn.Close()
 
-	var (
-		resolverAddr *net.UDPAddr
-		resolverConn *net.UDPConn
-	)
-	if *resolver != "" {
-		resolverAddr, err = net.ResolveUDPAddr("udp", *resolver)
+	if *rootDir != "" {
+		updater, err := newRootUpdater(*rootDir, *rootUpdateInterval, *rootAnchorsCA)
 		if err != nil {
-			log.Fatal("Failed to resolve resolver UDP address:", err)
+			log.Fatal("Failed to set up root data updates: ", err)
 		}
+		go updater.run()
+	}
 
-		resolverConn, err = net.DialUDP("udp", nil, resolverAddr)
-		if err != nil {
-			log.Fatal("Failed to dial to resolver address:", err)
+	if *outageJournal != "" {
+		if outages, err = openOutageJournal(*outageJournal); err != nil {
+			log.Fatal("Failed to open upstream journal: ", err)
 		}
-		defer resolverConn.Close()
 	}
 
-	buf := make([]byte, 512)
+	if *memoryLimit < 0 || *memoryShedUDPRate < 0 {
+		log.Fatal("-memory-limit and -memory-shed-udp-rate must not be negative")
+	}
+	if *memoryLimit > 0 {
+		shedder = newLoadShedder(uint64(*memoryLimit)<<20, *memoryShedUDPRate)
+	}
+
+	if *dnstapTarget != "" {
+		if tap, err = newDnstapWriter(*dnstapTarget, *dnstapIdentity); err != nil {
+			log.Fatal("Failed to open dnstap output: ", err)
+		}
+	}
 
-	for {
-		size, source, err := udpConn.ReadFromUDP(buf)
+	if *sloTarget <= 0 || *sloTarget >= 1 {
+		log.Fatal("-slo-target must be between 0 and 1")
+	}
+	var sloHooks *webhookNotifier
+	if len(sloWebhooks) > 0 {
+		sloHooks = newWebhookNotifier(sloWebhooks)
+	}
+	s := &server{slo: newSLOTracker(*sloLatency, *sloTarget, *sloBurnRate, sloHooks)}
+	if *rrlSlip < 0 {
+		log.Fatal("-rrl-slip must not be negative")
+	}
+	if *rrlRate > 0 {
+		s.rrl = newResponseLimiter(*rrlRate, *rrlSlip)
+		slog.Info("Response rate limiting enabled", "responses_per_second", *rrlRate, "slip", *rrlSlip)
+	}
+	go s.slo.run()
+	if *uncompressedClients != "" {
+		if s.uncompressedClients, err = parseACL(*uncompressedClients); err != nil {
+			log.Fatal("Invalid -uncompressed-clients: ", err)
+		}
+	}
+	if *profileClients != "" {
+		if s.profileClients, err = parseACL(*profileClients); err != nil {
+			log.Fatal("Invalid -profile-clients: ", err)
+		}
+	}
+	adminACL, err := parseACL(*adminAllow)
+	if err != nil {
+		log.Fatal("Invalid -admin-allow: ", err)
+	}
+	if s.tsigKeys, err = parseTSIGKeys(tsigKeySpecs); err != nil {
+		log.Fatal("Invalid -tsig-key: ", err)
+	}
+	var transferKeys map[string]bool
+	if *transferTSIGKeys != "" {
+		transferKeys = make(map[string]bool)
+		for _, name := range strings.Split(*transferTSIGKeys, ",") {
+			key, ok := s.tsigKeys.get(strings.TrimSpace(name))
+			if !ok {
+				log.Fatalf("Invalid -transfer-tsig-keys: unknown key %q", name)
+			}
+			transferKeys[key.Name] = true
+		}
+	}
+	s.notifier = newZoneNotifier(notifyAddrs)
+	var secondaryKey *dns.TSIGKey
+	if *secondaryTSIGKey != "" {
+		key, ok := s.tsigKeys.get(*secondaryTSIGKey)
+		if !ok {
+			log.Fatalf("Invalid -secondary-tsig-key: unknown key %q", *secondaryTSIGKey)
+		}
+		secondaryKey = &key
+	}
+	var quota *quotaTracker
+	if *quotaLimit > 0 {
+		action, err := parseQuotaAction(*quotaAction)
+		if err != nil {
+			log.Fatal("Invalid -quota-action:", err)
+		}
+		if quota, err = newQuotaTracker(*quotaLimit, action, *quotaFile); err != nil {
+			log.Fatal("Failed to load quota file:", err)
+		}
+		defer quota.save()
+	}
+	var registry *serviceRegistry
+	if *registryZone != "" {
+		z := newZone(*registryZone)
+		z.source = "registry"
+		registry = newServiceRegistry(z)
+	}
+	transfers := newTransferLimiter(*transferConcurrency, *transferRate)
+	var hooks *webhookNotifier
+	if len(webhooks) > 0 {
+		hooks = newWebhookNotifier(webhooks)
+	}
+
+	if len(listenAddrs) == 0 && !*singleShot {
+		listenAddrs = stringList{"127.0.0.1:2053"}
+	}
+	if *singleShot {
+		s.udpPayloadSize = *udpMaxSize
+	}
+	var udpListeners []*udpListener
+	for _, addr := range listenAddrs {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
 		if err != nil {
-			fmt.Println("Error receiving data:", err)
+			log.Fatal("Failed to resolve UDP address:", err)
+		}
+		if *checkConfig {
 			continue
 		}
+		udpConn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			log.Fatal("Failed to bind to address:", err)
+		}
+		defer udpConn.Close()
 
-		receivedData := buf[:size]
-		fmt.Printf("Received %d bytes from %s\n", size, source)
+		l := &udpListener{conn: udpConn, linkLimit: *udpMaxSize, inflight: *udpInflight}
+		if *udpDedupWindow > 0 {
+			l.replay = newReplayCache(*udpDedupWindow)
+		}
+		if l.linkLimit == 0 {
+			l.linkLimit = detectUDPPayloadSize(udpAddr.IP)
+		}
+		if s.udpPayloadSize == 0 || l.linkLimit < s.udpPayloadSize {
+			s.udpPayloadSize = l.linkLimit
+		}
+		slog.Info("Listening", "addr", udpConn.LocalAddr().String(), "udp_limit", l.linkLimit)
+		udpListeners = append(udpListeners, l)
+	}
+
+	// build sets up the pipeline from the flags and the files they name. It
+	// runs at startup and again on SIGHUP, after the configuration file is
+	// read again.
+	build := func() (*pipeline, error) {
+		p := &pipeline{stop: make(chan struct{})}
+		var err error
+		var middlewares []dns.Middleware
+		if *allow != "" || *deny != "" {
+			acl := &clientACL{}
+			if acl.allow, err = parseACL(*allow); err != nil {
+				return nil, fmt.Errorf("invalid -allow: %w", err)
+			}
+			if acl.deny, err = parseACL(*deny); err != nil {
+				return nil, fmt.Errorf("invalid -deny: %w", err)
+			}
+			if acl.action, err = parseACLAction(*aclAction); err != nil {
+				return nil, fmt.Errorf("invalid -acl-action: %w", err)
+			}
+			middlewares = append(middlewares, acl.middleware)
+		}
+		if quota != nil {
+			middlewares = append(middlewares, quota.middleware)
+		}
+		if *hostsPath != "" {
+			hosts, err := newHostsFile(*hostsPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load hosts file: %w", err)
+			}
+			go hosts.run(p.stop)
+			middlewares = append(middlewares, hosts.middleware)
+		}
+		if len(blocklistFiles) > 0 {
+			action, err := parseBlockAction(*blocklistAction)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -blocklist-action: %w", err)
+			}
+			blocklist, err := newBlocklist(blocklistFiles, action)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load blocklist: %w", err)
+			}
+			if *blocklistReload > 0 {
+				go blocklist.run(*blocklistReload, p.stop)
+			}
+			middlewares = append(middlewares, blocklist.middleware)
+		}
+		dns64Mode := *dns64Prefix
+		if *ipv6Only && dns64Mode == "" {
+			dns64Mode = "auto"
+		}
+		var nat64 *dns64
+		switch dns64Mode {
+		case "", "off":
+		case "auto":
+			nat64 = &dns64{}
+		default:
+			prefix, err := parseNAT64Prefix(dns64Mode)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -dns64: %w", err)
+			}
+			nat64 = &dns64{prefix: prefix}
+		}
+		if nat64 != nil {
+			middlewares = append(middlewares, nat64.middleware)
+		}
+		if *shuffleSeed != 0 {
+			shuffler := newAnswerShuffler(*shuffleSeed, uint32(*shuffleMinTTL))
+			middlewares = append(middlewares, shuffler.middleware)
+		}
 
-		var res dns.Message
-		if *resolver != "" {
-			res = handleWithResolver(receivedData, resolverAddr, resolverConn)
+		recursionACL, err := parseACL(*recursionAllow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -recursion-allow: %w", err)
+		}
+		mux := dns.NewServeMux()
+		p.handler = dns.Chain(mux, append(middlewares, followCNAMEs)...)
+		// validated goes around the resolvers, inside the caches, so that
+		// the answers are cached with their validation.
+		validated := func(h dns.Handler) dns.Handler { return h }
+		if *dnssecValidate {
+			anchorPath := *dnssecTrustAnchor
+			if anchorPath == "" && *rootDir != "" {
+				if path := filepath.Join(*rootDir, rootAnchorsFile); isFile(path) {
+					anchorPath = path
+				}
+			}
+			anchors, err := loadTrustAnchors(anchorPath, time.Now())
+			if err != nil {
+				return nil, fmt.Errorf("invalid -dnssec-trust-anchor: %w", err)
+			}
+			validated = func(h dns.Handler) dns.Handler {
+				return traced(stageValidation, newDNSSECValidator(h, anchors))
+			}
+		}
+		var ttlClamps *ttlPolicy
+		if len(cacheTTLs) > 0 {
+			if ttlClamps, err = parseTTLPolicy(cacheTTLs); err != nil {
+				return nil, fmt.Errorf("invalid -cache-ttl: %w", err)
+			}
+		}
+		if *recursive && *resolver != "" {
+			return nil, errors.New("-recursive and -resolver are mutually exclusive")
+		}
+		if *recursive && *dnssecValidate {
+			// The iterative resolver neither asks for signatures nor sends
+			// DS queries to the parent side of zone cuts.
+			return nil, errors.New("-dnssec-validate applies to forwarded answers and cannot be combined with -recursive")
+		}
+		softRCodes, err := parseRCodes(*retryRCodes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -retry-rcodes: %w", err)
+		}
+		upstreamTLS, err := upstreamTLSConfig(*resolverTLSCA, *resolverTLSInsecure)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -resolver-tls-ca: %w", err)
+		}
+		multiQuestion, err := parseMultiQuestionMode(*resolverMultiQuestion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -resolver-multi-question: %w", err)
+		}
+		upstreamOpts := upstreamOptions{tls: upstreamTLS, dohMaxStreams: *resolverDoHStreams, dohIdleTimeout: *resolverDoHIdle, preferIPv6: *ipv6Only, multiQuestion: multiQuestion}
+		if upstreamOpts.tsig, err = parseTSIGResolvers(resolverTSIG, s.tsigKeys); err != nil {
+			return nil, fmt.Errorf("invalid -resolver-tsig: %w", err)
+		}
+		if *recursive {
+			ir := newIterativeResolver(*resolverTimeout)
+			ir.ipv6 = *ipv6Only
+			hintsPath := *rootHintsPath
+			if hintsPath == "" && *rootDir != "" {
+				if path := filepath.Join(*rootDir, rootHintsFile); isFile(path) {
+					hintsPath = path
+				}
+			}
+			if hintsPath != "" {
+				if ir.hints, err = loadRootHints(hintsPath); err != nil {
+					return nil, fmt.Errorf("failed to load root hints: %w", err)
+				}
+				slog.Info("Loaded root hints", "file", hintsPath, "servers", len(ir.hints))
+			}
+			go ir.runPriming(p.stop)
+			var h dns.Handler = traced(stageRecursion, ir)
+			if *cacheSize > 0 {
+				p.rootCache = newResponseCache(*cacheSize, ttlClamps, *cacheStale)
+				h = traced(stageCache, p.rootCache.handler(h, *cacheRevalidate, p.stop))
+			}
+			mux.Handle(".", recursionGuard(recursionACL, h))
+			slog.Info("Resolving recursively from the root servers", "recursion_allow", recursionACL.String())
+		} else if *resolver != "" {
+			p.fwd, err = newForwarder(strings.Split(*resolver, ","), upstreamOpts, *resolverTimeout, *resolverRetries, softRCodes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to set up resolver: %w", err)
+			}
+			p.fwd.udpPayloadSize = s.udpPayloadSize
+			if *systemFallback {
+				p.fwd.fallback = newSystemResolver(*resolverTimeout)
+			}
+			h := validated(traced(stageUpstream, p.fwd))
+			if *cacheSize > 0 {
+				p.rootCache = newResponseCache(*cacheSize, ttlClamps, *cacheStale)
+				h = traced(stageCache, p.rootCache.handler(h, *cacheRevalidate, p.stop))
+			}
+			mux.Handle(".", recursionGuard(recursionACL, h))
+			slog.Info("Allowing recursion", "networks", recursionACL.String())
 		} else {
-			req := dns.NewRequest(receivedData)
-			res = dns.NewResponse(req, false)
+			static, err := loadStaticRecords(staticLines, staticFiles)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load static records: %w", err)
+			}
+			mux.Handle(".", traced(stageLocal, static))
 		}
 
-		if size, err = udpConn.WriteToUDP(res.Byte(), source); err != nil {
-			fmt.Println("Failed to send response:", err)
+		for _, rule := range forwardRules {
+			domain, addrs, ok := strings.Cut(rule, "=")
+			if !ok || addrs == "" {
+				return nil, fmt.Errorf("invalid -forward %s, want domain=addr[,addr...]", rule)
+			}
+			var addresses []string
+			for _, addr := range strings.Split(addrs, ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					addresses = append(addresses, addr)
+				}
+			}
+			domainFwd, err := newForwarder(addresses, upstreamOpts, *resolverTimeout, *resolverRetries, softRCodes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to set up resolver for %s: %w", domain, err)
+			}
+			domainFwd.udpPayloadSize = s.udpPayloadSize
+			h := validated(traced(stageUpstream, domainFwd))
+			if *cacheSize > 0 {
+				h = traced(stageCache, cached(h, *cacheSize, ttlClamps, *cacheStale, *cacheRevalidate, p.stop))
+			}
+			mux.Handle(strings.TrimSpace(domain), recursionGuard(recursionACL, h))
+			slog.Info("Forwarding domain", "domain", domain, "resolvers", addrs)
 		}
-		fmt.Printf("Written %d bytes to %s\n", size, source)
-	}
-}
 
-func forwardRequest(r dns.Message, resolverAddr *net.UDPAddr, resolverConn *net.UDPConn) (dns.Message, error) {
-	buf := make([]byte, 512)
-	size, err := resolverConn.Write(r.Byte())
+		if *internalDomains != "" {
+			var internalFwd *forwarder
+			if *internalResolver != "" {
+				internalFwd, err = newForwarder(strings.Split(*internalResolver, ","), upstreamOpts, *resolverTimeout, *resolverRetries, nil)
+				if err != nil {
+					return nil, fmt.Errorf("failed to set up internal resolver: %w", err)
+				}
+			}
+			guard := traced(stageInternal, &internalGuard{fwd: internalFwd})
+			if internalFwd != nil {
+				guard = recursionGuard(recursionACL, guard)
+			}
+			for _, domain := range strings.Split(*internalDomains, ",") {
+				mux.Handle(strings.TrimSpace(domain), guard)
+			}
+		}
+
+		if nat64 != nil && nat64.prefix == nil {
+			// The lookup goes around the middlewares, so that it sees the
+			// answers of the resolvers rather than our own synthesis.
+			go nat64.runDiscovery(mux, p.stop)
+		}
+
+		var signing *signingConfig
+		if *dnssecKeyDir != "" {
+			signing = &signingConfig{keyDir: *dnssecKeyDir, validity: *dnssecSignatureValidity, nsec3: *dnssecNSEC3}
+			// Validators treat zones hashed with more iterations as
+			// unsigned.
+			if *dnssecNSEC3Iterations < 0 || *dnssecNSEC3Iterations > dns.MaxNSEC3Iterations {
+				return nil, fmt.Errorf("invalid -dnssec-nsec3-iterations: not between 0 and %d", dns.MaxNSEC3Iterations)
+			}
+			signing.nsec3Iterations = uint16(*dnssecNSEC3Iterations)
+			if signing.nsec3Salt, err = hex.DecodeString(*dnssecNSEC3Salt); err != nil || len(signing.nsec3Salt) > 255 {
+				return nil, fmt.Errorf("invalid -dnssec-nsec3-salt: not up to 255 bytes in hex")
+			}
+		}
+		for _, arg := range zoneFiles {
+			z, err := loadZoneFile(arg, signing)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load zone: %w", err)
+			}
+			p.zones = append(p.zones, z)
+		}
+		for _, cidr := range reverseZones {
+			z, err := newReverseZone(cidr, p.zones)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate reverse zone: %w", err)
+			}
+			p.zones = append(p.zones, z)
+		}
+		if registry != nil {
+			p.zones = append(p.zones, registry.zone)
+		}
+		for _, arg := range secondaryZones {
+			sec, err := parseSecondary(arg, secondaryKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -secondary-zone: %w", err)
+			}
+			sec.notifier = s.notifier
+			// The zone carries over from the pipeline being replaced
+			// rather than being transferred again.
+			if old := s.current(); old != nil {
+				for _, z := range old.zones {
+					if z.secondary != nil {
+						sec.inherit(z.secondary)
+					}
+				}
+			}
+			p.zones = append(p.zones, sec.zone)
+			go sec.run(p.stop)
+		}
+		for _, z := range p.zones {
+			if hooks != nil {
+				z.notify = hooks.notify
+			}
+			mux.Handle(z.origin, traced(stageZone, z))
+			transfer := &transferHandler{zone: z, limits: transfers, keys: transferKeys}
+			mux.HandleType(z.origin, dns.TYPE_AXFR, transfer)
+			mux.HandleType(z.origin, dns.TYPE_IXFR, transfer)
+		}
+		return p, nil
+	}
+	p, err := build()
 	if err != nil {
-		return dns.Message{}, fmt.Errorf("resolver: %w", err)
+		log.Fatal("Failed to set up the server: ", err)
 	}
-	fmt.Printf("Written %d bytes to %s\n", size, resolverAddr)
+	s.swap(p)
 
-	size, _, err = resolverConn.ReadFromUDP(buf)
-	if err != nil {
-		return dns.Message{}, fmt.Errorf("resolver: %w", err)
+	if *checkConfig {
+		if (*dohAddr != "" || *dotAddr != "") && (*tlsCert == "" || *tlsKey == "") {
+			log.Fatal("-doh-addr and -dot-addr require -tls-cert and -tls-key")
+		}
+		if *tlsCert != "" || *tlsKey != "" {
+			if _, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey); err != nil {
+				log.Fatal("Invalid -tls-cert or -tls-key: ", err)
+			}
+		}
+		fmt.Println("Configuration OK")
+		return
 	}
-	receivedData := buf[:size]
-	fmt.Printf("Received %d bytes from %s\n", size, resolverAddr)
 
-	request := dns.NewRequest(receivedData)
-	return dns.NewResponse(request, true), nil
-}
+	if *singleShot {
+		if err := serveSingleShot(s, os.Stdin, stdout); err != nil {
+			log.Fatal("Single-shot query failed: ", err)
+		}
+		return
+	}
+
+	for _, l := range udpListeners {
+		tcpListener, err := net.Listen("tcp", l.conn.LocalAddr().String())
+		if err != nil {
+			log.Fatal("Failed to bind to TCP address:", err)
+		}
+		defer tcpListener.Close()
+		go func() {
+			log.Fatal("TCP listener failed: ", serveStreamListener(tcpListener, "TCP", s, *tcpIdleTimeout))
+		}()
+	}
+
+	if *dohAddr != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("-doh-addr requires -tls-cert and -tls-key")
+		}
+		go func() {
+			log.Fatal("DoH listener failed: ", serveDoH(*dohAddr, *tlsCert, *tlsKey, s))
+		}()
+	}
+
+	if *dohHTTPAddr != "" {
+		go func() {
+			log.Fatal("HTTP listener failed: ", serveDoHPlain(*dohHTTPAddr, s))
+		}()
+	}
+
+	if *adminAddr != "" {
+		api := &adminAPI{server: s, registry: registry, allow: adminACL, hosts: adminHosts(*adminAddr, *adminHostNames), started: time.Now()}
+		go func() {
+			log.Fatal("Admin listener failed: ", serveAdmin(*adminAddr, api))
+		}()
+	}
+
+	if *dotAddr != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("-dot-addr requires -tls-cert and -tls-key")
+		}
+		dotListener, err := listenDoT(*dotAddr, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal("Failed to start DoT listener:", err)
+		}
+		defer dotListener.Close()
+		slog.Info("Serving DNS-over-TLS", "addr", *dotAddr)
+		go func() {
+			log.Fatal("DoT listener failed: ", serveStreamListener(dotListener, "DoT", s, *tcpIdleTimeout))
+		}()
+	}
 
-func handleWithResolver(data []byte, resolverAddr *net.UDPAddr, resolverConn *net.UDPConn) dns.Message {
-	req := dns.NewRequest(data)
-	if req.Header.QDCOUNT > 1 {
-		responses := make([]dns.Message, req.Header.QDCOUNT)
-		for i, r := range dns.SplitMessageQuestions(req) {
-			res, err := forwardRequest(r, resolverAddr, resolverConn)
+	if shedder != nil {
+		go shedder.run(s)
+	}
+
+	// Resolving for everyone is only intended when any is allowed
+	// explicitly.
+	if (p.fwd != nil || *recursive) && !containsItem(*recursionAllow, "any") {
+		go runOpenResolverCheck(s, *openResolverCheck)
+	}
+
+	// SIGHUP reads the configuration file and the files it names again,
+	// and replaces the pipeline if all of them are valid.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			restore := snapshotFlags(flag.CommandLine)
+			var err error
+			if *configPath != "" {
+				err = reloadConfig(*configPath, flag.CommandLine, explicit)
+			}
+			var p *pipeline
+			if err == nil {
+				p, err = build()
+			}
 			if err != nil {
-				fmt.Println(err)
+				restore()
+				slog.Error("Failed to reload, keeping the current configuration", "err", err)
 				continue
 			}
-			responses[i] = res
+			old := s.current()
+			s.swap(p)
+			s.notifier.reloaded(old.zones, p.zones)
+			metrics.inc("reloads_total")
+			slog.Info("Reloaded configuration", "zones", len(p.zones))
 		}
-		return dns.MergeMessageAnswers(responses)
+	}()
+
+	for _, l := range udpListeners {
+		l := l
+		go func() {
+			log.Fatal("UDP listener failed: ", l.serve(s))
+		}()
 	}
+	select {}
+}
+
+// verdict is the outcome of a policy check on an incoming query.
+type verdict int
+
+const (
+	verdictAllow  verdict = iota // Resolve the query
+	verdictRefuse                // Answer with REFUSED
+	verdictDrop                  // Send no response at all
+)
+
+// server holds the resolution pipeline shared by all listeners.
+type server struct {
+	pipeline atomic.Pointer[pipeline] // Replaced on SIGHUP
+
+	udpPayloadSize int              // Smallest unfragmented UDP payload among the listening links
+	slo            *sloTracker      // Latency objective of responses
+	rrl            *responseLimiter // Response rate limiting of UDP clients, nil if disabled
+	profileClients netACL           // Clients whose responses carry the time of each stage
+
+	uncompressedClients netACL        // Clients whose responses are sent without name compression
+	tsigKeys            tsigKeyring   // Keys that signed requests are verified with
+	notifier            *zoneNotifier // Secondaries notified of changed zones, nil if none
+}
+
+// handle parses a raw request and serves it through w. Responses sent over
+// UDP are truncated to what the client, as far as its request tells, and the
+// link accept. Requests signed with TSIG are verified, and their responses
+// signed. NOTIFY messages go to the secondary zones rather than through
+// the pipeline. A panic while handling the request is turned into a
+// SERVFAIL response.
+func (s *server) handle(data []byte, w dns.ResponseWriter) {
+	start := time.Now()
+	defer func() {
+		if v := recover(); v != nil {
+			metrics.inc("panics_total")
+			attrs := []interface{}{addrAttr("client", w.RemoteAddr()), "panic", fmt.Sprint(v), "stack", string(debug.Stack())}
+			if privacy.mode == privacyOff {
+				attrs = append(attrs, "packet", hex.EncodeToString(data))
+			}
+			slog.Error("Panic while handling query", attrs...)
+			if len(data) >= 12 {
+				req, _ := dns.ParseMessage(data)
+				w.WriteMsg(errorResponse(req, dns.RCODE_SERVFAIL, reasonPanic))
+			}
+		}
+	}()
 
-	res, err := forwardRequest(req, resolverAddr, resolverConn)
+	req, err := dns.ParseMessage(data)
+	parsed := time.Now()
 	if err != nil {
-		fmt.Println(err)
+		slog.Info("Malformed request", addrAttr("client", w.RemoteAddr()), "err", err)
+		if len(data) >= 12 {
+			w.WriteMsg(dns.NewErrorResponse(req, dns.RCODE_FORMERR))
+		}
+		return
+	}
+	transport := writerTransport(w)
+	transports.received(transport, w.RemoteAddr(), req)
+	if pw, ok := w.(*packetWriter); ok {
+		pw.limit = udpResponseLimit(req, pw.linkLimit)
+	}
+	if s.uncompressedClients.contains(addrIP(w.RemoteAddr())) && disableCompression(w) {
+		metrics.inc("uncompressed_responses_total")
+	}
+	key, ok := s.verifyTSIG(w, &req, data)
+	if !ok {
+		return
+	}
+	_, edns := req.EDNS()
+	profile := newQueryProfile(parsed.Sub(start))
+	w = &encodeWriter{ResponseWriter: w, profile: profile, debug: edns && s.profileClients.contains(addrIP(w.RemoteAddr()))}
+	w = &sloWriter{ResponseWriter: w, slo: s.slo, start: start}
+	if tap != nil {
+		tap.log(dnstapEvent{
+			kind:     dnstapClientQuery,
+			protocol: transport,
+			peer:     w.RemoteAddr(),
+			queryAt:  start,
+			query:    append([]byte(nil), data...),
+		})
+		w = &tapWriter{ResponseWriter: w, transport: transport, start: start}
+	}
+	w = &queryLogWriter{ResponseWriter: w, transport: transport, start: start, edns: edns}
+	if s.rrl != nil && transport == "udp" {
+		w = &rrlWriter{ResponseWriter: w, rrl: s.rrl}
+	}
+	w = &profileWriter{ResponseWriter: w, profile: profile}
+	if key != "" {
+		w = &tsigWriter{ResponseWriter: w, key: key}
+	}
+	if req.Header.OpCode() == dns.OPCODE_NOTIFY {
+		s.serveNotify(w, &req)
+	} else {
+		s.current().handler.ServeDNS(w, &req)
 	}
-	return res
+	profile.record()
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	memoryCheckInterval = time.Second
+	// Shedding stops once the memory in use is back under this share of
+	// the limit, so that it does not flap around the limit.
+	memoryRecoverPercent = 90
+)
+
+// shedLevel is how much load is shed to stay under the memory limit. Each
+// level sheds what the ones below it do, and more.
+type shedLevel int32
+
+const (
+	shedNone  shedLevel = iota
+	shedCache           // Evict half of the cached responses on every check
+	shedTCP             // Close new TCP and DoT connections as they are accepted
+	shedUDP             // Drop UDP queries beyond the shedding rate
+)
+
+var shedLevelNames = [...]string{"none", "cache", "tcp", "udp"}
+
+func (l shedLevel) String() string {
+	return shedLevelNames[l]
+}
+
+var shedder *loadShedder // nil if there is no memory limit
+
+// loadShedder keeps the process under a memory limit rather than letting
+// it be killed for running out of memory. Every second that the memory in
+// use stays over the limit, it sheds load one level further; it stops once
+// usage is back well under the limit.
+type loadShedder struct {
+	limit   uint64 // Bytes
+	udpRate int    // UDP queries answered per second while shedding them
+
+	level atomic.Int32
+
+	mu     sync.Mutex
+	window time.Time // Start of the current second of UDP queries
+	count  int       // UDP queries answered in the current second
+}
+
+// newLoadShedder sets up shedding for a limit in bytes, which also becomes
+// the soft memory limit of the runtime, so that the garbage collector works
+// harder as usage nears it.
+func newLoadShedder(limit uint64, udpRate int) *loadShedder {
+	debug.SetMemoryLimit(int64(limit))
+	return &loadShedder{limit: limit, udpRate: udpRate}
+}
+
+// memoryInUse returns the memory the runtime holds from the operating
+// system and has not returned, which is close to the resident set size.
+func memoryInUse() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.Sys - m.HeapReleased
+}
+
+func (l *loadShedder) current() shedLevel {
+	if l == nil {
+		return shedNone
+	}
+	return shedLevel(l.level.Load())
+}
+
+// shedding reports whether load is shed at least at level.
+func (l *loadShedder) shedding(level shedLevel) bool {
+	return l.current() >= level
+}
+
+// allowUDP reports whether a UDP query received now is answered.
+func (l *loadShedder) allowUDP(now time.Time) bool {
+	if !l.shedding(shedUDP) {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.window) >= time.Second {
+		l.window, l.count = now, 0
+	}
+	if l.count >= l.udpRate {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// run checks the memory in use every second and adjusts the level,
+// evicting from the cache of the current pipeline of s while shedding. It
+// never returns.
+func (l *loadShedder) run(s *server) {
+	for range time.Tick(memoryCheckInterval) {
+		used := memoryInUse()
+		level := l.current()
+		switch {
+		case used > l.limit && level < shedUDP:
+			level++
+			metrics.inc("memory_shed_escalations_total")
+			slog.Warn("Memory over the limit, shedding load", "used_bytes", used, "limit_bytes", l.limit, "level", level.String())
+		case used < l.limit/100*memoryRecoverPercent && level != shedNone:
+			level = shedNone
+			slog.Info("Memory back under the limit, no longer shedding load", "used_bytes", used, "limit_bytes", l.limit)
+		}
+		l.level.Store(int32(level))
+		if level < shedCache {
+			continue
+		}
+		if c := s.current().rootCache; c != nil {
+			if n := c.trim(c.len() / 2); n > 0 {
+				metrics.add("memory_shed_cache_evictions_total", uint64(n))
+			}
+		}
+		debug.FreeOSMemory()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics holds the process wide counters exposed to operators.
+var metrics = &registry{counters: make(map[string]*uint64), gauges: make(map[string]func() uint64)}
+
+// registry is a set of named monotonic counters, and of gauges read when a
+// snapshot is taken.
+type registry struct {
+	mu       sync.Mutex
+	counters map[string]*uint64
+	gauges   map[string]func() uint64
+}
+
+func (r *registry) counter(name string) *uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.counters[name]
+	if !ok {
+		c = new(uint64)
+		r.counters[name] = c
+	}
+	return c
+}
+
+// inc increments the named counter by one.
+func (r *registry) inc(name string) {
+	atomic.AddUint64(r.counter(name), 1)
+}
+
+// add increments the named counter by n.
+func (r *registry) add(name string, n uint64) {
+	atomic.AddUint64(r.counter(name), n)
+}
+
+// gauge registers the named gauge, whose value is returned by value. It
+// replaces the gauge of the same name registered before, if any.
+func (r *registry) gauge(name string, value func() uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = value
+}
+
+// snapshot returns the current value of every counter and gauge.
+func (r *registry) snapshot() map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := make(map[string]uint64, len(r.counters)+len(r.gauges))
+	for name, c := range r.counters {
+		values[name] = atomic.LoadUint64(c)
+	}
+	for name, value := range r.gauges {
+		values[name] = value()
+	}
+	return values
+}
+
+// names returns the counter names in sorted order.
+func (r *registry) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.counters)+len(r.gauges))
+	for name := range r.counters {
+		names = append(names, name)
+	}
+	for name := range r.gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
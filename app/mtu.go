@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	minUDPPayloadSize = 512 // Payload every DNS client must accept (RFC 1035)
+	ipv4HeaderSize    = 20
+	ipv6HeaderSize    = 40
+	udpHeaderSize     = 8
+)
+
+// detectUDPPayloadSize returns the largest UDP payload that fits in a single
+// unfragmented packet on the interface owning ip. For unspecified addresses
+// the smallest MTU among the active interfaces is used.
+func detectUDPPayloadSize(ip net.IP) int {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return minUDPPayloadSize
+	}
+	mtu := 0
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.MTU <= 0 {
+			continue
+		}
+		if ip.IsUnspecified() {
+			if iface.Flags&net.FlagLoopback == 0 && (mtu == 0 || iface.MTU < mtu) {
+				mtu = iface.MTU
+			}
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				mtu = iface.MTU
+			}
+		}
+	}
+	if mtu == 0 {
+		return minUDPPayloadSize
+	}
+	size := mtu - udpHeaderSize - ipv4HeaderSize
+	if ip.To4() == nil {
+		size = mtu - udpHeaderSize - ipv6HeaderSize
+	}
+	if size > 0xFFFF {
+		size = 0xFFFF
+	}
+	if size < minUDPPayloadSize {
+		size = minUDPPayloadSize
+	}
+	return size
+}
+
+// udpResponseLimit returns the size a UDP response to req may have, given the
+// payload size supported by the local link.
+func udpResponseLimit(req dns.Message, linkLimit int) int {
+	limit := minUDPPayloadSize
+	if opt, ok := req.EDNS(); ok && int(opt.UDPSize) > limit {
+		limit = int(opt.UDPSize)
+	}
+	if linkLimit > 0 && limit > linkLimit {
+		limit = linkLimit
+	}
+	return limit
+}
+
+// capEDNSSize lowers the payload size advertised in the message's OPT record
+// so that peers never send more than the local link carries unfragmented.
+func capEDNSSize(m *dns.Message, linkLimit int) {
+	opt, ok := m.EDNS()
+	if !ok || linkLimit <= 0 || int(opt.UDPSize) <= linkLimit {
+		return
+	}
+	opt.UDPSize = uint16(linkLimit)
+	m.SetEDNS(opt)
+}
+
+// fitUDPResponse trims a response that exceeds limit, the largest response
+// the client accepts, in steps that lose as little as possible, counting the
+// step that made it fit:
+//
+//   - additional: RRsets of the additional section that do not fit are left
+//     out, which the client does not need to be told about;
+//   - authority: the authority section of an answer is left out as well, as
+//     it only holds optional name server data;
+//   - answers: whole answer RRsets are dropped and TC is set, so the client
+//     retries over TCP (RFC 2181 section 9);
+//   - header: if even the question does not fit, only the header is sent.
+//
+// The OPT record is kept in all but the last step, and the EDNS payload size
+// the response advertises is capped to linkLimit.
+// Sizes are those of the uncompressed encoding if uncompressed is set.
+func fitUDPResponse(m dns.Message, limit, linkLimit int, client net.Addr, uncompressed bool) dns.Message {
+	capEDNSSize(&m, linkLimit)
+	if len(encodeResponse(m, uncompressed)) <= limit {
+		return m
+	}
+	fit := dns.FitMessage
+	if uncompressed {
+		fit = dns.FitMessageUncompressed
+	}
+	stage := "additional"
+	fitted, _ := fit(m, limit)
+	if fitted.Header.TC() {
+		// Keep only the answers and the OPT record.
+		answers := m
+		answers.Authority = dns.Authority{}
+		answers.Additional = dns.Additional{}
+		if opt, ok := m.EDNS(); ok {
+			answers.SetEDNS(opt)
+		}
+		stage = "answers"
+		if len(m.Answer.Records) > 0 {
+			if fitted, _ = fit(answers, limit); !fitted.Header.TC() {
+				stage = "authority"
+			}
+		}
+	}
+	if len(encodeResponse(fitted, uncompressed)) > limit {
+		stage = "header"
+		fitted = dns.Message{Header: m.Header}
+		fitted.Header.QDCOUNT, fitted.Header.ANCOUNT, fitted.Header.NSCOUNT, fitted.Header.ARCOUNT = 0, 0, 0, 0
+		fitted.Header.SetTC(true)
+	}
+	metrics.inc("udp_truncated_" + stage + "_total")
+	slog.Debug("Truncated response", addrAttr("client", client), "stage", stage, "omitted_records", recordCount(m)-recordCount(fitted))
+	if fitted.Header.TC() {
+		transports.truncatedUDP(client, fitted)
+	}
+	return fitted
+}
+
+// recordCount returns the number of records in the sections of m.
+func recordCount(m dns.Message) int {
+	return len(m.Answer.Records) + len(m.Authority.Records) + len(m.Additional.Records)
+}
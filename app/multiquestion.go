@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// multiQuestionMode is how requests with several questions (QDCOUNT > 1)
+// are forwarded. Few servers answer such requests, so by default each
+// upstream is tried once and requests are split for the ones that fail.
+type multiQuestionMode int
+
+const (
+	multiQuestionAuto  multiQuestionMode = iota // Send requests whole until the upstream rejects one
+	multiQuestionSplit                          // Send one request per question
+	multiQuestionWhole                          // Always send requests as they are
+)
+
+func parseMultiQuestionMode(s string) (multiQuestionMode, error) {
+	switch s {
+	case "auto":
+		return multiQuestionAuto, nil
+	case "split":
+		return multiQuestionSplit, nil
+	case "whole":
+		return multiQuestionWhole, nil
+	}
+	return 0, fmt.Errorf("unknown mode %q", s)
+}
+
+// multiQuestionSupport is what is known of an upstream's handling of
+// requests with several questions.
+type multiQuestionSupport int32
+
+const (
+	multiQuestionUnknown multiQuestionSupport = iota
+	multiQuestionSupported
+	multiQuestionUnsupported
+)
+
+// sendsWhole reports whether a request with several questions goes to the
+// upstream as it is.
+func (u *upstream) sendsWhole() bool {
+	switch u.multiQuestionMode {
+	case multiQuestionSplit:
+		return false
+	case multiQuestionWhole:
+		return true
+	}
+	return multiQuestionSupport(u.multiQuestion.Load()) != multiQuestionUnsupported
+}
+
+// forwardQuestions sends the request to the upstream. A request with
+// several questions is sent whole if the upstream handles those, and split
+// into one request per question otherwise. An upstream not known to handle
+// them yet is found not to if it fails the request or rejects it with
+// FORMERR or NOTIMP, and the request is split right away.
+func (f *forwarder) forwardQuestions(u *upstream, r dns.Message) (dns.Message, error) {
+	if len(r.Question.Queries) <= 1 {
+		return f.forwardTo(u, r)
+	}
+	if !u.sendsWhole() {
+		return f.forwardSplit(u, r)
+	}
+	res, err := f.forwardTo(u, r)
+	if u.multiQuestionMode == multiQuestionWhole {
+		return res, err
+	}
+	known := multiQuestionSupport(u.multiQuestion.Load())
+	if err == nil {
+		if rcode := res.Header.RCode(); rcode != dns.RCODE_FORMERR && rcode != dns.RCODE_NOTIMP {
+			if known == multiQuestionUnknown {
+				u.multiQuestion.Store(int32(multiQuestionSupported))
+				slog.Debug("Resolver handles several questions in a request", "resolver", u.String())
+			}
+			return res, nil
+		}
+	} else if known == multiQuestionSupported {
+		// The upstream handled such requests before, so this is an
+		// ordinary failure.
+		return res, err
+	}
+	u.multiQuestion.Store(int32(multiQuestionUnsupported))
+	metrics.inc("upstream_multi_question_unsupported_total")
+	slog.Info("Resolver does not handle several questions in a request, splitting them", "resolver", u.String())
+	return f.forwardSplit(u, r)
+}
+
+// forwardSplit sends each question of the request to the upstream on its
+// own and merges the answers into a response to the whole request.
+func (f *forwarder) forwardSplit(u *upstream, r dns.Message) (dns.Message, error) {
+	metrics.inc("queries_split_total")
+	responses := make([]dns.Message, len(r.Question.Queries))
+	for i, q := range dns.SplitMessageQuestions(r) {
+		res, err := f.forwardTo(u, q)
+		if err != nil {
+			return dns.Message{}, err
+		}
+		responses[i] = res
+	}
+	res := dns.MergeMessageAnswers(responses)
+	res.Question, res.Header.QDCOUNT = r.Question, r.Header.QDCOUNT
+	return res, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const notifyAttempts = 5 // NOTIFY messages sent to a secondary before giving up
+
+// zoneNotifier tells the secondaries of -notify that a zone changed
+// (RFC 1996), so that they transfer it without waiting for their refresh
+// interval.
+type zoneNotifier struct {
+	secondaries []string
+	client      *dns.Client
+}
+
+// newZoneNotifier returns the notifier of the secondaries at addrs, with the
+// port 53 if they have none, or nil if there are none.
+func newZoneNotifier(addrs []string) *zoneNotifier {
+	if len(addrs) == 0 {
+		return nil
+	}
+	n := &zoneNotifier{client: &dns.Client{Rand: rng}}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+		}
+		n.secondaries = append(n.secondaries, addr)
+	}
+	return n
+}
+
+// changed notifies the secondaries in the background if the serial of z
+// grew past old.
+func (n *zoneNotifier) changed(z *zone, old uint32) {
+	if n == nil {
+		return
+	}
+	soa, ok := z.soa()
+	if !ok || len(soa.Data) == 0 {
+		return
+	}
+	if data, ok := soa.Records()[0].SOA(); !ok || !dns.SerialNewer(data.Serial, old) {
+		return
+	}
+	for _, addr := range n.secondaries {
+		go n.send(addr, z.origin, soa)
+	}
+}
+
+// reloaded notifies the secondaries of the zones of fresh whose serial grew
+// since they were served from old.
+func (n *zoneNotifier) reloaded(old, fresh []*zone) {
+	if n == nil {
+		return
+	}
+	serials := make(map[string]uint32)
+	for _, z := range old {
+		serials[z.origin] = z.status().Serial
+	}
+	for _, z := range fresh {
+		if serial, ok := serials[z.origin]; ok {
+			n.changed(z, serial)
+		}
+	}
+}
+
+// send sends a NOTIFY carrying the new SOA record of the zone to the
+// secondary at addr, again until it answers (RFC 1996 section 3.6).
+func (n *zoneNotifier) send(addr, origin string, soa dns.RRSet) {
+	msg := dns.NewQuery(origin, dns.TYPE_SOA).WithoutRD().Message()
+	msg.Header.SetOpCode(dns.OPCODE_NOTIFY)
+	msg.Header.SetAA(true)
+	msg.AddAnswer(soa)
+	var err error
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		var res dns.Message
+		if res, err = n.client.Exchange(context.Background(), msg, addr); err != nil {
+			continue
+		}
+		if rcode := res.Header.RCode(); rcode != dns.RCODE_NOERROR {
+			err = fmt.Errorf("NOTIFY answered with %s", rcode)
+			break
+		}
+		metrics.inc("notify_sent_total")
+		slog.Info("Notified secondary", "zone", origin, "secondary", addr)
+		return
+	}
+	metrics.inc("notify_failures_total")
+	slog.Warn("Failed to notify secondary", "zone", origin, "secondary", addr, "err", err)
+}
+
+// serveNotify answers a NOTIFY for a secondary zone sent by its primary,
+// and refreshes the zone right away. NOTIFY messages for other zones, or
+// from other senders, are refused.
+func (s *server) serveNotify(w dns.ResponseWriter, r *dns.Message) {
+	if len(r.Question.Queries) != 1 || r.Question.Queries[0].Type != dns.TYPE_SOA {
+		w.WriteMsg(dns.NewErrorResponse(*r, dns.RCODE_FORMERR))
+		return
+	}
+	origin := dns.CanonicalName(r.Question.Queries[0].Name)
+	for _, z := range s.current().zones {
+		if z.secondary == nil || z.origin != origin || !z.secondary.isPrimary(addrIP(w.RemoteAddr())) {
+			continue
+		}
+		metrics.inc("notify_received_total")
+		slog.Info("Received NOTIFY", "zone", z.origin, addrAttr("primary", w.RemoteAddr()))
+		z.secondary.wake()
+		res := dns.NewErrorResponse(*r, dns.RCODE_NOERROR)
+		res.Header.SetAA(true)
+		w.WriteMsg(res)
+		return
+	}
+	metrics.inc("notify_refused_total")
+	slog.Info("Refused NOTIFY", "zone", origin, addrAttr("client", w.RemoteAddr()))
+	reject(w, r, dns.RCODE_REFUSED, reasonNotify)
+}
+
+// isPrimary reports whether ip is an address of the primary.
+func (s *secondary) isPrimary(ip net.IP) bool {
+	host, _, _ := net.SplitHostPort(s.primary)
+	if primary := net.ParseIP(host); primary != nil {
+		return primary.Equal(ip)
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// wake has the zone refreshed now rather than when it is due.
+func (s *secondary) wake() {
+	select {
+	case s.refreshNow <- struct{}{}:
+	default:
+	}
+}
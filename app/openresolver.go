@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// openResolverProbes are the sources the open resolver check pretends to
+// query from, documentation addresses that are never local.
+var openResolverProbes = []net.IP{net.ParseIP("198.51.100.7"), net.ParseIP("2001:db8:ffff::7")}
+
+// openResolverName is the name looked up by the check. Its top-level domain
+// is reserved, so upstreams answer without further queries.
+const openResolverName = "open-resolver-check.invalid"
+
+// checkOpenResolver runs a recursive query through the pipeline as if it
+// came from each off-subnet probe address, and reports the sources that got
+// an answer rather than REFUSED or no response at all.
+func checkOpenResolver(s *server) []net.IP {
+	local, err := localSubnets()
+	if err != nil {
+		slog.Warn("Failed to detect local subnets for the open resolver check", "err", err)
+	}
+	var open []net.IP
+	for _, ip := range openResolverProbes {
+		if local.contains(ip) {
+			continue
+		}
+		req := dns.NewQuery(openResolverName, dns.TYPE_A).Message()
+		w := &probeWriter{addr: &net.UDPAddr{IP: ip, Port: 53}}
+		s.current().handler.ServeDNS(w, &req)
+		if w.written && w.msg.Header.RCode() != dns.RCODE_REFUSED {
+			open = append(open, ip)
+		}
+	}
+	return open
+}
+
+// runOpenResolverCheck checks at startup, and then every interval if it is
+// positive, warning loudly while the server resolves for anyone.
+func runOpenResolverCheck(s *server, interval time.Duration) {
+	for {
+		if open := checkOpenResolver(s); len(open) > 0 {
+			metrics.inc("open_resolver_detected_total")
+			sources := make([]string, len(open))
+			for i, ip := range open {
+				sources[i] = ip.String()
+			}
+			slog.Warn("OPEN RESOLVER: queries from outside the local networks are resolved, "+
+				"so the server can be abused for amplification attacks; restrict it with -recursion-allow or -allow",
+				"probes", sources)
+		}
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// probeWriter keeps the response to a probe query.
+type probeWriter struct {
+	addr    net.Addr
+	msg     dns.Message
+	written bool
+}
+
+func (w *probeWriter) RemoteAddr() net.Addr {
+	return w.addr
+}
+
+func (w *probeWriter) WriteMsg(m dns.Message) error {
+	w.msg, w.written = m, true
+	return nil
+}
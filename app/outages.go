@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// maxOutages is the number of most recent outages kept in the journal.
+const maxOutages = 1000
+
+// outages is the journal of upstream outages, nil if disabled.
+var outages *outageJournal
+
+// outage is a window during which an upstream endpoint was down: from the
+// failure that made it reach maxUpstreamFailures to its next success.
+type outage struct {
+	ID          int        `json:"id"`
+	Endpoint    string     `json:"endpoint"`
+	Transport   string     `json:"transport"`
+	Start       time.Time  `json:"start"`
+	End         *time.Time `json:"end,omitempty"`         // Nil while the outage lasts
+	Interrupted bool       `json:"interrupted,omitempty"` // The server stopped before the outage ended
+	ErrorClass  string     `json:"error_class"`           // Class of the error that started the outage
+	LastError   string     `json:"last_error"`
+	Queries     int        `json:"failed_queries"`
+}
+
+// outageJournal records upstream outages in a file of JSON lines, one
+// written when an outage starts and one when it ends, so that outages can
+// be looked into after the fact, across restarts.
+type outageJournal struct {
+	mu      sync.Mutex
+	file    *os.File
+	outages []*outage // Oldest first
+	nextID  int
+}
+
+// openOutageJournal loads the outages recorded in the file at path and
+// rewrites it with one line per outage, the last state of each. Outages
+// that had not ended are marked as interrupted.
+func openOutageJournal(path string) (*outageJournal, error) {
+	j := &outageJournal{nextID: 1}
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		byID := make(map[int]*outage)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			o := new(outage)
+			if err := json.Unmarshal(scanner.Bytes(), o); err != nil {
+				// A line cut short by a crash.
+				continue
+			}
+			if prev, ok := byID[o.ID]; ok {
+				*prev = *o
+				continue
+			}
+			byID[o.ID] = o
+			j.outages = append(j.outages, o)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	if len(j.outages) > maxOutages {
+		j.outages = j.outages[len(j.outages)-maxOutages:]
+	}
+	for _, o := range j.outages {
+		if o.End == nil {
+			o.Interrupted = true
+		}
+		if o.ID >= j.nextID {
+			j.nextID = o.ID + 1
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := j.writeAll(tmp); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	if j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, err
+	}
+	slog.Info("Opened upstream outage journal", "file", path, "outages", len(j.outages))
+	return j, nil
+}
+
+func (j *outageJournal) writeAll(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, o := range j.outages {
+		if err := enc.Encode(o); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// write appends the current state of o to the file. The caller holds j.mu.
+func (j *outageJournal) write(o *outage) {
+	if err := json.NewEncoder(j.file).Encode(o); err != nil {
+		slog.Warn("Failed to write upstream outage journal", "err", err)
+	}
+}
+
+// start records the beginning of an outage of e, caused by err after
+// queries failed queries.
+func (j *outageJournal) start(e *endpoint, err error, queries int) *outage {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	o := &outage{
+		ID:         j.nextID,
+		Endpoint:   e.addr.String(),
+		Transport:  e.transport,
+		Start:      time.Now().UTC(),
+		ErrorClass: errorClass(err),
+		LastError:  err.Error(),
+		Queries:    queries,
+	}
+	j.nextID++
+	j.outages = append(j.outages, o)
+	if len(j.outages) > maxOutages {
+		j.outages = j.outages[1:]
+	}
+	j.write(o)
+	metrics.inc("upstream_outages_total")
+	slog.Warn("Resolver is down", "resolver", o.Endpoint, "error_class", o.ErrorClass, "err", err)
+	return o
+}
+
+// failed counts a query failed with err during the outage.
+func (j *outageJournal) failed(o *outage, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	o.Queries++
+	o.LastError = err.Error()
+}
+
+// end records that the endpoint of o answered again.
+func (j *outageJournal) end(o *outage) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now().UTC()
+	o.End = &now
+	j.write(o)
+	slog.Info("Resolver recovered", "resolver", o.Endpoint, "down_for", now.Sub(o.Start).Round(time.Millisecond).String(), "failed_queries", o.Queries)
+}
+
+// list returns copies of the outages that lasted until since or later,
+// oldest first. Ongoing outages have no end.
+func (j *outageJournal) list(since time.Time) []outage {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	list := []outage{}
+	for _, o := range j.outages {
+		if o.End != nil && o.End.Before(since) {
+			continue
+		}
+		c := *o
+		if c.End != nil {
+			end := *c.End
+			c.End = &end
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// errorClass sorts an upstream error into a broad cause.
+func errorClass(err error) string {
+	var netErr net.Error
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var headerErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.As(err, &verifyErr), errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr), errors.As(err, &headerErr):
+		return "tls"
+	case errors.Is(err, dns.ErrShortMessage), errors.Is(err, dns.ErrTrailingRecord), errors.Is(err, dns.ErrInvalidName),
+		errors.Is(err, dns.ErrPointerLoop), errors.Is(err, errInvalidDNSCryptResponse):
+		return "protocol"
+	case errors.As(err, new(*net.OpError)):
+		return "network"
+	}
+	return "other"
+}
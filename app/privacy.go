@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// privacyMode controls how client addresses and query names are recorded in
+// logs and statistics.
+type privacyMode int
+
+const (
+	privacyOff      privacyMode = iota // Record everything as is
+	privacyHash                        // Replace with a keyed hash
+	privacyTruncate                    // Keep only the network prefix or registered domain
+)
+
+func parsePrivacyMode(s string) (privacyMode, error) {
+	switch s {
+	case "off", "":
+		return privacyOff, nil
+	case "hash":
+		return privacyHash, nil
+	case "truncate":
+		return privacyTruncate, nil
+	}
+	return 0, fmt.Errorf("unknown privacy mode %q", s)
+}
+
+// privacy is the redactor applied to everything written to logs and stats.
+var privacy = &redactor{}
+
+// redactor anonymizes client addresses and query names.
+type redactor struct {
+	mode privacyMode
+	key  []byte // HMAC key for privacyHash
+}
+
+// newRedactor constructs a redactor. Without a salt a random one is drawn from
+// the secure generator, so hashes are only stable for the lifetime of the
+// process.
+func newRedactor(mode privacyMode, salt string) (*redactor, error) {
+	r := &redactor{mode: mode, key: []byte(salt)}
+	if mode == privacyHash && salt == "" {
+		r.key = make([]byte, 32)
+		if _, err := dns.CryptoRand.Read(r.key); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *redactor) hash(s string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// client returns the loggable form of a client address. Truncation keeps the
+// /24 of IPv4 and the /48 of IPv6 addresses.
+func (r *redactor) client(ip net.IP) string {
+	switch r.mode {
+	case privacyHash:
+		return r.hash(ip.String())
+	case privacyTruncate:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+	return ip.String()
+}
+
+// addr is like client but for addresses that may carry a port, which is
+// dropped unless privacy is off.
+func (r *redactor) addr(a net.Addr) string {
+	if r.mode == privacyOff {
+		return a.String()
+	}
+	return r.client(addrIP(a))
+}
+
+// name returns the loggable form of a query name. The registered domain is
+// always kept so aggregate statistics remain useful.
+func (r *redactor) name(qname string) string {
+	if r.mode == privacyOff {
+		return qname
+	}
+	labels := dns.Labels(qname)
+	n := registeredDomainLabels(labels)
+	if len(labels) <= n {
+		return qname
+	}
+	domain := strings.Join(labels[len(labels)-n:], ".")
+	if r.mode == privacyHash {
+		return r.hash(strings.ToLower(strings.Join(labels[:len(labels)-n], "."))) + "." + domain
+	}
+	return "*." + domain
+}
+
+// registeredDomainLabels approximates how many trailing labels form the
+// registered domain: two, or three below second-level country domains such
+// as co.uk or com.au.
+func registeredDomainLabels(labels []string) int {
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 {
+		switch strings.ToLower(labels[len(labels)-2]) {
+		case "co", "com", "net", "org", "gov", "edu", "ac", "or", "ne", "go":
+			return 3
+		}
+	}
+	return 2
+}
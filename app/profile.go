@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// Stages of handling a query that are timed besides the ones answering it:
+// parsing the request, the middlewares and routing around the answering
+// stages, and encoding and sending the response.
+const (
+	stageParse  = "parse"
+	stagePolicy = "policy"
+	stageEncode = "encode"
+)
+
+// profileStages lists the stages in the order of the pipeline.
+var profileStages = []string{stageParse, stagePolicy, stageCache, stageValidation, stageZone, stageUpstream, stageRecursion, stageInternal, stageLocal, stageEncode}
+
+// queryProfile accumulates the time a query spends in each stage. The time
+// of a stage excludes the stages it calls, so the cache does not count the
+// upstream behind it, and policy is what is left once the others are taken
+// out.
+type queryProfile struct {
+	mu     sync.Mutex
+	start  time.Time                // When the handler was called
+	stages map[string]time.Duration // Time spent in each stage
+	nested time.Duration            // Time in stages called by the one being timed
+}
+
+func newQueryProfile(parse time.Duration) *queryProfile {
+	return &queryProfile{start: time.Now(), stages: map[string]time.Duration{stageParse: parse}}
+}
+
+// enter is called when a stage starts, and returns the function to call
+// when it ends.
+func (p *queryProfile) enter(stage string) (leave func()) {
+	p.mu.Lock()
+	outer := p.nested
+	p.nested = 0
+	p.mu.Unlock()
+	start := time.Now()
+	return func() {
+		elapsed := time.Since(start)
+		p.mu.Lock()
+		p.stages[stage] += elapsed - p.nested
+		p.nested = outer + elapsed
+		p.mu.Unlock()
+	}
+}
+
+// add counts d toward the stage.
+func (p *queryProfile) add(stage string, d time.Duration) {
+	p.mu.Lock()
+	p.stages[stage] += d
+	p.mu.Unlock()
+}
+
+// snapshot returns the time of every stage so far, with policy as the rest
+// of the time since the handler was called.
+func (p *queryProfile) snapshot() map[string]time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stages := make(map[string]time.Duration, len(p.stages)+1)
+	rest := time.Since(p.start)
+	for stage, d := range p.stages {
+		stages[stage] = d
+		if stage != stageParse {
+			rest -= d
+		}
+	}
+	if rest > 0 {
+		stages[stagePolicy] = rest
+	}
+	return stages
+}
+
+// record adds the time of every stage the query went through to the
+// stage_<stage>_microseconds_total counters, and counts the query in
+// stage_<stage>_total.
+func (p *queryProfile) record() {
+	for stage, d := range p.snapshot() {
+		metrics.inc("stage_" + stage + "_total")
+		metrics.add("stage_"+stage+"_microseconds_total", uint64(d.Microseconds()))
+	}
+}
+
+// String formats the stages so far, such as "parse=0.004ms policy=0.020ms
+// cache=0.003ms upstream=11.482ms".
+func (p *queryProfile) String() string {
+	stages := p.snapshot()
+	var parts []string
+	for _, stage := range profileStages {
+		if d, ok := stages[stage]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%.3fms", stage, float64(d.Microseconds())/1000))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// profileOf returns the profile of the query written to w, or nil if it is
+// not profiled, as for internal queries.
+func profileOf(w dns.ResponseWriter) *queryProfile {
+	for {
+		switch v := w.(type) {
+		case *profileWriter:
+			return v.profile
+		case interface{ Unwrap() dns.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// profileWriter is how the stages of a query find its profile. Writers
+// wrapping it inside the pipeline pass it on through Unwrap.
+type profileWriter struct {
+	dns.ResponseWriter
+	profile *queryProfile
+}
+
+func (w *profileWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+// encodeWriter times the encoding and sending of responses. With debug, set
+// for queries with EDNS from the -profile-clients networks, it also adds the
+// time of each stage so far to responses as the text of an Extended DNS
+// Error.
+type encodeWriter struct {
+	dns.ResponseWriter
+	profile *queryProfile
+	debug   bool
+}
+
+func (w *encodeWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *encodeWriter) WriteMsg(m dns.Message) error {
+	if w.debug {
+		m.AddExtendedError(dns.EDE_OTHER, w.profile.String())
+	}
+	start := time.Now()
+	err := w.ResponseWriter.WriteMsg(m)
+	w.profile.add(stageEncode, time.Since(start))
+	return err
+}
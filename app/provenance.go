@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// Origins of the records made up by the stages that answer in place of the
+// DNS, rather than passing on records of a zone or an upstream.
+const (
+	originBlocklist = "blocklist"
+	originHosts     = "hosts file"
+	originDNS64     = "synthesized by DNS64"
+	originSystem    = "system resolver"
+)
+
+// tagOrigin sets the origin of the records of m that have none. The record
+// slices of m may be shared, with the cache for one, so sections are copied
+// before they are changed.
+func tagOrigin(m *dns.Message, origin string) {
+	for _, section := range []*[]dns.Record{&m.Answer.Records, &m.Authority.Records, &m.Additional.Records} {
+		copied := false
+		for i, r := range *section {
+			if r.Origin != "" || r.Type == dns.TYPE_OPT {
+				continue
+			}
+			if !copied {
+				*section = append([]dns.Record(nil), *section...)
+				copied = true
+			}
+			(*section)[i].Origin = origin
+		}
+	}
+}
+
+// cachedOrigin is the origin of a record served from the cache.
+func cachedOrigin(origin string) string {
+	if origin == "" {
+		return stageCache
+	}
+	return "cache, from " + origin
+}
+
+// originWriter tags the records of responses that have no origin yet with
+// that of the stage answering, for stages that do not tag them in more
+// detail.
+type originWriter struct {
+	dns.ResponseWriter
+	origin string
+}
+
+func (w *originWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *originWriter) WriteMsg(m dns.Message) error {
+	tagOrigin(&m, w.origin)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// recordProvenance is a record of a response with where it came from.
+type recordProvenance struct {
+	Section string `json:"section"`
+	Record  string `json:"record"`
+	Origin  string `json:"origin"`
+}
+
+// messageSection is a section of a message, named as in the output of dig.
+type messageSection struct {
+	name    string
+	records []dns.Record
+}
+
+func messageSections(m dns.Message) []messageSection {
+	return []messageSection{{"answer", m.Answer.Records}, {"authority", m.Authority.Records}, {"additional", m.Additional.Records}}
+}
+
+// provenance lists the records of m with their origins.
+func provenance(m dns.Message) []recordProvenance {
+	list := []recordProvenance{}
+	for _, s := range messageSections(m) {
+		for _, r := range s.records {
+			if r.Type != dns.TYPE_OPT {
+				list = append(list, recordProvenance{Section: s.name, Record: r.String(), Origin: r.Origin})
+			}
+		}
+	}
+	return list
+}
+
+// logProvenance logs where the records of a response came from, by type
+// rather than in full so that no names escape the privacy mode.
+func logProvenance(m dns.Message) {
+	if len(m.Question.Queries) == 0 || !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	var origins []string
+	for _, s := range messageSections(m) {
+		for _, r := range s.records {
+			if r.Type != dns.TYPE_OPT {
+				origins = append(origins, s.name+" "+dns.TypeString(r.Type)+": "+r.Origin)
+			}
+		}
+	}
+	if len(origins) > 0 {
+		q := m.Question.Queries[0]
+		slog.Debug("Response provenance", "name", privacy.name(q.Name), "type", dns.TypeString(q.Type), "records", origins)
+	}
+}
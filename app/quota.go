@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	quotaSaveInterval = time.Minute // How often quota usage is persisted
+	quotaThrottleRate = time.Second // Minimum gap between queries of a throttled client
+)
+
+// quotaAction is what happens to queries of a client over its daily quota.
+type quotaAction int
+
+const (
+	quotaLog      quotaAction = iota // Only log that the quota was exceeded
+	quotaThrottle                    // Allow one query per quotaThrottleRate, drop the rest
+	quotaRefuse                      // Answer with REFUSED
+)
+
+func parseQuotaAction(s string) (quotaAction, error) {
+	switch s {
+	case "log":
+		return quotaLog, nil
+	case "throttle":
+		return quotaThrottle, nil
+	case "refuse":
+		return quotaRefuse, nil
+	}
+	return 0, fmt.Errorf("unknown action %q", s)
+}
+
+// quotaUsage is the persisted form of the quota counters.
+type quotaUsage struct {
+	Day    string         `json:"day"`
+	Counts map[string]int `json:"counts"` // By client address
+}
+
+// quotaTracker counts the queries of every client per day and decides what to
+// do with them once the daily limit is reached.
+type quotaTracker struct {
+	limit  int
+	action quotaAction
+	path   string // Persistence file, empty to keep usage in memory only
+
+	mu          sync.Mutex
+	usage       quotaUsage
+	lastAllowed map[string]time.Time // Last query let through per throttled client
+}
+
+func newQuotaTracker(limit int, action quotaAction, path string) (*quotaTracker, error) {
+	q := &quotaTracker{
+		limit:       limit,
+		action:      action,
+		path:        path,
+		usage:       quotaUsage{Day: quotaDay(time.Now()), Counts: make(map[string]int)},
+		lastAllowed: make(map[string]time.Time),
+	}
+	if path == "" {
+		return q, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var usage quotaUsage
+		if err := json.Unmarshal(b, &usage); err != nil {
+			return nil, err
+		}
+		if usage.Day == q.usage.Day && usage.Counts != nil {
+			q.usage = usage
+		}
+	}
+	go func() {
+		for range time.Tick(quotaSaveInterval) {
+			if err := q.save(); err != nil {
+				slog.Error("Failed to save quota usage", "err", err)
+			}
+		}
+	}()
+	return q, nil
+}
+
+// check accounts a query from client and returns how to treat it. Usage is
+// keyed by the client address itself, so that quotas stay per client and
+// survive restarts whatever the privacy mode; only the log redacts it.
+func (q *quotaTracker) check(client net.IP) verdict {
+	now := time.Now()
+	key := client.String()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if day := quotaDay(now); day != q.usage.Day {
+		q.usage = quotaUsage{Day: day, Counts: make(map[string]int)}
+		q.lastAllowed = make(map[string]time.Time)
+	}
+	q.usage.Counts[key]++
+	count := q.usage.Counts[key]
+	if count <= q.limit {
+		return verdictAllow
+	}
+	if count == q.limit+1 {
+		slog.Warn("Client exceeded its daily quota", "client", privacy.client(client), "quota", q.limit)
+	}
+	switch q.action {
+	case quotaThrottle:
+		if now.Sub(q.lastAllowed[key]) < quotaThrottleRate {
+			return verdictDrop
+		}
+		q.lastAllowed[key] = now
+	case quotaRefuse:
+		return verdictRefuse
+	}
+	return verdictAllow
+}
+
+// middleware applies the quota to every query before passing it on.
+func (q *quotaTracker) middleware(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Message) {
+		switch q.check(addrIP(w.RemoteAddr())) {
+		case verdictRefuse:
+			reject(w, r, dns.RCODE_REFUSED, reasonQuota)
+		case verdictDrop:
+			drop(w, r, reasonQuotaLimited)
+		default:
+			next.ServeDNS(w, r)
+		}
+	})
+}
+
+// save writes the current usage to the persistence file, if any.
+func (q *quotaTracker) save() error {
+	if q.path == "" {
+		return nil
+	}
+	q.mu.Lock()
+	b, err := json.Marshal(q.usage)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+func quotaDay(t time.Time) string {
+	return t.Format("2006-01-02")
+}
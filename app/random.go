@@ -0,0 +1,21 @@
+package main
+
+import "github.com/codecrafters-io/dns-server-starter-go/app/dns"
+
+// rng is the source of every random protocol value: transaction IDs, nonces,
+// the order servers are tried in, and the entries picked for revalidation.
+// With -random-seed it is deterministic, so that a run can be reproduced.
+// Key material is always drawn from the secure generator.
+var rng = dns.CryptoRand
+
+// randomID returns a random transaction ID.
+func randomID() (uint16, error) {
+	return dns.RandomID(rng)
+}
+
+// shuffle randomly reorders n elements with swap.
+func shuffle(n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		swap(i, rng.Intn(i+1))
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// registration is a service instance registered through the admin API. It
+// stays in the registry for TTL seconds after its last heartbeat.
+type registration struct {
+	Service  string            `json:"service"` // e.g. _http._tcp
+	Name     string            `json:"name"`    // Instance name, unique in the registry
+	Address  string            `json:"address"`
+	Port     uint16            `json:"port"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	TTL      uint32            `json:"ttl"`
+
+	expires time.Time
+}
+
+// serviceRegistry publishes registered services in a zone. Every instance
+// contributes an SRV record to <service>.<zone> pointing at
+// <name>.<zone>, which holds its address and a TXT record with its metadata
+// as key=value strings.
+type serviceRegistry struct {
+	zone *zone
+
+	mu      sync.Mutex
+	entries map[string]*registration // By lowercased name
+}
+
+// registrySOA is the SOA record of the registry zone. Its short MINIMUM
+// keeps resolvers from caching the absence of an instance for long.
+var registrySOA = dns.SOA{Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 5}
+
+func newServiceRegistry(z *zone) *serviceRegistry {
+	soa := registrySOA
+	soa.MName, soa.RName = z.origin, "hostmaster."+z.origin
+	z.set(dns.NewRRSet(dns.NewRecord(z.origin, dns.CLASS_IN, 60, soa)))
+	r := &serviceRegistry{zone: z, entries: make(map[string]*registration)}
+	go func() {
+		for now := range time.Tick(time.Second) {
+			r.expire(now)
+		}
+	}()
+	return r
+}
+
+// register adds an instance or renews its heartbeat.
+func (r *serviceRegistry) register(reg registration) error {
+	reg.Service = strings.ToLower(strings.Trim(reg.Service, "."))
+	reg.Name = strings.ToLower(strings.Trim(reg.Name, "."))
+	if reg.Service == "" || reg.Name == "" || strings.Contains(reg.Name, ".") {
+		return errors.New("service and a single label name are required")
+	}
+	if net.ParseIP(reg.Address) == nil {
+		return fmt.Errorf("invalid address %q", reg.Address)
+	}
+	if reg.TTL == 0 {
+		return errors.New("ttl must be positive")
+	}
+	if _, err := metadataTXT(reg.Metadata); err != nil {
+		return err
+	}
+	reg.expires = time.Now().Add(time.Duration(reg.TTL) * time.Second)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.entries[reg.Name]
+	r.entries[reg.Name] = &reg
+	if ok && old.Service != reg.Service {
+		r.syncService(old.Service)
+	}
+	if !ok || !sameRegistration(*old, reg) {
+		r.syncService(reg.Service)
+		r.syncHost(reg.Name)
+	}
+	return nil
+}
+
+// deregister removes an instance of service, reporting whether it was
+// registered as an instance of that service.
+func (r *serviceRegistry) deregister(service, name string) bool {
+	service = strings.ToLower(strings.Trim(service, "."))
+	name = strings.ToLower(strings.Trim(name, "."))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.entries[name]
+	if !ok || reg.Service != service {
+		return false
+	}
+	delete(r.entries, name)
+	r.syncService(reg.Service)
+	r.syncHost(name)
+	return true
+}
+
+// list returns the registered instances ordered by name.
+func (r *serviceRegistry) list() []registration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	regs := make([]registration, 0, len(r.entries))
+	for _, reg := range r.entries {
+		regs = append(regs, *reg)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].Name < regs[j].Name })
+	return regs
+}
+
+// expire removes the instances whose heartbeat is overdue.
+func (r *serviceRegistry) expire(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, reg := range r.entries {
+		if now.Before(reg.expires) {
+			continue
+		}
+		slog.Info("Service instance expired", "instance", name)
+		delete(r.entries, name)
+		r.syncService(reg.Service)
+		r.syncHost(name)
+	}
+}
+
+// syncService rebuilds the SRV records of a service. r.mu must be held.
+func (r *serviceRegistry) syncService(service string) {
+	set := dns.RRSet{Name: r.zoneName(service), Type: dns.TYPE_SRV, Class: dns.CLASS_IN}
+	for _, reg := range r.entries {
+		if reg.Service != service {
+			continue
+		}
+		srv := dns.SRV{Port: reg.Port, Target: r.zoneName(reg.Name)}
+		set.Add(srv.Pack())
+		if set.TTL == 0 || reg.TTL < set.TTL {
+			set.TTL = reg.TTL
+		}
+	}
+	if len(set.Data) == 0 {
+		r.zone.remove(set.Key())
+		return
+	}
+	sort.Slice(set.Data, func(i, j int) bool { return string(set.Data[i]) < string(set.Data[j]) })
+	r.zone.set(set)
+}
+
+// syncHost rebuilds the address and TXT records of an instance. r.mu must be
+// held.
+func (r *serviceRegistry) syncHost(name string) {
+	owner := r.zoneName(name)
+	reg, ok := r.entries[name]
+	for _, t := range []uint16{dns.TYPE_A, dns.TYPE_AAAA, dns.TYPE_TXT} {
+		set := dns.RRSet{Name: owner, Type: t, Class: dns.CLASS_IN}
+		if !ok {
+			r.zone.remove(set.Key())
+			continue
+		}
+		set.TTL = reg.TTL
+		ip := net.ParseIP(reg.Address)
+		switch {
+		case t == dns.TYPE_A && ip.To4() != nil:
+			set.Add(dns.A{Addr: ip}.Pack())
+		case t == dns.TYPE_AAAA && ip.To4() == nil:
+			set.Add(dns.AAAA{Addr: ip}.Pack())
+		case t == dns.TYPE_TXT && len(reg.Metadata) > 0:
+			txt, _ := metadataTXT(reg.Metadata)
+			set.Add(txt.Pack())
+		}
+		if len(set.Data) == 0 {
+			r.zone.remove(set.Key())
+		} else {
+			r.zone.set(set)
+		}
+	}
+}
+
+func (r *serviceRegistry) zoneName(name string) string {
+	return name + "." + r.zone.origin
+}
+
+// metadataTXT encodes metadata as key=value strings in key order.
+func metadataTXT(metadata map[string]string) (dns.TXT, error) {
+	var txt dns.TXT
+	for k, v := range metadata {
+		s := k + "=" + v
+		if k == "" || len(s) > 255 {
+			return dns.TXT{}, fmt.Errorf("invalid metadata entry %q", k)
+		}
+		txt.Strings = append(txt.Strings, s)
+	}
+	sort.Strings(txt.Strings)
+	return txt, nil
+}
+
+// sameRegistration reports whether both registrations publish the same
+// records, so a heartbeat does not rewrite the zone.
+func sameRegistration(a, b registration) bool {
+	if a.Service != b.Service || a.Address != b.Address || a.Port != b.Port || a.TTL != b.TTL || len(a.Metadata) != len(b.Metadata) {
+		return false
+	}
+	for k, v := range a.Metadata {
+		if bv, ok := b.Metadata[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
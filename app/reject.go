@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// rejectReason is a machine-readable cause of a query not being answered
+// normally, with the Extended DNS Error code that conveys it to clients.
+type rejectReason struct {
+	code string
+	ede  uint16
+}
+
+// Policy denials.
+var (
+	reasonACL          = rejectReason{"acl_denied", dns.EDE_PROHIBITED}
+	reasonRecursion    = rejectReason{"recursion_denied", dns.EDE_PROHIBITED}
+	reasonQuota        = rejectReason{"quota_exceeded", dns.EDE_PROHIBITED}
+	reasonQuotaLimited = rejectReason{"quota_throttled", dns.EDE_PROHIBITED}
+	reasonInternal     = rejectReason{"internal_domain", dns.EDE_BLOCKED}
+	reasonBlocked      = rejectReason{"blocklisted", dns.EDE_BLOCKED}
+	reasonTransfers    = rejectReason{"transfer_limit", dns.EDE_PROHIBITED}
+	reasonTransferKey  = rejectReason{"transfer_unsigned", dns.EDE_PROHIBITED}
+	reasonNotify       = rejectReason{"notify_refused", dns.EDE_PROHIBITED}
+	reasonRateLimited  = rejectReason{"rate_limited", dns.EDE_OTHER}
+)
+
+// Failures.
+var (
+	reasonMalformed        = rejectReason{"malformed_query", dns.EDE_OTHER}
+	reasonPanic            = rejectReason{"internal_error", dns.EDE_OTHER}
+	reasonUpstream         = rejectReason{"upstream_unreachable", dns.EDE_NO_REACHABLE_AUTHORITY}
+	reasonInternalUpstream = rejectReason{"internal_resolver_unreachable", dns.EDE_NETWORK_ERROR}
+	reasonResolution       = rejectReason{"resolution_failed", dns.EDE_NO_REACHABLE_AUTHORITY}
+	reasonBogus            = rejectReason{"dnssec_bogus", dns.EDE_DNSSEC_BOGUS}
+)
+
+// errorResponse returns the response with rcode to r, carrying the reason
+// as an Extended DNS Error whose text is the reason code. The query log
+// takes the reason from it and removes it for clients without EDNS.
+func errorResponse(r dns.Message, rcode dns.RCode, reason rejectReason) dns.Message {
+	m := dns.NewErrorResponse(r, rcode)
+	m.AddExtendedError(reason.ede, reason.code)
+	return m
+}
+
+// reject answers r with rcode for the reason.
+func reject(w dns.ResponseWriter, r *dns.Message, rcode dns.RCode, reason rejectReason) {
+	w.WriteMsg(errorResponse(*r, rcode, reason))
+}
+
+// drop leaves r unanswered, logging the reason in place of a response. Over
+// HTTPS, where a request cannot go unanswered, the reason picks the status
+// of the HTTP response.
+func drop(w dns.ResponseWriter, r *dns.Message, reason rejectReason) {
+	noteDrop(w, reason)
+	attrs := []interface{}{addrAttr("client", w.RemoteAddr()), "reason", reason.code}
+	if len(r.Question.Queries) > 0 {
+		q := r.Question.Queries[0]
+		attrs = append(attrs, "name", privacy.name(q.Name), "type", dns.TypeString(q.Type))
+	}
+	slog.Info("query dropped", attrs...)
+}
+
+// responseReason returns the reason code and Extended DNS Error code of a
+// response, if it has one.
+func responseReason(m dns.Message) (string, uint16, bool) {
+	opt, ok := m.EDNS()
+	if !ok {
+		return "", 0, false
+	}
+	o, ok := opt.Option(dns.EDNS_OPTION_EDE)
+	if !ok {
+		return "", 0, false
+	}
+	code, text, ok := o.ExtendedError()
+	return text, code, ok
+}
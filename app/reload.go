@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// pipeline is the part of the server that is set up again on SIGHUP: the
+// middlewares, the routes of the mux, and the resolvers and zones they lead
+// to. Listeners, the admin API, and state that outlives a configuration,
+// such as quotas and registered services, stay as they are.
+type pipeline struct {
+	handler   dns.Handler    // Middleware chain around the routing mux
+	fwd       *forwarder     // Forwarder of the root zone, nil if forwarding is off
+	rootCache *responseCache // Cache of the root zone, nil if caching is off
+	zones     []*zone        // Authoritative zones
+	stop      chan struct{}  // Closed once the pipeline is replaced, ending its background work
+}
+
+// current returns the pipeline new queries go through. A query keeps the
+// pipeline it started with, even if it is replaced in the meantime.
+func (s *server) current() *pipeline {
+	return s.pipeline.Load()
+}
+
+// swap makes p the pipeline of new queries, and stops the background work
+// of the one it replaces.
+func (s *server) swap(p *pipeline) {
+	if old := s.pipeline.Swap(p); old != nil {
+		close(old.stop)
+	}
+}
+
+// snapshotFlags returns a function that sets the flags of fs back to their
+// current values. Repeatable flags are copied value by value, as their
+// values may hold the commas that separate them in String.
+func snapshotFlags(fs *flag.FlagSet) (restore func()) {
+	values := make(map[string]string)
+	lists := make(map[string][]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if l, ok := listValues(f.Value); ok {
+			lists[f.Name] = append([]string(nil), *l...)
+			return
+		}
+		values[f.Name] = f.Value.String()
+	})
+	return func() {
+		fs.VisitAll(func(f *flag.Flag) {
+			if l, ok := listValues(f.Value); ok {
+				*l = lists[f.Name]
+				return
+			}
+			setFlag(f, values[f.Name])
+		})
+	}
+}
+
+// reloadConfig sets the flags of fs from the configuration file at path
+// again, except the ones in explicit. Flags the file no longer sets go back
+// to their defaults.
+func reloadConfig(path string, fs *flag.FlagSet, explicit map[string]bool) error {
+	fs.VisitAll(func(f *flag.Flag) {
+		if !explicit[f.Name] && !configFlags[f.Name] {
+			setFlag(f, f.DefValue)
+		}
+	})
+	return loadConfig(path, fs, explicit)
+}
+
+// setFlag replaces the value of f, emptying repeatable flags first rather
+// than adding to them.
+func setFlag(f *flag.Flag, value string) {
+	if l, ok := listValues(f.Value); ok {
+		*l = nil
+	}
+	// The value was valid when it was set, or is the default.
+	f.Value.Set(value)
+}
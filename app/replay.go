@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// maxReplayEntries bounds the number of responses kept for replay. Once it
+// is reached, new responses are not kept until older ones expire.
+const maxReplayEntries = 4096
+
+// replayCache remembers the responses recently sent over UDP, so that a
+// query retransmitted within the window is answered with the same bytes
+// without going through the pipeline again. Entries are keyed by the client
+// address and the exact query bytes, which include its ID and question.
+type replayCache struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]replayEntry
+	lastSweep time.Time
+}
+
+type replayEntry struct {
+	response []byte
+	expires  time.Time
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{window: window, entries: make(map[string]replayEntry)}
+}
+
+// replayKey returns the key of a query received from addr.
+func replayKey(addr *net.UDPAddr, query []byte) string {
+	return addr.String() + "/" + string(query)
+}
+
+// lookup returns the response sent for the key within the window.
+func (c *replayCache) lookup(key string, now time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expires) {
+		return nil, false
+	}
+	return e.response, true
+}
+
+// store keeps the response sent for the key for the length of the window.
+func (c *replayCache) store(key string, response []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) >= c.window || len(c.entries) >= maxReplayEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if len(c.entries) >= maxReplayEntries {
+		return
+	}
+	c.entries[key] = replayEntry{response: response, expires: now.Add(c.window)}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// cacheRevalidator checks cached responses against the upstream to detect
+// poisoned or stale entries: now and then it picks a random entry, resolves
+// its question again without the cache, and reports when the answers
+// differ. It only reports, the entry is left in place.
+type cacheRevalidator struct {
+	cache    *responseCache
+	upstream dns.Handler // The handler behind the cache
+	interval time.Duration
+	stop     <-chan struct{} // Ends the revalidation when closed
+}
+
+// run revalidates one entry every interval, until v.stop is closed.
+func (v *cacheRevalidator) run() {
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+		}
+		k, e, ok := v.cache.sample(time.Now())
+		if !ok {
+			continue
+		}
+		v.revalidate(k, e.msg)
+	}
+}
+
+func (v *cacheRevalidator) revalidate(k cacheKey, cached dns.Message) {
+	b := dns.NewQuery(k.name, k.qtype).WithClass(k.qclass)
+	if k.do {
+		b.WithDO()
+	}
+	if k.cd {
+		b.WithCD()
+	}
+	req := b.Message()
+	w := &probeWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	v.upstream.ServeDNS(w, &req)
+	if !w.written {
+		return
+	}
+	metrics.inc("cache_revalidations_total")
+	fresh := w.msg
+	if fresh.Header.RCode() == dns.RCODE_SERVFAIL {
+		// Not a discrepancy, the upstream could not be asked.
+		return
+	}
+	cachedRCode, freshRCode := cached.Header.RCode(), fresh.Header.RCode()
+	cachedAnswer, freshAnswer := answerDigest(cached), answerDigest(fresh)
+	if cachedRCode == freshRCode && cachedAnswer == freshAnswer {
+		return
+	}
+	metrics.inc("cache_revalidation_mismatches_total")
+	slog.Warn("Cached response differs from the upstream",
+		"name", privacy.name(k.name), "type", dns.TypeString(k.qtype),
+		"cached_rcode", cachedRCode.String(), "upstream_rcode", freshRCode.String(),
+		"cached_answer", cachedAnswer, "upstream_answer", freshAnswer)
+}
+
+// answerDigest describes the answer records of m independently of their
+// order and TTLs.
+func answerDigest(m dns.Message) string {
+	records := make([]string, len(m.Answer.Records))
+	for i, r := range m.Answer.Records {
+		records[i] = dns.CanonicalName(r.Name) + " " + dns.TypeString(r.Type) + " " + hex.EncodeToString(r.Data)
+	}
+	sort.Strings(records)
+	return strings.Join(records, ", ")
+}
+
+// sample returns a random unexpired entry valid for every client.
+func (c *responseCache) sample(now time.Time) (cacheKey, *cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size == 0 {
+		return cacheKey{}, nil, false
+	}
+	skip := rng.Intn(c.size)
+	var (
+		key   cacheKey
+		found *cacheEntry
+	)
+	for k, entries := range c.entries {
+		for _, e := range entries {
+			if e.scope != nil || !now.Before(e.expires) {
+				continue
+			}
+			key, found = k, e
+			if skip--; skip < 0 {
+				return key, found, true
+			}
+		}
+	}
+	return key, found, found != nil
+}
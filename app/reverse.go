@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// reverseSOA is the SOA record of generated reverse zones.
+var reverseSOA = dns.SOA{Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 300}
+
+// newReverseZone generates the in-addr.arpa or ip6.arpa zone of a network
+// given in CIDR notation, with a PTR record for every address record of the
+// zones that falls in the network.
+func newReverseZone(cidr string, zones []*zone) (*zone, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	origin, err := dns.ReverseZone(network)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cidr, err)
+	}
+	rz := newZone(origin)
+	rz.source = "reverse " + cidr
+	rz.load = func() (*zone, error) { return newReverseZone(cidr, zones) }
+	soa := reverseSOA
+	soa.MName, soa.RName = rz.origin, "hostmaster."+rz.origin
+	rz.set(dns.NewRRSet(dns.NewRecord(rz.origin, dns.CLASS_IN, 3600, soa)))
+
+	ptrs := make(map[string]dns.RRSet)
+	for _, z := range zones {
+		var after *dns.RRSetKey
+		for {
+			sets := z.page(after, transferPageSize)
+			if len(sets) == 0 {
+				break
+			}
+			for _, set := range sets {
+				for _, r := range set.Records() {
+					var ip net.IP
+					if a, ok := r.A(); ok {
+						ip = a.Addr
+					} else if a, ok := r.AAAA(); ok {
+						ip = a.Addr
+					}
+					if ip == nil || !network.Contains(ip) {
+						continue
+					}
+					name := dns.ReverseAddr(ip)
+					if ptr, ok := ptrs[name]; ok {
+						ptr.Add(dns.PTR{Target: r.Name}.Pack())
+						ptrs[name] = ptr
+					} else {
+						ptrs[name] = dns.NewRRSet(dns.NewRecord(name, dns.CLASS_IN, r.TTL, dns.PTR{Target: r.Name}))
+					}
+				}
+			}
+			key := sets[len(sets)-1].Key()
+			after = &key
+		}
+	}
+	for _, ptr := range ptrs {
+		rz.set(ptr)
+	}
+	slog.Info("Generated reverse zone", "zone", rz.origin, "addresses", len(ptrs))
+	return rz, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const primeRetry = 5 * time.Minute // Wait after a failed priming query
+
+// loadRootHints reads the root name servers and their addresses from a file
+// in the format of named.root.
+func loadRootHints(path string) ([]nameServer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := dns.ParseZone(f, ".")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	hints := rootServers(records, records, nil)
+	if len(hints) == 0 {
+		return nil, fmt.Errorf("%s: no root servers with addresses", path)
+	}
+	return hints, nil
+}
+
+// rootServers returns the hosts of the root NS records in nsRecords with the
+// addresses given for them in addrRecords, or in old for hosts without any.
+// Hosts without known addresses are left out.
+func rootServers(nsRecords, addrRecords []dns.Record, old []nameServer) []nameServer {
+	var servers []nameServer
+	for _, rr := range nsRecords {
+		ns, ok := rr.NS()
+		if !ok || dns.CanonicalName(rr.Name) != "" {
+			continue
+		}
+		server := nameServer{host: dns.CanonicalName(ns.Host)}
+		for _, rr := range addrRecords {
+			if dns.CanonicalName(rr.Name) != server.host {
+				continue
+			}
+			if a, ok := rr.A(); ok {
+				server.addrs = append(server.addrs, a.Addr)
+			} else if a, ok := rr.AAAA(); ok {
+				server.addrs = append(server.addrs, a.Addr)
+			}
+		}
+		if len(server.addrs) == 0 {
+			for _, o := range old {
+				if o.host == server.host {
+					server.addrs = o.addrs
+				}
+			}
+		}
+		if len(server.addrs) > 0 {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// prime asks the hinted root servers for the current root server set (RFC
+// 8109) and uses it in place of the hints. It returns how long the set is
+// valid.
+func (ir *iterativeResolver) prime() (time.Duration, error) {
+	ir.mu.Lock()
+	hints := ir.hints
+	ir.mu.Unlock()
+	root := &delegation{zone: "", servers: hints}
+	m, err := ir.queryZone(&resolution{}, root, dns.Query{Name: "", Type: dns.TYPE_NS, Class: dns.CLASS_IN}, iterativeMaxDepth)
+	if err != nil {
+		return 0, err
+	}
+	servers := rootServers(m.Answer.Records, m.Additional.Records, hints)
+	if len(servers) == 0 {
+		return 0, errors.New("priming response lists no root servers with addresses")
+	}
+	ttl := uint32(0)
+	for _, rr := range m.Answer.Records {
+		if rr.Type == dns.TYPE_NS && (ttl == 0 || rr.TTL < ttl) {
+			ttl = rr.TTL
+		}
+	}
+	ir.mu.Lock()
+	ir.hints = servers
+	ir.mu.Unlock()
+	return ttlDuration(ttl), nil
+}
+
+// runPriming primes the root server set at startup and again whenever it
+// expires, until stop is closed. Until priming succeeds the hints are used
+// as they are.
+func (ir *iterativeResolver) runPriming(stop <-chan struct{}) {
+	for {
+		valid, err := ir.prime()
+		if err != nil {
+			slog.Warn("Root priming query failed, using the root hints", "err", err)
+			valid = primeRetry
+		} else {
+			slog.Info("Primed root servers", "servers", len(ir.rootServers()), "valid", valid.String())
+		}
+		if valid < primeRetry {
+			valid = primeRetry
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(valid):
+		}
+	}
+}
+
+// isFile reports whether path exists and is a regular file.
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// rootServers returns the current root server set.
+func (ir *iterativeResolver) rootServers() []nameServer {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	return ir.hints
+}
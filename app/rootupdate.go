@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	rootHintsURL       = "https://www.internic.net/domain/named.root"
+	rootHintsDigestURL = "https://www.internic.net/domain/named.root.md5"
+	rootAnchorsURL     = "https://data.iana.org/root-anchors/root-anchors.xml"
+	rootAnchorsSigURL  = "https://data.iana.org/root-anchors/root-anchors.p7s"
+
+	rootHintsFile   = "named.root"
+	rootAnchorsFile = "root-anchors.xml"
+
+	rootFetchMaxSize  = 1 << 20
+	rootRetryInterval = time.Hour // Wait after a failed update
+)
+
+// rootUpdater keeps local copies of the root hints and the DNSSEC root trust
+// anchor current by periodically fetching them from IANA. Neither is taken
+// on the word of the server it is downloaded from: the root hints must agree
+// with what the root servers already trusted answer, and the trust anchor
+// must be signed by a CA obtained out of band, or it is not updated at all.
+type rootUpdater struct {
+	dir       string
+	interval  time.Duration
+	client    *http.Client
+	anchorsCA *x509.CertPool // Must have issued the signer of the trust anchor, nil to leave it alone
+}
+
+// newRootUpdater returns an updater of the files in dir. The trust anchor
+// is only updated with caFile, holding the PEM certificate of the ICANN CA
+// that signs it.
+func newRootUpdater(dir string, interval time.Duration, caFile string) (*rootUpdater, error) {
+	u := &rootUpdater{dir: dir, interval: interval, client: &http.Client{Timeout: 30 * time.Second}}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		u.anchorsCA = x509.NewCertPool()
+		if !u.anchorsCA.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// run updates the files whenever they are older than the interval, retrying
+// failed updates sooner. It never returns.
+func (u *rootUpdater) run() {
+	names := []string{rootHintsFile}
+	if u.anchorsCA != nil {
+		names = append(names, rootAnchorsFile)
+	} else {
+		slog.Warn("Not updating the root trust anchor without a CA to verify its signature", "file", filepath.Join(u.dir, rootAnchorsFile))
+	}
+	for {
+		wait := u.interval
+		for _, name := range names {
+			if !u.stale(name) {
+				continue
+			}
+			if err := u.update(name); err != nil {
+				slog.Warn("Failed to update root data", "file", name, "err", err)
+				if rootRetryInterval < wait {
+					wait = rootRetryInterval
+				}
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// stale reports whether the file is missing or older than the interval.
+func (u *rootUpdater) stale(name string) bool {
+	info, err := os.Stat(filepath.Join(u.dir, name))
+	return err != nil || time.Since(info.ModTime()) >= u.interval
+}
+
+// update fetches and verifies a new version of the file and persists it.
+func (u *rootUpdater) update(name string) error {
+	path := filepath.Join(u.dir, name)
+	var (
+		b   []byte
+		err error
+	)
+	switch name {
+	case rootHintsFile:
+		b, err = u.fetchHints(path)
+	case rootAnchorsFile:
+		b, err = u.fetchAnchors(path)
+	}
+	if err != nil {
+		return err
+	}
+	old, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(old, b) {
+		// Unchanged, only record that the file was checked.
+		now := time.Now()
+		return os.Chtimes(path, now, now)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	slog.Info("Updated root data", "file", path)
+	return nil
+}
+
+// fetchHints downloads the root hints and checks them against the digest
+// published alongside, which only catches a damaged download. They are
+// accepted if the root servers of the hints persisted at path, or of the
+// built-in ones, list the same servers at the same addresses.
+func (u *rootUpdater) fetchHints(path string) ([]byte, error) {
+	b, err := u.fetch(rootHintsURL)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := u.fetch(rootHintsDigestURL)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(b)
+	if !strings.Contains(strings.ToLower(string(digest)), hex.EncodeToString(sum[:])) {
+		return nil, errors.New("root hints do not match the published digest")
+	}
+	records, err := dns.ParseZone(bytes.NewReader(b), ".")
+	if err != nil {
+		return nil, err
+	}
+	fetched := rootServers(records, records, nil)
+	if len(fetched) == 0 {
+		return nil, errors.New("root hints list no root servers")
+	}
+	current := rootHints
+	if isFile(path) {
+		if current, err = loadRootHints(path); err != nil {
+			current = rootHints
+		}
+	}
+	ir := newIterativeResolver(u.client.Timeout)
+	ir.hints = current
+	if _, err := ir.prime(); err != nil {
+		return nil, fmt.Errorf("asking the root servers for the root server set: %w", err)
+	}
+	if !sameServers(fetched, ir.rootServers()) {
+		return nil, errors.New("root hints do not match the root server set of the root servers")
+	}
+	return b, nil
+}
+
+// sameServers reports whether a and b list the same hosts with the same
+// addresses.
+func sameServers(a, b []nameServer) bool {
+	index := func(servers []nameServer) map[string]string {
+		m := make(map[string]string)
+		for _, s := range servers {
+			addrs := make([]string, len(s.addrs))
+			for i, ip := range s.addrs {
+				addrs[i] = ip.String()
+			}
+			sort.Strings(addrs)
+			m[s.host] = strings.Join(addrs, " ")
+		}
+		return m
+	}
+	am, bm := index(a), index(b)
+	if len(am) != len(bm) {
+		return false
+	}
+	for host, addrs := range am {
+		if bm[host] != addrs {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchAnchors downloads the root trust anchor. An update is only accepted
+// if its S/MIME signature is from a certificate issued by u.anchorsCA, it
+// lists a key that is currently valid and, when an anchor is already
+// persisted at path, keeps one of the keys currently trusted, so a rollover
+// is never taken from a source that does not know the present key.
+func (u *rootUpdater) fetchAnchors(path string) ([]byte, error) {
+	b, err := u.fetch(rootAnchorsURL)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := u.fetch(rootAnchorsSigURL)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := verifyDetachedSignature(b, sig, u.anchorsCA, now); err != nil {
+		return nil, fmt.Errorf("trust anchor: %w", err)
+	}
+	anchor, err := parseTrustAnchor(b)
+	if err != nil {
+		return nil, err
+	}
+	valid := anchor.validDigests(now)
+	if len(valid) == 0 {
+		return nil, errors.New("trust anchor has no currently valid key")
+	}
+	old, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	current, err := parseTrustAnchor(old)
+	if err != nil {
+		// A corrupt local copy cannot vouch for anything, replace it.
+		return b, nil
+	}
+	for _, d := range current.validDigests(now) {
+		for _, n := range anchor.Digests {
+			if d.same(n) {
+				return b, nil
+			}
+		}
+	}
+	return nil, errors.New("trust anchor does not list any currently trusted key")
+}
+
+func (u *rootUpdater) fetch(url string) ([]byte, error) {
+	res, err := u.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, rootFetchMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > rootFetchMaxSize {
+		return nil, fmt.Errorf("%s: response too large", url)
+	}
+	return b, nil
+}
+
+// trustAnchor is the root trust anchor as published by IANA (RFC 7958).
+type trustAnchor struct {
+	Zone    string      `xml:"Zone"`
+	Digests []keyDigest `xml:"KeyDigest"`
+}
+
+// keyDigest is the DS record data of a root key and its validity period.
+type keyDigest struct {
+	ValidFrom  string `xml:"validFrom,attr"`
+	ValidUntil string `xml:"validUntil,attr"`
+	KeyTag     uint16 `xml:"KeyTag"`
+	Algorithm  uint8  `xml:"Algorithm"`
+	DigestType uint8  `xml:"DigestType"`
+	Digest     string `xml:"Digest"`
+}
+
+func parseTrustAnchor(b []byte) (trustAnchor, error) {
+	var a trustAnchor
+	if err := xml.Unmarshal(b, &a); err != nil {
+		return trustAnchor{}, err
+	}
+	if a.Zone != "." {
+		return trustAnchor{}, fmt.Errorf("trust anchor for zone %s, want the root", strconv.Quote(a.Zone))
+	}
+	for _, d := range a.Digests {
+		if _, err := hex.DecodeString(d.Digest); err != nil {
+			return trustAnchor{}, fmt.Errorf("trust anchor key %d: %w", d.KeyTag, err)
+		}
+	}
+	return a, nil
+}
+
+// validDigests returns the keys valid at the given time.
+func (a trustAnchor) validDigests(now time.Time) []keyDigest {
+	var valid []keyDigest
+	for _, d := range a.Digests {
+		from, err := time.Parse(time.RFC3339, d.ValidFrom)
+		if err != nil || now.Before(from) {
+			continue
+		}
+		if d.ValidUntil != "" {
+			until, err := time.Parse(time.RFC3339, d.ValidUntil)
+			if err != nil || !now.Before(until) {
+				continue
+			}
+		}
+		valid = append(valid, d)
+	}
+	return valid
+}
+
+// same reports whether both digests describe the same key.
+func (d keyDigest) same(o keyDigest) bool {
+	return d.KeyTag == o.KeyTag && d.Algorithm == o.Algorithm && d.DigestType == o.DigestType &&
+		strings.EqualFold(d.Digest, o.Digest)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	rrlIPv4Prefix  = 24               // Clients sharing this prefix share a limit
+	rrlIPv6Prefix  = 56               // Likewise for IPv6, the usual size of a customer allocation
+	rrlIdle        = 15 * time.Second // Idle time after which the state of a response is forgotten
+	rrlMaxEntries  = 100000           // Entries kept before idle ones are purged
+	rrlPurgePeriod = 5 * time.Second
+)
+
+// rrlEntry is the credit of one kind of response to one network.
+type rrlEntry struct {
+	tokens  float64 // Responses that can be sent right away
+	last    time.Time
+	limited int // Responses over the limit since the credit last ran out
+}
+
+// responseLimiter implements Response Rate Limiting as done by BIND: UDP
+// clients are grouped by network prefix, and identical authoritative
+// responses sent to a group are limited to rate per second. Over the limit,
+// every slip-th response is replaced by an empty truncated one, which makes
+// a real client retry over TCP while giving a spoofed victim nothing to
+// amplify, and the others are dropped. A slip of 0 drops all of them.
+type responseLimiter struct {
+	rate float64
+	slip int
+
+	mu        sync.Mutex
+	entries   map[string]*rrlEntry
+	lastPurge time.Time
+}
+
+func newResponseLimiter(rate, slip int) *responseLimiter {
+	return &responseLimiter{rate: float64(rate), slip: slip, entries: make(map[string]*rrlEntry)}
+}
+
+// rrlKey identifies the kind of response m sent to client. Negative
+// responses are keyed by the zone in their authority section rather than by
+// the query name, so that queries for random names share a limit.
+func rrlKey(client net.IP, m dns.Message) string {
+	var prefix net.IP
+	if ip4 := client.To4(); ip4 != nil {
+		prefix = ip4.Mask(net.CIDRMask(rrlIPv4Prefix, 32))
+	} else {
+		prefix = client.Mask(net.CIDRMask(rrlIPv6Prefix, 128))
+	}
+	var name string
+	var qtype uint16
+	if len(m.Question.Queries) > 0 {
+		name, qtype = m.Question.Queries[0].Name, m.Question.Queries[0].Type
+	}
+	if rcode := m.Header.RCode(); rcode == dns.RCODE_NXDOMAIN || (rcode == dns.RCODE_NOERROR && len(m.Answer.Records) == 0) {
+		for _, rr := range m.Authority.Records {
+			if rr.Type == dns.TYPE_SOA {
+				name = rr.Name
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("%s/%s/%d/%d", prefix, dns.CanonicalName(name), qtype, m.Header.RCode())
+}
+
+// check accounts a response and returns verdictAllow to send it,
+// verdictRefuse to send it truncated, or verdictDrop, and whether the
+// response has just started to be limited.
+func (l *responseLimiter) check(key string, now time.Time) (verdict, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.purge(now)
+	e, ok := l.entries[key]
+	if !ok {
+		e = &rrlEntry{tokens: l.rate, last: now}
+		l.entries[key] = e
+	}
+	e.tokens += now.Sub(e.last).Seconds() * l.rate
+	if e.tokens > l.rate {
+		e.tokens = l.rate
+	}
+	e.last = now
+	if e.tokens >= 1 {
+		e.tokens--
+		e.limited = 0
+		return verdictAllow, false
+	}
+	e.limited++
+	if l.slip > 0 && e.limited%l.slip == 0 {
+		return verdictRefuse, e.limited == 1
+	}
+	return verdictDrop, e.limited == 1
+}
+
+// purge forgets idle entries once the table has grown large. l.mu must be
+// held.
+func (l *responseLimiter) purge(now time.Time) {
+	if len(l.entries) < rrlMaxEntries || now.Sub(l.lastPurge) < rrlPurgePeriod {
+		return
+	}
+	l.lastPurge = now
+	for key, e := range l.entries {
+		if now.Sub(e.last) > rrlIdle {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// rrlWriter applies response rate limiting to the authoritative responses
+// of a UDP client.
+type rrlWriter struct {
+	dns.ResponseWriter
+	rrl *responseLimiter
+}
+
+func (w *rrlWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *rrlWriter) WriteMsg(m dns.Message) error {
+	client := addrIP(w.RemoteAddr())
+	if !m.Header.AA() || client == nil {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	v, started := w.rrl.check(rrlKey(client, m), time.Now())
+	if started {
+		attrs := []interface{}{addrAttr("client", w.RemoteAddr()), "rcode", m.Header.RCode().String()}
+		if len(m.Question.Queries) > 0 {
+			q := m.Question.Queries[0]
+			attrs = append(attrs, "name", privacy.name(q.Name), "type", dns.TypeString(q.Type))
+		}
+		slog.Info("Rate limiting responses", attrs...)
+	}
+	switch v {
+	case verdictRefuse:
+		metrics.inc("rrl_slipped_total")
+		return w.ResponseWriter.WriteMsg(slipResponse(m))
+	case verdictDrop:
+		metrics.inc("rrl_dropped_total")
+		r := dns.Message{Header: m.Header, Question: m.Question}
+		drop(w, &r, reasonRateLimited)
+		return nil
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// slipResponse is m stripped down to its header and question, with the TC
+// bit set.
+func slipResponse(m dns.Message) dns.Message {
+	t := dns.Message{Header: m.Header, Question: m.Question}
+	t.Header.ANCOUNT, t.Header.NSCOUNT, t.Header.ARCOUNT = 0, 0, 0
+	t.Header.SetTC(true)
+	return t
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	// Interval between attempts to load a secondary zone for the first
+	// time, before its SOA timers are known.
+	secondaryLoadRetry = 30 * time.Second
+	// Shortest refresh and retry intervals, whatever the SOA record of the
+	// primary says, so that a zone with zero timers does not flood it.
+	secondaryMinInterval = 5 * time.Second
+)
+
+// secondary keeps a zone in sync with the primary server it is
+// transferred from (RFC 1034 section 4.3.5). The serial of the primary is
+// checked every refresh interval of the SOA record, and the changes are
+// transferred with IXFR when it grew, or the whole zone with AXFR if the
+// primary cannot send changes. Failed checks are retried every retry
+// interval, and once the primary has been unreachable for the expire
+// interval the zone is dropped and answered with SERVFAIL until it is
+// transferred again.
+type secondary struct {
+	zone       *zone
+	primary    string
+	client     *dns.Client
+	notifier   *zoneNotifier // Of the secondaries of this zone in turn, nil if none
+	refreshNow chan struct{} // Signaled by a NOTIFY from the primary
+
+	mu           sync.Mutex
+	lastRefresh  time.Time // Of the last check of the serial that succeeded, zero if none did
+	nextRefresh  time.Time
+	expires      time.Time // Zero while the zone is not loaded
+	lastTransfer *transferStats
+}
+
+// transferStats describes the last transfer of a secondary zone.
+type transferStats struct {
+	Type     string    `json:"type"` // AXFR or IXFR
+	At       time.Time `json:"at"`
+	Serial   uint32    `json:"serial"`
+	Duration float64   `json:"duration_seconds"`
+	Bytes    int       `json:"bytes"`
+}
+
+// parseSecondary sets up the secondary zone of the argument of the
+// -secondary-zone flag, of the form origin=primary with the port of the
+// primary 53 if it has none. With a TSIG key, the queries to the primary
+// are signed with it.
+func parseSecondary(arg string, key *dns.TSIGKey) (*secondary, error) {
+	origin, primary, ok := strings.Cut(arg, "=")
+	if !ok || origin == "" || primary == "" {
+		return nil, fmt.Errorf("secondary zone %q is not of the form origin=primary", arg)
+	}
+	if _, _, err := net.SplitHostPort(primary); err != nil {
+		primary = net.JoinHostPort(strings.Trim(primary, "[]"), "53")
+	}
+	s := &secondary{
+		zone:       newZone(origin),
+		primary:    primary,
+		client:     &dns.Client{Rand: rng, Timeout: 30 * time.Second, TSIG: key},
+		refreshNow: make(chan struct{}, 1),
+	}
+	s.zone.source = "primary " + primary
+	s.zone.secondary = s
+	return s, nil
+}
+
+// inherit takes over the records and timers of the zone that old kept in
+// sync, if it is the same zone from the same primary, so that reloading
+// the configuration does not transfer it again.
+func (s *secondary) inherit(old *secondary) {
+	if old.zone.origin != s.zone.origin || old.primary != s.primary {
+		return
+	}
+	s.zone.replace(old.zone)
+	old.mu.Lock()
+	s.lastRefresh, s.nextRefresh, s.expires, s.lastTransfer = old.lastRefresh, old.nextRefresh, old.expires, old.lastTransfer
+	old.mu.Unlock()
+}
+
+// run refreshes the zone whenever it is due or the primary notifies it of
+// a change, until stop is closed.
+func (s *secondary) run(stop <-chan struct{}) {
+	s.registerMetrics()
+	for {
+		s.mu.Lock()
+		timer := time.NewTimer(time.Until(s.nextRefresh))
+		s.mu.Unlock()
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-s.refreshNow:
+			timer.Stop()
+		}
+		s.refresh()
+	}
+}
+
+// refresh brings the zone up to date with the primary and schedules the
+// next refresh.
+func (s *secondary) refresh() {
+	metrics.inc("zone_refresh_total")
+	now := time.Now()
+	err := s.sync()
+	refresh, retry, expire, loaded := s.timers()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil && loaded {
+		s.lastRefresh, s.nextRefresh, s.expires = now, now.Add(refresh), now.Add(expire)
+		return
+	}
+	if err == nil {
+		err = errors.New("no SOA record at the zone apex")
+	}
+	metrics.inc("zone_transfer_failures_total")
+	if !loaded {
+		retry = secondaryLoadRetry
+	}
+	s.nextRefresh = now.Add(retry)
+	slog.Warn("Failed to refresh secondary zone", "zone", s.zone.origin, "primary", s.primary, "retry_in", retry.String(), "err", err)
+	if !s.expires.IsZero() && now.After(s.expires) {
+		s.zone.replace(newZone(s.zone.origin))
+		s.expires = time.Time{}
+		slog.Error("Secondary zone expired, answering SERVFAIL until the primary is reached", "zone", s.zone.origin, "primary", s.primary)
+	}
+}
+
+// timers returns the refresh, retry, and expire intervals of the SOA
+// record of the zone, and false if the zone has none.
+func (s *secondary) timers() (refresh, retry, expire time.Duration, ok bool) {
+	set, ok := s.zone.soa()
+	if !ok || len(set.Data) == 0 {
+		return 0, 0, 0, false
+	}
+	soa, ok := set.Records()[0].SOA()
+	if !ok {
+		return 0, 0, 0, false
+	}
+	interval := func(seconds uint32) time.Duration {
+		if d := time.Duration(seconds) * time.Second; d > secondaryMinInterval {
+			return d
+		}
+		return secondaryMinInterval
+	}
+	return interval(soa.Refresh), interval(soa.Retry), time.Duration(soa.Expire) * time.Second, true
+}
+
+// sync transfers the zone if the primary has a newer serial than ours, or
+// if it is not loaded yet.
+func (s *secondary) sync() error {
+	ctx := context.Background()
+	var have *dns.Record
+	if set, ok := s.zone.soa(); ok && len(set.Data) > 0 {
+		have = &set.Records()[0]
+		ours, _ := have.SOA()
+		theirs, err := s.primarySerial(ctx)
+		if err != nil {
+			return err
+		}
+		if !dns.SerialNewer(theirs, ours.Serial) {
+			return nil
+		}
+	}
+
+	start := time.Now()
+	stats := &transferStats{Type: "AXFR", At: start}
+	var t dns.ZoneTransfer
+	var err error
+	if have != nil {
+		stats.Type = "IXFR"
+		if t, err = s.client.TransferZone(ctx, s.zone.origin, s.primary, have); err != nil {
+			slog.Info("Incremental transfer failed, transferring the whole zone", "zone", s.zone.origin, "primary", s.primary, "err", err)
+		}
+	}
+	if have == nil || err != nil {
+		stats.Type = "AXFR"
+		if t, err = s.client.TransferZone(ctx, s.zone.origin, s.primary, nil); err != nil {
+			return err
+		}
+	}
+	metrics.add("zone_transfer_bytes_total", uint64(t.Bytes))
+	if t.Records == nil && t.Diffs == nil {
+		return nil
+	}
+	fresh, err := s.apply(t)
+	if err != nil {
+		return err
+	}
+	old := s.zone.status().Serial
+	s.zone.replace(fresh)
+	s.notifier.changed(s.zone, old)
+
+	soa, _ := t.SOA.SOA()
+	stats.Serial, stats.Duration, stats.Bytes = soa.Serial, time.Since(start).Seconds(), t.Bytes
+	s.mu.Lock()
+	s.lastTransfer = stats
+	s.mu.Unlock()
+	slog.Info("Transferred secondary zone", "zone", s.zone.origin, "primary", s.primary, "type", stats.Type, "serial", soa.Serial, "changes", len(t.Diffs), "bytes", t.Bytes)
+	return nil
+}
+
+// primarySerial asks the primary for the serial of the zone.
+func (s *secondary) primarySerial(ctx context.Context) (uint32, error) {
+	res, err := s.client.Exchange(ctx, dns.NewQuery(s.zone.origin, dns.TYPE_SOA).WithoutRD().Message(), s.primary)
+	if err != nil {
+		return 0, err
+	}
+	if rcode := res.Header.RCode(); rcode != dns.RCODE_NOERROR {
+		return 0, fmt.Errorf("SOA query answered with %s", rcode)
+	}
+	if !res.Header.AA() {
+		return 0, errors.New("primary is not authoritative for the zone")
+	}
+	for _, r := range res.Answer.Records {
+		if soa, ok := r.SOA(); ok && dns.CompareNames(r.Name, s.zone.origin) == 0 {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("no SOA record in the answer of the primary")
+}
+
+// apply returns a new version of the zone with the records of a transfer:
+// the whole zone, or the current records with the changes applied.
+func (s *secondary) apply(t dns.ZoneTransfer) (*zone, error) {
+	fresh := newZone(s.zone.origin)
+	if t.Records != nil {
+		for _, set := range dns.GroupRRSets(t.Records) {
+			fresh.set(set)
+		}
+		return fresh, nil
+	}
+	rrsets := make(map[dns.RRSetKey]dns.RRSet)
+	for _, set := range s.zone.page(nil, math.MaxInt) {
+		rrsets[set.Key()] = set
+	}
+	for _, diff := range t.Diffs {
+		for _, r := range diff.Removed {
+			key := dns.NewRRSet(r).Key()
+			set, ok := rrsets[key]
+			i := indexData(set.Data, r.Data)
+			if !ok || i < 0 {
+				return nil, fmt.Errorf("incremental transfer removes %s %s, which the zone does not have", r.Name, dns.TypeString(r.Type))
+			}
+			set.Data = append(append([][]byte(nil), set.Data[:i]...), set.Data[i+1:]...)
+			rrsets[key] = set
+			if len(set.Data) == 0 {
+				delete(rrsets, key)
+			}
+		}
+		for _, r := range diff.Added {
+			key := dns.NewRRSet(r).Key()
+			set, ok := rrsets[key]
+			if !ok {
+				rrsets[key] = dns.NewRRSet(r)
+				continue
+			}
+			if indexData(set.Data, r.Data) < 0 {
+				set.Data = append(append([][]byte(nil), set.Data...), r.Data)
+			}
+			set.TTL = r.TTL
+			rrsets[key] = set
+		}
+	}
+	for _, set := range rrsets {
+		fresh.set(set)
+	}
+	return fresh, nil
+}
+
+func indexData(data [][]byte, d []byte) int {
+	for i, b := range data {
+		if bytes.Equal(b, d) {
+			return i
+		}
+	}
+	return -1
+}
+
+// registerMetrics exposes the state of the zone as gauges named after its
+// origin: the serial, the seconds until it expires, and the duration in
+// milliseconds and size in bytes of the last transfer. They read zero while
+// the zone is not loaded or was never transferred. A secondary of the same
+// zone in a reloaded configuration takes the gauges over.
+func (s *secondary) registerMetrics() {
+	origin := s.zone.origin
+	metrics.gauge("zone_serial_"+origin, func() uint64 {
+		if set, ok := s.zone.soa(); ok && len(set.Data) > 0 {
+			soa, _ := set.Records()[0].SOA()
+			return uint64(soa.Serial)
+		}
+		return 0
+	})
+	metrics.gauge("zone_expires_in_seconds_"+origin, func() uint64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if in := time.Until(s.expires); !s.expires.IsZero() && in > 0 {
+			return uint64(in.Seconds())
+		}
+		return 0
+	})
+	metrics.gauge("zone_last_transfer_duration_ms_"+origin, func() uint64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.lastTransfer == nil {
+			return 0
+		}
+		return uint64(s.lastTransfer.Duration * 1000)
+	})
+	metrics.gauge("zone_last_transfer_bytes_"+origin, func() uint64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.lastTransfer == nil {
+			return 0
+		}
+		return uint64(s.lastTransfer.Bytes)
+	})
+}
+
+// status adds the refresh state of the zone to st.
+func (s *secondary) status(st *zoneStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st.Primary = s.primary
+	if !s.lastRefresh.IsZero() {
+		last := s.lastRefresh
+		st.LastRefresh = &last
+	}
+	next := s.nextRefresh
+	st.NextRefresh = &next
+	if !s.expires.IsZero() {
+		in := time.Until(s.expires).Seconds()
+		st.ExpiresIn = &in
+	}
+	st.LastTransfer = s.lastTransfer
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/subtle"
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+// The X25519-XSalsa20Poly1305 construction of NaCl's crypto_box, used by
+// DNSCrypt. The standard library has X25519 but neither Salsa20 nor a public
+// Poly1305, so both are implemented here following their specifications
+// (https://cr.yp.to/snuffle/spec.pdf, RFC 8439 section 2.5).
+
+const (
+	boxOverhead = 16 // Size of the Poly1305 tag preceding the ciphertext
+	boxNonceLen = 24
+)
+
+// salsaSigma is "expand 32-byte k".
+var salsaSigma = [4]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574}
+
+// boxSharedKey returns the key shared by the owners of the X25519 keys, as
+// computed by crypto_box_beforenm.
+func boxSharedKey(private *ecdh.PrivateKey, peer []byte) ([32]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	secret, err := private.ECDH(pub)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var key, in [32]byte
+	copy(in[:], secret)
+	hsalsa20(&key, &[16]byte{}, &in)
+	return key, nil
+}
+
+// secretboxSeal encrypts and authenticates msg, returning the tag followed
+// by the ciphertext.
+func secretboxSeal(msg []byte, nonce *[boxNonceLen]byte, key *[32]byte) []byte {
+	stream := xsalsa20Stream(nonce, key, 32+len(msg))
+	out := make([]byte, boxOverhead+len(msg))
+	for i, b := range msg {
+		out[boxOverhead+i] = b ^ stream[32+i]
+	}
+	tag := poly1305(out[boxOverhead:], stream[:32])
+	copy(out, tag[:])
+	return out
+}
+
+// secretboxOpen verifies and decrypts a box made by secretboxSeal.
+func secretboxOpen(box []byte, nonce *[boxNonceLen]byte, key *[32]byte) ([]byte, bool) {
+	if len(box) < boxOverhead {
+		return nil, false
+	}
+	ciphertext := box[boxOverhead:]
+	stream := xsalsa20Stream(nonce, key, 32+len(ciphertext))
+	tag := poly1305(ciphertext, stream[:32])
+	if subtle.ConstantTimeCompare(tag[:], box[:boxOverhead]) != 1 {
+		return nil, false
+	}
+	msg := make([]byte, len(ciphertext))
+	for i, b := range ciphertext {
+		msg[i] = b ^ stream[32+i]
+	}
+	return msg, true
+}
+
+// xsalsa20Stream returns n bytes of the XSalsa20 key stream.
+func xsalsa20Stream(nonce *[boxNonceLen]byte, key *[32]byte, n int) []byte {
+	var subkey [32]byte
+	var hNonce [16]byte
+	copy(hNonce[:], nonce[:16])
+	hsalsa20(&subkey, &hNonce, key)
+
+	var in [16]uint32
+	in[0], in[5], in[10], in[15] = salsaSigma[0], salsaSigma[1], salsaSigma[2], salsaSigma[3]
+	for i := 0; i < 4; i++ {
+		in[1+i] = binary.LittleEndian.Uint32(subkey[4*i:])
+		in[11+i] = binary.LittleEndian.Uint32(subkey[16+4*i:])
+	}
+	in[6] = binary.LittleEndian.Uint32(nonce[16:])
+	in[7] = binary.LittleEndian.Uint32(nonce[20:])
+
+	stream := make([]byte, 0, n+63)
+	for counter := uint64(0); len(stream) < n; counter++ {
+		in[8], in[9] = uint32(counter), uint32(counter>>32)
+		x := salsa20Rounds(in)
+		for i := range x {
+			stream = binary.LittleEndian.AppendUint32(stream, x[i]+in[i])
+		}
+	}
+	return stream[:n]
+}
+
+// hsalsa20 derives a key from key and the first 16 bytes of an XSalsa20
+// nonce.
+func hsalsa20(out *[32]byte, nonce *[16]byte, key *[32]byte) {
+	var in [16]uint32
+	in[0], in[5], in[10], in[15] = salsaSigma[0], salsaSigma[1], salsaSigma[2], salsaSigma[3]
+	for i := 0; i < 4; i++ {
+		in[1+i] = binary.LittleEndian.Uint32(key[4*i:])
+		in[11+i] = binary.LittleEndian.Uint32(key[16+4*i:])
+		in[6+i] = binary.LittleEndian.Uint32(nonce[4*i:])
+	}
+	x := salsa20Rounds(in)
+	for i, w := range []uint32{x[0], x[5], x[10], x[15], x[6], x[7], x[8], x[9]} {
+		binary.LittleEndian.PutUint32(out[4*i:], w)
+	}
+}
+
+// salsa20Rounds applies the 20 rounds of the Salsa20 core to in, without
+// the final addition of the input.
+func salsa20Rounds(x [16]uint32) [16]uint32 {
+	rotl := bits.RotateLeft32
+	for i := 0; i < 10; i++ {
+		// Column round
+		x[4] ^= rotl(x[0]+x[12], 7)
+		x[8] ^= rotl(x[4]+x[0], 9)
+		x[12] ^= rotl(x[8]+x[4], 13)
+		x[0] ^= rotl(x[12]+x[8], 18)
+		x[9] ^= rotl(x[5]+x[1], 7)
+		x[13] ^= rotl(x[9]+x[5], 9)
+		x[1] ^= rotl(x[13]+x[9], 13)
+		x[5] ^= rotl(x[1]+x[13], 18)
+		x[14] ^= rotl(x[10]+x[6], 7)
+		x[2] ^= rotl(x[14]+x[10], 9)
+		x[6] ^= rotl(x[2]+x[14], 13)
+		x[10] ^= rotl(x[6]+x[2], 18)
+		x[3] ^= rotl(x[15]+x[11], 7)
+		x[7] ^= rotl(x[3]+x[15], 9)
+		x[11] ^= rotl(x[7]+x[3], 13)
+		x[15] ^= rotl(x[11]+x[7], 18)
+		// Row round
+		x[1] ^= rotl(x[0]+x[3], 7)
+		x[2] ^= rotl(x[1]+x[0], 9)
+		x[3] ^= rotl(x[2]+x[1], 13)
+		x[0] ^= rotl(x[3]+x[2], 18)
+		x[6] ^= rotl(x[5]+x[4], 7)
+		x[7] ^= rotl(x[6]+x[5], 9)
+		x[4] ^= rotl(x[7]+x[6], 13)
+		x[5] ^= rotl(x[4]+x[7], 18)
+		x[11] ^= rotl(x[10]+x[9], 7)
+		x[8] ^= rotl(x[11]+x[10], 9)
+		x[9] ^= rotl(x[8]+x[11], 13)
+		x[10] ^= rotl(x[9]+x[8], 18)
+		x[12] ^= rotl(x[15]+x[14], 7)
+		x[13] ^= rotl(x[12]+x[15], 9)
+		x[14] ^= rotl(x[13]+x[12], 13)
+		x[15] ^= rotl(x[14]+x[13], 18)
+	}
+	return x
+}
+
+var (
+	poly1305P     = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 130), big.NewInt(5))
+	poly1305Clamp = new(big.Int).SetBytes([]byte{0x0f, 0xff, 0xff, 0xfc, 0x0f, 0xff, 0xff, 0xfc, 0x0f, 0xff, 0xff, 0xfc, 0x0f, 0xff, 0xff, 0xff})
+	poly1305Mod   = new(big.Int).Lsh(big.NewInt(1), 128)
+)
+
+// poly1305 returns the Poly1305 tag of msg under the one-time key. DNS
+// messages are small, so the arithmetic is done with big integers for
+// clarity rather than speed.
+func poly1305(msg, key []byte) [16]byte {
+	r := new(big.Int).And(leInt(key[:16]), poly1305Clamp)
+	s := leInt(key[16:32])
+	acc := new(big.Int)
+	for len(msg) > 0 {
+		n := 16
+		if len(msg) < n {
+			n = len(msg)
+		}
+		block := append(append([]byte{}, msg[:n]...), 1)
+		acc.Add(acc, leInt(block))
+		acc.Mul(acc, r)
+		acc.Mod(acc, poly1305P)
+		msg = msg[n:]
+	}
+	acc.Add(acc, s)
+	acc.Mod(acc, poly1305Mod)
+	var tag [16]byte
+	be := acc.FillBytes(make([]byte, 16))
+	for i := range tag {
+		tag[i] = be[15-i]
+	}
+	return tag
+}
+
+// leInt interprets b as a little endian integer.
+func leInt(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
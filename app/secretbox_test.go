@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// unhex decodes hex dumps wrapped over several strings.
+func unhex(t *testing.T, parts ...string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The crypto_box vector of the NaCl distribution (tests/box.c and
+// tests/box2.c): Alice boxes a message for Bob.
+var (
+	boxAlicePrivate = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+	boxBobPrivate   = "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb"
+	boxAlicePublic  = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+	boxBobPublic    = "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"
+	boxSharedVector = "1b27556473e985d462cd51197a9a46c76009549eac6474f206c4ee0844f68389"
+	boxNonceVector  = "69696ee955b62b73cd62bda875fc73d68219e0036b7a0b37"
+	boxMessage      = []string{
+		"be075fc53c81f2d5cf141316ebeb0c7b5228c52a4c62cbd44b66849b64244ffc",
+		"e5ecbaaf33bd751a1ac728d45e6c61296cdc3c01233561f41db66cce314adb31",
+		"0e3be8250c46f06dceea3a7fa1348057e2f6556ad6b1318a024a838f21af1fde",
+		"048977eb48f59ffd4924ca1c60902e52f0a089bc76897040e082f93776384864",
+		"5e0705",
+	}
+	boxSealed = []string{
+		"f3ffc7703f9400e52a7dfb4b3d3305d9",
+		"8e993b9f48681273c29650ba32fc76ce48332ea7164d96a4476fb8c531a1186a",
+		"c0dfc17c98dce87b4da7f011ec48c97271d2c20f9b928fe2270d6fb863d51738",
+		"b48eeee314a7cc8ab932164548e526ae90224368517acfeabd6bb3732bc0e9da",
+		"99832b61ca01b6de56244a9e88d5f9b37973f622a43d14a6599b1f654cb45a74",
+		"e355a5",
+	}
+)
+
+func TestBoxSharedKey(t *testing.T) {
+	for _, tt := range []struct{ name, private, peer string }{
+		{"alice", boxAlicePrivate, boxBobPublic},
+		{"bob", boxBobPrivate, boxAlicePublic},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			private, err := ecdh.X25519().NewPrivateKey(unhex(t, tt.private))
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := boxSharedKey(private, unhex(t, tt.peer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := unhex(t, boxSharedVector); !bytes.Equal(key[:], want) {
+				t.Errorf("shared key %x, want %x", key, want)
+			}
+		})
+	}
+}
+
+func TestSecretbox(t *testing.T) {
+	var key [32]byte
+	var nonce [boxNonceLen]byte
+	copy(key[:], unhex(t, boxSharedVector))
+	copy(nonce[:], unhex(t, boxNonceVector))
+	msg, want := unhex(t, boxMessage...), unhex(t, boxSealed...)
+
+	box := secretboxSeal(msg, &nonce, &key)
+	if !bytes.Equal(box, want) {
+		t.Fatalf("sealed\n%x\nwant\n%x", box, want)
+	}
+	opened, ok := secretboxOpen(box, &nonce, &key)
+	if !ok || !bytes.Equal(opened, msg) {
+		t.Fatalf("opened %x, %v, want the message", opened, ok)
+	}
+	// Any change to the tag or the ciphertext is caught.
+	for _, i := range []int{0, boxOverhead - 1, boxOverhead, len(box) - 1} {
+		tampered := append([]byte(nil), box...)
+		tampered[i] ^= 1
+		if _, ok := secretboxOpen(tampered, &nonce, &key); ok {
+			t.Errorf("box changed at byte %d opened", i)
+		}
+	}
+	if _, ok := secretboxOpen(box[:boxOverhead-1], &nonce, &key); ok {
+		t.Error("box shorter than its tag opened")
+	}
+}
+
+// TestPoly1305 checks the test vector of RFC 8439 section 2.5.2.
+func TestPoly1305(t *testing.T) {
+	key := unhex(t, "85d6be7857556d337f4452fe42d506a80103808afb0db2fd4abff6af4149f51b")
+	tag := poly1305([]byte("Cryptographic Forum Research Group"), key)
+	if want := unhex(t, "a8061dc1305136c6c22b8baf0c0127a9"); !bytes.Equal(tag[:], want) {
+		t.Errorf("tag %x, want %x", tag, want)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// answerShuffler randomizes the answer order and TTLs of outgoing responses so
+// downstream consumers can be tested for order-dependence bugs. Every
+// response gets its own random source derived from the seed, the domain, and
+// the message ID, which keeps a run reproducible regardless of how queries
+// interleave, without keeping state per domain.
+type answerShuffler struct {
+	seed   int64
+	minTTL uint32
+}
+
+func newAnswerShuffler(seed int64, minTTL uint32) *answerShuffler {
+	return &answerShuffler{seed: seed, minTTL: minTTL}
+}
+
+// middleware shuffles the responses of every query.
+func (s *answerShuffler) middleware(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Message) {
+		next.ServeDNS(&shuffleWriter{ResponseWriter: w, shuffler: s}, r)
+	})
+}
+
+// shuffleWriter shuffles the answers of responses before sending them.
+type shuffleWriter struct {
+	dns.ResponseWriter
+	shuffler *answerShuffler
+}
+
+func (w *shuffleWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *shuffleWriter) WriteMsg(m dns.Message) error {
+	w.shuffler.Shuffle(&m)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Shuffle reorders the answers of the response in place.
+func (s *answerShuffler) Shuffle(m *dns.Message) {
+	if len(m.Question.Queries) == 0 {
+		return
+	}
+	h := fnv.New64a()
+	h.Write([]byte(m.Question.Queries[0].Name))
+	h.Write(binary.BigEndian.AppendUint16(nil, m.Header.ID))
+	dns.ShuffleAnswers(m, dns.NewSeededRand(s.seed^int64(h.Sum64())), s.minTTL)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	sloBucket       = 10 * time.Second // Resolution of the rolling windows
+	sloBuckets      = 360              // Buckets kept, enough for the longest window
+	sloEvalInterval = 30 * time.Second
+	sloMinQueries   = 20 // Queries needed in the short window before alerting
+	sloShortWindow  = 5 * time.Minute
+	sloLongWindow   = time.Hour
+)
+
+// sloBucketCounts are the responses of one bucket of time.
+type sloBucketCounts struct {
+	start time.Time
+	total uint64
+	fast  uint64 // Responses within the latency objective
+}
+
+// sloTracker measures the fraction of responses sent within a latency
+// objective over rolling windows. It alerts when the error budget burns
+// faster than the threshold over both a short and a long window, which
+// catches fast burns without paging on brief spikes.
+type sloTracker struct {
+	latency   time.Duration // Latency objective
+	target    float64       // Fraction of responses that must meet it
+	burnAlert float64       // Burn rate that raises an alert, 0 to disable alerts
+	hooks     *webhookNotifier
+
+	mu       sync.Mutex
+	buckets  [sloBuckets]sloBucketCounts
+	alerting bool
+}
+
+func newSLOTracker(latency time.Duration, target, burnAlert float64, hooks *webhookNotifier) *sloTracker {
+	return &sloTracker{latency: latency, target: target, burnAlert: burnAlert, hooks: hooks}
+}
+
+// observe records a response sent d after its query arrived.
+func (t *sloTracker) observe(d time.Duration, now time.Time) {
+	fast := d <= t.latency
+	metrics.inc("slo_responses_total")
+	if fast {
+		metrics.inc("slo_responses_fast_total")
+	}
+	start := now.Truncate(sloBucket)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[start.Unix()/int64(sloBucket/time.Second)%sloBuckets]
+	if !b.start.Equal(start) {
+		*b = sloBucketCounts{start: start}
+	}
+	b.total++
+	if fast {
+		b.fast++
+	}
+}
+
+// sloWindow is the state of the objective over a rolling window.
+type sloWindow struct {
+	Window   string  `json:"window"`
+	Total    uint64  `json:"total"`
+	Fast     uint64  `json:"fast"`
+	Ratio    float64 `json:"ratio"`     // Fraction of fast responses, 1 without responses
+	BurnRate float64 `json:"burn_rate"` // Error budget spent relative to the sustainable rate
+}
+
+// window sums the buckets of the last d.
+func (t *sloTracker) window(d time.Duration, now time.Time) sloWindow {
+	since := now.Add(-d)
+	w := sloWindow{Window: d.String(), Ratio: 1}
+	t.mu.Lock()
+	for _, b := range t.buckets {
+		if b.start.After(since) && !b.start.After(now) {
+			w.Total += b.total
+			w.Fast += b.fast
+		}
+	}
+	t.mu.Unlock()
+	if w.Total > 0 {
+		w.Ratio = float64(w.Fast) / float64(w.Total)
+	}
+	if budget := 1 - t.target; budget > 0 {
+		w.BurnRate = (1 - w.Ratio) / budget
+	}
+	return w
+}
+
+// sloStatus is the state of the objective reported by the admin API and
+// posted to webhooks when an alert fires or resolves.
+type sloStatus struct {
+	Latency   float64     `json:"latency_ms"`
+	Target    float64     `json:"target"`
+	BurnAlert float64     `json:"burn_rate_alert"`
+	Alerting  bool        `json:"alerting"`
+	Windows   []sloWindow `json:"windows"`
+	Time      time.Time   `json:"time"`
+}
+
+func (t *sloTracker) status(now time.Time) sloStatus {
+	t.mu.Lock()
+	alerting := t.alerting
+	t.mu.Unlock()
+	return sloStatus{
+		Latency:   float64(t.latency.Microseconds()) / 1000,
+		Target:    t.target,
+		BurnAlert: t.burnAlert,
+		Alerting:  alerting,
+		Windows:   []sloWindow{t.window(sloShortWindow, now), t.window(sloLongWindow, now)},
+		Time:      now.UTC(),
+	}
+}
+
+// run evaluates the burn rate periodically, logging and posting to the
+// webhooks when the alert fires or resolves.
+func (t *sloTracker) run() {
+	for now := range time.Tick(sloEvalInterval) {
+		t.evaluate(now)
+	}
+}
+
+func (t *sloTracker) evaluate(now time.Time) {
+	if t.burnAlert <= 0 {
+		return
+	}
+	short, long := t.window(sloShortWindow, now), t.window(sloLongWindow, now)
+	firing := short.Total >= sloMinQueries && short.BurnRate >= t.burnAlert && long.BurnRate >= t.burnAlert
+	t.mu.Lock()
+	changed := firing != t.alerting
+	t.alerting = firing
+	t.mu.Unlock()
+	if !changed {
+		return
+	}
+	attrs := []interface{}{
+		"latency_ms", float64(t.latency.Microseconds()) / 1000,
+		"target", t.target,
+		"burn_rate_short", short.BurnRate,
+		"burn_rate_long", long.BurnRate,
+	}
+	if firing {
+		metrics.inc("slo_alerts_total")
+		slog.Warn("Latency SLO is burning its error budget too fast", attrs...)
+	} else {
+		slog.Info("Latency SLO burn rate is back under the alert threshold", attrs...)
+	}
+	if t.hooks == nil {
+		return
+	}
+	body, err := json.Marshal(t.status(now))
+	if err != nil {
+		slog.Error("Failed to encode SLO status", "err", err)
+		return
+	}
+	for _, url := range t.hooks.urls {
+		if err := t.hooks.post(url, body); err != nil {
+			metrics.inc("webhooks_failed_total")
+			slog.Warn("Webhook failed", "url", url, "err", err)
+		}
+	}
+}
+
+// sloWriter observes the time taken to answer each query.
+type sloWriter struct {
+	dns.ResponseWriter
+	slo   *sloTracker
+	start time.Time
+}
+
+func (w *sloWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *sloWriter) WriteMsg(m dns.Message) error {
+	now := time.Now()
+	w.slo.observe(now.Sub(w.start), now)
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Object identifiers of CMS (RFC 5652) and the algorithms its signatures use.
+var (
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidAttrContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrDigest      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidRSA             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+)
+
+// cmsDigests maps the digest algorithms of signer infos to their hash.
+var cmsDigests = map[string]crypto.Hash{
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+// cmsSignatures maps the signature algorithms of signer infos to their x509
+// equivalent. Plain rsaEncryption takes the hash of the digest algorithm.
+var cmsSignatures = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+}
+
+var cmsRSAWith = map[crypto.Hash]x509.SignatureAlgorithm{
+	crypto.SHA256: x509.SHA256WithRSA,
+	crypto.SHA384: x509.SHA384WithRSA,
+	crypto.SHA512: x509.SHA512WithRSA,
+}
+
+var (
+	errNoTrustedSigner  = errors.New("signature is not from a certificate issued by the trusted CA")
+	errSignatureInvalid = errors.New("signature does not match the content")
+)
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContent     cmsEncapContent
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsEncapContent struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional,explicit,tag:0"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue // IssuerAndSerialNumber, or [0] SubjectKeyIdentifier
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// verifyDetachedSignature checks that sig, a DER encoded CMS SignedData
+// structure such as an S/MIME .p7s file, signs content with a certificate
+// that chains up to one of roots at the given time. The certificates the
+// signature carries only serve as intermediates.
+func verifyDetachedSignature(content, sig []byte, roots *x509.CertPool, now time.Time) error {
+	var ci cmsContentInfo
+	if rest, err := asn1.Unmarshal(sig, &ci); err != nil || len(rest) > 0 {
+		return errors.New("signature is not a DER encoded CMS structure")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return fmt.Errorf("signature has content type %s, want signed data", ci.ContentType)
+	}
+	var sd cmsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return fmt.Errorf("signed data: %w", err)
+	}
+	if len(sd.EncapContent.Content.Bytes) > 0 {
+		return errors.New("signature is not detached")
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return fmt.Errorf("signature certificates: %w", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		intermediates.AddCert(c)
+	}
+	err = errNoTrustedSigner
+	for _, si := range sd.SignerInfos {
+		signer := cmsSigner(si, certs)
+		if signer == nil {
+			continue
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: now, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+		if _, verr := signer.Verify(opts); verr != nil {
+			continue
+		}
+		if err = cmsVerifySigner(si, signer, content); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// cmsSigner returns the certificate of certs that si identifies, or nil.
+func cmsSigner(si cmsSignerInfo, certs []*x509.Certificate) *x509.Certificate {
+	var ias cmsIssuerAndSerial
+	if _, err := asn1.Unmarshal(si.SID.FullBytes, &ias); err == nil && ias.Serial != nil {
+		for _, c := range certs {
+			if bytes.Equal(c.RawIssuer, ias.Issuer.FullBytes) && c.SerialNumber.Cmp(ias.Serial) == 0 {
+				return c
+			}
+		}
+		return nil
+	}
+	if si.SID.Class == asn1.ClassContextSpecific && si.SID.Tag == 0 {
+		for _, c := range certs {
+			if len(c.SubjectKeyId) > 0 && bytes.Equal(c.SubjectKeyId, si.SID.Bytes) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// cmsVerifySigner checks the signature of si by signer over content: over
+// the signed attributes, which must hold the digest of content, when it has
+// any, or else over content itself.
+func cmsVerifySigner(si cmsSignerInfo, signer *x509.Certificate, content []byte) error {
+	hash, ok := cmsDigests[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+	algo, ok := cmsSignatures[si.SignatureAlgorithm.Algorithm.String()]
+	if si.SignatureAlgorithm.Algorithm.Equal(oidRSA) {
+		algo, ok = cmsRSAWith[hash]
+	}
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm %s", si.SignatureAlgorithm.Algorithm)
+	}
+	signed := content
+	if len(si.SignedAttrs.FullBytes) > 0 {
+		// The signature covers the attributes encoded as a SET rather
+		// than with their implicit tag (RFC 5652 section 5.4).
+		signed = append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+		var attrs []cmsAttribute
+		if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+			return fmt.Errorf("signed attributes: %w", err)
+		}
+		h := hash.New()
+		h.Write(content)
+		if err := cmsCheckAttributes(attrs, h.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	if err := signer.CheckSignature(algo, signed, si.Signature); err != nil {
+		return errSignatureInvalid
+	}
+	return nil
+}
+
+// cmsCheckAttributes checks that the signed attributes describe plain data
+// with the given digest.
+func cmsCheckAttributes(attrs []cmsAttribute, digest []byte) error {
+	var contentType, haveDigest bool
+	for _, a := range attrs {
+		if len(a.Values) != 1 {
+			continue
+		}
+		switch {
+		case a.Type.Equal(oidAttrContentType):
+			var oid asn1.ObjectIdentifier
+			_, err := asn1.Unmarshal(a.Values[0].FullBytes, &oid)
+			contentType = err == nil && oid.Equal(oidData)
+		case a.Type.Equal(oidAttrDigest):
+			var d []byte
+			_, err := asn1.Unmarshal(a.Values[0].FullBytes, &d)
+			if err == nil && !bytes.Equal(d, digest) {
+				return errSignatureInvalid
+			}
+			haveDigest = err == nil
+		}
+	}
+	if !contentType || !haveDigest {
+		return errors.New("signed attributes lack the content type or digest")
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DNS stamps (https://dnscrypt.info/stamps-specifications) encode everything
+// needed to reach a resolver in a single sdns:// string, as published in
+// public resolver lists.
+
+// Stamp protocol identifiers.
+const (
+	stampPlain    = 0x00
+	stampDNSCrypt = 0x01
+	stampDoH      = 0x02
+	stampDoT      = 0x03
+)
+
+var errStampTruncated = errors.New("DNS stamp is truncated")
+
+// stampReader reads the fields of a decoded stamp.
+type stampReader struct {
+	b []byte
+}
+
+// lp reads a length-prefixed field.
+func (r *stampReader) lp() ([]byte, error) {
+	if len(r.b) < 1 || len(r.b) < 1+int(r.b[0]) {
+		return nil, errStampTruncated
+	}
+	n := int(r.b[0])
+	v := r.b[1 : 1+n]
+	r.b = r.b[1+n:]
+	return v, nil
+}
+
+// vlp reads a set of length-prefixed fields, in which the high bit of each
+// length tells whether another field follows.
+func (r *stampReader) vlp() ([][]byte, error) {
+	var set [][]byte
+	for {
+		if len(r.b) < 1 {
+			return nil, errStampTruncated
+		}
+		more := r.b[0]&0x80 != 0
+		n := int(r.b[0] &^ 0x80)
+		if len(r.b) < 1+n {
+			return nil, errStampTruncated
+		}
+		if n > 0 {
+			set = append(set, r.b[1:1+n])
+		}
+		r.b = r.b[1+n:]
+		if !more {
+			return set, nil
+		}
+	}
+}
+
+// parseStamp decodes a DNS stamp of a plain, DNSCrypt, DoH, or DoT
+// resolver.
+func parseStamp(stamp string) (upstreamAddress, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimPrefix(stamp, "sdns://"), "="))
+	if err != nil {
+		return upstreamAddress{}, fmt.Errorf("invalid DNS stamp: %w", err)
+	}
+	// The protocol is followed by 8 bytes of properties, such as whether
+	// the resolver keeps logs, which do not affect how it is reached.
+	if len(b) < 9 {
+		return upstreamAddress{}, errStampTruncated
+	}
+	protocol := b[0]
+	r := &stampReader{b: b[9:]}
+	addr, err := r.lp()
+	if err != nil {
+		return upstreamAddress{}, err
+	}
+	var a upstreamAddress
+	switch protocol {
+	case stampPlain:
+		a.transport = "udp"
+		err = a.setHostPort(string(addr), 53)
+	case stampDNSCrypt:
+		a.transport = "dnscrypt"
+		if err = a.setHostPort(string(addr), 443); err != nil {
+			break
+		}
+		var key, provider []byte
+		if key, err = r.lp(); err != nil {
+			break
+		}
+		if provider, err = r.lp(); err != nil {
+			break
+		}
+		if len(key) != 32 {
+			err = errors.New("DNS stamp has an invalid DNSCrypt provider key")
+			break
+		}
+		a.dnscrypt = dnscryptUpstream{host: a.host, port: strconv.Itoa(a.port), provider: string(provider), providerKey: key}
+	case stampDoH, stampDoT:
+		defaultPort := 443
+		a.transport = "https"
+		if protocol == stampDoT {
+			defaultPort, a.transport = 853, "tls"
+		}
+		if a.pins, err = r.vlp(); err != nil {
+			break
+		}
+		var hostname, path []byte
+		if hostname, err = r.lp(); err != nil {
+			break
+		}
+		if protocol == stampDoH {
+			if path, err = r.lp(); err != nil {
+				break
+			}
+		}
+		// The host name is what the certificate is issued for, and where
+		// to connect when the stamp has no address.
+		var name upstreamAddress
+		if err = name.setHostPort(string(hostname), defaultPort); err != nil {
+			break
+		}
+		if len(addr) == 0 {
+			a.host, a.port = name.host, name.port
+		} else if err = a.setHostPort(string(addr), name.port); err != nil {
+			break
+		}
+		a.serverName = name.host
+		if protocol == stampDoH {
+			a.url = "https://" + string(hostname) + string(path)
+		}
+	default:
+		return upstreamAddress{}, fmt.Errorf("unsupported DNS stamp protocol %#x", protocol)
+	}
+	if err != nil {
+		return upstreamAddress{}, err
+	}
+	if a.host == "" {
+		return upstreamAddress{}, errors.New("DNS stamp has no address")
+	}
+	return a, nil
+}
+
+// setHostPort sets the host and port from an address of the form host,
+// [IPv6], or either followed by :port.
+func (a *upstreamAddress) setHostPort(addr string, defaultPort int) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		a.host, a.port = strings.Trim(addr, "[]"), defaultPort
+		return nil
+	}
+	if a.port, err = strconv.Atoi(port); err != nil {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+	a.host = host
+	return nil
+}
+
+// verifyPins returns a TLS connection check requiring one of the
+// certificates sent by the server to have the SHA-256 hash of its
+// to-be-signed part in pins.
+func verifyPins(pins [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawTBSCertificate)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+		}
+		return errors.New("no certificate of the resolver matches the hashes of its DNS stamp")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// stdioMaxSize is the largest query read in -single-shot mode, the same as
+// over TCP.
+const stdioMaxSize = 65535
+
+// stdinAddr is the client address reported for -single-shot queries.
+var stdinAddr = &net.UnixAddr{Name: "stdin", Net: "unix"}
+
+// serveSingleShot reads one query in wire format from in, resolves it, and
+// writes the response in wire format to out. Nothing is truncated, as the
+// response does not travel over UDP.
+func serveSingleShot(s *server, in io.Reader, out io.Writer) error {
+	data, err := io.ReadAll(io.LimitReader(in, stdioMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > stdioMaxSize {
+		return errors.New("query larger than 65535 bytes")
+	}
+	slog.Debug("Received query", "bytes", len(data), "client", stdinAddr.String())
+	w := &stdioWriter{w: out}
+	s.handle(data, w)
+	if !w.written {
+		return errors.New("query dropped without a response")
+	}
+	return w.err
+}
+
+// stdioWriter writes a response to a stream without a length prefix.
+type stdioWriter struct {
+	w       io.Writer
+	written bool
+	err     error
+}
+
+func (w *stdioWriter) RemoteAddr() net.Addr {
+	return stdinAddr
+}
+
+func (w *stdioWriter) WriteMsg(m dns.Message) error {
+	if w.written {
+		return errors.New("response already written")
+	}
+	w.written = true
+	_, w.err = w.w.Write(m.Byte())
+	return w.err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// serveStreamListener accepts connections on the listener and answers the
+// length-prefixed DNS messages sent over them, as used by TCP and DoT.
+func serveStreamListener(ln net.Listener, transport string, s *server, idleTimeout time.Duration) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		if shedder.shedding(shedTCP) {
+			metrics.inc("memory_shed_connections_total")
+			conn.Close()
+			continue
+		}
+		go serveStream(conn, transport, s, idleTimeout)
+	}
+}
+
+// listenDoT opens a DNS-over-TLS (RFC 7858) listener on the given address.
+func listenDoT(addr, certFile, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
+// serveStream answers queries on a single connection until the client closes
+// it or stays idle for longer than idleTimeout. Queries are resolved
+// concurrently, so responses may be sent out of order.
+func serveStream(conn net.Conn, transport string, s *server, idleTimeout time.Duration) {
+	defer conn.Close()
+	var (
+		wg      sync.WaitGroup
+		writeMu sync.Mutex
+	)
+	defer wg.Wait()
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return
+		}
+		data, err := dns.ReadStreamMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Info("Closing connection", addrAttr("client", conn.RemoteAddr()), "err", err)
+			}
+			return
+		}
+		slog.Debug("Received query", "bytes", len(data), addrAttr("client", conn.RemoteAddr()), "transport", transport)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(data, &streamWriter{conn: conn, mu: &writeMu, transport: transport})
+		}()
+	}
+}
+
+// streamWriter sends responses to a client over a stream connection. The
+// mutex is shared by all writers of the connection.
+type streamWriter struct {
+	conn      net.Conn
+	mu        *sync.Mutex
+	transport string
+	enc       responseEncoding
+}
+
+func (w *streamWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+func (w *streamWriter) WriteMsg(m dns.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := dns.WriteStreamMessage(w.conn, w.enc.encode(m)); err != nil {
+		slog.Warn("Failed to send response", "err", err)
+		return err
+	}
+	return nil
+}
+
+// streams reports whether responses written to w go to a stream
+// connection, which can carry several responses to one query, unlike UDP
+// and HTTPS.
+func streams(w dns.ResponseWriter) bool {
+	for {
+		switch v := w.(type) {
+		case *streamWriter:
+			return true
+		case interface{ Unwrap() dns.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// addrIP extracts the IP address from a network address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	upstreamTCPConns       = 2                // Persistent TCP connections kept per upstream endpoint
+	upstreamTCPIdleTimeout = 30 * time.Second // Close pooled connections idle for this long
+)
+
+var errConnClosed = errors.New("upstream closed the TCP connection")
+
+// tcpPool keeps a few persistent TCP connections to an upstream endpoint and
+// pipelines queries over them (RFC 7766 section 6.2.1.1): a query is written
+// without waiting for the responses to earlier ones, which are matched to
+// their queries by ID as they arrive, in any order. With a TLS
+// configuration the connections carry DNS over TLS (RFC 7858), resuming
+// earlier TLS sessions when reconnecting.
+type tcpPool struct {
+	addr string
+	size int
+	tls  *tls.Config  // Set for DNS over TLS
+	tsig *dns.TSIGKey // Signs the queries, nil if unsigned
+
+	mu      sync.Mutex
+	conns   []*pipelinedConn
+	dialing int           // Connections being dialed, counted against size
+	dialed  chan struct{} // Closed and replaced whenever a dial ends
+	next    int           // Connection the next query goes to, once the pool is full
+}
+
+func newTCPPool(addr string, size int) *tcpPool {
+	return &tcpPool{addr: addr, size: size, dialed: make(chan struct{})}
+}
+
+// exchange sends msg over one of the pooled connections, dialing a new one
+// while the pool is not full, and waits for its response.
+func (p *tcpPool) exchange(ctx context.Context, msg dns.Message) (dns.Message, error) {
+	c, err := p.conn(ctx)
+	if err != nil {
+		return dns.Message{}, err
+	}
+	return c.exchange(ctx, msg)
+}
+
+// conn returns a connection for a query: a new one while the pool is not
+// full, or else one of the open ones in turn. When the pool is full of
+// connections still being dialed, it waits for one of the dials to end.
+func (p *tcpPool) conn(ctx context.Context) (*pipelinedConn, error) {
+	for {
+		p.mu.Lock()
+		if len(p.conns)+p.dialing < p.size {
+			break
+		}
+		if len(p.conns) > 0 {
+			c := p.conns[p.next%len(p.conns)]
+			p.next++
+			p.mu.Unlock()
+			return c, nil
+		}
+		dialed := p.dialed
+		p.mu.Unlock()
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if p.tls != nil {
+		d := tls.Dialer{Config: p.tls}
+		conn, err = d.DialContext(ctx, "tcp", p.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", p.addr)
+	}
+	p.mu.Lock()
+	p.dialing--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	if err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	c := &pipelinedConn{conn: conn, tsig: p.tsig, pending: make(map[uint16]*pendingQuery)}
+	p.conns = append(p.conns, c)
+	p.mu.Unlock()
+	metrics.inc("upstream_tcp_connections_total")
+	go func() {
+		c.read()
+		p.remove(c)
+	}()
+	return c, nil
+}
+
+func (p *tcpPool) remove(c *pipelinedConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, pc := range p.conns {
+		if pc == c {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// pipelinedConn is a TCP connection with queries in flight.
+type pipelinedConn struct {
+	conn net.Conn
+	tsig *dns.TSIGKey
+	wmu  sync.Mutex // Serializes writes of whole messages
+
+	mu      sync.Mutex
+	pending map[uint16]*pendingQuery
+	err     error // Set once the connection is closed
+}
+
+type pendingQuery struct {
+	query dns.Message
+	res   chan dns.Message
+	tsig  *dns.TSIGSession // Verifies the response of a signed query
+	err   error            // Why the response was refused, set before it is sent on res
+}
+
+func (c *pipelinedConn) exchange(ctx context.Context, msg dns.Message) (dns.Message, error) {
+	pq := &pendingQuery{query: msg, res: make(chan dns.Message, 1)}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return dns.Message{}, c.err
+	}
+	for {
+		id, err := randomID()
+		if err != nil {
+			c.mu.Unlock()
+			return dns.Message{}, err
+		}
+		pq.query.Header.ID = id
+		if c.pending[id] == nil {
+			break
+		}
+	}
+	q := pq.query.Byte()
+	if c.tsig != nil {
+		pq.tsig = &dns.TSIGSession{Key: *c.tsig}
+		var err error
+		if q, err = pq.tsig.Sign(q, time.Now()); err != nil {
+			c.mu.Unlock()
+			return dns.Message{}, err
+		}
+	}
+	c.pending[pq.query.Header.ID] = pq
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, pq.query.Header.ID)
+		c.mu.Unlock()
+	}()
+
+	c.wmu.Lock()
+	deadline, _ := ctx.Deadline()
+	c.conn.SetWriteDeadline(deadline)
+	err := dns.WriteStreamMessage(c.conn, q)
+	c.wmu.Unlock()
+	if err != nil {
+		c.conn.Close()
+		return dns.Message{}, err
+	}
+	select {
+	case res, ok := <-pq.res:
+		if !ok {
+			return dns.Message{}, errConnClosed
+		}
+		if pq.err != nil {
+			return dns.Message{}, pq.err
+		}
+		res.Header.ID = msg.Header.ID
+		return res, nil
+	case <-ctx.Done():
+		return dns.Message{}, ctx.Err()
+	}
+}
+
+// read dispatches responses to the queries waiting for them until the
+// connection fails or receives nothing for upstreamTCPIdleTimeout, which
+// is far longer than any query waits, then fails the queries still in
+// flight.
+func (c *pipelinedConn) read() {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(upstreamTCPIdleTimeout))
+		data, err := dns.ReadStreamMessage(c.conn)
+		if err != nil {
+			break
+		}
+		res, err := dns.ParseMessage(data)
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		pq := c.pending[res.Header.ID]
+		if pq != nil && dns.ValidateResponse(pq.query, res) == nil {
+			delete(c.pending, res.Header.ID)
+			if pq.tsig != nil {
+				res, pq.err = verifySigned(pq.tsig, data)
+			}
+			pq.res <- res
+		}
+		c.mu.Unlock()
+	}
+	c.conn.Close()
+	c.mu.Lock()
+	c.err = errConnClosed
+	for id, pq := range c.pending {
+		close(pq.res)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// Stages of the pipeline that can answer a query.
+const (
+	stageCache      = "cache"
+	stageValidation = "validation"
+	stageZone       = "zone"
+	stageUpstream   = "upstream"
+	stageRecursion  = "recursion"
+	stageInternal   = "internal"
+	stageLocal      = "local"
+)
+
+// stageTrace is one pass of a lookup through a stage. Latency includes the
+// stages it called, such as the upstream behind the cache.
+type stageTrace struct {
+	Stage    string  `json:"stage"`
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Answered bool    `json:"answered"` // Whether the stage wrote the response itself
+	Latency  float64 `json:"latency_ms"`
+}
+
+// resolveTrace collects the stages a traced query passes through.
+type resolveTrace struct {
+	mu      sync.Mutex
+	stages  []stageTrace
+	writing bool // A response is on its way out through the stages
+}
+
+// traceAddr is the client address of traced queries. It is how stages find
+// the trace, as every response writer passes RemoteAddr on from the one it
+// wraps.
+type traceAddr struct {
+	trace *resolveTrace
+}
+
+func (traceAddr) Network() string { return "trace" }
+func (traceAddr) String() string  { return "admin-resolve" }
+
+// traceOf returns the trace of the query written to w, or nil if it is not
+// traced.
+func traceOf(w dns.ResponseWriter) *resolveTrace {
+	if a, ok := w.RemoteAddr().(traceAddr); ok {
+		return a.trace
+	}
+	return nil
+}
+
+// traced wraps the handler of a stage so that traced queries record their
+// pass through it, and profiled queries the time spent in it. The records
+// the stage answers with are tagged with its name unless it tagged them
+// itself.
+func traced(stage string, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Message) {
+		w = &originWriter{ResponseWriter: w, origin: stage}
+		if p := profileOf(w); p != nil {
+			defer p.enter(stage)()
+		}
+		t := traceOf(w)
+		if t == nil || len(r.Question.Queries) == 0 {
+			next.ServeDNS(w, r)
+			return
+		}
+		tw := &traceWriter{ResponseWriter: w, trace: t}
+		start := time.Now()
+		next.ServeDNS(tw, r)
+		q := r.Question.Queries[0]
+		t.mu.Lock()
+		t.stages = append(t.stages, stageTrace{
+			Stage:    stage,
+			Name:     q.Name,
+			Type:     dns.TypeString(q.Type),
+			Answered: tw.first,
+			Latency:  float64(time.Since(start).Microseconds()) / 1000,
+		})
+		t.mu.Unlock()
+	})
+}
+
+// traceWriter notes whether its stage wrote the response itself. Writers of
+// nested stages pass the response on to those of outer ones, so the stage
+// whose writer sees it first answered it.
+type traceWriter struct {
+	dns.ResponseWriter
+	trace *resolveTrace
+	first bool
+}
+
+func (w *traceWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *traceWriter) WriteMsg(m dns.Message) error {
+	w.trace.mu.Lock()
+	if !w.trace.writing {
+		w.first, w.trace.writing = true, true
+	}
+	w.trace.mu.Unlock()
+	err := w.ResponseWriter.WriteMsg(m)
+	if w.first {
+		w.trace.mu.Lock()
+		w.trace.writing = false
+		w.trace.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	transferPageSize    = 256       // RRsets read from the zone at a time
+	transferMessageSize = 16 * 1024 // Largest message sent during a transfer
+)
+
+// transferLimiter bounds the number of concurrent zone transfers and the
+// bandwidth used by each of them, so that transfers of large zones do not
+// starve query traffic.
+type transferLimiter struct {
+	slots chan struct{}
+	rate  int // Bytes per second per transfer, 0 for unlimited
+}
+
+func newTransferLimiter(concurrent, rate int) *transferLimiter {
+	return &transferLimiter{slots: make(chan struct{}, concurrent), rate: rate}
+}
+
+// acquire reserves a transfer slot, reporting false if all are taken.
+func (l *transferLimiter) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *transferLimiter) release() {
+	<-l.slots
+}
+
+// pace sleeps until sending total bytes since start stays within the rate.
+func (l *transferLimiter) pace(start time.Time, total int) {
+	if l.rate <= 0 {
+		return
+	}
+	due := start.Add(time.Duration(total) * time.Second / time.Duration(l.rate))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// transferHandler answers AXFR queries for a zone (RFC 5936) over TCP and
+// TLS, the transports that can carry the several messages of a transfer.
+// Records are streamed from the zone in bounded messages, reading the zone
+// a page at a time instead of copying it. No history of the zone is kept,
+// so IXFR queries get the whole zone too, as RFC 1995 section 4 allows,
+// unless the client is up to date.
+type transferHandler struct {
+	zone   *zone
+	limits *transferLimiter
+	keys   map[string]bool // TSIG keys allowed to transfer the zone, nil to allow unsigned transfers
+}
+
+func (h *transferHandler) ServeDNS(w dns.ResponseWriter, r *dns.Message) {
+	stream := streams(w)
+	ixfr := len(r.Question.Queries) > 0 && r.Question.Queries[0].Type == dns.TYPE_IXFR
+	if !stream && !ixfr {
+		w.WriteMsg(dns.NewErrorResponse(*r, dns.RCODE_NOTIMP))
+		return
+	}
+	if h.keys != nil && !h.keys[signedBy(w)] {
+		metrics.inc("transfers_unsigned_total")
+		reject(w, r, dns.RCODE_REFUSED, reasonTransferKey)
+		return
+	}
+	soa, ok := h.zone.soa()
+	if !ok {
+		w.WriteMsg(dns.NewErrorResponse(*r, dns.RCODE_SERVFAIL))
+		return
+	}
+	// The SOA record alone tells the client that it is up to date or,
+	// over UDP and HTTPS, that it has to ask again over TCP.
+	if ixfr && (!stream || upToDate(r, soa)) {
+		res := dns.NewErrorResponse(*r, dns.RCODE_NOERROR)
+		res.Header.SetAA(true)
+		res.AddAnswer(soa)
+		w.WriteMsg(res)
+		return
+	}
+	if !h.limits.acquire() {
+		metrics.inc("transfers_refused_total")
+		reject(w, r, dns.RCODE_REFUSED, reasonTransfers)
+		return
+	}
+	defer h.limits.release()
+	metrics.inc("transfers_total")
+
+	if err := h.transfer(w, r, soa); err != nil {
+		slog.Warn("Zone transfer failed", "zone", h.zone.origin, addrAttr("client", w.RemoteAddr()), "err", err)
+	}
+}
+
+// upToDate reports whether the SOA record in the authority section of an
+// IXFR query has a serial no older than the one of soa.
+func upToDate(r *dns.Message, soa dns.RRSet) bool {
+	current, ok := soa.Records()[0].SOA()
+	if !ok {
+		return false
+	}
+	for _, rr := range r.Authority.Records {
+		if have, ok := rr.SOA(); ok && !dns.SerialNewer(current.Serial, have.Serial) {
+			return true
+		}
+	}
+	return false
+}
+
+// transfer sends the zone framed by its SOA record, as required by RFC 5936
+// section 2.2.
+func (h *transferHandler) transfer(w dns.ResponseWriter, r *dns.Message, soa dns.RRSet) error {
+	header := dns.NewErrorResponse(*r, dns.RCODE_NOERROR).Header
+	header.SetAA(true)
+	start := time.Now()
+	sent := 0
+
+	b := dns.NewBuilder(header, r.Question.Queries, transferMessageSize)
+	flush := func() error {
+		// A record that did not fit moves to the next message, the
+		// transfer is not truncated.
+		m := b.Message()
+		m.Header.SetTC(false)
+		if err := w.WriteMsg(m); err != nil {
+			return err
+		}
+		sent += b.Len()
+		h.limits.pace(start, sent)
+		// Only the first message carries the question.
+		b = dns.NewBuilder(header, nil, transferMessageSize)
+		return nil
+	}
+	add := func(set dns.RRSet) error {
+		for _, record := range set.Records() {
+			if ok, _ := b.Add(dns.SectionAnswer, dns.NewRRSet(record)); ok {
+				continue
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			if ok, _ := b.Add(dns.SectionAnswer, dns.NewRRSet(record)); !ok {
+				return errors.New("record too large for a transfer message")
+			}
+		}
+		return nil
+	}
+
+	if err := add(soa); err != nil {
+		return err
+	}
+	soaKey := soa.Key()
+	var cursor *dns.RRSetKey
+	for {
+		sets := h.zone.page(cursor, transferPageSize)
+		if len(sets) == 0 {
+			break
+		}
+		for _, set := range sets {
+			if set.Key() == soaKey {
+				continue
+			}
+			if err := add(set); err != nil {
+				return err
+			}
+		}
+		key := sets[len(sets)-1].Key()
+		cursor = &key
+	}
+	if err := add(soa); err != nil {
+		return err
+	}
+	return flush()
+}
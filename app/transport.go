@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// truncationMemory is how long a truncated UDP response is remembered to
+// recognize the client retrying over a stream transport.
+const truncationMemory = 10 * time.Second
+
+// maxTruncations bounds the number of truncated responses remembered.
+const maxTruncations = 4096
+
+// transportTracker counts the queries received over every transport and
+// logs the clients switching from UDP to a stream transport after a
+// truncated response.
+type transportTracker struct {
+	mu        sync.Mutex
+	truncated map[string]time.Time // When the response to a client IP and question was truncated
+}
+
+var transports = &transportTracker{truncated: make(map[string]time.Time)}
+
+// writerTransport names the transport a response writer answers over, as
+// used in counter names.
+func writerTransport(w dns.ResponseWriter) string {
+	switch w := w.(type) {
+	case *packetWriter:
+		return "udp"
+	case *streamWriter:
+		return strings.ToLower(w.transport)
+	case *dohWriter:
+		return "doh"
+	case *stdioWriter:
+		return "stdio"
+	}
+	return "other"
+}
+
+// disableCompression makes the writer send responses with every name written
+// in full, for clients that mishandle compression pointers. It reports
+// whether the writer encodes responses itself.
+func disableCompression(w dns.ResponseWriter) bool {
+	enc := writerEncoding(w)
+	if enc == nil {
+		return false
+	}
+	enc.uncompressed = true
+	return true
+}
+
+// signResponses makes the writer sign responses in the TSIG session of the
+// request. It reports whether the writer encodes responses itself.
+func signResponses(w dns.ResponseWriter, session *dns.TSIGSession) bool {
+	enc := writerEncoding(w)
+	if enc == nil {
+		return false
+	}
+	enc.tsig = session
+	return true
+}
+
+func writerEncoding(w dns.ResponseWriter) *responseEncoding {
+	switch w := w.(type) {
+	case *packetWriter:
+		return &w.enc
+	case *streamWriter:
+		return &w.enc
+	case *dohWriter:
+		return &w.enc
+	}
+	return nil
+}
+
+// responseEncoding is how a writer turns responses into wire format.
+type responseEncoding struct {
+	uncompressed bool             // Names are written in full
+	tsig         *dns.TSIGSession // Signs responses to a signed request, nil if unsigned
+}
+
+// encode returns the wire format of a response, with compressed names
+// unless uncompressed is set, and signed in the TSIG session if any.
+func (e *responseEncoding) encode(m dns.Message) []byte {
+	b := encodeResponse(m, e.uncompressed)
+	if e.tsig != nil {
+		signed, err := e.tsig.Sign(b, time.Now())
+		if err != nil {
+			slog.Warn("Failed to sign response", "key", e.tsig.Key.Name, "err", err)
+			return b
+		}
+		b = signed
+	}
+	return b
+}
+
+// tsigSize returns the bytes signing adds to a response.
+func (e *responseEncoding) tsigSize() int {
+	if e.tsig == nil {
+		return 0
+	}
+	return e.tsig.Size()
+}
+
+// encodeResponse returns the wire format of a response, with compressed
+// names unless uncompressed is set.
+func encodeResponse(m dns.Message, uncompressed bool) []byte {
+	if uncompressed {
+		return m.UncompressedByte()
+	}
+	return m.Byte()
+}
+
+// truncationKey identifies the question of a client across transports,
+// which use different source ports.
+func truncationKey(client net.Addr, m dns.Message) string {
+	var b strings.Builder
+	b.WriteString(addrIP(client).String())
+	for _, q := range m.Question.Queries {
+		fmt.Fprintf(&b, "/%s/%d/%d", strings.ToLower(q.Name), q.Type, q.Class)
+	}
+	return b.String()
+}
+
+// received counts a query and logs it if it repeats a question whose UDP
+// response was truncated.
+func (t *transportTracker) received(transport string, client net.Addr, req dns.Message) {
+	metrics.inc("queries_received_" + transport + "_total")
+	if transport == "udp" || len(req.Question.Queries) == 0 {
+		return
+	}
+	key := truncationKey(client, req)
+	t.mu.Lock()
+	when, ok := t.truncated[key]
+	delete(t.truncated, key)
+	t.mu.Unlock()
+	if ok && time.Since(when) < truncationMemory {
+		metrics.inc("truncation_retries_total")
+		slog.Info("Client retried after a truncated UDP response", addrAttr("client", client),
+			"name", privacy.name(req.Question.Queries[0].Name), "transport", strings.ToUpper(transport))
+	}
+}
+
+// truncatedUDP records that the UDP response m to client was truncated.
+func (t *transportTracker) truncatedUDP(client net.Addr, m dns.Message) {
+	metrics.inc("responses_truncated_total")
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.truncated) >= maxTruncations {
+		for k, when := range t.truncated {
+			if now.Sub(when) >= truncationMemory {
+				delete(t.truncated, k)
+			}
+		}
+		if len(t.truncated) >= maxTruncations {
+			return
+		}
+	}
+	t.truncated[truncationKey(client, m)] = now
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// tsigKeyring holds the TSIG keys of -tsig-key by canonical name.
+type tsigKeyring map[string]dns.TSIGKey
+
+// parseTSIGKeys parses keys in the [algorithm:]name:secret form of dig -y,
+// with the secret in base64.
+func parseTSIGKeys(specs []string) (tsigKeyring, error) {
+	keys := make(tsigKeyring)
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) == 2 {
+			parts = append([]string{dns.TSIG_HMAC_SHA256}, parts...)
+		}
+		if len(parts) != 3 || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not [algorithm:]name:secret", spec)
+		}
+		if !strings.EqualFold(strings.TrimSuffix(parts[0], "."), dns.TSIG_HMAC_SHA256) {
+			return nil, fmt.Errorf("unsupported algorithm %q", parts[0])
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("secret of %s: %w", parts[1], err)
+		}
+		keys[dns.CanonicalName(parts[1])] = dns.TSIGKey{Name: parts[1], Algorithm: dns.TSIG_HMAC_SHA256, Secret: secret}
+	}
+	return keys, nil
+}
+
+func (k tsigKeyring) get(name string) (dns.TSIGKey, bool) {
+	key, ok := k[dns.CanonicalName(name)]
+	return key, ok
+}
+
+// verifyTSIG checks the signature of a request ending with a TSIG record,
+// replacing req with the request without it and having w sign the
+// responses. It returns the name of the key as configured, empty for
+// unsigned requests.
+// Requests that fail verification are answered here, with NOTAUTH and the
+// TSIG error, and ok is false.
+func (s *server) verifyTSIG(w dns.ResponseWriter, req *dns.Message, data []byte) (key string, ok bool) {
+	if !hasTSIG(*req) {
+		return "", true
+	}
+	name, t, _, err := dns.SplitTSIG(data)
+	if err != nil {
+		slog.Info("Malformed TSIG record", addrAttr("client", w.RemoteAddr()), "err", err)
+		w.WriteMsg(dns.NewErrorResponse(*req, dns.RCODE_FORMERR))
+		return "", false
+	}
+	session := &dns.TSIGSession{Key: dns.TSIGKey{Name: name, Algorithm: t.Algorithm}, Error: dns.RCODE_BADKEY}
+	var unsigned []byte
+	err = dns.ErrTSIGBadKey
+	if k, found := s.tsigKeys.get(name); found {
+		session = &dns.TSIGSession{Key: k}
+		unsigned, err = session.Verify(data, time.Now())
+	}
+	signResponses(w, session)
+	if err == nil {
+		if *req, err = dns.ParseMessage(unsigned); err == nil {
+			metrics.inc("tsig_verified_total")
+			return session.Key.Name, true
+		}
+	}
+	metrics.inc("tsig_failures_total")
+	slog.Info("TSIG verification failed", addrAttr("client", w.RemoteAddr()), "key", name, "err", err)
+	w.WriteMsg(dns.NewErrorResponse(*req, dns.RCODE_NOTAUTH))
+	return "", false
+}
+
+func hasTSIG(m dns.Message) bool {
+	for _, r := range m.Additional.Records {
+		if r.Type == dns.TYPE_TSIG {
+			return true
+		}
+	}
+	return false
+}
+
+// tsigWriter is how the handlers of a signed request find the key it was
+// signed with. Writers wrapping it inside the pipeline pass it on through
+// Unwrap.
+type tsigWriter struct {
+	dns.ResponseWriter
+	key string
+}
+
+func (w *tsigWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+// signedBy returns the name of the key the request answered through w was
+// signed with, empty if it was not signed.
+func signedBy(w dns.ResponseWriter) string {
+	for {
+		switch v := w.(type) {
+		case *tsigWriter:
+			return v.key
+		case interface{ Unwrap() dns.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return ""
+		}
+	}
+}
+
+// verifySigned checks the TSIG record of a response to a signed query, and
+// parses the response without it.
+func verifySigned(session *dns.TSIGSession, b []byte) (dns.Message, error) {
+	unsigned, err := session.Verify(b, time.Now())
+	if err != nil {
+		return dns.Message{}, err
+	}
+	return dns.ParseMessage(unsigned)
+}
+
+// parseTSIGResolvers parses the resolver=key pairs of -resolver-tsig.
+func parseTSIGResolvers(pairs []string, keys tsigKeyring) (map[string]*dns.TSIGKey, error) {
+	resolvers := make(map[string]*dns.TSIGKey)
+	for _, pair := range pairs {
+		address, name, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not resolver=key", pair)
+		}
+		key, ok := keys.get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", name)
+		}
+		resolvers[address] = &key
+	}
+	return resolvers, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// defaultUDPInflight is the number of queries a UDP listener handles at
+// once when none is configured.
+const defaultUDPInflight = 1024
+
+// udpListener is a bound UDP socket and the largest response payload its
+// link carries without fragmentation.
+type udpListener struct {
+	conn      *net.UDPConn
+	linkLimit int
+	replay    *replayCache // Answers retransmitted queries, nil if disabled
+	inflight  int          // Queries handled at once, defaultUDPInflight if 0
+}
+
+// serve reads queries from the socket until it is closed, answering each
+// one through s in its own goroutine, so that a query waiting on a slow
+// resolver does not hold up the others. Once inflight queries are being
+// handled, reading waits for one of them to finish, and further queries
+// queue up in the socket buffer.
+func (l *udpListener) serve(s *server) error {
+	buf := make([]byte, 65535)
+	inflight := l.inflight
+	if inflight <= 0 {
+		inflight = defaultUDPInflight
+	}
+	sem := make(chan struct{}, inflight)
+
+	for {
+		size, source, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			slog.Error("Failed to receive data", "err", err)
+			continue
+		}
+
+		if !shedder.allowUDP(time.Now()) {
+			metrics.inc("memory_shed_udp_total")
+			continue
+		}
+		receivedData := append([]byte(nil), buf[:size]...)
+		slog.Debug("Received query", "bytes", size, addrAttr("client", source), "transport", "UDP")
+
+		w := &packetWriter{conn: l.conn, addr: source, linkLimit: l.linkLimit}
+		if l.replay != nil {
+			w.replay, w.replayKey = l.replay, replayKey(source, receivedData)
+			if res, ok := l.replay.lookup(w.replayKey, time.Now()); ok {
+				metrics.inc("udp_replayed_total")
+				w.write(res)
+				continue
+			}
+		}
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			s.handle(receivedData, w)
+		}()
+	}
+}
+
+// packetWriter sends responses to a client over UDP.
+type packetWriter struct {
+	conn      *net.UDPConn
+	addr      *net.UDPAddr
+	linkLimit int // Largest unfragmented payload on the receiving socket's link
+	limit     int // Largest response the client accepts, 512 bytes until its request is parsed
+	replay    *replayCache
+	replayKey string
+	enc       responseEncoding
+}
+
+func (w *packetWriter) RemoteAddr() net.Addr {
+	return w.addr
+}
+
+// WriteMsg sends m, trimmed to the size the client accepts.
+func (w *packetWriter) WriteMsg(m dns.Message) error {
+	limit := w.limit
+	if limit == 0 {
+		limit = minUDPPayloadSize
+	}
+	// The TSIG record is added once the response fits.
+	limit -= w.enc.tsigSize()
+	b := w.enc.encode(fitUDPResponse(m, limit, w.linkLimit, w.addr, w.enc.uncompressed))
+	if w.replay != nil {
+		w.replay.store(w.replayKey, b, time.Now())
+	}
+	return w.write(b)
+}
+
+func (w *packetWriter) write(b []byte) error {
+	size, err := w.conn.WriteToUDP(b, w.addr)
+	if err != nil {
+		slog.Warn("Failed to send response", "err", err)
+		return err
+	}
+	slog.Debug("Sent response", "bytes", size, addrAttr("client", w.addr))
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	maxUpstreamFailures = 3                // Consecutive failures before an endpoint is considered down
+	upstreamCooldown    = 30 * time.Second // How long a down endpoint is skipped
+)
+
+// upstreamOptions configures the encrypted transports to upstreams, how
+// requests with several questions are sent to them, and which of them
+// queries are signed for.
+type upstreamOptions struct {
+	tls            *tls.Config   // Base configuration of DoT and DoH connections, nil for the defaults
+	dohMaxStreams  int           // Requests in flight per DoH endpoint
+	dohIdleTimeout time.Duration // Close idle DoH connections after this long
+	preferIPv6     bool          // Query IPv4 endpoints only when no IPv6 one is healthy
+	multiQuestion  multiQuestionMode
+	tsig           map[string]*dns.TSIGKey // Keys signing the queries to resolvers, by address as configured
+}
+
+// upstreamTLSConfig returns the TLS configuration of connections to
+// encrypted upstreams, verifying their certificates against the CAs in
+// caFile, or the system roots if empty, unless insecure is set.
+func upstreamTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+	return config, nil
+}
+
+// upstream is a single resolver the forwarder can relay requests to. A
+// resolver configured by host name may be reachable over both IPv4 and
+// IPv6; each family is an endpoint with its own health and latency, and
+// queries go to the historically faster one.
+type upstream struct {
+	name       string      // Address as configured
+	endpoints  []*endpoint // At most one per address family
+	preferIPv6 bool
+
+	multiQuestionMode multiQuestionMode
+	multiQuestion     atomic.Int32 // A multiQuestionSupport, detected in multiQuestionAuto mode
+}
+
+// upstreamAddress is the parsed address of a resolver.
+type upstreamAddress struct {
+	transport  string // udp, tcp, tls, https, or dnscrypt
+	host       string // IP address or host name to connect to
+	port       int
+	serverName string           // Name the TLS certificate is verified for
+	url        string           // DNS over HTTPS endpoint
+	dnscrypt   dnscryptUpstream // DNSCrypt provider
+	pins       [][]byte         // SHA-256 hashes of certificates, one of which must be in the TLS chain
+}
+
+// parseUpstreamAddress parses the address of a resolver: host:port for plain
+// DNS over UDP, tcp://host[:port] for plain DNS over TCP only, for networks
+// where UDP is blocked, tls://host[:port] for DNS over TLS,
+// https://host[:port]/path for DNS over HTTPS,
+// dnscrypt://key@host[:port]/provider for DNSCrypt, or a DNS stamp (sdns://)
+// of any of these.
+func parseUpstreamAddress(address string) (upstreamAddress, error) {
+	if strings.HasPrefix(address, "sdns://") {
+		return parseStamp(address)
+	}
+	a := upstreamAddress{transport: "udp"}
+	hostport, defaultPort := address, ""
+	switch {
+	case strings.HasPrefix(address, "dnscrypt://"):
+		var err error
+		if a.dnscrypt, err = parseDNSCryptAddress(address); err != nil {
+			return upstreamAddress{}, err
+		}
+		a.transport, hostport = "dnscrypt", net.JoinHostPort(a.dnscrypt.host, a.dnscrypt.port)
+	case strings.HasPrefix(address, "tcp://"):
+		a.transport, hostport, defaultPort = "tcp", address[len("tcp://"):], "53"
+	case strings.HasPrefix(address, "tls://"):
+		a.transport, hostport, defaultPort = "tls", address[len("tls://"):], "853"
+	case strings.HasPrefix(address, "https://"):
+		u, err := url.Parse(address)
+		if err != nil {
+			return upstreamAddress{}, err
+		}
+		if u.Path == "" {
+			u.Path = dohPath
+		}
+		a.transport, hostport, defaultPort, a.url = "https", u.Host, "443", u.String()
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil && defaultPort != "" {
+		host, port, err = strings.Trim(hostport, "[]"), defaultPort, nil
+	}
+	if err != nil {
+		return upstreamAddress{}, err
+	}
+	if a.port, err = net.LookupPort("tcp", port); err != nil {
+		return upstreamAddress{}, err
+	}
+	a.host, a.serverName = host, host
+	return a, nil
+}
+
+// newUpstream sets up the resolver at address, in any of the forms accepted
+// by parseUpstreamAddress.
+func newUpstream(address string, opts upstreamOptions) (*upstream, error) {
+	a, err := parseUpstreamAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{net.ParseIP(a.host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(a.host); err != nil {
+			return nil, err
+		}
+	}
+	var tlsConfig *tls.Config
+	if a.transport == "tls" || a.transport == "https" {
+		tlsConfig = &tls.Config{}
+		if opts.tls != nil {
+			tlsConfig = opts.tls.Clone()
+		}
+		tlsConfig.ServerName = a.serverName
+		if tlsConfig.ClientSessionCache == nil {
+			tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+		if len(a.pins) > 0 {
+			tlsConfig.VerifyConnection = verifyPins(a.pins)
+		}
+	}
+	tsig := opts.tsig[address]
+	if tsig != nil && a.transport != "udp" && a.transport != "tcp" && a.transport != "tls" {
+		return nil, fmt.Errorf("%s: TSIG needs a resolver over UDP, TCP, or TLS", address)
+	}
+	u := &upstream{name: address, preferIPv6: opts.preferIPv6, multiQuestionMode: opts.multiQuestion}
+	var have4, have6 bool
+	for _, ip := range ips {
+		if is4 := ip.To4() != nil; is4 && !have4 || !is4 && !have6 {
+			e := newEndpoint(&net.UDPAddr{IP: ip, Port: a.port}, a.transport)
+			e.tsig, e.tcp.tsig = tsig, tsig
+			switch a.transport {
+			case "tls":
+				e.tcp.tls = tlsConfig
+			case "https":
+				e.doh = newDoHClient(a.url, e.addr.String(), tlsConfig, opts)
+			case "dnscrypt":
+				e.dnscrypt = newDNSCryptClient(e.addr.String(), a.dnscrypt)
+			}
+			u.endpoints = append(u.endpoints, e)
+			have4, have6 = have4 || is4, have6 || !is4
+		}
+	}
+	return u, nil
+}
+
+func (u *upstream) String() string {
+	return u.name
+}
+
+// healthy reports whether any endpoint of the upstream should receive
+// queries.
+func (u *upstream) healthy() bool {
+	for _, e := range u.endpoints {
+		if e.healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns the endpoint to send the next query to, skipping the ones in
+// tried while others remain: a healthy endpoint without a latency sample
+// yet, or else the healthy one with the lowest latency. With preferIPv6,
+// IPv4 endpoints are only picked when no IPv6 endpoint qualifies.
+func (u *upstream) pick(tried map[*endpoint]error) *endpoint {
+	var best *endpoint
+	var bestRTT time.Duration
+	for _, e := range u.endpoints {
+		if _, ok := tried[e]; ok || !e.healthy() {
+			continue
+		}
+		rtt := e.latency()
+		if best == nil || u.less(e, rtt, best, bestRTT) {
+			best, bestRTT = e, rtt
+		}
+	}
+	if best != nil {
+		return best
+	}
+	for _, e := range u.endpoints {
+		if _, ok := tried[e]; !ok {
+			return e
+		}
+	}
+	return u.endpoints[0]
+}
+
+// less reports whether endpoint a with latency aRTT is preferred to b with
+// latency bRTT.
+func (u *upstream) less(a *endpoint, aRTT time.Duration, b *endpoint, bRTT time.Duration) bool {
+	if u.preferIPv6 && a.isIPv6() != b.isIPv6() {
+		return a.isIPv6()
+	}
+	return aRTT < bRTT
+}
+
+// endpoint is one address of an upstream.
+type endpoint struct {
+	addr      *net.UDPAddr
+	transport string          // udp, tcp, tls, https, or dnscrypt
+	tcp       *tcpPool        // Connections for responses truncated over UDP, or for all queries over TCP and TLS
+	doh       *dohClient      // Set for DNS over HTTPS
+	dnscrypt  *dnscryptClient // Set for DNSCrypt
+	tsig      *dns.TSIGKey    // Signs the queries, nil if unsigned
+
+	mu          sync.Mutex
+	failures    int           // Consecutive failed queries
+	lastFailure time.Time     // Time of the most recent failure
+	outage      *outage       // Current outage in the journal, nil if up or not journaled
+	rtt         time.Duration // Moving average of the exchange latency, 0 until measured
+}
+
+func newEndpoint(addr *net.UDPAddr, transport string) *endpoint {
+	return &endpoint{addr: addr, transport: transport, tcp: newTCPPool(addr.String(), upstreamTCPConns)}
+}
+
+func (e *endpoint) isIPv6() bool {
+	return e.addr.IP.To4() == nil
+}
+
+// healthy reports whether the endpoint should receive queries. An endpoint
+// that failed repeatedly is skipped until its cooldown expires.
+func (e *endpoint) healthy() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.failures < maxUpstreamFailures || time.Since(e.lastFailure) > upstreamCooldown
+}
+
+func (e *endpoint) latency() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rtt
+}
+
+// markResult records the outcome of a query, and its latency on success.
+func (e *endpoint) markResult(err error, rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		e.failures++
+		e.lastFailure = time.Now()
+		if e.outage != nil {
+			outages.failed(e.outage, err)
+		} else if e.failures == maxUpstreamFailures && outages != nil {
+			e.outage = outages.start(e, err, e.failures)
+		}
+		return
+	}
+	e.failures = 0
+	if e.outage != nil {
+		outages.end(e.outage)
+		e.outage = nil
+	}
+	if e.rtt == 0 {
+		e.rtt = rtt
+	} else {
+		e.rtt = (7*e.rtt + rtt) / 8
+	}
+}
+
+// endpointStatus describes an endpoint for the admin API.
+type endpointStatus struct {
+	Address   string     `json:"address"`
+	Transport string     `json:"transport"`
+	Healthy   bool       `json:"healthy"`
+	Failures  int        `json:"failures"`
+	RTT       float64    `json:"rtt_ms"`
+	DoH       *dohStatus `json:"doh,omitempty"`
+}
+
+func (e *endpoint) status() endpointStatus {
+	e.mu.Lock()
+	failures, rtt := e.failures, e.rtt
+	e.mu.Unlock()
+	ms := float64(rtt) / float64(time.Millisecond)
+	st := endpointStatus{Address: e.addr.String(), Transport: e.transport, Healthy: e.healthy(), Failures: failures, RTT: ms}
+	if e.doh != nil {
+		doh := e.doh.status()
+		st.DoH = &doh
+	}
+	return st
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	webhookQueueSize = 1024
+	webhookAttempts  = 3
+	webhookTimeout   = 5 * time.Second
+)
+
+// recordChange describes a change of an RRset in an authoritative zone, as
+// posted to webhooks.
+type recordChange struct {
+	Zone   string    `json:"zone"`
+	Action string    `json:"action"` // "set" or "remove"
+	Name   string    `json:"name"`
+	Type   uint16    `json:"type"`
+	Class  uint16    `json:"class"`
+	TTL    uint32    `json:"ttl,omitempty"`
+	RData  [][]byte  `json:"rdata,omitempty"` // Wire format data of each record, base64 encoded
+	Time   time.Time `json:"time"`
+}
+
+func newRecordChange(zone, action string, s dns.RRSet) recordChange {
+	return recordChange{
+		Zone:   zone,
+		Action: action,
+		Name:   s.Name,
+		Type:   s.Type,
+		Class:  s.Class,
+		TTL:    s.TTL,
+		RData:  s.Data,
+		Time:   time.Now().UTC(),
+	}
+}
+
+// webhookNotifier posts record changes to a set of URLs. Changes are queued
+// and delivered in order by a single goroutine, so that slow receivers never
+// hold up zone updates. Changes are dropped when the queue is full.
+type webhookNotifier struct {
+	urls   []string
+	queue  chan recordChange
+	client *http.Client
+}
+
+func newWebhookNotifier(urls []string) *webhookNotifier {
+	n := &webhookNotifier{
+		urls:   urls,
+		queue:  make(chan recordChange, webhookQueueSize),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+	go n.run()
+	return n
+}
+
+// notify queues the change for delivery.
+func (n *webhookNotifier) notify(c recordChange) {
+	select {
+	case n.queue <- c:
+	default:
+		metrics.inc("webhooks_dropped_total")
+	}
+}
+
+func (n *webhookNotifier) run() {
+	for c := range n.queue {
+		body, err := json.Marshal(c)
+		if err != nil {
+			slog.Error("Failed to encode record change", "err", err)
+			continue
+		}
+		for _, url := range n.urls {
+			if err := n.post(url, body); err != nil {
+				metrics.inc("webhooks_failed_total")
+				slog.Warn("Webhook failed", "url", url, "err", err)
+			}
+		}
+	}
+}
+
+// post delivers the body to the URL, retrying with backoff on errors and
+// non-2xx responses.
+func (n *webhookNotifier) post(url string, body []byte) error {
+	var err error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var res *http.Response
+		res, err = n.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode/100 == 2 {
+			return nil
+		}
+		err = fmt.Errorf("status %s", res.Status)
+	}
+	return err
+}
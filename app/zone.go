@@ -0,0 +1,360 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// zone is an authoritative zone held in memory. The keys of its RRsets are
+// kept sorted so that the zone can be walked page by page, without holding
+// the lock for the whole walk or copying the zone.
+type zone struct {
+	origin string
+	source string                // Where the records come from, such as the path of the zone file
+	load   func() (*zone, error) // Reads the zone again from its source, nil if it has none
+	notify func(recordChange)    // Called after every change, if set
+	signer *zoneSigner           // nil if the zone is not signed
+	// Keeps the zone in sync with the primary it is transferred from, nil
+	// if the zone is not a secondary.
+	secondary *secondary
+
+	mu     sync.RWMutex
+	loaded time.Time // When the records were read
+	rrsets map[dns.RRSetKey]dns.RRSet
+	keys   []dns.RRSetKey // Sorted with keyLess
+	names  map[string]int // Number of RRsets at or below each name
+	gen    uint64         // Bumped on every change, for data derived from the records
+}
+
+func newZone(origin string) *zone {
+	return &zone{
+		origin: strings.ToLower(strings.Trim(origin, ".")),
+		loaded: time.Now(),
+		rrsets: make(map[dns.RRSetKey]dns.RRSet),
+		names:  make(map[string]int),
+	}
+}
+
+// replace swaps the records of the zone for the ones of fresh, all at
+// once.
+func (z *zone) replace(fresh *zone) {
+	fresh.mu.RLock()
+	rrsets, keys, names, loaded := fresh.rrsets, fresh.keys, fresh.names, fresh.loaded
+	fresh.mu.RUnlock()
+	z.mu.Lock()
+	z.rrsets, z.keys, z.names, z.loaded = rrsets, keys, names, loaded
+	z.gen++
+	z.mu.Unlock()
+	if z.signer != nil {
+		z.signer.forget()
+	}
+}
+
+// keyLess orders RRset keys by owner name in canonical order, type, and
+// class.
+func keyLess(a, b dns.RRSetKey) bool {
+	if c := dns.CompareNames(a.Name, b.Name); c != 0 {
+		return c < 0
+	}
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	return a.Class < b.Class
+}
+
+// set adds the RRset to the zone, replacing any RRset with the same key.
+func (z *zone) set(s dns.RRSet) {
+	z.mu.Lock()
+	z.store(s)
+	z.mu.Unlock()
+	if z.notify != nil {
+		z.notify(newRecordChange(z.origin, "set", s))
+	}
+}
+
+// store adds the RRset without notifying anyone. z.mu must be held.
+func (z *zone) store(s dns.RRSet) {
+	key := s.Key()
+	if _, ok := z.rrsets[key]; !ok {
+		i := sort.Search(len(z.keys), func(i int) bool { return !keyLess(z.keys[i], key) })
+		z.keys = append(z.keys, dns.RRSetKey{})
+		copy(z.keys[i+1:], z.keys[i:])
+		z.keys[i] = key
+		z.countName(key.Name, 1)
+	}
+	z.rrsets[key] = s
+	z.gen++
+}
+
+// countName adds delta to the RRset count of name and of its ancestors in
+// the zone, so that empty non-terminals exist too. z.mu must be held.
+func (z *zone) countName(name string, delta int) {
+	for {
+		if z.names[name] += delta; z.names[name] == 0 {
+			delete(z.names, name)
+		}
+		if name == z.origin {
+			return
+		}
+		parent, ok := dns.Parent(name)
+		if !ok {
+			return
+		}
+		name = parent
+	}
+}
+
+// remove deletes the RRset with the given key from the zone.
+func (z *zone) remove(key dns.RRSetKey) {
+	z.mu.Lock()
+	s, ok := z.rrsets[key]
+	if ok {
+		delete(z.rrsets, key)
+		i := sort.Search(len(z.keys), func(i int) bool { return !keyLess(z.keys[i], key) })
+		z.keys = append(z.keys[:i], z.keys[i+1:]...)
+		z.countName(key.Name, -1)
+		z.gen++
+	}
+	z.mu.Unlock()
+	if ok && z.notify != nil {
+		z.notify(newRecordChange(z.origin, "remove", dns.RRSet{Name: s.Name, Type: s.Type, Class: s.Class}))
+	}
+}
+
+// get returns the RRset with the given key.
+func (z *zone) get(key dns.RRSetKey) (dns.RRSet, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	s, ok := z.rrsets[key]
+	return s, ok
+}
+
+// exists reports whether the name owns records or has descendants that do.
+func (z *zone) exists(name string) bool {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.names[dns.CanonicalName(name)] > 0
+}
+
+// generation returns a number that changes whenever the records do.
+func (z *zone) generation() uint64 {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.gen
+}
+
+// owners returns every name of the zone in canonical order, empty
+// non-terminals included, with the types of the RRsets at each name and
+// the generation of the records they were read from.
+func (z *zone) owners() ([]string, map[string][]uint16, uint64) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	types := make(map[string][]uint16, len(z.names))
+	names := make([]string, 0, len(z.names))
+	for name := range z.names {
+		names = append(names, name)
+		types[name] = nil
+	}
+	for _, key := range z.keys {
+		types[key.Name] = append(types[key.Name], key.Type)
+	}
+	sort.Slice(names, func(i, j int) bool { return dns.CompareNames(names[i], names[j]) < 0 })
+	return names, types, z.gen
+}
+
+// soa returns the SOA RRset at the zone apex.
+func (z *zone) soa() (dns.RRSet, bool) {
+	return z.get(dns.RRSetKey{Name: z.origin, Type: dns.TYPE_SOA, Class: dns.CLASS_IN})
+}
+
+// negativeSOA returns the SOA RRset to put in the authority section of
+// negative answers, with its TTL lowered to the MINIMUM field so that
+// resolvers cache the answer for the right time (RFC 2308 section 3).
+func (z *zone) negativeSOA() (dns.RRSet, bool) {
+	set, ok := z.soa()
+	if !ok || len(set.Data) == 0 {
+		return dns.RRSet{}, false
+	}
+	if soa, ok := set.Records()[0].SOA(); ok && soa.Minimum < set.TTL {
+		set.TTL = soa.Minimum
+	}
+	return set, true
+}
+
+// page returns up to n RRsets in key order, starting after the given key or
+// from the beginning if after is nil.
+func (z *zone) page(after *dns.RRSetKey, n int) []dns.RRSet {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	i := 0
+	if after != nil {
+		i = sort.Search(len(z.keys), func(i int) bool { return keyLess(*after, z.keys[i]) })
+	}
+	var sets []dns.RRSet
+	for ; i < len(z.keys) && len(sets) < n; i++ {
+		sets = append(sets, z.rrsets[z.keys[i]])
+	}
+	return sets
+}
+
+// ServeDNS answers queries for names in the zone from its records, as the
+// authority for the zone. Aliases are answered with their CNAME record.
+// Names that do not exist get NXDOMAIN and names without records of the
+// asked type get an empty NOERROR answer, both with the SOA record in the
+// authority section. If the zone is signed, queries with the DO bit get
+// the signatures of the records too, and negative answers the NSEC or
+// NSEC3 records that prove them. Queries with the ZONEVERSION option get
+// the serial of the zone. A secondary zone that is not loaded, or that
+// expired, answers SERVFAIL.
+func (z *zone) ServeDNS(w dns.ResponseWriter, r *dns.Message) {
+	if _, ok := z.soa(); !ok && z.secondary != nil {
+		w.WriteMsg(dns.NewErrorResponse(*r, dns.RCODE_SERVFAIL))
+		return
+	}
+	res := dns.NewErrorResponse(*r, dns.RCODE_NOERROR)
+	res.Header.SetAA(true)
+	opt, _ := r.EDNS()
+	signed := z.signer != nil && opt.DO
+	if signed {
+		res.SetEDNS(dns.OPT{UDPSize: dns.DefaultUDPSize, DO: true})
+	}
+	answer := func(set dns.RRSet) {
+		res.AddAnswer(set)
+		if sig, ok := z.signature(set, signed); ok {
+			res.AddAnswer(sig)
+		}
+	}
+	type denied struct {
+		name     string
+		nxdomain bool
+	}
+	var negative []denied
+	for _, q := range r.Question.Queries {
+		key := dns.RRSet{Name: q.Name, Type: q.Type, Class: q.Class}.Key()
+		if set, ok := z.get(key); ok {
+			answer(set)
+			continue
+		}
+		// An alias answers every type; the target is resolved by the
+		// CNAME follower.
+		key.Type = dns.TYPE_CNAME
+		if set, ok := z.get(key); ok {
+			answer(set)
+			continue
+		}
+		nxdomain := !z.exists(key.Name)
+		if nxdomain {
+			res.Header.SetRCode(dns.RCODE_NXDOMAIN)
+		}
+		negative = append(negative, denied{key.Name, nxdomain})
+	}
+	if len(negative) > 0 {
+		if soa, ok := z.negativeSOA(); ok {
+			res.AddAuthority(soa)
+			if sig, ok := z.signature(soa, signed); ok {
+				res.AddAuthority(sig)
+			}
+			if signed {
+				for _, d := range negative {
+					for _, set := range z.signer.denial(z, d.name, d.nxdomain, soa.TTL) {
+						res.AddAuthority(set)
+						if sig, ok := z.signature(set, signed); ok {
+							res.AddAuthority(sig)
+						}
+					}
+				}
+			}
+		}
+	}
+	if signed {
+		for _, section := range []*[]dns.Record{&res.Answer.Records, &res.Authority.Records} {
+			for i, rr := range *section {
+				if rr.Type == dns.TYPE_RRSIG || rr.Type == dns.TYPE_NSEC || rr.Type == dns.TYPE_NSEC3 {
+					(*section)[i].Origin = z.provenance() + ", signed online"
+				}
+			}
+		}
+	}
+	if set, ok := z.soa(); ok && len(set.Data) > 0 {
+		if soa, ok := set.Records()[0].SOA(); ok {
+			dns.AddZoneVersion(*r, &res, z.origin, soa.Serial)
+		}
+	}
+	tagOrigin(&res, z.provenance())
+	w.WriteMsg(res)
+}
+
+// provenance is the origin of the records answered from the zone.
+func (z *zone) provenance() string {
+	origin := "zone " + z.origin + "."
+	if z.origin == "" {
+		origin = "zone ."
+	}
+	if z.source != "" {
+		origin += " (" + z.source + ")"
+	}
+	return origin
+}
+
+// signature returns the RRSIG RRset over set if the answer is signed. A
+// set that cannot be signed is answered without a signature, which
+// validating resolvers will find bogus.
+func (z *zone) signature(set dns.RRSet, signed bool) (dns.RRSet, bool) {
+	if !signed {
+		return dns.RRSet{}, false
+	}
+	sig, err := z.signer.sign(set, time.Now())
+	if err != nil {
+		slog.Error("Failed to sign RRset", "zone", z.origin, "name", set.Name, "type", dns.TypeString(set.Type), "err", err)
+		return dns.RRSet{}, false
+	}
+	return sig, true
+}
+
+// zoneStatus describes a zone for the admin API. The SOA timers are in
+// seconds.
+type zoneStatus struct {
+	Origin   string    `json:"origin"`
+	Source   string    `json:"source"`
+	Serial   uint32    `json:"serial"`
+	Refresh  uint32    `json:"refresh"`
+	Retry    uint32    `json:"retry"`
+	Expire   uint32    `json:"expire"`
+	Minimum  uint32    `json:"minimum"`
+	RRSets   int       `json:"rrsets"`
+	LoadedAt time.Time `json:"loaded_at"`
+	DS       string    `json:"ds,omitempty"` // Of the key signing key, if the zone is signed
+
+	// Refresh state of secondary zones
+	Primary      string         `json:"primary,omitempty"`
+	LastRefresh  *time.Time     `json:"last_refresh,omitempty"`
+	NextRefresh  *time.Time     `json:"next_refresh,omitempty"`
+	ExpiresIn    *float64       `json:"expires_in_seconds,omitempty"`
+	LastTransfer *transferStats `json:"last_transfer,omitempty"`
+}
+
+func (z *zone) status() zoneStatus {
+	st := zoneStatus{Origin: z.origin, Source: z.source}
+	if set, ok := z.soa(); ok && len(set.Data) > 0 {
+		if soa, ok := set.Records()[0].SOA(); ok {
+			st.Serial, st.Refresh, st.Retry, st.Expire, st.Minimum = soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum
+		}
+	}
+	z.mu.RLock()
+	st.RRSets, st.LoadedAt = len(z.keys), z.loaded
+	z.mu.RUnlock()
+	if z.signer != nil {
+		if ds, err := z.signer.ds(); err == nil {
+			st.DS = ds.String()
+		}
+	}
+	if z.secondary != nil {
+		z.secondary.status(&st)
+	}
+	return st
+}
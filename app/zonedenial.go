@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// denialChain is the chain of NSEC or NSEC3 records of a signed zone, as of
+// one generation of its records. The records themselves are built as they
+// are needed.
+type denialChain struct {
+	gen   uint64
+	types map[string][]uint16 // Of the RRsets at every name, empty non-terminals included
+
+	owned []string // Names with records, in canonical order, for NSEC
+
+	hashes [][]byte // NSEC3 hashes of all names, in hash order
+	hashed []string // Name of each hash
+}
+
+// chain returns the denial chain of the current records of z, building it
+// again if they changed.
+func (s *zoneSigner) chain(z *zone) *denialChain {
+	gen := z.generation()
+	s.mu.Lock()
+	c := s.lastChain
+	s.mu.Unlock()
+	if c != nil && c.gen == gen {
+		return c
+	}
+	names, types, gen := z.owners()
+	c = &denialChain{gen: gen, types: types}
+	if s.nsec3 == nil {
+		for _, name := range names {
+			if len(types[name]) > 0 {
+				c.owned = append(c.owned, name)
+			}
+		}
+	} else {
+		c.hashes, c.hashed = make([][]byte, len(names)), make([]string, len(names))
+		order := make([]int, len(names))
+		hashes := make([][]byte, len(names))
+		for i, name := range names {
+			hashes[i], order[i] = s.nsec3.HashName(name), i
+		}
+		sort.Slice(order, func(i, j int) bool { return bytes.Compare(hashes[order[i]], hashes[order[j]]) < 0 })
+		for i, j := range order {
+			c.hashes[i], c.hashed[i] = hashes[j], names[j]
+		}
+	}
+	s.mu.Lock()
+	s.lastChain = c
+	s.mu.Unlock()
+	return c
+}
+
+// denial returns the NSEC or NSEC3 RRsets that prove that name does not
+// exist, or that it has no records of the asked type if nxdomain is false.
+// The zone has no wildcards, so the proof that none matches is one more
+// record covering the wildcard at the closest encloser.
+func (s *zoneSigner) denial(z *zone, name string, nxdomain bool, ttl uint32) []dns.RRSet {
+	c := s.chain(z)
+	name = dns.CanonicalName(name)
+	var (
+		sets []dns.RRSet
+		seen = make(map[string]bool)
+	)
+	add := func(set dns.RRSet, ok bool) {
+		if ok && !seen[set.Name] {
+			seen[set.Name] = true
+			sets = append(sets, set)
+		}
+	}
+	if !nxdomain {
+		if s.nsec3 == nil {
+			add(c.nsec(s.origin, name, ttl))
+		} else {
+			add(c.nsec3Match(s, name, ttl))
+		}
+		return sets
+	}
+	encloser, nextCloser := c.closestEncloser(s.origin, name)
+	wildcard := "*." + encloser
+	if encloser == "" {
+		wildcard = "*"
+	}
+	if s.nsec3 == nil {
+		add(c.nsec(s.origin, name, ttl))
+		add(c.nsec(s.origin, wildcard, ttl))
+	} else {
+		add(c.nsec3Match(s, encloser, ttl))
+		add(c.nsec3Cover(s, nextCloser, ttl))
+		add(c.nsec3Cover(s, wildcard, ttl))
+	}
+	return sets
+}
+
+// closestEncloser returns the closest ancestor of name that exists in the
+// zone, and the name one label below it on the way to name.
+func (c *denialChain) closestEncloser(origin, name string) (string, string) {
+	child := name
+	for {
+		parent, ok := dns.Parent(child)
+		if !ok || parent == origin {
+			return origin, child
+		}
+		if _, ok := c.types[parent]; ok {
+			return parent, child
+		}
+		child = parent
+	}
+}
+
+// nsec returns the NSEC record of the name at or before name in canonical
+// order, which covers name if it does not exist.
+func (c *denialChain) nsec(origin, name string, ttl uint32) (dns.RRSet, bool) {
+	if len(c.owned) == 0 {
+		return dns.RRSet{}, false
+	}
+	i := sort.Search(len(c.owned), func(i int) bool { return dns.CompareNames(c.owned[i], name) > 0 }) - 1
+	if i < 0 {
+		i = len(c.owned) - 1
+	}
+	owner := c.owned[i]
+	types := append(append([]uint16(nil), c.types[owner]...), dns.TYPE_RRSIG, dns.TYPE_NSEC)
+	return dns.NewRRSet(dns.NewRecord(owner, dns.CLASS_IN, ttl, dns.NSEC{NextName: c.owned[(i+1)%len(c.owned)], Types: types})), true
+}
+
+// nsec3Match returns the NSEC3 record of name, which exists in the zone.
+func (c *denialChain) nsec3Match(s *zoneSigner, name string, ttl uint32) (dns.RRSet, bool) {
+	i, ok := c.nsec3Index(s.nsec3.HashName(name))
+	if !ok {
+		return dns.RRSet{}, false
+	}
+	return c.nsec3(s, i, ttl), true
+}
+
+// nsec3Cover returns the NSEC3 record whose hash is the last one before
+// the hash of name, covering it.
+func (c *denialChain) nsec3Cover(s *zoneSigner, name string, ttl uint32) (dns.RRSet, bool) {
+	if len(c.hashes) == 0 {
+		return dns.RRSet{}, false
+	}
+	i, _ := c.nsec3Index(s.nsec3.HashName(name))
+	return c.nsec3(s, i, ttl), true
+}
+
+// nsec3Index returns the index of the last hash at or before h, wrapping
+// around to the last one, and whether it is h.
+func (c *denialChain) nsec3Index(h []byte) (int, bool) {
+	if len(c.hashes) == 0 {
+		return 0, false
+	}
+	i := sort.Search(len(c.hashes), func(i int) bool { return bytes.Compare(c.hashes[i], h) > 0 }) - 1
+	if i < 0 {
+		i = len(c.hashes) - 1
+	}
+	return i, bytes.Equal(c.hashes[i], h)
+}
+
+func (c *denialChain) nsec3(s *zoneSigner, i int, ttl uint32) dns.RRSet {
+	n := *s.nsec3
+	n.NextHash = c.hashes[(i+1)%len(c.hashes)]
+	// Empty non-terminals have no records, nor signatures.
+	if types := c.types[c.hashed[i]]; len(types) > 0 {
+		n.Types = append(append([]uint16(nil), types...), dns.TYPE_RRSIG)
+	}
+	return dns.NewRRSet(dns.NewRecord(dns.HashedOwnerName(c.hashes[i], s.origin), dns.CLASS_IN, ttl, n))
+}
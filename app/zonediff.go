@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// runZoneDiff implements the zonediff command, comparing two sources of a
+// zone and printing the RRsets added, removed, and changed between them. A
+// source is the path of a zone file or axfr://host[:port] to transfer the
+// zone from a server. Like diff, it exits with 0 when the zones are equal,
+// 1 when they differ, and 2 on errors.
+func runZoneDiff(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("zonediff", flag.ContinueOnError)
+	origin := fs.String("origin", "", "name of the zone, required")
+	timeout := fs.Duration("timeout", 30*time.Second, "time allowed for each zone transfer")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: zonediff -origin zone OLD NEW")
+		fmt.Fprintln(fs.Output(), "OLD and NEW are zone files or axfr://host[:port] sources.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *origin == "" || fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	var sides [2][]dns.RRSet
+	for i, source := range fs.Args() {
+		records, err := loadZoneSource(source, *origin, *timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "zonediff: %s: %v\n", source, err)
+			return 2
+		}
+		sides[i] = dns.GroupRRSets(records)
+	}
+	if diffRRSets(sides[0], sides[1], out) {
+		return 1
+	}
+	return 0
+}
+
+// loadZoneSource reads the records of the zone from a zone file or, for
+// axfr:// sources, by a zone transfer.
+func loadZoneSource(source, origin string, timeout time.Duration) ([]dns.Record, error) {
+	if strings.HasPrefix(source, "axfr://") {
+		addr := strings.TrimSuffix(strings.TrimPrefix(source, "axfr://"), "/")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		c := &dns.Client{Timeout: timeout, Rand: rng}
+		return c.Transfer(context.Background(), origin, addr)
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return dns.ParseZone(f, origin)
+}
+
+// diffRRSets prints the differences between the older and newer RRsets in
+// canonical order: "+" for added RRsets, "-" for removed ones, and "~" for
+// RRsets whose TTL or records changed, followed by the records removed and
+// added, or all of them when the TTL changed. It reports whether there was
+// any difference.
+func diffRRSets(older, newer []dns.RRSet, out io.Writer) bool {
+	oldSets := make(map[dns.RRSetKey]dns.RRSet, len(older))
+	keys := make(map[dns.RRSetKey]bool)
+	for _, set := range older {
+		oldSets[set.Key()] = set.Canonical()
+		keys[set.Key()] = true
+	}
+	newSets := make(map[dns.RRSetKey]dns.RRSet, len(newer))
+	for _, set := range newer {
+		newSets[set.Key()] = set.Canonical()
+		keys[set.Key()] = true
+	}
+	sorted := make([]dns.RRSetKey, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return keyLess(sorted[i], sorted[j]) })
+
+	changed := false
+	for _, key := range sorted {
+		o, inOld := oldSets[key]
+		n, inNew := newSets[key]
+		switch {
+		case !inOld:
+			printRRSet(out, "+ ", n)
+		case !inNew:
+			printRRSet(out, "- ", o)
+		case !sameRRSet(o, n):
+			fmt.Fprintf(out, "~ %s %s\n", key.Name, dns.TypeString(key.Type))
+			if o.TTL == n.TTL {
+				o, n = withoutCommon(o, n), withoutCommon(n, o)
+			}
+			printRRSet(out, "  - ", o)
+			printRRSet(out, "  + ", n)
+		default:
+			continue
+		}
+		changed = true
+	}
+	return changed
+}
+
+// sameRRSet reports whether two RRsets in canonical form are equal.
+func sameRRSet(a, b dns.RRSet) bool {
+	if a.TTL != b.TTL || len(a.Data) != len(b.Data) {
+		return false
+	}
+	for i := range a.Data {
+		if !bytes.Equal(a.Data[i], b.Data[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutCommon returns the RRset without the records also found in other.
+func withoutCommon(set, other dns.RRSet) dns.RRSet {
+	var data [][]byte
+	for _, d := range set.Data {
+		found := false
+		for _, od := range other.Data {
+			if bytes.Equal(d, od) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			data = append(data, d)
+		}
+	}
+	set.Data = data
+	return set
+}
+
+func printRRSet(out io.Writer, prefix string, set dns.RRSet) {
+	for _, r := range set.Records() {
+		fmt.Fprintf(out, "%s%s\n", prefix, r)
+	}
+}
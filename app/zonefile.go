@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// loadZoneFile reads the zone file at path into a new zone. The argument of
+// the -zone flag has the form origin=path. With a signing configuration,
+// the zone is signed and its DNSKEY records are added to it.
+func loadZoneFile(arg string, signing *signingConfig) (*zone, error) {
+	origin, path, ok := strings.Cut(arg, "=")
+	if !ok || origin == "" || path == "" {
+		return nil, fmt.Errorf("zone %q is not of the form origin=path", arg)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := dns.ParseZone(f, origin)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	z := newZone(origin)
+	z.source = path
+	z.load = func() (*zone, error) { return loadZoneFile(arg, signing) }
+	for _, set := range dns.GroupRRSets(records) {
+		z.set(set)
+	}
+	slog.Info("Loaded zone", "zone", z.origin, "records", len(records), "file", path)
+	if signing != nil {
+		if z.signer, err = newZoneSigner(z.origin, *signing); err != nil {
+			return nil, fmt.Errorf("failed to set up signing of %s: %w", z.origin, err)
+		}
+		z.set(z.signer.dnskeys())
+		if param, ok := z.signer.nsec3param(); ok {
+			z.set(param)
+		}
+		ds, err := z.signer.ds()
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Signing zone", "zone", z.origin, "ds", ds.String())
+	}
+	return z, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+const (
+	dnskeyTTL = 3600
+	// Signatures start to be valid an hour in the past, for resolvers
+	// whose clock is behind ours.
+	signatureInceptionSkew = time.Hour
+)
+
+// signingConfig is where the keys of signed zones are kept, how long their
+// signatures last, and how names are denied.
+type signingConfig struct {
+	keyDir   string
+	validity time.Duration
+
+	nsec3           bool // Deny with NSEC3 rather than NSEC records
+	nsec3Salt       []byte
+	nsec3Iterations uint16
+}
+
+// signingKey is a key of a signed zone, with its DNSKEY record data.
+type signingKey struct {
+	dnskey dns.DNSKEY
+	priv   crypto.Signer
+}
+
+// sigKey identifies the signature of an RRset. The TTL is part of it, as
+// the SOA record is served with a lower TTL in negative answers and each
+// TTL needs its own signature.
+type sigKey struct {
+	dns.RRSetKey
+	ttl uint32
+}
+
+type zoneSignature struct {
+	digest  [sha256.Size]byte // Of the data of the RRset that was signed
+	sig     dns.RRSet
+	refresh time.Time // When to sign again, well before the signature expires
+}
+
+// zoneSigner signs the RRsets of a zone online, as they are answered. The
+// DNSKEY RRset is signed with the key signing key, whose DS record is
+// published in the parent zone, and every other RRset with the zone
+// signing key. Signatures are kept until the RRset changes or a quarter
+// of their validity is left.
+type zoneSigner struct {
+	origin   string
+	ksk, zsk signingKey
+	validity time.Duration
+	nsec3    *dns.NSEC3 // Parameters of the NSEC3 records, nil to deny with NSEC
+
+	mu        sync.Mutex
+	sigs      map[sigKey]zoneSignature
+	lastChain *denialChain // Of the records last denied from
+}
+
+// newZoneSigner loads the keys of the zone from the key directory, as
+// <origin>.ksk.pem and <origin>.zsk.pem PKCS #8 files, generating ECDSA
+// P-256 keys for the ones that are missing.
+func newZoneSigner(origin string, cfg signingConfig) (*zoneSigner, error) {
+	base := origin
+	if base == "" {
+		base = "root"
+	}
+	s := &zoneSigner{origin: origin, validity: cfg.validity, sigs: make(map[sigKey]zoneSignature)}
+	if cfg.nsec3 {
+		s.nsec3 = &dns.NSEC3{HashAlgorithm: dns.NSEC3_HASH_SHA1, Iterations: cfg.nsec3Iterations, Salt: cfg.nsec3Salt}
+	}
+	var err error
+	if s.ksk, err = loadSigningKey(filepath.Join(cfg.keyDir, base+".ksk.pem"), dns.DNSKEY_ZONE|dns.DNSKEY_SEP); err != nil {
+		return nil, err
+	}
+	if s.zsk, err = loadSigningKey(filepath.Join(cfg.keyDir, base+".zsk.pem"), dns.DNSKEY_ZONE); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func loadSigningKey(path string, flags uint16) (signingKey, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return generateSigningKey(path, flags)
+	}
+	if err != nil {
+		return signingKey{}, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return signingKey{}, fmt.Errorf("%s: no PEM data", path)
+	}
+	var priv any
+	if block.Type == "EC PRIVATE KEY" {
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	} else {
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return signingKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s: unsupported key", path)
+	}
+	dnskey, err := dns.NewDNSKEY(signer.Public(), flags)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return signingKey{dnskey: dnskey, priv: signer}, nil
+}
+
+func generateSigningKey(path string, flags uint16) (signingKey, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return signingKey{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return signingKey{}, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return signingKey{}, err
+	}
+	dnskey, err := dns.NewDNSKEY(priv.Public(), flags)
+	if err != nil {
+		return signingKey{}, err
+	}
+	slog.Info("Generated DNSSEC key", "file", path, "key_tag", dnskey.KeyTag())
+	return signingKey{dnskey: dnskey, priv: priv}, nil
+}
+
+// dnskeys returns the DNSKEY RRset of the zone apex.
+func (s *zoneSigner) dnskeys() dns.RRSet {
+	return dns.RRSet{
+		Name:  s.origin,
+		Type:  dns.TYPE_DNSKEY,
+		Class: dns.CLASS_IN,
+		TTL:   dnskeyTTL,
+		Data:  [][]byte{s.ksk.dnskey.Pack(), s.zsk.dnskey.Pack()},
+	}
+}
+
+// nsec3param returns the NSEC3PARAM RRset of the zone apex, if names are
+// denied with NSEC3.
+func (s *zoneSigner) nsec3param() (dns.RRSet, bool) {
+	if s.nsec3 == nil {
+		return dns.RRSet{}, false
+	}
+	p := dns.NSEC3PARAM{HashAlgorithm: s.nsec3.HashAlgorithm, Iterations: s.nsec3.Iterations, Salt: s.nsec3.Salt}
+	// The record is for the servers of the zone rather than resolvers, so
+	// it is not to be cached.
+	return dns.NewRRSet(dns.NewRecord(s.origin, dns.CLASS_IN, 0, p)), true
+}
+
+// ds returns the DS record of the key signing key, to publish in the
+// parent zone.
+func (s *zoneSigner) ds() (dns.Record, error) {
+	ds, err := s.ksk.dnskey.ToDS(s.origin, dns.DIGEST_SHA256)
+	if err != nil {
+		return dns.Record{}, err
+	}
+	return dns.NewRecord(s.origin, dns.CLASS_IN, dnskeyTTL, ds), nil
+}
+
+// sign returns the RRSIG RRset over set, signing it again if it changed
+// since it was last signed or its signature is due for renewal.
+func (s *zoneSigner) sign(set dns.RRSet, now time.Time) (dns.RRSet, error) {
+	key := sigKey{set.Key(), set.TTL}
+	digest := sha256.Sum256(dns.SignedData(set, dns.RRSIG{}))
+	s.mu.Lock()
+	cached, ok := s.sigs[key]
+	s.mu.Unlock()
+	if ok && cached.digest == digest && now.Before(cached.refresh) {
+		return cached.sig, nil
+	}
+	k := s.zsk
+	if set.Type == dns.TYPE_DNSKEY {
+		k = s.ksk
+	}
+	sig, err := dns.SignRRSet(set, dns.RRSIG{
+		Algorithm:  k.dnskey.Algorithm,
+		Labels:     uint8(len(dns.Labels(set.Name))),
+		OrigTTL:    set.TTL,
+		Inception:  uint32(now.Add(-signatureInceptionSkew).Unix()),
+		Expiration: uint32(now.Add(s.validity).Unix()),
+		KeyTag:     k.dnskey.KeyTag(),
+		SignerName: s.origin,
+	}, k.priv)
+	if err != nil {
+		return dns.RRSet{}, err
+	}
+	metrics.inc("zone_signatures_total")
+	rrsig := dns.NewRRSet(dns.NewRecord(set.Name, set.Class, set.TTL, sig))
+	s.mu.Lock()
+	s.sigs[key] = zoneSignature{digest: digest, sig: rrsig, refresh: now.Add(s.validity * 3 / 4)}
+	s.mu.Unlock()
+	return rrsig, nil
+}
+
+// forget drops the signatures kept, once the records of the zone have
+// been replaced.
+func (s *zoneSigner) forget() {
+	s.mu.Lock()
+	s.sigs = make(map[sigKey]zoneSignature)
+	s.lastChain = nil
+	s.mu.Unlock()
+}
@@ -0,0 +1,1213 @@
+// Command e2e builds the server and runs end-to-end scenarios against it over
+// the network: every scenario launches the real binary with its own flags,
+// optionally in front of a mock upstream, and checks the responses on the
+// wire. Run it from the repository root with
+//
+//	go run ./e2e
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnstest"
+)
+
+// env is what a scenario check runs against.
+type env struct {
+	*dnstest.Server               // The server, with clients for its listeners
+	peer            string        // Address of the peer server, empty if the scenario has none
+	dir             string        // Temporary directory of the scenario
+	upstream        *mockUpstream // Mock upstream, nil if the scenario has none
+	primary         *mockPrimary  // Mock primary, nil if the scenario has none
+	admin           string        // Address the ADMIN token of the flags stands for
+}
+
+// scenario is a single end-to-end check.
+type scenario struct {
+	name     string
+	upstream string               // Mock upstream mode, empty to run without one
+	primary  bool                 // Whether to run a mock primary of example.test
+	doh      bool                 // Whether the server also serves DNS over HTTP, for env.DoH
+	peer     []string             // Flags of a second server started ahead of this one, nil to run without one
+	setup    func(env *env) error // Run before the server starts, nil for nothing
+	flags    []string             // Server flags, "UPSTREAM", "PRIMARY", and "PEER" are replaced by the addresses of the mocks and the peer, and "DIR" by the temporary directory
+	check    func(env *env) error
+}
+
+// testZone is the zone file served by the authoritative scenarios, relative
+// to the repository root.
+var testZone = filepath.Join("e2e", "testdata", "example.test.zone")
+
+// TSIG keys of the TSIG scenario, as -tsig-key takes them: the transfer key
+// is the only one allowed to transfer zones.
+var (
+	transferKey = dns.TSIGKey{Name: "transfer.", Algorithm: dns.TSIG_HMAC_SHA256, Secret: []byte("transfer key of the e2e scenario")}
+	otherKey    = dns.TSIGKey{Name: "other.", Algorithm: dns.TSIG_HMAC_SHA256, Secret: []byte("other key of the e2e scenario")}
+)
+
+// Files of the DNSSEC scenarios: a root zone, the directory of the keys it
+// is signed with, and trust anchors that do and do not match them.
+var (
+	rootZone    = filepath.Join("e2e", "testdata", "root.zone")
+	rootKeyDir  = filepath.Join("e2e", "testdata", "keys")
+	rootAnchor  = filepath.Join("e2e", "testdata", "root.anchor")
+	wrongAnchor = filepath.Join("e2e", "testdata", "wrong.anchor")
+)
+
+var scenarios = []scenario{
+	{
+		name: "local answer over UDP",
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("example.com", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_NOERROR, 1, []byte{1, 1, 1, 1})
+		},
+	},
+	{
+		name: "local answer over TCP",
+		check: func(env *env) error {
+			res, err := env.TCP.Exchange(newQuery("example.com", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_NOERROR, 1, []byte{1, 1, 1, 1})
+		},
+	},
+	{
+		name: "local AAAA answer",
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("example.com", dns.TYPE_AAAA))
+			if err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_NOERROR, 1, net.ParseIP("2001:db8::1"))
+		},
+	},
+	{
+		name:  "static records replace local answers",
+		flags: []string{"-static-record", "app.test. 60 IN A 10.0.0.1"},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("app.test", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 1, net.ParseIP("10.0.0.1").To4()); err != nil {
+				return err
+			}
+			res, err = env.UDP.Exchange(newQuery("example.com", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_NXDOMAIN, 0, nil)
+		},
+	},
+	{
+		name:  "configuration file",
+		flags: []string{"-config", filepath.Join("e2e", "testdata", "server.toml")},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("app.test", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_NOERROR, 1, net.ParseIP("10.0.0.2").To4())
+		},
+	},
+	{
+		name: "malformed request",
+		check: func(env *env) error {
+			// A header announcing a question that is missing.
+			req := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+			b, err := env.UDP.ExchangeRaw(req)
+			if err != nil {
+				return err
+			}
+			res, err := dns.ParseMessage(b)
+			if err != nil {
+				return err
+			}
+			if res.Header.ID != 0x1234 {
+				return fmt.Errorf("ID %#x, want 0x1234", res.Header.ID)
+			}
+			return expectRCode(res, dns.RCODE_FORMERR)
+		},
+	},
+	{
+		name:  "authoritative NXDOMAIN",
+		flags: []string{"-zone", "example.test=" + testZone},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("missing.example.test", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NXDOMAIN, 0, nil); err != nil {
+				return err
+			}
+			return expectNegativeSOA(res, 120)
+		},
+	},
+	{
+		name:  "authoritative NODATA",
+		flags: []string{"-zone", "example.test=" + testZone},
+		check: func(env *env) error {
+			for _, name := range []string{"www.example.test", "deep.example.test"} {
+				res, err := env.UDP.Exchange(newQuery(name, dns.TYPE_AAAA))
+				if err != nil {
+					return err
+				}
+				if err := expectAnswer(res, dns.RCODE_NOERROR, 0, nil); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				if err := expectNegativeSOA(res, 120); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		name:  "zone version",
+		flags: []string{"-zone", "example.test=" + testZone},
+		check: func(env *env) error {
+			req := newQuery("www.example.test", dns.TYPE_A)
+			req.SetEDNS(dns.OPT{UDPSize: 1232, Options: []dns.EDNSOption{{Code: dns.EDNS_OPTION_ZONEVERSION}}})
+			res, err := env.UDP.Exchange(req)
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 1, []byte{192, 0, 2, 1}); err != nil {
+				return err
+			}
+			opt, _ := res.EDNS()
+			o, ok := opt.Option(dns.EDNS_OPTION_ZONEVERSION)
+			if !ok {
+				return errors.New("no ZONEVERSION option in the response")
+			}
+			labels, typ, version, ok := o.ZoneVersion()
+			if want := binary.BigEndian.AppendUint32(nil, 2024010101); !ok || labels != 2 || typ != dns.ZONEVERSION_SOA_SERIAL || !bytes.Equal(version, want) {
+				return fmt.Errorf("ZONEVERSION option is %x, want labels 2 and serial 2024010101", o.Data)
+			}
+			// Without the option in the request, none is sent back.
+			req = newQuery("www.example.test", dns.TYPE_A)
+			req.SetEDNS(dns.OPT{UDPSize: 1232})
+			if res, err = env.UDP.Exchange(req); err != nil {
+				return err
+			}
+			if opt, _ := res.EDNS(); len(opt.Options) > 0 {
+				return fmt.Errorf("unexpected options %v in the response", opt.Options)
+			}
+			return nil
+		},
+	},
+	{
+		name:  "zone record in generic format",
+		flags: []string{"-zone", "example.test=" + testZone},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("opaque.example.test", 52))
+			if err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_NOERROR, 1, opaqueData)
+		},
+	},
+	{
+		name:  "zone HTTPS record",
+		flags: []string{"-zone", "example.test=" + testZone},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("example.test", dns.TYPE_HTTPS))
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 1, nil); err != nil {
+				return err
+			}
+			s, ok := res.Answer.Records[0].SVCB()
+			if !ok {
+				return errors.New("answer is not an HTTPS record")
+			}
+			want := "1 . alpn=h2,h3 port=8443 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1"
+			if got := s.String(); !s.HTTPS || got != want {
+				return fmt.Errorf("HTTPS %q, want %q", got, want)
+			}
+			return nil
+		},
+	},
+	{
+		name:  "reverse zone",
+		flags: []string{"-zone", "example.test=" + testZone, "-reverse-zone", "192.0.2.0/24"},
+		check: func(env *env) error {
+			name := dns.ReverseAddr(net.ParseIP("192.0.2.1"))
+			res, err := env.UDP.Exchange(newQuery(name, dns.TYPE_PTR))
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 1, nil); err != nil {
+				return err
+			}
+			if ptr, ok := res.Answer.Records[0].PTR(); !ok || ptr.Target != "www.example.test" {
+				return fmt.Errorf("PTR %+v, want www.example.test", ptr)
+			}
+			res, err = env.UDP.Exchange(newQuery(dns.ReverseAddr(net.ParseIP("192.0.2.2")), dns.TYPE_PTR))
+			if err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_NXDOMAIN, 0, nil)
+		},
+	},
+	{
+		name:     "CNAME chain",
+		upstream: "ok",
+		flags:    []string{"-zone", "example.test=" + testZone, "-resolver", "UPSTREAM"},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("chain.example.test", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 3, nil); err != nil {
+				return err
+			}
+			if last := res.Answer.Records[2]; !bytes.Equal(last.Data, []byte{192, 0, 2, 1}) {
+				return fmt.Errorf("chain ends in %s %v, want A 192.0.2.1", dns.TypeString(last.Type), last.Data)
+			}
+			// The target of the alias lies outside the zone.
+			res, err = env.UDP.Exchange(newQuery("external.example.test", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 2, nil); err != nil {
+				return err
+			}
+			if last := res.Answer.Records[1]; !bytes.Equal(last.Data, []byte{10, 0, 0, 7}) {
+				return fmt.Errorf("chain ends in %s %v, want A 10.0.0.7", dns.TypeString(last.Type), last.Data)
+			}
+			return nil
+		},
+	},
+	{
+		name: "TSIG",
+		flags: []string{
+			"-zone", "example.test=" + testZone,
+			"-tsig-key", tsigKeyFlag(transferKey), "-tsig-key", tsigKeyFlag(otherKey),
+			"-transfer-tsig-keys", "transfer",
+		},
+		check: func(env *env) error {
+			ctx := context.Background()
+			// Signed queries get signed responses, which the client
+			// verifies.
+			for _, key := range []dns.TSIGKey{transferKey, otherKey} {
+				key := key
+				client := &dns.Client{TSIG: &key}
+				res, err := client.Exchange(ctx, newQuery("www.example.test", dns.TYPE_A), env.Addr)
+				if err != nil {
+					return fmt.Errorf("query signed with %s: %w", key.Name, err)
+				}
+				if err := expectAnswer(res, dns.RCODE_NOERROR, 1, []byte{192, 0, 2, 1}); err != nil {
+					return fmt.Errorf("query signed with %s: %w", key.Name, err)
+				}
+			}
+			// A query signed with the wrong secret is rejected.
+			wrong := transferKey
+			wrong.Secret = []byte("not the secret")
+			req := newQuery("www.example.test", dns.TYPE_A)
+			signed, err := (&dns.TSIGSession{Key: wrong}).Sign(req.Byte(), time.Now())
+			if err != nil {
+				return err
+			}
+			b, err := env.UDP.ExchangeRaw(signed)
+			if err != nil {
+				return err
+			}
+			res, err := dnstest.ParseResponse(req, b)
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOTAUTH, 0, nil); err != nil {
+				return fmt.Errorf("query signed with the wrong secret: %w", err)
+			}
+
+			// Only the transfer key may transfer the zone.
+			for _, client := range []*dns.Client{{}, {TSIG: &otherKey}} {
+				if _, err := client.Transfer(ctx, "example.test", env.Addr); err == nil {
+					return errors.New("zone transferred without the transfer key")
+				}
+			}
+			client := &dns.Client{TSIG: &transferKey}
+			records, err := client.Transfer(ctx, "example.test", env.Addr)
+			if err != nil {
+				return fmt.Errorf("transfer signed with the transfer key: %w", err)
+			}
+			for _, r := range records {
+				if r.Type == dns.TYPE_A && dns.CompareNames(r.Name, "www.example.test") == 0 {
+					return nil
+				}
+			}
+			return fmt.Errorf("%d records transferred, without www.example.test", len(records))
+		},
+	},
+	{
+		name:  "zone transfer over a single response transport",
+		doh:   true,
+		flags: []string{"-zone", "example.test=" + testZone},
+		check: func(env *env) error {
+			// HTTPS, like UDP, carries a single response, too few for a
+			// transfer.
+			res, err := env.DoH.Exchange(newQuery("example.test", dns.TYPE_AXFR))
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOTIMP, 0, nil); err != nil {
+				return fmt.Errorf("AXFR over HTTPS: %w", err)
+			}
+			// An IXFR query gets the SOA record alone, telling the client
+			// to ask again over TCP.
+			req := newQuery("example.test", dns.TYPE_IXFR)
+			req.AddAuthority(dns.NewRRSet(dns.NewRecord("example.test.", dns.CLASS_IN, 0, dns.SOA{MName: ".", RName: ".", Serial: 1})))
+			if res, err = env.DoH.Exchange(req); err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 1, nil); err != nil {
+				return fmt.Errorf("IXFR over HTTPS: %w", err)
+			}
+			if _, ok := res.Answer.Records[0].SOA(); !ok {
+				return errors.New("IXFR over HTTPS not answered with the SOA record")
+			}
+			// Over TCP, the whole zone is transferred.
+			records, err := (&dns.Client{}).Transfer(context.Background(), "example.test", env.Addr)
+			if err != nil {
+				return fmt.Errorf("AXFR over TCP: %w", err)
+			}
+			if len(records) < 2 {
+				return fmt.Errorf("%d records transferred over TCP", len(records))
+			}
+			return nil
+		},
+	},
+	{
+		name:  "dropped query over HTTPS by the ACL",
+		doh:   true,
+		flags: []string{"-zone", "example.test=" + testZone, "-deny", "127.0.0.1,::1", "-acl-action", "drop"},
+		check: func(env *env) error {
+			return expectDoHStatus(env, newQuery("www.example.test", dns.TYPE_A), http.StatusForbidden)
+		},
+	},
+	{
+		name:  "dropped query over HTTPS by the quota",
+		doh:   true,
+		flags: []string{"-zone", "example.test=" + testZone, "-quota", "1", "-quota-action", "throttle"},
+		check: func(env *env) error {
+			// Past the quota, a query is let through now and then, and the
+			// others are dropped.
+			for _, status := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+				if err := expectDoHStatus(env, newQuery("www.example.test", dns.TYPE_A), status); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		name:    "secondary zone",
+		primary: true,
+		flags:   []string{"-secondary-zone", "example.test=PRIMARY", "-admin-addr", "ADMIN"},
+		check: func(env *env) error {
+			// The zone is transferred whole at startup.
+			if err := waitAddress(env.UDP, "www.example.test", []byte{192, 0, 2, 1}, 5*time.Second); err != nil {
+				return err
+			}
+			if types := env.primary.transferTypes(); len(types) != 1 || types[0] != dns.TYPE_AXFR {
+				return fmt.Errorf("transfers %v, want one AXFR", types)
+			}
+			// Once the refresh interval has passed, the new version is
+			// transferred as changes, which replace the address.
+			env.primary.update()
+			if err := waitAddress(env.UDP, "www.example.test", []byte{192, 0, 2, 2}, 10*time.Second); err != nil {
+				return err
+			}
+			if types := env.primary.transferTypes(); len(types) != 2 || types[1] != dns.TYPE_IXFR {
+				return fmt.Errorf("transfers %v, want an AXFR and then an IXFR", types)
+			}
+			// The state of the zone is exposed in the metrics.
+			var metrics map[string]uint64
+			if err := getJSON("http://"+env.admin+"/metrics", &metrics); err != nil {
+				return err
+			}
+			if serial := metrics["zone_serial_example.test"]; serial != 2 {
+				return fmt.Errorf("serial gauge %d, want 2", serial)
+			}
+			for _, name := range []string{"zone_expires_in_seconds_example.test", "zone_last_transfer_bytes_example.test"} {
+				if metrics[name] == 0 {
+					return fmt.Errorf("gauge %s is zero", name)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		name:    "NOTIFY to a secondary",
+		primary: true,
+		flags:   []string{"-secondary-zone", "example.test=PRIMARY"},
+		check: func(env *env) error {
+			if err := waitAddress(env.UDP, "www.example.test", []byte{192, 0, 2, 1}, 5*time.Second); err != nil {
+				return err
+			}
+			// The primary, also on the loopback address, notifies the
+			// secondary of the new version, which is then transferred
+			// well before the refresh interval of five seconds passes.
+			env.primary.update()
+			res, err := env.UDP.Exchange(notifyQuery("example.test"))
+			if err != nil {
+				return err
+			}
+			if err := expectRCode(res, dns.RCODE_NOERROR); err != nil {
+				return err
+			}
+			if !res.Header.AA() {
+				return errors.New("NOTIFY acknowledged without the AA bit")
+			}
+			if err := waitAddress(env.UDP, "www.example.test", []byte{192, 0, 2, 2}, 2*time.Second); err != nil {
+				return err
+			}
+			// NOTIFY messages for other zones are refused.
+			if res, err = env.UDP.Exchange(notifyQuery("other.test")); err != nil {
+				return err
+			}
+			return expectRCode(res, dns.RCODE_REFUSED)
+		},
+	},
+	{
+		name:     "NOTIFY from a primary",
+		upstream: "notify",
+		setup: func(env *env) error {
+			return copyZone(testZone, filepath.Join(env.dir, "example.test.zone"), nil)
+		},
+		flags: []string{"-zone", "example.test=DIR/example.test.zone", "-notify", "UPSTREAM"},
+		check: func(env *env) error {
+			// A reload without a new serial notifies no one.
+			if err := env.Process.Signal(syscall.SIGHUP); err != nil {
+				return err
+			}
+			select {
+			case <-env.upstream.notified:
+				return errors.New("secondary notified of an unchanged zone")
+			case <-time.After(500 * time.Millisecond):
+			}
+
+			replace := strings.NewReplacer("2024010101", "2024010102", "192.0.2.1", "192.0.2.9")
+			if err := copyZone(testZone, filepath.Join(env.dir, "example.test.zone"), replace); err != nil {
+				return err
+			}
+			if err := env.Process.Signal(syscall.SIGHUP); err != nil {
+				return err
+			}
+			var msg dns.Message
+			select {
+			case msg = <-env.upstream.notified:
+			case <-time.After(3 * time.Second):
+				return errors.New("secondary not notified of the new serial")
+			}
+			if q := msg.Question.Queries; len(q) != 1 || dns.CompareNames(q[0].Name, "example.test") != 0 || q[0].Type != dns.TYPE_SOA {
+				return fmt.Errorf("NOTIFY for %v, want the SOA record of example.test", q)
+			}
+			for _, r := range msg.Answer.Records {
+				if soa, ok := r.SOA(); ok && soa.Serial == 2024010102 {
+					return nil
+				}
+			}
+			return errors.New("NOTIFY without the new SOA record")
+		},
+	},
+	{
+		name:  "DNSSEC signing",
+		flags: []string{"-zone", "example.test=" + testZone, "-dnssec-key-dir", "DIR"},
+		check: func(env *env) error {
+			if files, _ := filepath.Glob(filepath.Join(env.dir, "*.pem")); len(files) != 2 {
+				return fmt.Errorf("key directory holds %v, want the generated KSK and ZSK", files)
+			}
+			res, err := env.UDP.Exchange(dns.NewQuery("example.test", dns.TYPE_DNSKEY).WithDO().Message())
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 3, nil); err != nil {
+				return fmt.Errorf("DNSKEY records and their RRSIG: %w", err)
+			}
+			var ksk, zsk []dns.DNSKEY
+			for _, r := range res.Answer.Records {
+				if k, ok := r.DNSKEY(); ok && k.Flags&dns.DNSKEY_SEP != 0 {
+					ksk = append(ksk, k)
+				} else if ok {
+					zsk = append(zsk, k)
+				}
+			}
+			if len(ksk) != 1 || len(zsk) != 1 {
+				return fmt.Errorf("%d KSK and %d ZSK, want one of each", len(ksk), len(zsk))
+			}
+			if err := verifySignatures(res.Answer.Records, ksk); err != nil {
+				return err
+			}
+
+			if res, err = env.UDP.Exchange(dns.NewQuery("www.example.test", dns.TYPE_A).WithDO().Message()); err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 2, []byte{192, 0, 2, 1}); err != nil {
+				return fmt.Errorf("answer and its RRSIG: %w", err)
+			}
+			if err := verifySignatures(res.Answer.Records, zsk); err != nil {
+				return err
+			}
+			// Without DO, the answer is not signed.
+			if res, err = env.UDP.Exchange(newQuery("www.example.test", dns.TYPE_A)); err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 1, []byte{192, 0, 2, 1}); err != nil {
+				return err
+			}
+
+			// Names that do not exist are denied with signed NSEC records.
+			if res, err = env.UDP.Exchange(dns.NewQuery("missing.example.test", dns.TYPE_A).WithDO().Message()); err != nil {
+				return err
+			}
+			if err := expectRCode(res, dns.RCODE_NXDOMAIN); err != nil {
+				return err
+			}
+			nsec := false
+			for _, r := range res.Authority.Records {
+				nsec = nsec || r.Type == dns.TYPE_NSEC
+			}
+			if !nsec {
+				return errors.New("no NSEC record in the denial")
+			}
+			return verifySignatures(res.Authority.Records, zsk)
+		},
+	},
+	{
+		name:  "DNSSEC validation",
+		peer:  []string{"-zone", ".=" + rootZone, "-dnssec-key-dir", rootKeyDir},
+		flags: []string{"-resolver", "PEER", "-dnssec-validate", "-dnssec-trust-anchor", rootAnchor},
+		check: func(env *env) error {
+			req := dns.NewQuery("www.example.test", dns.TYPE_A).WithDO().Message()
+			res, err := env.UDP.Exchange(req)
+			if err != nil {
+				return err
+			}
+			if err := expectSecure(res, dns.RCODE_NOERROR); err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 2, []byte{192, 0, 2, 1}); err != nil {
+				return fmt.Errorf("answer and its RRSIG: %w", err)
+			}
+			// The denial of a name is validated too.
+			req = dns.NewQuery("missing.example.test", dns.TYPE_A).WithDO().Message()
+			if res, err = env.UDP.Exchange(req); err != nil {
+				return err
+			}
+			if err := expectSecure(res, dns.RCODE_NXDOMAIN); err != nil {
+				return fmt.Errorf("denial: %w", err)
+			}
+			// A client setting AD without DO gets the bit, but no
+			// signatures.
+			req = newQuery("www.example.test", dns.TYPE_A)
+			req.Header.SetAD(true)
+			if res, err = env.UDP.Exchange(req); err != nil {
+				return err
+			}
+			if err := expectSecure(res, dns.RCODE_NOERROR); err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_NOERROR, 1, []byte{192, 0, 2, 1})
+		},
+	},
+	{
+		name:  "DNSSEC validation with a wrong trust anchor",
+		peer:  []string{"-zone", ".=" + rootZone, "-dnssec-key-dir", rootKeyDir},
+		flags: []string{"-resolver", "PEER", "-dnssec-validate", "-dnssec-trust-anchor", wrongAnchor},
+		check: func(env *env) error {
+			req := dns.NewQuery("www.example.test", dns.TYPE_A).WithDO().Message()
+			res, err := env.UDP.Exchange(req)
+			if err != nil {
+				return err
+			}
+			if err := expectRCode(res, dns.RCODE_SERVFAIL); err != nil {
+				return err
+			}
+			opt, _ := res.EDNS()
+			o, ok := opt.Option(dns.EDNS_OPTION_EDE)
+			if code, _, _ := o.ExtendedError(); !ok || code != dns.EDE_DNSKEY_MISSING {
+				return fmt.Errorf("extended error %x, want DNSKEY missing", o.Data)
+			}
+			// Clients validating themselves get the answer.
+			req = dns.NewQuery("www.example.test", dns.TYPE_A).WithDO().WithCD().Message()
+			if res, err = env.UDP.Exchange(req); err != nil {
+				return err
+			}
+			if res.Header.AD() {
+				return errors.New("AD bit set on an unvalidated answer")
+			}
+			return expectAnswer(res, dns.RCODE_NOERROR, 2, []byte{192, 0, 2, 1})
+		},
+	},
+	{
+		name:     "forwarding",
+		upstream: "ok",
+		flags:    []string{"-resolver", "UPSTREAM"},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("example.com", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_NOERROR, 1, []byte{10, 0, 0, 7})
+		},
+	},
+	{
+		name:     "forwarding compressed SRV target",
+		upstream: "srv",
+		flags:    []string{"-resolver", "UPSTREAM"},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("_sip._udp.example.com", dns.TYPE_SRV))
+			if err != nil {
+				return err
+			}
+			if err := expectRCode(res, dns.RCODE_NOERROR); err != nil {
+				return err
+			}
+			if len(res.Answer.Records) != 1 {
+				return fmt.Errorf("%d answers, want 1", len(res.Answer.Records))
+			}
+			srv, ok := res.Answer.Records[0].SRV()
+			if !ok {
+				return errors.New("answer is not a self-contained SRV record")
+			}
+			if srv.Port != 5060 || srv.Target != "sip._sip._udp.example.com" {
+				return fmt.Errorf("SRV %+v", srv)
+			}
+			return nil
+		},
+	},
+	{
+		name:     "forwarding labels with embedded dots",
+		upstream: "ok",
+		flags:    []string{"-resolver", "UPSTREAM"},
+		check:    checkEmbeddedDots,
+	},
+	{
+		name:     "UDP retransmit de-duplication",
+		upstream: "ok",
+		flags:    []string{"-resolver", "UPSTREAM", "-cache-size", "0", "-udp-dedup-window", "5s"},
+		check:    checkReplay,
+	},
+	{
+		name:     "forwarding unknown type",
+		upstream: "opaque",
+		flags:    []string{"-resolver", "UPSTREAM"},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("example.com", 52))
+			if err != nil {
+				return err
+			}
+			if err := expectAnswer(res, dns.RCODE_NOERROR, 1, opaqueData); err != nil {
+				return err
+			}
+			want := "example.com.\t300\tIN\tTYPE52\t\\# 6 0001c00c0000"
+			if got := res.Answer.Records[0].String(); got != want {
+				return fmt.Errorf("record %q, want %q", got, want)
+			}
+			return nil
+		},
+	},
+	{
+		name:     "concurrent forwarding over TCP",
+		upstream: "indexed",
+		flags:    []string{"-resolver", "UPSTREAM"},
+		check:    checkConcurrentForwarding,
+	},
+	{
+		name:     "unreachable upstream",
+		upstream: "drop",
+		flags:    []string{"-resolver", "UPSTREAM", "-resolver-timeout", "200ms", "-resolver-retries", "0"},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("example.com", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			return expectRCode(res, dns.RCODE_SERVFAIL)
+		},
+	},
+	{
+		name:     "upstream SERVFAIL",
+		upstream: "servfail",
+		flags:    []string{"-resolver", "UPSTREAM"},
+		check: func(env *env) error {
+			res, err := env.UDP.Exchange(newQuery("example.com", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_SERVFAIL, 0, nil)
+		},
+	},
+	{
+		name:     "negative caching",
+		upstream: "nxdomain",
+		flags:    []string{"-resolver", "UPSTREAM"},
+		check: func(env *env) error {
+			for i := 0; i < 2; i++ {
+				res, err := env.UDP.Exchange(newQuery("missing.example.com", dns.TYPE_A))
+				if err != nil {
+					return err
+				}
+				if err := expectAnswer(res, dns.RCODE_NXDOMAIN, 0, nil); err != nil {
+					return err
+				}
+				if len(res.Authority.Records) != 1 {
+					return fmt.Errorf("%d authority records, want the SOA", len(res.Authority.Records))
+				}
+			}
+			if n := env.upstream.received(); n != 1 {
+				return fmt.Errorf("upstream received %d queries, want 1", n)
+			}
+			return nil
+		},
+	},
+	{
+		name:     "truncation over UDP",
+		upstream: "many",
+		flags:    []string{"-resolver", "UPSTREAM", "-cache-size", "0"},
+		check: func(env *env) error {
+			req := newQuery("example.com", dns.TYPE_A)
+			b, err := env.UDP.ExchangeRaw(req.Byte())
+			if err != nil {
+				return err
+			}
+			if len(b) > 512 {
+				return fmt.Errorf("response of %d bytes exceeds 512", len(b))
+			}
+			res, err := dnstest.ParseResponse(req, b)
+			if err != nil {
+				return err
+			}
+			if !res.Header.TC() {
+				return errors.New("TC bit not set")
+			}
+			return nil
+		},
+	},
+	{
+		name:     "EDNS payload size",
+		upstream: "many",
+		flags:    []string{"-resolver", "UPSTREAM", "-cache-size", "0", "-udp-max-size", "4096"},
+		check: func(env *env) error {
+			req := newQuery("example.com", dns.TYPE_A)
+			req.SetEDNS(dns.OPT{UDPSize: 4096})
+			res, err := env.UDP.Exchange(req)
+			if err != nil {
+				return err
+			}
+			if res.Header.TC() {
+				return errors.New("TC bit set")
+			}
+			return expectAnswer(res, dns.RCODE_NOERROR, manyRecords, nil)
+		},
+	},
+	{
+		name:     "no truncation over TCP",
+		upstream: "many",
+		flags:    []string{"-resolver", "UPSTREAM", "-cache-size", "0"},
+		check: func(env *env) error {
+			res, err := env.TCP.Exchange(newQuery("example.com", dns.TYPE_A))
+			if err != nil {
+				return err
+			}
+			return expectAnswer(res, dns.RCODE_NOERROR, manyRecords, nil)
+		},
+	},
+}
+
+// checkConcurrentForwarding pipelines queries on one TCP connection, which
+// the server resolves concurrently, while the upstream answers them in
+// reverse order. Each response must carry the answer to its own question.
+func checkConcurrentForwarding(env *env) error {
+	conn, err := net.DialTimeout("tcp", env.Addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	reqs := make(map[uint16]dns.Message)
+	for i := 0; i < concurrentQueries; i++ {
+		req := newQuery(fmt.Sprintf("q%d.example.com", i), dns.TYPE_A)
+		reqs[req.Header.ID] = req
+		if err := dns.WriteStreamMessage(conn, req.Byte()); err != nil {
+			return err
+		}
+	}
+	for range reqs {
+		b, err := dns.ReadStreamMessage(conn)
+		if err != nil {
+			return err
+		}
+		res, err := dns.ParseMessage(b)
+		if err != nil {
+			return err
+		}
+		req, ok := reqs[res.Header.ID]
+		if !ok {
+			return fmt.Errorf("response with unknown ID %#x", res.Header.ID)
+		}
+		if err := dns.ValidateResponse(req, res); err != nil {
+			return err
+		}
+		want := []byte{10, 0, 2, byte(queryIndex(req))}
+		if err := expectAnswer(res, dns.RCODE_NOERROR, 1, want); err != nil {
+			return fmt.Errorf("%s: %w", req.Question.Queries[0].Name, err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	run := flag.String("run", "", "only run scenarios whose name contains this string")
+	verbose := flag.Bool("v", false, "print the server output of every scenario")
+	flag.Parse()
+
+	dir, err := os.MkdirTemp("", "dns-e2e")
+	if err != nil {
+		fmt.Println("Failed to create temporary directory:", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "server")
+	if err := dnstest.Build(bin); err != nil {
+		fmt.Println("Failed to build server:", err)
+		os.Exit(1)
+	}
+
+	failed := 0
+	for _, sc := range scenarios {
+		if !strings.Contains(sc.name, *run) {
+			continue
+		}
+		var output bytes.Buffer
+		err := runScenario(bin, sc, &output)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", sc.name, err)
+		} else {
+			fmt.Printf("ok   %s\n", sc.name)
+		}
+		if err != nil || *verbose {
+			io.Copy(os.Stdout, &output)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d scenarios failed\n", failed)
+		os.Exit(1)
+	}
+}
+
+// runScenario launches the server for the scenario, after its peer if it
+// has one, runs its check, and stops the servers again. Server output is
+// written to out.
+func runScenario(bin string, sc scenario, out io.Writer) error {
+	var (
+		e            env
+		upstreamAddr string
+		err          error
+	)
+	if e.dir, err = os.MkdirTemp("", "dns-e2e-scenario"); err != nil {
+		return err
+	}
+	defer os.RemoveAll(e.dir)
+	if sc.upstream != "" {
+		if e.upstream, err = startUpstream(sc.upstream); err != nil {
+			return fmt.Errorf("mock upstream: %w", err)
+		}
+		defer e.upstream.conn.Close()
+		upstreamAddr = e.upstream.conn.LocalAddr().String()
+	}
+	var primaryAddr string
+	if sc.primary {
+		if e.primary, err = startPrimary(); err != nil {
+			return fmt.Errorf("mock primary: %w", err)
+		}
+		defer e.primary.close()
+		primaryAddr = e.primary.addr
+	}
+	if sc.peer != nil {
+		peer, err := dnstest.Start(dnstest.Options{Binary: bin, Flags: sc.peer, Output: out})
+		if err != nil {
+			return fmt.Errorf("peer: %w", err)
+		}
+		defer peer.Close()
+		e.peer = peer.Addr
+	}
+	if e.admin, err = dnstest.FreeAddr(); err != nil {
+		return err
+	}
+	if sc.setup != nil {
+		if err := sc.setup(&e); err != nil {
+			return fmt.Errorf("setup: %w", err)
+		}
+	}
+
+	var flags []string
+	for _, f := range sc.flags {
+		flags = append(flags, strings.NewReplacer("UPSTREAM", upstreamAddr, "PRIMARY", primaryAddr, "PEER", e.peer, "DIR", e.dir, "ADMIN", e.admin).Replace(f))
+	}
+	if e.Server, err = dnstest.Start(dnstest.Options{Binary: bin, Flags: flags, DoH: sc.doh, Output: out}); err != nil {
+		return err
+	}
+	defer e.Close()
+	return sc.check(&e)
+}
+
+// getJSON decodes the JSON body of a successful GET request for url into v.
+func getJSON(url string, v any) error {
+	res, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+var nextID uint16 = 0x4000
+
+// newQuery returns a recursive query for name.
+func newQuery(name string, qtype uint16) dns.Message {
+	nextID++
+	return dns.NewQuery(name, qtype).WithID(nextID).Message()
+}
+
+// checkReplay retransmits a query from the same socket and expects the
+// repeat to be answered without reaching the upstream, while a query with
+// another ID is resolved again.
+func checkReplay(env *env) error {
+	conn, err := net.Dial("udp", env.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	exchange := func(req []byte) ([]byte, error) {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+
+	req := newQuery("example.com", dns.TYPE_A).Byte()
+	first, err := exchange(req)
+	if err != nil {
+		return err
+	}
+	second, err := exchange(req)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(first, second) {
+		return errors.New("retransmit answered with a different response")
+	}
+	if n := env.upstream.received(); n != 1 {
+		return fmt.Errorf("upstream received %d queries, want 1", n)
+	}
+	if _, err := exchange(newQuery("example.com", dns.TYPE_A).Byte()); err != nil {
+		return err
+	}
+	if n := env.upstream.received(); n != 2 {
+		return fmt.Errorf("upstream received %d queries after a new ID, want 2", n)
+	}
+	return nil
+}
+
+// embeddedDotLabels are the leading labels of a query name holding dots,
+// backslashes, and unprintable bytes, which must survive decoding and
+// encoding by both the server and the upstream.
+var embeddedDotLabels = [][]byte{[]byte("a.b"), []byte(`c\`), {0, '.', ' '}, []byte(`.\.`)}
+
+// checkEmbeddedDots forwards a query for a name with adversarial labels and
+// expects the same wire name in the question and the answer.
+func checkEmbeddedDots(env *env) error {
+	var wire []byte
+	for _, label := range append(embeddedDotLabels, []byte("example"), []byte("com")) {
+		wire = append(append(wire, byte(len(label))), label...)
+	}
+	wire = append(wire, 0)
+	name := `a\.b.c\\.\000\.\032.\.\\\..example.com`
+	req := newQuery(name, dns.TYPE_A)
+	b := req.Byte()
+	if !bytes.Equal(b[12:12+len(wire)], wire) {
+		return fmt.Errorf("query name %q encoded as %q", name, b[12:12+len(wire)])
+	}
+	res, err := env.UDP.Exchange(req)
+	if err != nil {
+		return err
+	}
+	if err := expectAnswer(res, dns.RCODE_NOERROR, 1, []byte{10, 0, 0, 7}); err != nil {
+		return err
+	}
+	if got := res.Question.Queries[0].Name; got != name {
+		return fmt.Errorf("question name %q, want %q", got, name)
+	}
+	if got := res.Answer.Records[0].Name; got != name {
+		return fmt.Errorf("answer name %q, want %q", got, name)
+	}
+	return nil
+}
+
+// expectDoHStatus posts req to the DNS-over-HTTPS endpoint and checks the
+// status of the HTTP response.
+func expectDoHStatus(env *env, req dns.Message, status int) error {
+	res, err := http.Post(env.DoHURL, "application/dns-message", bytes.NewReader(req.Byte()))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != status {
+		return fmt.Errorf("HTTP status %s, want %d", res.Status, status)
+	}
+	return nil
+}
+
+func expectRCode(res dns.Message, rcode dns.RCode) error {
+	if got := res.Header.RCode(); got != rcode {
+		return fmt.Errorf("rcode %s, want %s", got, rcode)
+	}
+	return nil
+}
+
+// expectAnswer checks the rcode and number of answers of res, and the data of
+// the first answer unless data is nil.
+func expectAnswer(res dns.Message, rcode dns.RCode, count int, data []byte) error {
+	if err := expectRCode(res, rcode); err != nil {
+		return err
+	}
+	if len(res.Answer.Records) != count {
+		return fmt.Errorf("%d answers, want %d", len(res.Answer.Records), count)
+	}
+	if data != nil && !bytes.Equal(res.Answer.Records[0].Data, data) {
+		return fmt.Errorf("answer %v, want %v", res.Answer.Records[0].Data, data)
+	}
+	return nil
+}
+
+// expectSecure checks the rcode of res and that it has the AD bit, as
+// validated answers do.
+func expectSecure(res dns.Message, rcode dns.RCode) error {
+	if err := expectRCode(res, rcode); err != nil {
+		return err
+	}
+	if !res.Header.AD() {
+		return errors.New("AD bit not set")
+	}
+	return nil
+}
+
+// waitAddress queries the server for the address of name until it answers
+// with addr alone, or the timeout passes.
+func waitAddress(server dnstest.Client, name string, addr []byte, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		res, err := server.Exchange(newQuery(name, dns.TYPE_A))
+		if err == nil {
+			err = expectAnswer(res, dns.RCODE_NOERROR, 1, addr)
+		}
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not answered with %v: %w", name, net.IP(addr), err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// notifyQuery returns a NOTIFY message for the zone.
+func notifyQuery(zone string) dns.Message {
+	msg := newQuery(zone, dns.TYPE_SOA)
+	msg.Header.SetRD(false)
+	msg.Header.SetAA(true)
+	msg.Header.SetOpCode(dns.OPCODE_NOTIFY)
+	return msg
+}
+
+// copyZone copies the zone file from to to, passing its text through
+// replace unless it is nil.
+func copyZone(from, to string, replace *strings.Replacer) error {
+	b, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	text := string(b)
+	if replace != nil {
+		text = replace.Replace(text)
+	}
+	return os.WriteFile(to, []byte(text), 0o644)
+}
+
+// tsigKeyFlag returns the argument of -tsig-key for key.
+func tsigKeyFlag(key dns.TSIGKey) string {
+	return strings.TrimSuffix(key.Name, ".") + ":" + base64.StdEncoding.EncodeToString(key.Secret)
+}
+
+// verifySignatures checks that every RRset of the records is signed by one
+// of the keys, with an RRSIG record among them.
+func verifySignatures(records []dns.Record, keys []dns.DNSKEY) error {
+	var sigs []dns.RRSIG
+	for _, r := range records {
+		if sig, ok := r.RRSIG(); ok {
+			sigs = append(sigs, sig)
+		}
+	}
+	for _, set := range dns.GroupRRSets(records) {
+		if set.Type == dns.TYPE_RRSIG {
+			continue
+		}
+		verified := false
+		for _, sig := range sigs {
+			for _, k := range keys {
+				verified = verified || dns.VerifyRRSIG(set, sig, k) == nil
+			}
+		}
+		if !verified {
+			return fmt.Errorf("%s %s is not signed by the expected key", set.Name, dns.TypeString(set.Type))
+		}
+	}
+	return nil
+}
+
+// expectNegativeSOA checks that the authority section of a negative answer
+// holds the zone's SOA record with the given TTL.
+func expectNegativeSOA(res dns.Message, ttl uint32) error {
+	if len(res.Authority.Records) != 1 {
+		return fmt.Errorf("%d authority records, want 1", len(res.Authority.Records))
+	}
+	r := res.Authority.Records[0]
+	if _, ok := r.SOA(); !ok {
+		return fmt.Errorf("authority record of type %s, want SOA", dns.TypeString(r.Type))
+	}
+	if r.TTL != ttl {
+		return fmt.Errorf("SOA TTL %d, want %d", r.TTL, ttl)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+	"github.com/codecrafters-io/dns-server-starter-go/app/dnstest"
+)
+
+// primaryZone is the zone served by the mock primary.
+const primaryZone = "example.test."
+
+// mockPrimary is a primary server of primaryZone for the secondary
+// scenarios. Version N of the zone has the serial N and the single address
+// 192.0.2.N for www. The SOA record is answered over UDP and TCP, and AXFR
+// and IXFR queries over TCP, with the changes since the version asked for
+// in IXFR responses.
+type mockPrimary struct {
+	addr string
+	udp  net.PacketConn
+	tcp  net.Listener
+
+	mu        sync.Mutex
+	serial    uint32
+	transfers []uint16 // Types of the transfer queries received, in order
+}
+
+// startPrimary runs a mock primary serving version 1 of the zone on a
+// loopback port, until close is called.
+func startPrimary() (*mockPrimary, error) {
+	addr, err := dnstest.FreeAddr()
+	if err != nil {
+		return nil, err
+	}
+	p := &mockPrimary{addr: addr, serial: 1}
+	if p.udp, err = net.ListenPacket("udp", addr); err != nil {
+		return nil, err
+	}
+	if p.tcp, err = net.Listen("tcp", addr); err != nil {
+		p.udp.Close()
+		return nil, err
+	}
+	go p.serveUDP()
+	go p.serveTCP()
+	return p, nil
+}
+
+func (p *mockPrimary) close() {
+	p.udp.Close()
+	p.tcp.Close()
+}
+
+// update moves the zone to its next version.
+func (p *mockPrimary) update() {
+	p.mu.Lock()
+	p.serial++
+	p.mu.Unlock()
+}
+
+// transferTypes returns the types of the transfer queries received so far.
+func (p *mockPrimary) transferTypes() []uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]uint16(nil), p.transfers...)
+}
+
+func (p *mockPrimary) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := p.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := dns.ParseMessage(buf[:n])
+		if err != nil || len(req.Question.Queries) != 1 {
+			continue
+		}
+		if req.Question.Queries[0].Type != dns.TYPE_SOA {
+			p.udp.WriteTo(dns.NewErrorResponse(req, dns.RCODE_REFUSED).Byte(), addr)
+			continue
+		}
+		p.udp.WriteTo(p.respond(req).Byte(), addr)
+	}
+}
+
+func (p *mockPrimary) serveTCP() {
+	for {
+		conn, err := p.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				b, err := dns.ReadStreamMessage(conn)
+				if err != nil {
+					return
+				}
+				req, err := dns.ParseMessage(b)
+				if err != nil || len(req.Question.Queries) != 1 {
+					return
+				}
+				if err := dns.WriteStreamMessage(conn, p.respond(req).Byte()); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// respond answers a query for the SOA record or a transfer of the zone.
+func (p *mockPrimary) respond(req dns.Message) dns.Message {
+	q := req.Question.Queries[0]
+	if dns.CompareNames(q.Name, primaryZone) != 0 {
+		return dns.NewErrorResponse(req, dns.RCODE_REFUSED)
+	}
+	p.mu.Lock()
+	serial := p.serial
+	if q.Type == dns.TYPE_AXFR || q.Type == dns.TYPE_IXFR {
+		p.transfers = append(p.transfers, q.Type)
+	}
+	p.mu.Unlock()
+
+	res := dns.NewErrorResponse(req, dns.RCODE_NOERROR)
+	res.Header.SetAA(true)
+	answer := func(records ...dns.Record) {
+		for _, r := range records {
+			res.AddAnswer(dns.NewRRSet(r))
+		}
+	}
+	switch q.Type {
+	case dns.TYPE_SOA:
+		answer(primarySOA(serial))
+	case dns.TYPE_AXFR:
+		answer(primarySOA(serial), primaryWWW(serial), primarySOA(serial))
+	case dns.TYPE_IXFR:
+		var have uint32
+		if len(req.Authority.Records) > 0 {
+			soa, _ := req.Authority.Records[0].SOA()
+			have = soa.Serial
+		}
+		answer(primarySOA(serial))
+		if have == 0 || have >= serial {
+			// Up to date, or without the version held.
+			break
+		}
+		for v := have; v < serial; v++ {
+			answer(primarySOA(v), primaryWWW(v), primarySOA(v+1), primaryWWW(v+1))
+		}
+		answer(primarySOA(serial))
+	default:
+		return dns.NewErrorResponse(req, dns.RCODE_NOTIMP)
+	}
+	return res
+}
+
+// primarySOA returns the SOA record of a version of the zone. Its refresh
+// interval of a second is raised to the shortest the secondary allows.
+func primarySOA(serial uint32) dns.Record {
+	return dns.NewRecord(primaryZone, dns.CLASS_IN, 3600, dns.SOA{
+		MName: "ns1." + primaryZone, RName: "hostmaster." + primaryZone,
+		Serial: serial, Refresh: 1, Retry: 1, Expire: 7 * 24 * 3600, Minimum: 60,
+	})
+}
+
+// primaryWWW returns the address record of www in a version of the zone.
+func primaryWWW(serial uint32) dns.Record {
+	return dns.NewRecord("www."+primaryZone, dns.CLASS_IN, 3600, dns.A{Addr: net.IPv4(192, 0, 2, byte(serial))})
+}
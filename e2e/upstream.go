@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/dns"
+)
+
+// concurrentQueries is the number of queries in flight in the concurrency
+// scenario.
+const concurrentQueries = 10
+
+// manyRecords is the number of distinct A records answered in "many" mode,
+// enough to exceed 512 bytes.
+const manyRecords = 40
+
+// opaqueData is answered in "opaque" mode. It looks like a compression
+// pointer to the question, which must not be followed in data of unknown
+// types.
+var opaqueData = []byte{0, 1, 0xC0, 0x0C, 0, 0}
+
+// startUpstream runs a mock upstream resolver on a loopback UDP port. The
+// mode selects its behavior:
+//
+//	ok        answer A queries with 10.0.0.7
+//	many      answer with manyRecords distinct A records
+//	indexed   answer qN.<domain> with 10.0.2.N, delaying earlier indexes
+//	          longer so that answers arrive out of order
+//	nxdomain  answer with NXDOMAIN and a SOA record with a MINIMUM of 60
+//	srv       answer with an SRV record whose target is compressed
+//	opaque    answer any type with opaqueData
+//	notify    acknowledge NOTIFY messages, passing them on to notified
+//	servfail  answer with SERVFAIL
+//	drop      never answer
+//
+// The upstream stops when its connection is closed.
+func startUpstream(mode string) (*mockUpstream, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	up := &mockUpstream{conn: conn, notified: make(chan dns.Message, 1)}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&up.queries, 1)
+			req, err := dns.ParseMessage(buf[:n])
+			if err != nil || mode == "drop" {
+				continue
+			}
+			if mode == "notify" {
+				select {
+				case up.notified <- req:
+				default:
+				}
+			}
+			if mode == "indexed" {
+				go func() {
+					time.Sleep(time.Duration(concurrentQueries-queryIndex(req)) * 10 * time.Millisecond)
+					conn.WriteTo(mockResponse(req, mode).Byte(), addr)
+				}()
+				continue
+			}
+			conn.WriteTo(mockResponse(req, mode).Byte(), addr)
+		}
+	}()
+	return up, nil
+}
+
+// mockUpstream is a running mock upstream resolver.
+type mockUpstream struct {
+	conn     net.PacketConn
+	queries  int64            // Number of queries received
+	notified chan dns.Message // NOTIFY messages received in notify mode
+}
+
+// received returns the number of queries received so far.
+func (u *mockUpstream) received() int64 {
+	return atomic.LoadInt64(&u.queries)
+}
+
+func mockResponse(req dns.Message, mode string) dns.Message {
+	if mode == "servfail" {
+		return dns.NewErrorResponse(req, dns.RCODE_SERVFAIL)
+	}
+	if mode == "notify" {
+		res := dns.NewErrorResponse(req, dns.RCODE_NOERROR)
+		res.Header.SetAA(true)
+		return res
+	}
+	q := req.Question.Queries[0]
+	if mode == "nxdomain" {
+		res := dns.NewErrorResponse(req, dns.RCODE_NXDOMAIN)
+		res.Header.SetRA(true)
+		// Root names for MNAME and RNAME followed by serial, refresh, retry,
+		// expire, and minimum.
+		soa := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0x0E, 0x10, 0, 0, 0x02, 0x58, 0, 0x09, 0x3A, 0x80, 0, 0, 0, 60}
+		res.AddAuthority(dns.RRSet{Name: "example.com", Type: dns.TYPE_SOA, Class: dns.CLASS_IN, TTL: 300, Data: [][]byte{soa}})
+		return res
+	}
+	res := dns.NewErrorResponse(req, dns.RCODE_NOERROR)
+	res.Header.SetRA(true)
+	if mode == "opaque" {
+		res.AddAnswer(dns.RRSet{Name: q.Name, Type: q.Type, Class: dns.CLASS_IN, TTL: 300, Data: [][]byte{opaqueData}})
+		return res
+	}
+	if mode == "srv" {
+		// Priority 1, weight 2, port 5060, and target sip.<qname> with the
+		// qname compressed to point at the question.
+		srv := []byte{0, 1, 0, 2, 0x13, 0xC4, 3, 's', 'i', 'p', 0xC0, 12}
+		res.AddAnswer(dns.RRSet{Name: q.Name, Type: dns.TYPE_SRV, Class: dns.CLASS_IN, TTL: 300, Data: [][]byte{srv}})
+		return res
+	}
+	set := dns.RRSet{Name: q.Name, Type: dns.TYPE_A, Class: dns.CLASS_IN, TTL: 300}
+	switch mode {
+	case "indexed":
+		set.Add([]byte{10, 0, 2, byte(queryIndex(req))})
+	case "many":
+		for i := 0; i < manyRecords; i++ {
+			set.Add([]byte{10, 0, 1, byte(i)})
+		}
+	default:
+		set.Add([]byte{10, 0, 0, 7})
+	}
+	res.AddAnswer(set)
+	return res
+}
+
+// queryIndex returns N for a question named qN.<domain>.
+func queryIndex(req dns.Message) int {
+	label := strings.SplitN(req.Question.Queries[0].Name, ".", 2)[0]
+	n, _ := strconv.Atoi(strings.TrimPrefix(label, "q"))
+	return n
+}